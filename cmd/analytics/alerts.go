@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/alerting"
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+	"github.com/redis/go-redis/v9"
+)
+
+// Metrics alert rules can watch. Rules may narrow every metric except
+// active_users_5m to a model.
+const (
+	alertErrorRate       = "error_rate"
+	alertResponseTimeP95 = "response_time_p95"
+	alertResponseTimeP99 = "response_time_p99"
+	alertTokensPerMinute = "tokens_per_minute"
+	alertActiveUsers     = "active_users_5m"
+	alertCostToday       = "cost_today_usd"
+)
+
+var alertMetrics = map[string]bool{
+	alertErrorRate:       true,
+	alertResponseTimeP95: true,
+	alertResponseTimeP99: true,
+	alertTokensPerMinute: true,
+	alertActiveUsers:     true,
+	alertCostToday:       true,
+}
+
+// validateAlertRules checks that rules only watch metrics the service samples
+func validateAlertRules(rules []alerting.Rule) error {
+	for _, rule := range rules {
+		if !alertMetrics[rule.Metric] {
+			return fmt.Errorf("rule %q: unknown metric %q", rule.Name, rule.Metric)
+		}
+		if rule.Metric == alertActiveUsers && rule.Model != "" {
+			return fmt.Errorf("rule %q: %s cannot be narrowed to a model", rule.Name, rule.Metric)
+		}
+		if rule.Tenant != "" && !capture.ValidTenant(rule.Tenant) {
+			return fmt.Errorf("rule %q: invalid tenant %q", rule.Name, rule.Tenant)
+		}
+	}
+	return nil
+}
+
+// sampleAlertMetric returns the current value of a rule's metric from the
+// rule's tenant, and model if set
+func (tas *TokenAnalyticsService) sampleAlertMetric(ctx context.Context, rule alerting.Rule) (float64, error) {
+	ks := capture.TenantKeyspace(rule.Tenant)
+	now := time.Now().UTC()
+
+	switch rule.Metric {
+	case alertErrorRate:
+		// Errors over requests in the current and previous hour
+		models := []string{rule.Model}
+		if rule.Model == "" {
+			var err error
+			if models, err = tas.redis.SMembers(ctx, ks.Key("models")).Result(); err != nil {
+				return 0, err
+			}
+		}
+		pipe := tas.redis.Pipeline()
+		var cmds []*redis.SliceCmd
+		for _, model := range models {
+			for _, hour := range []time.Time{now, now.Add(-time.Hour)} {
+				cmds = append(cmds, pipe.HMGet(ctx, capture.ModelHourlyKey(ks, model, hour), "requests", "errors"))
+			}
+		}
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return 0, err
+		}
+		var requests, errors float64
+		for _, cmd := range cmds {
+			var counts struct {
+				Requests float64 `redis:"requests"`
+				Errors   float64 `redis:"errors"`
+			}
+			cmd.Scan(&counts)
+			requests += counts.Requests
+			errors += counts.Errors
+		}
+		if requests == 0 {
+			return 0, nil
+		}
+		return errors / requests, nil
+
+	case alertResponseTimeP95, alertResponseTimeP99:
+		samples, err := tas.redis.LRange(ctx, capture.LatencyKey(ks, rule.Model), 0, -1).Result()
+		if err != nil {
+			return 0, err
+		}
+		q := 0.95
+		if rule.Metric == alertResponseTimeP99 {
+			q = 0.99
+		}
+		return capture.Percentiles(samples, q)[0], nil
+
+	case alertTokensPerMinute:
+		rate, modelRates, err := tas.getTokenRates(ctx, ks)
+		if err != nil {
+			return 0, err
+		}
+		if rule.Model != "" {
+			rate = modelRates[rule.Model]
+		}
+		return rate.InputPerMinute + rate.OutputPerMinute, nil
+
+	case alertActiveUsers:
+		count, err := tas.redis.SCard(ctx, ks.Key("users:active:5m")).Result()
+		return float64(count), err
+
+	case alertCostToday:
+		start := now.Truncate(24 * time.Hour)
+		_, _, hours := windowHours(start, now)
+		pipe := tas.redis.Pipeline()
+		cmds := make([]*redis.StringCmd, len(hours))
+		for i, hour := range hours {
+			key := ks.Key("tokens:hourly:%s", hour.Format("2006010215"))
+			if rule.Model != "" {
+				key = capture.ModelHourlyKey(ks, rule.Model, hour)
+			}
+			cmds[i] = pipe.HGet(ctx, key, "cost_usd")
+		}
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return 0, err
+		}
+		var cost float64
+		for _, cmd := range cmds {
+			value, _ := cmd.Float64()
+			cost += value
+		}
+		return cost, nil
+	}
+
+	return 0, fmt.Errorf("unknown metric %q", rule.Metric)
+}
+
+// alertsHandler serves /analytics/alerts, listing each alert rule's state
+func (tas *TokenAnalyticsService) alertsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	rules := []alerting.RuleStatus{}
+	if tas.alerts != nil {
+		rules = tas.alerts.States()
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"rules": rules})
+}
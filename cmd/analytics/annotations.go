@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+	"github.com/ajeetraina/genai-app-demo/pkg/grafana"
+	"github.com/ajeetraina/genai-app-demo/pkg/logger"
+)
+
+// modelWatchInterval is how often the models seen in each tenant are checked
+// for additions and removals
+const modelWatchInterval = time.Minute
+
+// watchModels annotates Grafana dashboards when a model first appears in a
+// tenant's usage or drops out of it. The models seen at startup are the
+// baseline, so restarts do not annotate every model again.
+func (tas *TokenAnalyticsService) watchModels() {
+	ticker := time.NewTicker(modelWatchInterval)
+	defer ticker.Stop()
+
+	known := make(map[string]map[string]bool)
+	tas.checkModels(known)
+	for range ticker.C {
+		tas.checkModels(known)
+	}
+}
+
+// checkModels compares each tenant's models with those last seen, updating
+// known. Tenants seen for the first time only record their baseline.
+func (tas *TokenAnalyticsService) checkModels(known map[string]map[string]bool) {
+	if !tas.redisMonitor.Available() {
+		return
+	}
+	tenants, err := tas.redis.SMembers(tas.ctx, "tenants").Result()
+	if err != nil {
+		logger.Component("annotations").Error().Err(err).Msg("Failed to list tenants for model annotations")
+		return
+	}
+
+	for _, tenant := range append([]string{""}, tenants...) {
+		ks := capture.TenantKeyspace(tenant)
+		models, err := tas.redis.SMembers(tas.ctx, ks.Key("models")).Result()
+		if err != nil {
+			logger.Component("annotations").Error().Err(err).Str("tenant", tenant).Msg("Failed to list models for annotations")
+			continue
+		}
+		current := make(map[string]bool, len(models))
+		for _, model := range models {
+			current[model] = true
+		}
+
+		previous, seen := known[tenant]
+		known[tenant] = current
+		if !seen {
+			continue
+		}
+		var added, removed []string
+		for model := range current {
+			if !previous[model] {
+				added = append(added, model)
+			}
+		}
+		for model := range previous {
+			if !current[model] {
+				removed = append(removed, model)
+			}
+		}
+		sort.Strings(added)
+		sort.Strings(removed)
+		for _, model := range added {
+			tas.annotateModel(tenant, model, "added")
+		}
+		for _, model := range removed {
+			tas.annotateModel(tenant, model, "removed")
+		}
+	}
+}
+
+// annotateModel records a model being added or removed
+func (tas *TokenAnalyticsService) annotateModel(tenant, model, change string) {
+	text := fmt.Sprintf("Model %s %s", model, change)
+	tags := []string{"model", "model_" + change, model}
+	if tenant != "" {
+		text += " in tenant " + tenant
+		tags = append(tags, "tenant:"+tenant)
+	}
+
+	ctx, cancel := context.WithTimeout(tas.ctx, 10*time.Second)
+	defer cancel()
+	if _, err := tas.annotator.Annotate(ctx, grafana.Annotation{Tags: tags, Text: text}); err != nil {
+		logger.Component("annotations").Error().Err(err).Str("text", text).Msg("Failed to annotate")
+	}
+}
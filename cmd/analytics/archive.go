@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+	"github.com/ajeetraina/genai-app-demo/pkg/postgres"
+	"github.com/redis/go-redis/v9"
+)
+
+// archiveRollups upserts a tenant's hourly and daily rollups within the
+// rollup lookback into the Postgres rollups table. Every run rewrites the
+// whole lookback, so an archive outage shorter than the lookback leaves no gaps.
+func (tas *TokenAnalyticsService) archiveRollups(ctx context.Context, tenant string, now time.Time) error {
+	ks := capture.TenantKeyspace(tenant)
+	end := now.UTC().Truncate(time.Hour)
+	_, _, hours := windowHours(end.Add(-rollupLookback), end)
+	var days []time.Time
+	for day := end.Add(-rollupLookback).Truncate(24 * time.Hour); day.Before(end); day = day.Add(24 * time.Hour) {
+		days = append(days, day)
+	}
+
+	pipe := tas.redis.Pipeline()
+	hourCmds := make([]*redis.MapStringStringCmd, len(hours))
+	for i, hour := range hours {
+		hourCmds[i] = pipe.HGetAll(ctx, capture.HourlyRollupKey(ks, hour))
+	}
+	dayCmds := make([]*redis.MapStringStringCmd, len(days))
+	for i, day := range days {
+		dayCmds[i] = pipe.HGetAll(ctx, capture.DailyRollupKey(ks, day))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return err
+	}
+
+	var values []string
+	add := func(period string, start time.Time, cmd *redis.MapStringStringCmd) error {
+		if len(cmd.Val()) == 0 {
+			return nil
+		}
+		var rollup Rollup
+		if err := cmd.Scan(&rollup); err != nil {
+			return err
+		}
+		values = append(values, fmt.Sprintf("(%s, %s, %s, %d, %d, %d, %s, %d, %d)",
+			postgres.Literal(tenant), postgres.Literal(period), postgres.Literal(start.Format(time.RFC3339)),
+			rollup.Requests, rollup.InputTokens, rollup.OutputTokens,
+			strconv.FormatFloat(rollup.CostUSD, 'f', -1, 64), rollup.Errors, rollup.UniqueUsers))
+		return nil
+	}
+	for i, hour := range hours {
+		if err := add("hour", hour, hourCmds[i]); err != nil {
+			return err
+		}
+	}
+	for i, day := range days {
+		if err := add("day", day, dayCmds[i]); err != nil {
+			return err
+		}
+	}
+	if len(values) == 0 {
+		return nil
+	}
+
+	return tas.archive.Exec(`INSERT INTO rollups (tenant, period, period_start, requests, input_tokens,
+		output_tokens, cost_usd, errors, unique_users) VALUES ` + strings.Join(values, ", ") + `
+		ON CONFLICT (tenant, period, period_start) DO UPDATE SET requests = EXCLUDED.requests,
+		input_tokens = EXCLUDED.input_tokens, output_tokens = EXCLUDED.output_tokens,
+		cost_usd = EXCLUDED.cost_usd, errors = EXCLUDED.errors, unique_users = EXCLUDED.unique_users,
+		updated_at = now()`)
+}
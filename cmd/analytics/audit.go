@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+	"github.com/ajeetraina/genai-app-demo/pkg/middleware"
+	"github.com/rs/zerolog/log"
+)
+
+// defaultAuditPage is the number of audit entries returned without a limit
+const defaultAuditPage = 100
+
+// recordAudit appends a data access or change made by the request to the
+// audit log of tenant. A failure is logged rather than failing the request.
+func (tas *TokenAnalyticsService) recordAudit(r *http.Request, tenant, action, resource string, payload []byte) {
+	entry := middleware.AuditEntry(r, action, resource, tenant)
+	if err := capture.RecordAudit(r.Context(), tas.redis, entry, payload); err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Str("action", action).Str("resource", resource).Msg("Failed to record audit entry")
+	}
+}
+
+// auditHandler serves /analytics/audit?actor=&action=&from=RFC3339&to=RFC3339&cursor=&limit=N,
+// listing the tenant's audit entries newest first. Pass the next_cursor of
+// a page as cursor to get the next one.
+func (tas *TokenAnalyticsService) auditHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !tas.authorizeAdmin(w, r) {
+		return
+	}
+	ks, ok := tenantKeyspace(w, r)
+	if !ok {
+		return
+	}
+
+	query, err := parseAuditQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	page, err := capture.ListAudit(r.Context(), tas.redis, ks, query)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list audit entries: %v", err), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+// parseAuditQuery reads the filters and paging of an audit request
+func parseAuditQuery(r *http.Request) (capture.AuditQuery, error) {
+	values := r.URL.Query()
+	query := capture.AuditQuery{
+		Actor:  values.Get("actor"),
+		Action: values.Get("action"),
+		Cursor: values.Get("cursor"),
+		Limit:  defaultAuditPage,
+	}
+	var err error
+	if value := values.Get("from"); value != "" {
+		if query.From, err = time.Parse(time.RFC3339, value); err != nil {
+			return query, fmt.Errorf("invalid from, expected an RFC 3339 timestamp")
+		}
+	}
+	if value := values.Get("to"); value != "" {
+		if query.To, err = time.Parse(time.RFC3339, value); err != nil {
+			return query, fmt.Errorf("invalid to, expected an RFC 3339 timestamp")
+		}
+	}
+	if query.Cursor != "" {
+		if err := capture.ValidStreamID(query.Cursor); err != nil {
+			return query, err
+		}
+	}
+	if value := values.Get("limit"); value != "" {
+		if query.Limit, err = strconv.Atoi(value); err != nil || query.Limit <= 0 || query.Limit > 1000 {
+			return query, fmt.Errorf("invalid limit, expected 1 to 1000")
+		}
+	}
+	return query, nil
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+	"github.com/ajeetraina/genai-app-demo/pkg/logger"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// BudgetStatus is a budget with its usage in the current period
+type BudgetStatus struct {
+	capture.Budget
+	PeriodStart time.Time `json:"period_start"`
+	UsedTokens  int64     `json:"used_tokens"`
+	UsedCostUSD float64   `json:"used_cost_usd"`
+	Exceeded    bool      `json:"exceeded"`
+}
+
+// GetBudgetStatuses loads a keyspace's budgets and measures their usage for
+// the period containing now
+func (tas *TokenAnalyticsService) GetBudgetStatuses(ctx context.Context, ks capture.Keyspace, now time.Time) ([]BudgetStatus, error) {
+	values, err := tas.redis.HGetAll(ctx, capture.BudgetsKey(ks)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make([]BudgetStatus, 0, len(values))
+	for name, value := range values {
+		var budget capture.Budget
+		if err := json.Unmarshal([]byte(value), &budget); err != nil {
+			log.Ctx(ctx).Warn().Err(err).Str("budget", name).Msg("Skipping invalid budget")
+			continue
+		}
+
+		status := BudgetStatus{
+			Budget:      budget,
+			PeriodStart: capture.BudgetPeriodStart(budget.Period, now),
+		}
+		status.UsedTokens, status.UsedCostUSD, err = tas.budgetUsage(ctx, ks, budget, status.PeriodStart, now)
+		if err != nil {
+			return nil, err
+		}
+		status.Exceeded = (budget.TokenLimit > 0 && status.UsedTokens >= budget.TokenLimit) ||
+			(budget.CostLimitUSD > 0 && status.UsedCostUSD >= budget.CostLimitUSD)
+		statuses = append(statuses, status)
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name() < statuses[j].Name()
+	})
+	return statuses, nil
+}
+
+// budgetUsage measures a budget subject's tokens and cost since start. Tokens
+// come from the leaderboards; costs from the per-user cost hashes or the
+// hourly rollups.
+func (tas *TokenAnalyticsService) budgetUsage(ctx context.Context, ks capture.Keyspace, budget capture.Budget, start, now time.Time) (int64, float64, error) {
+	board := "models"
+	if budget.Scope == capture.BudgetScopeUser {
+		board = "users"
+	}
+	boardKey, err := capture.LeaderboardKey(ks, board, budget.Period, now)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	pipe := tas.redis.Pipeline()
+	var tokensCmd *redis.FloatCmd
+	var boardCmd *redis.ZSliceCmd
+	if budget.Scope == capture.BudgetScopeTenant {
+		boardCmd = pipe.ZRangeWithScores(ctx, boardKey, 0, -1)
+	} else {
+		tokensCmd = pipe.ZScore(ctx, boardKey, budget.ID)
+	}
+
+	var costCmds []*redis.StringCmd
+	if budget.CostLimitUSD > 0 {
+		if budget.Scope == capture.BudgetScopeUser {
+			costKey := ks.Key("costs:daily:%s", now.UTC().Format("20060102"))
+			if budget.Period == capture.BudgetMonthly {
+				costKey = ks.Key("costs:monthly:%s", now.UTC().Format("200601"))
+			}
+			costCmds = append(costCmds, pipe.HGet(ctx, costKey, budget.ID))
+		} else {
+			_, _, hours := windowHours(start, now)
+			for _, hour := range hours {
+				hourlyKey := ks.Key("tokens:hourly:%s", hour.Format("2006010215"))
+				if budget.Scope == capture.BudgetScopeModel {
+					hourlyKey = capture.ModelHourlyKey(ks, budget.ID, hour)
+				}
+				costCmds = append(costCmds, pipe.HGet(ctx, hourlyKey, "cost_usd"))
+			}
+		}
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return 0, 0, err
+	}
+
+	var tokens float64
+	if boardCmd != nil {
+		for _, z := range boardCmd.Val() {
+			tokens += z.Score
+		}
+	} else {
+		tokens, _ = tokensCmd.Result()
+	}
+
+	var cost float64
+	for _, cmd := range costCmds {
+		value, _ := cmd.Float64()
+		cost += value
+	}
+
+	return int64(tokens), cost, nil
+}
+
+// EvaluateBudgets measures a tenant's budgets and rewrites the exceeded
+// budgets hash consulted by the chat backend. Budgets newly exceeded, or
+// escalated from warn to block, are published to the activity feed.
+func (tas *TokenAnalyticsService) EvaluateBudgets(ctx context.Context, tenant string) error {
+	ks := capture.TenantKeyspace(tenant)
+	statuses, err := tas.GetBudgetStatuses(ctx, ks, time.Now())
+	if err != nil {
+		return err
+	}
+
+	exceeded := make(map[string]interface{})
+	for _, status := range statuses {
+		if !status.Exceeded || exceeded[status.Field()] == capture.BudgetBlock {
+			continue
+		}
+		exceeded[status.Field()] = status.Action
+	}
+
+	// Reading the hash in the same transaction that rewrites it lets only
+	// one replica see each change
+	pipe := tas.redis.TxPipeline()
+	previous := pipe.HGetAll(ctx, capture.BudgetsExceededKey(ks))
+	pipe.Del(ctx, capture.BudgetsExceededKey(ks))
+	if len(exceeded) > 0 {
+		pipe.HSet(ctx, capture.BudgetsExceededKey(ks), exceeded)
+	}
+	if _, err = pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	for field, action := range exceeded {
+		if previous.Val()[field] == action || previous.Val()[field] == capture.BudgetBlock {
+			continue
+		}
+		err := capture.PublishActivity(ctx, tas.redis, capture.ActivityEvent{
+			Type:    capture.ActivityBudgetExceeded,
+			Tenant:  tenant,
+			Subject: field,
+			Message: fmt.Sprintf("Budget exceeded for %s, requests now %s", field, budgetOutcome(action.(string))),
+			Data:    map[string]string{"action": action.(string)},
+		})
+		if err != nil {
+			logger.Component("budgets").Error().Err(err).Str("budget", field).Msg("Failed to publish budget event")
+		}
+	}
+	return nil
+}
+
+// budgetOutcome describes what an exceeded budget's action does to requests
+func budgetOutcome(action string) string {
+	if action == capture.BudgetBlock {
+		return "blocked"
+	}
+	return "warned"
+}
+
+// evaluateBudgetsPeriodically evaluates every tenant's budgets each interval
+func (tas *TokenAnalyticsService) evaluateBudgetsPeriodically(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if !tas.redisMonitor.Available() {
+			continue
+		}
+		tenants, err := tas.redis.SMembers(tas.ctx, "tenants").Result()
+		if err != nil {
+			logger.Component("budgets").Error().Err(err).Msg("Failed to list tenants for budget evaluation")
+			continue
+		}
+		for _, tenant := range append([]string{""}, tenants...) {
+			if err := tas.EvaluateBudgets(tas.ctx, tenant); err != nil {
+				logger.Component("budgets").Error().Err(err).Str("tenant", tenant).Msg("Failed to evaluate budgets")
+			}
+		}
+	}
+}
+
+// authorizeAdmin checks the ANALYTICS_ADMIN_TOKEN bearer token of requests
+// to admin endpoints, which are unavailable while no token is configured
+func (tas *TokenAnalyticsService) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if tas.adminToken == "" {
+		http.Error(w, "Admin endpoints are disabled, set ANALYTICS_ADMIN_TOKEN", http.StatusServiceUnavailable)
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(tas.adminToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+// budgetsHandler serves /analytics/budgets. GET lists the budgets with their
+// current usage, PUT creates or replaces a budget and DELETE removes the
+// budget identified by ?scope=&id=&period=.
+func (tas *TokenAnalyticsService) budgetsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	ks, ok := tenantKeyspace(w, r)
+	if !ok {
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		statuses, err := tas.GetBudgetStatuses(r.Context(), ks, time.Now())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to get budgets: %v", err), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"budgets": statuses})
+		return
+
+	case http.MethodPut:
+		if !tas.authorizeAdmin(w, r) {
+			return
+		}
+		var budget capture.Budget
+		if err := json.NewDecoder(r.Body).Decode(&budget); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if err := budget.Validate(); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		data, _ := json.Marshal(budget)
+		if err := tas.redis.HSet(r.Context(), capture.BudgetsKey(ks), budget.Name(), data).Err(); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to save budget: %v", err), http.StatusInternalServerError)
+			return
+		}
+		tas.recordAudit(r, r.URL.Query().Get("tenant"), capture.AuditBudgetPut, "budget:"+budget.Name(), data)
+
+	case http.MethodDelete:
+		if !tas.authorizeAdmin(w, r) {
+			return
+		}
+		query := r.URL.Query()
+		budget := capture.Budget{Scope: query.Get("scope"), ID: query.Get("id"), Period: query.Get("period")}
+		removed, err := tas.redis.HDel(r.Context(), capture.BudgetsKey(ks), budget.Name()).Result()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to delete budget: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if removed == 0 {
+			http.Error(w, "Budget not found", http.StatusNotFound)
+			return
+		}
+		tas.recordAudit(r, query.Get("tenant"), capture.AuditBudgetDelete, "budget:"+budget.Name(), []byte(r.URL.RawQuery))
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Apply the change right away rather than on the next evaluation
+	if err := tas.EvaluateBudgets(r.Context(), r.URL.Query().Get("tenant")); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to evaluate budgets: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// responseCache holds recent analytics responses so dashboards polling the
+// same endpoints do not each recompute them from Redis. Responses are kept in
+// memory and, when shared is set, in Redis so every analytics replica reuses
+// them.
+type responseCache struct {
+	ttl    time.Duration
+	shared *redis.Client
+
+	mu      sync.Mutex
+	entries map[string]cachedResponse
+
+	requestsCounter *prometheus.CounterVec
+}
+
+type cachedResponse struct {
+	body    []byte
+	etag    string
+	expires time.Time
+}
+
+// newResponseCache creates a cache keeping responses for ttl, or nil when ttl
+// is not positive. shared may be nil to cache in memory only.
+func newResponseCache(ttl time.Duration, shared *redis.Client) *responseCache {
+	if ttl <= 0 {
+		return nil
+	}
+	requestsCounter := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "token_analytics_cache_requests_total",
+			Help: "Analytics requests by response cache result",
+		},
+		[]string{"result"},
+	)
+	prometheus.MustRegister(requestsCounter)
+
+	return &responseCache{
+		ttl:             ttl,
+		shared:          shared,
+		entries:         make(map[string]cachedResponse),
+		requestsCounter: requestsCounter,
+	}
+}
+
+// parseCacheTTL reads how long analytics responses are cached
+func parseCacheTTL() time.Duration {
+	seconds, err := strconv.Atoi(getEnvOrDefault("ANALYTICS_CACHE_TTL_SECONDS", "5"))
+	if err != nil || seconds < 0 {
+		seconds = 5
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// sharedKey is the Redis key a response is shared under
+func sharedKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return "cache:analytics:" + hex.EncodeToString(sum[:])
+}
+
+// etag returns the entity tag of a response body
+func etag(body []byte) string {
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// get returns the cached response for key, checking Redis on a memory miss
+func (c *responseCache) get(ctx context.Context, key string) (cachedResponse, bool) {
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		return entry, true
+	}
+	if c.shared == nil {
+		return cachedResponse{}, false
+	}
+
+	pipe := c.shared.Pipeline()
+	body := pipe.Get(ctx, sharedKey(key))
+	ttl := pipe.PTTL(ctx, sharedKey(key))
+	if _, err := pipe.Exec(ctx); err != nil {
+		if err != redis.Nil {
+			log.Ctx(ctx).Warn().Err(err).Msg("Failed to read shared analytics cache")
+		}
+		return cachedResponse{}, false
+	}
+	data, _ := body.Bytes()
+	entry = cachedResponse{body: data, etag: etag(data), expires: time.Now().Add(ttl.Val())}
+	c.remember(key, entry)
+	return entry, true
+}
+
+// put caches a response body for the cache's TTL
+func (c *responseCache) put(ctx context.Context, key string, body []byte) cachedResponse {
+	entry := cachedResponse{body: body, etag: etag(body), expires: time.Now().Add(c.ttl)}
+	c.remember(key, entry)
+	if c.shared != nil {
+		if err := c.shared.Set(ctx, sharedKey(key), body, c.ttl).Err(); err != nil {
+			log.Ctx(ctx).Warn().Err(err).Msg("Failed to write shared analytics cache")
+		}
+	}
+	return entry
+}
+
+// remember stores an entry in memory, dropping expired ones
+func (c *responseCache) remember(key string, entry cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = entry
+}
+
+// cacheRecorder buffers a handler's response so it can be cached
+type cacheRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (rec *cacheRecorder) Header() http.Header { return rec.header }
+
+func (rec *cacheRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+}
+
+func (rec *cacheRecorder) Write(p []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.body.Write(p)
+}
+
+// notModified reports whether an If-None-Match header matches etag
+func notModified(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// cached serves GET requests to handler from the response cache. Responses
+// carry an ETag, conditional requests whose tag still matches get 304 Not
+// Modified, and X-Cache reports whether the response was a HIT or MISS.
+// Only successful responses are cached; other methods bypass the cache.
+func (tas *TokenAnalyticsService) cached(handler http.HandlerFunc) http.HandlerFunc {
+	c := tas.cache
+	if c == nil {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			handler(w, r)
+			return
+		}
+
+		// Query().Encode sorts parameters, so equivalent URLs share an entry
+		key := r.URL.Path + "?" + r.URL.Query().Encode()
+		entry, hit := c.get(r.Context(), key)
+		if hit {
+			c.requestsCounter.WithLabelValues("hit").Inc()
+			w.Header().Set("X-Cache", "HIT")
+		} else {
+			rec := &cacheRecorder{header: make(http.Header)}
+			handler(rec, r)
+
+			for name, values := range rec.header {
+				w.Header()[name] = values
+			}
+			if rec.status != http.StatusOK {
+				c.requestsCounter.WithLabelValues("bypass").Inc()
+				w.WriteHeader(rec.status)
+				w.Write(rec.body.Bytes())
+				return
+			}
+			c.requestsCounter.WithLabelValues("miss").Inc()
+			entry = c.put(r.Context(), key, rec.body.Bytes())
+			w.Header().Set("X-Cache", "MISS")
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		w.Header().Set("ETag", entry.etag)
+		w.Header().Set("Cache-Control", "max-age="+strconv.Itoa(int(c.ttl.Seconds())))
+		if notModified(r.Header.Get("If-None-Match"), entry.etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write(entry.body)
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+)
+
+// ClientUsage is the all-time usage of each value of a client dimension, such
+// as each consuming application, origin or API key
+type ClientUsage struct {
+	GroupBy string                `json:"group_by"`
+	Usage   map[string]ModelStats `json:"usage"`
+	// Ranking lists the values by descending cost
+	Ranking []string `json:"ranking"`
+}
+
+// clientDimension returns the client dimension named by group_by, defaulting to app
+func clientDimension(name string) (capture.ClientDimension, bool) {
+	if name == "" {
+		name = "app"
+	}
+	for _, dimension := range capture.ClientDimensions {
+		if dimension.Name == name {
+			return dimension, true
+		}
+	}
+	return capture.ClientDimension{}, false
+}
+
+// clientsHandler serves /analytics/clients?group_by=app|origin|api_key
+func (tas *TokenAnalyticsService) clientsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	ks, ok := tenantKeyspace(w, r)
+	if !ok {
+		return
+	}
+
+	dimension, ok := clientDimension(r.URL.Query().Get("group_by"))
+	if !ok {
+		names := make([]string, len(capture.ClientDimensions))
+		for i, d := range capture.ClientDimensions {
+			names[i] = d.Name
+		}
+		http.Error(w, fmt.Sprintf("Invalid group_by, expected %s", strings.Join(names, ", ")), http.StatusBadRequest)
+		return
+	}
+
+	usage, err := tas.getUsageStats(r.Context(), ks, dimension.Index, dimension.Kind)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get client usage: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	ranking := make([]string, 0, len(usage))
+	for name := range usage {
+		ranking = append(ranking, name)
+	}
+	sort.Slice(ranking, func(i, j int) bool {
+		a, b := usage[ranking[i]], usage[ranking[j]]
+		if a.TotalCostUSD != b.TotalCostUSD {
+			return a.TotalCostUSD > b.TotalCostUSD
+		}
+		return ranking[i] < ranking[j]
+	})
+
+	json.NewEncoder(w).Encode(ClientUsage{GroupBy: dimension.Name, Usage: usage, Ranking: ranking})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+	"github.com/redis/go-redis/v9"
+)
+
+// DailyCost is the spend on one UTC day
+type DailyCost struct {
+	Date    string  `json:"date"`
+	CostUSD float64 `json:"cost_usd"`
+}
+
+// NamedCost is the spend of a user or model
+type NamedCost struct {
+	Name    string  `json:"name"`
+	CostUSD float64 `json:"cost_usd"`
+}
+
+// CostReport summarises a month's spend
+type CostReport struct {
+	Month   string  `json:"month"`
+	CostUSD float64 `json:"cost_usd"`
+	// ProjectedCostUSD extrapolates the spend so far to the end of the
+	// current month; for past months it equals CostUSD
+	ProjectedCostUSD float64     `json:"projected_cost_usd"`
+	ByDay            []DailyCost `json:"by_day"`
+	ByModel          []NamedCost `json:"by_model"`
+	TopUsers         []NamedCost `json:"top_users"`
+	TotalUsers       int         `json:"total_users"`
+}
+
+// GetCostReport reports a month's (YYYYMM) spend per day and per model from
+// the hourly rollups, and per user from the monthly cost hash
+func (tas *TokenAnalyticsService) GetCostReport(ctx context.Context, ks capture.Keyspace, month string, userLimit int) (*CostReport, error) {
+	start, err := time.Parse("200601", month)
+	if err != nil {
+		return nil, err
+	}
+	end := start.AddDate(0, 1, 0)
+	now := time.Now().UTC()
+	if end.After(now) {
+		end = now.Truncate(time.Hour).Add(time.Hour)
+	}
+	_, _, hours := windowHours(start, end)
+
+	models, err := tas.redis.SMembers(ctx, ks.Key("models")).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := tas.redis.Pipeline()
+	usersCmd := pipe.HGetAll(ctx, ks.Key("costs:monthly:%s", month))
+	hourCmds := make([]*redis.StringCmd, len(hours))
+	modelCmds := make(map[string][]*redis.StringCmd, len(models))
+	for i, hour := range hours {
+		hourCmds[i] = pipe.HGet(ctx, ks.Key("tokens:hourly:%s", hour.Format("2006010215")), "cost_usd")
+	}
+	for _, model := range models {
+		cmds := make([]*redis.StringCmd, len(hours))
+		for i, hour := range hours {
+			cmds[i] = pipe.HGet(ctx, capture.ModelHourlyKey(ks, model, hour), "cost_usd")
+		}
+		modelCmds[model] = cmds
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	report := &CostReport{
+		Month:    month,
+		ByDay:    []DailyCost{},
+		ByModel:  []NamedCost{},
+		TopUsers: []NamedCost{},
+	}
+
+	days := make(map[string]float64)
+	for i, hour := range hours {
+		cost, _ := hourCmds[i].Float64()
+		date := hour.Format("2006-01-02")
+		if _, ok := days[date]; !ok {
+			report.ByDay = append(report.ByDay, DailyCost{Date: date})
+		}
+		days[date] += cost
+		report.CostUSD += cost
+	}
+	for i := range report.ByDay {
+		report.ByDay[i].CostUSD = days[report.ByDay[i].Date]
+	}
+
+	for model, cmds := range modelCmds {
+		var cost float64
+		for _, cmd := range cmds {
+			hourCost, _ := cmd.Float64()
+			cost += hourCost
+		}
+		if cost > 0 {
+			report.ByModel = append(report.ByModel, NamedCost{Name: model, CostUSD: cost})
+		}
+	}
+	sortCosts(report.ByModel)
+
+	for userID, value := range usersCmd.Val() {
+		cost, _ := strconv.ParseFloat(value, 64)
+		report.TopUsers = append(report.TopUsers, NamedCost{Name: userID, CostUSD: cost})
+	}
+	report.TotalUsers = len(report.TopUsers)
+	sortCosts(report.TopUsers)
+	if len(report.TopUsers) > userLimit {
+		report.TopUsers = report.TopUsers[:userLimit]
+	}
+
+	// Project the current month from the average spend per elapsed hour
+	report.ProjectedCostUSD = report.CostUSD
+	monthEnd := start.AddDate(0, 1, 0)
+	if now.Before(monthEnd) {
+		if elapsed := now.Sub(start).Hours(); elapsed >= 1 {
+			report.ProjectedCostUSD = report.CostUSD / elapsed * monthEnd.Sub(start).Hours()
+		}
+	}
+
+	return report, nil
+}
+
+// sortCosts orders costs from highest to lowest, breaking ties by name
+func sortCosts(costs []NamedCost) {
+	sort.Slice(costs, func(i, j int) bool {
+		if costs[i].CostUSD != costs[j].CostUSD {
+			return costs[i].CostUSD > costs[j].CostUSD
+		}
+		return costs[i].Name < costs[j].Name
+	})
+}
+
+// costsHandler serves /analytics/costs?month=YYYYMM&limit=N, defaulting to
+// the current month and the top 10 users
+func (tas *TokenAnalyticsService) costsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	ks, ok := tenantKeyspace(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	month := query.Get("month")
+	if month == "" {
+		month = time.Now().UTC().Format("200601")
+	} else if _, err := time.Parse("200601", month); err != nil {
+		http.Error(w, "Invalid month, expected YYYYMM", http.StatusBadRequest)
+		return
+	}
+
+	limit, err := queryInt(query.Get("limit"), 10)
+	if err != nil || limit <= 0 || limit > 1000 {
+		http.Error(w, "Invalid limit, expected 1 to 1000", http.StatusBadRequest)
+		return
+	}
+
+	report, err := tas.GetCostReport(r.Context(), ks, month, limit)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get cost report: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(report)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+	"github.com/redis/go-redis/v9"
+)
+
+// unclassifiedErrors is the status reported for errors counted before hourly
+// rollups recorded each error's status
+const unclassifiedErrors = "unclassified"
+
+// ErrorCounts is the requests and errors, by status, of a model or hour
+type ErrorCounts struct {
+	Requests  int64            `json:"requests"`
+	Errors    int64            `json:"errors"`
+	ErrorRate float64          `json:"error_rate"`
+	ByStatus  map[string]int64 `json:"by_status"`
+}
+
+// add accumulates an hourly rollup's counts
+func (c *ErrorCounts) add(data map[string]string) {
+	requests, _ := strconv.ParseInt(data["requests"], 10, 64)
+	errors, _ := strconv.ParseInt(data["errors"], 10, 64)
+	c.Requests += requests
+	c.Errors += errors
+
+	classified := int64(0)
+	for _, status := range capture.ErrorStatuses {
+		count, _ := strconv.ParseInt(data[capture.ErrorStatusField(status)], 10, 64)
+		if count > 0 {
+			c.ByStatus[string(status)] += count
+			classified += count
+		}
+	}
+	if errors > classified {
+		c.ByStatus[unclassifiedErrors] += errors - classified
+	}
+}
+
+// finish computes the error rate
+func (c *ErrorCounts) finish() {
+	if c.Requests > 0 {
+		c.ErrorRate = float64(c.Errors) / float64(c.Requests)
+	}
+}
+
+func newErrorCounts() ErrorCounts {
+	return ErrorCounts{ByStatus: map[string]int64{}}
+}
+
+// HourlyErrors is the error counts of one hour
+type HourlyErrors struct {
+	Hour time.Time `json:"hour"`
+	ErrorCounts
+}
+
+// ErrorBreakdown is the errors within a time range by model and status, with
+// an hourly trend
+type ErrorBreakdown struct {
+	From   time.Time              `json:"from"`
+	To     time.Time              `json:"to"`
+	Total  ErrorCounts            `json:"total"`
+	Models map[string]ErrorCounts `json:"models"`
+	Hourly []HourlyErrors         `json:"hourly"`
+}
+
+// GetErrorBreakdown sums the model hourly rollups over the hours overlapping
+// [from, to), optionally for a single model
+func (tas *TokenAnalyticsService) GetErrorBreakdown(ctx context.Context, ks capture.Keyspace, model string, from, to time.Time) (*ErrorBreakdown, error) {
+	models := []string{model}
+	if model == "" {
+		var err error
+		if models, err = tas.redis.SMembers(ctx, ks.Key("models")).Result(); err != nil {
+			return nil, err
+		}
+		sort.Strings(models)
+	}
+
+	from, to, hours := windowHours(from, to)
+
+	pipe := tas.redis.Pipeline()
+	cmds := make([][]*redis.MapStringStringCmd, len(models))
+	for i, name := range models {
+		cmds[i] = make([]*redis.MapStringStringCmd, len(hours))
+		for j, hour := range hours {
+			cmds[i][j] = pipe.HGetAll(ctx, capture.ModelHourlyKey(ks, name, hour))
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	breakdown := &ErrorBreakdown{
+		From:   from,
+		To:     to,
+		Total:  newErrorCounts(),
+		Models: make(map[string]ErrorCounts, len(models)),
+		Hourly: make([]HourlyErrors, len(hours)),
+	}
+	for j, hour := range hours {
+		breakdown.Hourly[j] = HourlyErrors{Hour: hour, ErrorCounts: newErrorCounts()}
+	}
+	for i, name := range models {
+		counts := newErrorCounts()
+		for j, cmd := range cmds[i] {
+			data := cmd.Val()
+			counts.add(data)
+			breakdown.Total.add(data)
+			breakdown.Hourly[j].add(data)
+		}
+		if counts.Requests > 0 {
+			counts.finish()
+			breakdown.Models[name] = counts
+		}
+	}
+	breakdown.Total.finish()
+	for j := range breakdown.Hourly {
+		breakdown.Hourly[j].finish()
+	}
+	return breakdown, nil
+}
+
+// errorsHandler serves /analytics/errors?from=RFC3339&to=RFC3339&model=,
+// defaulting to the last 24 hours of every model
+func (tas *TokenAnalyticsService) errorsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	ks, ok := tenantKeyspace(w, r)
+	if !ok {
+		return
+	}
+
+	from, to, _, err := parseWindow(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	breakdown, err := tas.GetErrorBreakdown(r.Context(), ks, r.URL.Query().Get("model"), from, to)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get error breakdown: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(breakdown)
+}
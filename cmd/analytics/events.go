@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/alerting"
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+)
+
+// defaultActivityPage is the number of activity events returned without a limit
+const defaultActivityPage = 50
+
+// activityNotifier publishes alerts that fire or resolve to the activity
+// feed of their rule's tenant
+type activityNotifier struct {
+	redis *redis.Client
+}
+
+// Name identifies the notifier in metrics and logs
+func (n activityNotifier) Name() string { return "activity" }
+
+// Notify publishes the alert as an alert.firing or alert.resolved event
+func (n activityNotifier) Notify(ctx context.Context, alert alerting.Alert) error {
+	event := capture.ActivityEvent{
+		Type:    capture.ActivityAlertFiring,
+		Time:    alert.StartsAt,
+		Tenant:  alert.Tenant,
+		Subject: alert.Rule,
+		Message: alert.Summary(),
+		Data: map[string]string{
+			"severity": alert.Severity,
+			"metric":   alert.Metric,
+			"value":    strconv.FormatFloat(alert.Value, 'g', -1, 64),
+		},
+	}
+	if alert.Status == alerting.StatusResolved {
+		event.Type = capture.ActivityAlertResolved
+		if alert.EndsAt != nil {
+			event.Time = *alert.EndsAt
+		}
+	}
+	return capture.PublishActivity(ctx, n.redis, event)
+}
+
+// eventsHandler serves /events?type=&cursor=&limit=N, listing the tenant's
+// activity events newest first. Pass the next_cursor of a page as cursor to
+// get the next one. Requests accepting text/event-stream, or with
+// stream=true, get new events as Server-Sent Events instead.
+func (tas *TokenAnalyticsService) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Last-Event-ID")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ks, ok := tenantKeyspace(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	if stream, _ := strconv.ParseBool(query.Get("stream")); stream || strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		tas.streamActivity(w, r, ks, query.Get("type"))
+		return
+	}
+
+	activityQuery := capture.ActivityQuery{
+		Type:   query.Get("type"),
+		Cursor: query.Get("cursor"),
+		Limit:  defaultActivityPage,
+	}
+	if activityQuery.Cursor != "" {
+		if err := capture.ValidStreamID(activityQuery.Cursor); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if value := query.Get("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 || limit > 500 {
+			http.Error(w, "invalid limit, expected 1 to 500", http.StatusBadRequest)
+			return
+		}
+		activityQuery.Limit = limit
+	}
+
+	page, err := capture.ListActivity(r.Context(), tas.redis, ks, activityQuery)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list events: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+// streamActivity sends the keyspace's activity events of type eventType,
+// or of every type when it is empty, as Server-Sent Events as they are
+// published. A reconnecting client's Last-Event-ID resumes after the last
+// event it received; other clients get events from now on.
+func (tas *TokenAnalyticsService) streamActivity(w http.ResponseWriter, r *http.Request, ks capture.Keyspace, eventType string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	last := r.Header.Get("Last-Event-ID")
+	if last != "" {
+		if err := capture.ValidStreamID(last); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	} else {
+		var err error
+		if last, err = capture.LatestActivityID(r.Context(), tas.redis, ks); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read events: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprintf(w, "retry: %d\n\n", streamRetryMs)
+	flusher.Flush()
+
+	ticker := time.NewTicker(streamPollInterval)
+	defer ticker.Stop()
+
+	lastWrite := time.Now()
+	for {
+		events, err := capture.ActivitySince(r.Context(), tas.redis, ks, last, 100)
+		if err == nil {
+			for _, event := range events {
+				last = event.ID
+				if eventType != "" && event.Type != eventType {
+					continue
+				}
+				data, _ := json.Marshal(event)
+				fmt.Fprintf(w, "id: %s\ndata: %s\n\n", event.ID, data)
+				lastWrite = time.Now()
+			}
+		}
+		if time.Since(lastWrite) >= streamKeepAlive {
+			fmt.Fprint(w, ": keepalive\n\n")
+			lastWrite = time.Now()
+		}
+		flusher.Flush()
+
+		// Catch up without waiting while a backlog remains
+		if len(events) == 100 {
+			continue
+		}
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
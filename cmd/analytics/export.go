@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+)
+
+// exportHeaders are the CSV columns of each export dimension
+var exportHeaders = map[string][]string{
+	"user":  {"date", "user_id", "total_tokens", "cost_usd"},
+	"model": {"date", "model", "requests", "input_tokens", "output_tokens", "total_tokens", "cost_usd", "errors"},
+}
+
+// UserDayUsage is a user's usage on one UTC day
+type UserDayUsage struct {
+	Date        string
+	UserID      string
+	TotalTokens int64
+	CostUSD     float64
+}
+
+// csvRow formats the usage in the user export's columns
+func (u UserDayUsage) csvRow() []string {
+	return []string{
+		u.Date,
+		u.UserID,
+		strconv.FormatInt(u.TotalTokens, 10),
+		strconv.FormatFloat(u.CostUSD, 'f', -1, 64),
+	}
+}
+
+// ModelDayUsage is a model's usage on one UTC day
+type ModelDayUsage struct {
+	Date         string
+	Model        string
+	Requests     int64
+	InputTokens  int64
+	OutputTokens int64
+	CostUSD      float64
+	Errors       int64
+}
+
+// csvRow formats the usage in the model export's columns
+func (m ModelDayUsage) csvRow() []string {
+	return []string{
+		m.Date,
+		m.Model,
+		strconv.FormatInt(m.Requests, 10),
+		strconv.FormatInt(m.InputTokens, 10),
+		strconv.FormatInt(m.OutputTokens, 10),
+		strconv.FormatInt(m.InputTokens+m.OutputTokens, 10),
+		strconv.FormatFloat(m.CostUSD, 'f', -1, 64),
+		strconv.FormatInt(m.Errors, 10),
+	}
+}
+
+// getUserDayUsage returns each user's tokens and cost on a day, ordered by user
+func (tas *TokenAnalyticsService) getUserDayUsage(ctx context.Context, ks capture.Keyspace, day time.Time) ([]UserDayUsage, error) {
+	pipe := tas.redis.Pipeline()
+	tokensCmd := pipe.HGetAll(ctx, ks.Key("tokens:daily:%s", day.Format("20060102")))
+	costsCmd := pipe.HGetAll(ctx, ks.Key("costs:daily:%s", day.Format("20060102")))
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	tokens, costs := tokensCmd.Val(), costsCmd.Val()
+	users := make([]string, 0, len(tokens))
+	for userID := range tokens {
+		users = append(users, userID)
+	}
+	for userID := range costs {
+		if _, ok := tokens[userID]; !ok {
+			users = append(users, userID)
+		}
+	}
+	sort.Strings(users)
+
+	date := day.Format("2006-01-02")
+	usage := make([]UserDayUsage, len(users))
+	for i, userID := range users {
+		total, _ := strconv.ParseInt(tokens[userID], 10, 64)
+		cost, _ := strconv.ParseFloat(costs[userID], 64)
+		usage[i] = UserDayUsage{Date: date, UserID: userID, TotalTokens: total, CostUSD: cost}
+	}
+	return usage, nil
+}
+
+// getModelDayUsage returns the usage on a day of each model that served
+// requests, summed from the model hourly rollups
+func (tas *TokenAnalyticsService) getModelDayUsage(ctx context.Context, ks capture.Keyspace, models []string, day time.Time) ([]ModelDayUsage, error) {
+	_, _, hours := windowHours(day, day.Add(24*time.Hour))
+
+	pipe := tas.redis.Pipeline()
+	cmds := make([][]*redis.MapStringStringCmd, len(models))
+	for i, model := range models {
+		cmds[i] = make([]*redis.MapStringStringCmd, len(hours))
+		for j, hour := range hours {
+			cmds[i][j] = pipe.HGetAll(ctx, capture.ModelHourlyKey(ks, model, hour))
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	date := day.Format("2006-01-02")
+	var usage []ModelDayUsage
+	for i, model := range models {
+		total := ModelDayUsage{Date: date, Model: model}
+		for _, cmd := range cmds[i] {
+			var hourly Rollup
+			if err := cmd.Scan(&hourly); err != nil {
+				return nil, err
+			}
+			total.Requests += hourly.Requests
+			total.InputTokens += hourly.InputTokens
+			total.OutputTokens += hourly.OutputTokens
+			total.CostUSD += hourly.CostUSD
+			total.Errors += hourly.Errors
+		}
+		if total.Requests > 0 {
+			usage = append(usage, total)
+		}
+	}
+	return usage, nil
+}
+
+// parseExportRange reads the range parameter as a number of days ending now,
+// e.g. range=30d, falling back to the from and to parameters
+func parseExportRange(r *http.Request) (time.Time, time.Time, error) {
+	value := r.URL.Query().Get("range")
+	if value == "" {
+		from, to, _, err := parseWindow(r)
+		return from, to, err
+	}
+
+	days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+	if err != nil || !strings.HasSuffix(value, "d") || days <= 0 || time.Duration(days)*24*time.Hour > maxWindow {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid range, expected 1d to %dd", int(maxWindow.Hours()/24))
+	}
+	to := time.Now()
+	return to.Add(-time.Duration(days) * 24 * time.Hour), to, nil
+}
+
+// exportHandler serves /analytics/export?format=csv&by=user|model&range=30d,
+// streaming one row per user (the default) or model per UTC day. The range
+// may instead be given with from and to as for /analytics/usage.
+func (tas *TokenAnalyticsService) exportHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	ks, ok := tenantKeyspace(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	if format := query.Get("format"); format != "" && format != "csv" {
+		http.Error(w, "Invalid format, expected csv", http.StatusBadRequest)
+		return
+	}
+	by := query.Get("by")
+	if by == "" {
+		by = "user"
+	}
+	header, ok := exportHeaders[by]
+	if !ok {
+		http.Error(w, "Invalid by, expected user or model", http.StatusBadRequest)
+		return
+	}
+	from, to, err := parseExportRange(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var models []string
+	if by == "model" {
+		if models, err = tas.redis.SMembers(r.Context(), ks.Key("models")).Result(); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list models: %v", err), http.StatusInternalServerError)
+			return
+		}
+		sort.Strings(models)
+	}
+
+	tas.recordAudit(r, query.Get("tenant"), capture.AuditAnalyticsExport, "usage:"+by, []byte(r.URL.RawQuery))
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=usage-by-%s-%s-%s.csv",
+		by, from.UTC().Format("20060102"), to.UTC().Format("20060102")))
+
+	// Rows are streamed a day at a time once the header is sent, so a failure
+	// part way through can only end the stream early
+	writer := csv.NewWriter(w)
+	writer.Write(header)
+	for day := from.UTC().Truncate(24 * time.Hour); day.Before(to); day = day.Add(24 * time.Hour) {
+		var rows [][]string
+		if by == "model" {
+			usage, err := tas.getModelDayUsage(r.Context(), ks, models, day)
+			if err != nil {
+				log.Ctx(r.Context()).Error().Err(err).Str("day", day.Format("2006-01-02")).Msg("Failed to export usage")
+				break
+			}
+			for _, u := range usage {
+				rows = append(rows, u.csvRow())
+			}
+		} else {
+			usage, err := tas.getUserDayUsage(r.Context(), ks, day)
+			if err != nil {
+				log.Ctx(r.Context()).Error().Err(err).Str("day", day.Format("2006-01-02")).Msg("Failed to export usage")
+				break
+			}
+			for _, u := range usage {
+				rows = append(rows, u.csvRow())
+			}
+		}
+		writer.WriteAll(rows)
+	}
+	writer.Flush()
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+	"github.com/ajeetraina/genai-app-demo/pkg/logger"
+	"github.com/ajeetraina/genai-app-demo/pkg/parquet"
+	"github.com/ajeetraina/genai-app-demo/pkg/s3"
+)
+
+// Parquet export scheduling. Completed days within the lookback that have no
+// export marker are exported; markers outlive the lookback so days are not
+// exported twice.
+const (
+	parquetExportInterval = time.Hour
+	parquetExportLookback = 7 * 24 * time.Hour
+	parquetMarkerTTL      = 30 * 24 * time.Hour
+)
+
+var userDayColumns = []parquet.Column{
+	{Name: "tenant", Type: parquet.String},
+	{Name: "date", Type: parquet.String},
+	{Name: "user_id", Type: parquet.String},
+	{Name: "total_tokens", Type: parquet.Int64},
+	{Name: "cost_usd", Type: parquet.Double},
+}
+
+var modelDayColumns = []parquet.Column{
+	{Name: "tenant", Type: parquet.String},
+	{Name: "date", Type: parquet.String},
+	{Name: "model", Type: parquet.String},
+	{Name: "requests", Type: parquet.Int64},
+	{Name: "input_tokens", Type: parquet.Int64},
+	{Name: "output_tokens", Type: parquet.Int64},
+	{Name: "total_tokens", Type: parquet.Int64},
+	{Name: "cost_usd", Type: parquet.Double},
+	{Name: "errors", Type: parquet.Int64},
+}
+
+// ParquetExporter writes each completed UTC day's usage per user and per model,
+// across all tenants, as Parquet objects partitioned by date:
+// {prefix}/usage_by_user/date=YYYY-MM-DD/usage.parquet and likewise
+// usage_by_model
+type ParquetExporter struct {
+	tas    *TokenAnalyticsService
+	store  *s3.Client
+	prefix string
+}
+
+// NewParquetExporter creates an exporter writing under prefix in the bucket
+func NewParquetExporter(tas *TokenAnalyticsService, store *s3.Client, prefix string) *ParquetExporter {
+	return &ParquetExporter{tas: tas, store: store, prefix: prefix}
+}
+
+// Run exports completed days every interval
+func (pe *ParquetExporter) Run() {
+	ticker := time.NewTicker(parquetExportInterval)
+	defer ticker.Stop()
+
+	pe.exportPending(time.Now())
+	for range ticker.C {
+		pe.exportPending(time.Now())
+	}
+}
+
+// exportPending exports the completed days in the lookback not exported yet
+func (pe *ParquetExporter) exportPending(now time.Time) {
+	ctx := pe.tas.ctx
+	today := now.UTC().Truncate(24 * time.Hour)
+	for day := today.Add(-parquetExportLookback); day.Before(today); day = day.Add(24 * time.Hour) {
+		markerKey := fmt.Sprintf("exports:parquet:%s", day.Format("20060102"))
+		exported, err := pe.tas.redis.Exists(ctx, markerKey).Result()
+		if err != nil {
+			logger.Component("lakehouse").Error().Err(err).Str("day", day.Format("2006-01-02")).Msg("Failed to check Parquet export")
+			return
+		}
+		if exported > 0 {
+			continue
+		}
+
+		if err := pe.ExportDay(ctx, day); err != nil {
+			logger.Component("lakehouse").Error().Err(err).Str("day", day.Format("2006-01-02")).Msg("Failed to export to Parquet")
+			return
+		}
+		pe.tas.redis.Set(ctx, markerKey, now.Unix(), parquetMarkerTTL)
+		logger.Component("lakehouse").Info().Str("day", day.Format("2006-01-02")).Msg("Exported usage to Parquet")
+	}
+}
+
+// ExportDay writes a day's usage objects
+func (pe *ParquetExporter) ExportDay(ctx context.Context, day time.Time) error {
+	tenants, err := pe.tas.redis.SMembers(ctx, "tenants").Result()
+	if err != nil {
+		return err
+	}
+	sort.Strings(tenants)
+
+	var userRows, modelRows [][]interface{}
+	for _, tenant := range append([]string{""}, tenants...) {
+		ks := capture.TenantKeyspace(tenant)
+
+		users, err := pe.tas.getUserDayUsage(ctx, ks, day)
+		if err != nil {
+			return err
+		}
+		for _, u := range users {
+			userRows = append(userRows, []interface{}{tenant, u.Date, u.UserID, u.TotalTokens, u.CostUSD})
+		}
+
+		models, err := pe.tas.redis.SMembers(ctx, ks.Key("models")).Result()
+		if err != nil {
+			return err
+		}
+		sort.Strings(models)
+		usage, err := pe.tas.getModelDayUsage(ctx, ks, models, day)
+		if err != nil {
+			return err
+		}
+		for _, m := range usage {
+			modelRows = append(modelRows, []interface{}{tenant, m.Date, m.Model, m.Requests,
+				m.InputTokens, m.OutputTokens, m.InputTokens + m.OutputTokens, m.CostUSD, m.Errors})
+		}
+	}
+
+	if err := pe.upload(ctx, "usage_by_user", day, userDayColumns, userRows); err != nil {
+		return err
+	}
+	return pe.upload(ctx, "usage_by_model", day, modelDayColumns, modelRows)
+}
+
+// upload encodes rows as Parquet and writes them to the day's partition of a table
+func (pe *ParquetExporter) upload(ctx context.Context, table string, day time.Time, columns []parquet.Column, rows [][]interface{}) error {
+	var buf bytes.Buffer
+	if err := parquet.Write(&buf, columns, rows); err != nil {
+		return fmt.Errorf("failed to encode %s: %v", table, err)
+	}
+	key := path.Join(pe.prefix, table, "date="+day.Format("2006-01-02"), "usage.parquet")
+	if err := pe.store.PutObject(ctx, key, "application/vnd.apache.parquet", buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to upload %s: %v", key, err)
+	}
+	return nil
+}
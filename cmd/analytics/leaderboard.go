@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+)
+
+// LeaderboardEntry is a ranked user or model
+type LeaderboardEntry struct {
+	Rank   int64   `json:"rank"`
+	Name   string  `json:"name"`
+	Tokens float64 `json:"tokens"`
+}
+
+// Leaderboard ranks users or models by tokens over a period
+type Leaderboard struct {
+	Board   string             `json:"board"`
+	Period  string             `json:"period"`
+	Key     string             `json:"key"`
+	Entries []LeaderboardEntry `json:"entries"`
+}
+
+// GetLeaderboard returns the top entries of the users or models board for the
+// period containing at
+func (tas *TokenAnalyticsService) GetLeaderboard(ctx context.Context, ks capture.Keyspace, board, period string, at time.Time, limit int) (*Leaderboard, error) {
+	key, err := capture.LeaderboardKey(ks, board, period, at)
+	if err != nil {
+		return nil, err
+	}
+
+	scores, err := tas.redis.ZRevRangeWithScores(ctx, key, 0, int64(limit-1)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	leaderboard := &Leaderboard{
+		Board:   board,
+		Period:  period,
+		Key:     key,
+		Entries: make([]LeaderboardEntry, 0, len(scores)),
+	}
+	for i, z := range scores {
+		leaderboard.Entries = append(leaderboard.Entries, LeaderboardEntry{
+			Rank:   int64(i + 1),
+			Name:   fmt.Sprint(z.Member),
+			Tokens: z.Score,
+		})
+	}
+	return leaderboard, nil
+}
+
+// leaderboardHandler serves /analytics/leaderboards/{board}?period=daily|weekly|monthly|all&date=YYYY-MM-DD&limit=N
+func (tas *TokenAnalyticsService) leaderboardHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	ks, ok := tenantKeyspace(w, r)
+	if !ok {
+		return
+	}
+
+	board := r.PathValue("board")
+	if board != "users" && board != "models" {
+		http.Error(w, "Invalid board, expected users or models", http.StatusBadRequest)
+		return
+	}
+
+	query := r.URL.Query()
+	period := query.Get("period")
+	if period == "" {
+		period = capture.LeaderboardDaily
+	}
+	if _, err := capture.LeaderboardKey(ks, board, period, time.Now()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	at := time.Now()
+	if date := query.Get("date"); date != "" {
+		parsed, err := time.Parse("2006-01-02", date)
+		if err != nil {
+			http.Error(w, "Invalid date, expected YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		at = parsed
+	}
+
+	limit := 10
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	leaderboard, err := tas.GetLeaderboard(r.Context(), ks, board, period, at, limit)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get leaderboard: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(leaderboard)
+}
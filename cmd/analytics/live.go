@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+	"github.com/ajeetraina/genai-app-demo/pkg/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+// liveCache shares each tenant's analytics between live clients, so they are
+// computed at most once per push interval however many clients are connected
+type liveCache struct {
+	mu      sync.Mutex
+	entries map[capture.Keyspace]liveEntry
+}
+
+type liveEntry struct {
+	analytics *AnalyticsResponse
+	updated   time.Time
+}
+
+// LiveMessage is pushed to WebSocket clients: a snapshot of the full
+// AnalyticsResponse first, then deltas holding only the fields that changed
+type LiveMessage struct {
+	Type string                     `json:"type"`
+	Data map[string]json.RawMessage `json:"data"`
+}
+
+// parseLiveInterval reads how often live clients are sent updates
+func parseLiveInterval() time.Duration {
+	seconds, _ := strconv.Atoi(os.Getenv("LIVE_PUSH_INTERVAL_SECONDS"))
+	if seconds <= 0 {
+		seconds = 5
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// liveAnalytics returns the tenant's analytics, reusing those computed within
+// the push interval
+func (tas *TokenAnalyticsService) liveAnalytics(ctx context.Context, ks capture.Keyspace) (*AnalyticsResponse, error) {
+	tas.live.mu.Lock()
+	defer tas.live.mu.Unlock()
+
+	if entry, ok := tas.live.entries[ks]; ok && time.Since(entry.updated) < tas.liveInterval {
+		return entry.analytics, nil
+	}
+	analytics, err := tas.GetAnalytics(ctx, ks)
+	if err != nil {
+		return nil, err
+	}
+	if tas.live.entries == nil {
+		tas.live.entries = make(map[capture.Keyspace]liveEntry)
+	}
+	tas.live.entries[ks] = liveEntry{analytics: analytics, updated: time.Now()}
+	return analytics, nil
+}
+
+// analyticsFields encodes analytics as its top-level JSON fields
+func analyticsFields(analytics *AnalyticsResponse) (map[string]json.RawMessage, error) {
+	encoded, err := json.Marshal(analytics)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(encoded, &fields)
+	return fields, err
+}
+
+// wsHandler serves /analytics/ws, pushing the tenant's analytics to a
+// dashboard every push interval. The first message is a snapshot; later ones
+// are deltas of the fields that changed, which clients merge into it.
+func (tas *TokenAnalyticsService) wsHandler(w http.ResponseWriter, r *http.Request) {
+	ks, ok := tenantKeyspace(w, r)
+	if !ok {
+		return
+	}
+	conn, err := websocket.Upgrade(w, r)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	ticker := time.NewTicker(tas.liveInterval)
+	defer ticker.Stop()
+
+	var previous map[string]json.RawMessage
+	for {
+		analytics, err := tas.liveAnalytics(tas.ctx, ks)
+		if err != nil {
+			log.Ctx(r.Context()).Warn().Err(err).Msg("Failed to get live analytics")
+		} else if fields, err := analyticsFields(analytics); err == nil {
+			message := LiveMessage{Type: "snapshot", Data: fields}
+			if previous != nil {
+				message = LiveMessage{Type: "delta", Data: map[string]json.RawMessage{}}
+				for field, value := range fields {
+					if !bytes.Equal(previous[field], value) {
+						message.Data[field] = value
+					}
+				}
+			}
+			previous = fields
+
+			encoded, _ := json.Marshal(message)
+			if err := conn.WriteText(encoded); err != nil {
+				return
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-conn.Done():
+			return
+		}
+	}
+}
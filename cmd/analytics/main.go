@@ -4,45 +4,91 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
-	"strings"
+	"syscall"
 	"time"
 
-	"github.com/go-redis/redis/v8"
+	"github.com/ajeetraina/genai-app-demo/pkg/alerting"
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+	"github.com/ajeetraina/genai-app-demo/pkg/errorreport"
+	"github.com/ajeetraina/genai-app-demo/pkg/grafana"
+	"github.com/ajeetraina/genai-app-demo/pkg/health"
+	"github.com/ajeetraina/genai-app-demo/pkg/logger"
+	"github.com/ajeetraina/genai-app-demo/pkg/metrics"
+	"github.com/ajeetraina/genai-app-demo/pkg/middleware"
+	"github.com/ajeetraina/genai-app-demo/pkg/otelmetrics"
+	"github.com/ajeetraina/genai-app-demo/pkg/postgres"
+	"github.com/ajeetraina/genai-app-demo/pkg/redisconn"
+	"github.com/ajeetraina/genai-app-demo/pkg/s3"
+	"github.com/ajeetraina/genai-app-demo/pkg/tracing"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
 )
 
 // TokenAnalyticsService provides real-time analytics from Redis data
 type TokenAnalyticsService struct {
 	redis  *redis.Client
 	ctx    context.Context
+
+	// adminToken is the bearer token required to change budgets; the admin
+	// endpoints are disabled while it is unset
+	adminToken string
+
+	// alerts evaluates the configured alert rules, or is nil without rules
+	alerts *alerting.Evaluator
+
+	// rollupRetention is how long hourly and daily rollups are kept
+	rollupRetention time.Duration
+
+	// archive, when set, is the Postgres database rollups are copied to
+	archive *postgres.Conn
+
+	// liveInterval is how often live dashboard clients are sent updates
+	liveInterval time.Duration
+	live         liveCache
+
+	// cache, when set, holds recent responses of the JSON endpoints
+	cache *responseCache
+
+	// redisMonitor tracks whether Redis is reachable
+	redisMonitor *redisconn.Monitor
+
+	// annotator, when set, marks operational events on Grafana dashboards
+	annotator *grafana.Annotator
 	
 	// Prometheus metrics
 	activeUsersGauge     *prometheus.GaugeVec
 	activeSessionsGauge  prometheus.Gauge
 	tokenRateGauge       *prometheus.GaugeVec
-	userTokensCounter    *prometheus.CounterVec
+	userTokens           *userTokensCollector
 	modelUsageGauge      *prometheus.GaugeVec
 	responseTimeHist     *prometheus.HistogramVec
 	errorRateGauge       *prometheus.GaugeVec
+	errorRateWindowGauge *prometheus.GaugeVec
+	errorCountGauge      *prometheus.GaugeVec
 }
 
 // AnalyticsResponse represents the API response for analytics data
 type AnalyticsResponse struct {
-	ActiveUsers5m     int64                  `json:"active_users_5m"`
-	ActiveUsers1h     int64                  `json:"active_users_1h"`
-	ActiveSessions    int64                  `json:"active_sessions"`
-	TokenRates        map[string]float64     `json:"token_rates"`
-	TopUsers          []UserStats            `json:"top_users"`
-	ModelUsage        map[string]ModelStats  `json:"model_usage"`
-	ResponseTimeP95   float64                `json:"response_time_p95"`
-	ResponseTimeP99   float64                `json:"response_time_p99"`
-	ErrorRate         float64                `json:"error_rate"`
-	Timestamp         int64                  `json:"timestamp"`
+	ActiveUsers5m   int64                        `json:"active_users_5m"`
+	ActiveUsers1h   int64                        `json:"active_users_1h"`
+	ActiveSessions  int64                        `json:"active_sessions"`
+	TokenRates      map[string]float64           `json:"token_rates"`
+	ModelTokenRates map[string]capture.TokenRate `json:"model_token_rates"`
+	TopUsers        []UserStats                  `json:"top_users"`
+	ModelUsage      map[string]ModelStats        `json:"model_usage"`
+	ClientUsage     map[string]ModelStats        `json:"client_usage"`
+	ResponseTimeP95 float64                      `json:"response_time_p95"`
+	ResponseTimeP99 float64                      `json:"response_time_p99"`
+	ErrorRate       float64                      `json:"error_rate"`
+	ErrorRates      map[string]capture.ErrorRate `json:"error_rates"`
+	Window          *WindowUsage                 `json:"window,omitempty"`
+	Timestamp       int64                        `json:"timestamp"`
 }
 
 type UserStats struct {
@@ -51,6 +97,7 @@ type UserStats struct {
 	TotalOutputTokens   int64   `json:"total_output_tokens"`
 	TotalSessions       int64   `json:"total_sessions"`
 	AvgTokensPerRequest float64 `json:"avg_tokens_per_request"`
+	TotalCostUSD        float64 `json:"total_cost_usd"`
 	LastSeen            string  `json:"last_seen"`
 }
 
@@ -59,21 +106,50 @@ type ModelStats struct {
 	TotalInputTokens   int64   `json:"total_input_tokens"`
 	TotalOutputTokens  int64   `json:"total_output_tokens"`
 	AvgResponseTime    float64 `json:"avg_response_time"`
+	ResponseTimeP95    float64 `json:"response_time_p95"`
+	ResponseTimeP99    float64 `json:"response_time_p99"`
 	AvgTokensPerSecond float64 `json:"avg_tokens_per_second"`
+	TotalCostUSD       float64 `json:"total_cost_usd"`
 }
 
-// NewTokenAnalyticsService creates a new analytics service
-func NewTokenAnalyticsService(redisAddr, redisPassword string, redisDB int) *TokenAnalyticsService {
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     redisAddr,
-		Password: redisPassword,
-		DB:       redisDB,
-	})
+// UserCost represents a user's spend for a month and over their lifetime
+type UserCost struct {
+	UserID       string  `json:"user_id"`
+	Month        string  `json:"month"`
+	CostUSD      float64 `json:"cost_usd"`
+	TotalCostUSD float64 `json:"total_cost_usd"`
+}
+
+// ActiveRequest represents the live progress of an in-flight streamed response
+type ActiveRequest struct {
+	RequestID          string  `json:"request_id"`
+	SessionID          string  `json:"session_id"`
+	UserID             string  `json:"user_id"`
+	Model              string  `json:"model"`
+	StartedAt          int64   `json:"started_at"`
+	UpdatedAt          int64   `json:"updated_at"`
+	OutputTokens       int64   `json:"output_tokens"`
+	Chunks             int64   `json:"chunks"`
+	TimeToFirstTokenMs int64   `json:"time_to_first_token_ms"`
+	TokensPerSecond    float64 `json:"tokens_per_second"`
+	ChunksPerSecond    float64 `json:"chunks_per_second"`
+}
+
+// activeRequestTimeout is how long an in-flight request may go without a
+// progress update before it is considered abandoned
+const activeRequestTimeout = 2 * time.Minute
+
+// NewTokenAnalyticsService creates the analytics service, waiting up to
+// connectTimeout for Redis. If Redis is not up by then the service starts
+// degraded and recovers once a health check, every healthInterval, succeeds.
+func NewTokenAnalyticsService(options redisconn.Options, connectTimeout, healthInterval time.Duration) *TokenAnalyticsService {
+	rdb := options.NewClient()
+	redisconn.Instrument(rdb, "default", prometheus.DefaultRegisterer)
 
 	ctx := context.Background()
-	_, err := rdb.Ping(ctx).Result()
+	err := redisconn.Wait(ctx, rdb, connectTimeout)
 	if err != nil {
-		log.Fatalf("Failed to connect to Redis: %v", err)
+		log.Warn().Err(err).Msg("Redis unavailable, starting degraded")
 	}
 
 	// Initialize Prometheus metrics
@@ -100,13 +176,7 @@ func NewTokenAnalyticsService(redisAddr, redisPassword string, redisDB int) *Tok
 		[]string{"direction", "window"},
 	)
 
-	userTokensCounter := prometheus.NewCounterVec(
-		prometheus.CounterOpts{
-			Name: "token_analytics_user_tokens_total",
-			Help: "Total tokens processed per user",
-		},
-		[]string{"user_id", "direction"},
-	)
+	userTokens := newUserTokensCollector()
 
 	modelUsageGauge := prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -128,7 +198,23 @@ func NewTokenAnalyticsService(redisAddr, redisPassword string, redisDB int) *Tok
 	errorRateGauge := prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Name: "token_analytics_error_rate",
-			Help: "Error rate by type",
+			Help: "Share of requests in the last 5 minutes that failed, by error type",
+		},
+		[]string{"error_type"},
+	)
+
+	errorRateWindowGauge := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "token_analytics_error_rate_window",
+			Help: "Share of requests that failed over the last 1m, 5m and 1h",
+		},
+		[]string{"window"},
+	)
+
+	errorCountGauge := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "token_analytics_errors",
+			Help: "Errors captured since the counters were created, by error type",
 		},
 		[]string{"error_type"},
 	)
@@ -138,22 +224,27 @@ func NewTokenAnalyticsService(redisAddr, redisPassword string, redisDB int) *Tok
 		activeUsersGauge,
 		activeSessionsGauge,
 		tokenRateGauge,
-		userTokensCounter,
+		userTokens,
 		modelUsageGauge,
 		responseTimeHist,
 		errorRateGauge,
+		errorRateWindowGauge,
+		errorCountGauge,
 	)
 
 	service := &TokenAnalyticsService{
-		redis:               rdb,
-		ctx:                 ctx,
-		activeUsersGauge:    activeUsersGauge,
-		activeSessionsGauge: activeSessionsGauge,
-		tokenRateGauge:      tokenRateGauge,
-		userTokensCounter:   userTokensCounter,
-		modelUsageGauge:     modelUsageGauge,
-		responseTimeHist:    responseTimeHist,
-		errorRateGauge:      errorRateGauge,
+		redis:                rdb,
+		ctx:                  ctx,
+		activeUsersGauge:     activeUsersGauge,
+		activeSessionsGauge:  activeSessionsGauge,
+		tokenRateGauge:       tokenRateGauge,
+		userTokens:           userTokens,
+		modelUsageGauge:      modelUsageGauge,
+		responseTimeHist:     responseTimeHist,
+		errorRateGauge:       errorRateGauge,
+		errorRateWindowGauge: errorRateWindowGauge,
+		errorCountGauge:      errorCountGauge,
+		redisMonitor:         redisconn.NewMonitor(rdb, err == nil, healthInterval, prometheus.DefaultRegisterer),
 	}
 
 	// Start background metrics collection
@@ -168,101 +259,214 @@ func (tas *TokenAnalyticsService) collectMetricsPeriodically() {
 	defer ticker.Stop()
 
 	for range ticker.C {
-		tas.updatePrometheusMetrics()
+		if tas.redisMonitor.Available() {
+			tas.updatePrometheusMetrics()
+		}
 	}
 }
 
 // updatePrometheusMetrics reads from Redis and updates Prometheus metrics
 func (tas *TokenAnalyticsService) updatePrometheusMetrics() {
-	// Update active users
+	// Update active users and sessions in one round trip
 	windows := []string{"5m", "15m", "1h", "24h"}
-	for _, window := range windows {
-		key := fmt.Sprintf("users:active:%s", window)
-		count, err := tas.redis.SCard(tas.ctx, key).Result()
-		if err == nil {
+	pipe := tas.redis.Pipeline()
+	windowCmds := make([]*redis.IntCmd, len(windows))
+	for i, window := range windows {
+		windowCmds[i] = pipe.SCard(tas.ctx, fmt.Sprintf("users:active:%s", window))
+	}
+	activeSessions := pipe.SCard(tas.ctx, "sessions:active")
+	pipe.Exec(tas.ctx)
+
+	for i, window := range windows {
+		if count, err := windowCmds[i].Result(); err == nil {
 			tas.activeUsersGauge.WithLabelValues(window).Set(float64(count))
 		}
 	}
-
-	// Update active sessions
-	activeSessions, err := tas.redis.SCard(tas.ctx, "sessions:active").Result()
-	if err == nil {
-		tas.activeSessionsGauge.Set(float64(activeSessions))
+	if count, err := activeSessions.Result(); err == nil {
+		tas.activeSessionsGauge.Set(float64(count))
 	}
 
 	// Update model usage statistics
-	models, err := tas.redis.Keys(tas.ctx, "model:*:usage").Result()
+	models, err := tas.getModelUsage(tas.ctx, "")
 	if err == nil {
-		for _, modelKey := range models {
-			modelName := strings.Split(modelKey, ":")[1]
-			
-			totalRequests, _ := tas.redis.HGet(tas.ctx, modelKey, "total_requests").Float64()
-			totalInputTokens, _ := tas.redis.HGet(tas.ctx, modelKey, "total_input_tokens").Float64()
-			totalOutputTokens, _ := tas.redis.HGet(tas.ctx, modelKey, "total_output_tokens").Float64()
-			avgResponseTime, _ := tas.redis.HGet(tas.ctx, modelKey, "avg_response_time").Float64()
-
-			tas.modelUsageGauge.WithLabelValues(modelName, "requests").Set(totalRequests)
-			tas.modelUsageGauge.WithLabelValues(modelName, "input_tokens").Set(totalInputTokens)
-			tas.modelUsageGauge.WithLabelValues(modelName, "output_tokens").Set(totalOutputTokens)
-			tas.modelUsageGauge.WithLabelValues(modelName, "avg_response_time").Set(avgResponseTime)
+		for modelName, stats := range models {
+			tas.modelUsageGauge.WithLabelValues(modelName, "requests").Set(float64(stats.TotalRequests))
+			tas.modelUsageGauge.WithLabelValues(modelName, "input_tokens").Set(float64(stats.TotalInputTokens))
+			tas.modelUsageGauge.WithLabelValues(modelName, "output_tokens").Set(float64(stats.TotalOutputTokens))
+			tas.modelUsageGauge.WithLabelValues(modelName, "avg_response_time").Set(stats.AvgResponseTime)
+			tas.modelUsageGauge.WithLabelValues(modelName, "response_time_p95").Set(stats.ResponseTimeP95)
+			tas.modelUsageGauge.WithLabelValues(modelName, "response_time_p99").Set(stats.ResponseTimeP99)
+		}
+
+		// Per-user tokens, within the user label budget
+		if err := tas.updateUserTokenMetrics(tas.ctx, models); err != nil {
+			logger.Component("metrics").Warn().Err(err).Msg("Failed to update user token metrics")
 		}
 	}
 
-	// Update error rates
-	errorTypes := []string{"timeout", "error", "rate_limit"}
-	for _, errorType := range errorTypes {
-		key := fmt.Sprintf("errors:%s:count", errorType)
+	// Update error counts per error class
+	for _, status := range capture.ErrorStatuses {
+		key := fmt.Sprintf("errors:%s:count", status)
 		count, err := tas.redis.Get(tas.ctx, key).Float64()
 		if err == nil {
-			tas.errorRateGauge.WithLabelValues(errorType).Set(count)
+			tas.errorCountGauge.WithLabelValues(string(status)).Set(count)
+		}
+	}
+
+	// Update error rates over the rolling windows
+	if rates, err := tas.getErrorRates(tas.ctx, ""); err == nil {
+		for window, rate := range rates {
+			tas.errorRateWindowGauge.WithLabelValues(window).Set(rate.Rate)
+		}
+		recent := rates["5m"]
+		for _, status := range capture.ErrorStatuses {
+			var share float64
+			if recent.Requests > 0 {
+				share = float64(recent.ByStatus[string(status)]) / float64(recent.Requests)
+			}
+			tas.errorRateGauge.WithLabelValues(string(status)).Set(share)
 		}
 	}
 }
 
-// GetAnalytics returns comprehensive analytics data
-func (tas *TokenAnalyticsService) GetAnalytics() (*AnalyticsResponse, error) {
+// GetAnalytics returns comprehensive analytics data for a tenant's keyspace
+func (tas *TokenAnalyticsService) GetAnalytics(ctx context.Context, ks capture.Keyspace) (*AnalyticsResponse, error) {
 	response := &AnalyticsResponse{
 		Timestamp: time.Now().Unix(),
 	}
 
 	// Get active users and sessions
-	response.ActiveUsers5m, _ = tas.redis.SCard(tas.ctx, "users:active:5m").Result()
-	response.ActiveUsers1h, _ = tas.redis.SCard(tas.ctx, "users:active:1h").Result()
-	response.ActiveSessions, _ = tas.redis.SCard(tas.ctx, "sessions:active").Result()
+	pipe := tas.redis.Pipeline()
+	activeUsers5m := pipe.SCard(ctx, ks.Key("users:active:5m"))
+	activeUsers1h := pipe.SCard(ctx, ks.Key("users:active:1h"))
+	activeSessions := pipe.SCard(ctx, ks.Key("sessions:active"))
+	pipe.Exec(ctx)
+	response.ActiveUsers5m = activeUsers5m.Val()
+	response.ActiveUsers1h = activeUsers1h.Val()
+	response.ActiveSessions = activeSessions.Val()
+
+	// Response time percentiles over the most recent successful requests
+	samples, err := tas.redis.LRange(ctx, capture.LatencyKey(ks, ""), 0, -1).Result()
+	if err == nil {
+		percentiles := capture.Percentiles(samples, 0.95, 0.99)
+		response.ResponseTimeP95, response.ResponseTimeP99 = percentiles[0], percentiles[1]
+	}
 
-	// Get token rates
-	response.TokenRates = make(map[string]float64)
-	response.TokenRates["input_per_minute"] = 0.0
-	response.TokenRates["output_per_minute"] = 0.0
+	// Token rates averaged over the last few complete minutes
+	rates, modelRates, err := tas.getTokenRates(ctx, ks)
+	if err != nil {
+		return nil, err
+	}
+	response.TokenRates = map[string]float64{
+		"input_per_minute":  rates.InputPerMinute,
+		"output_per_minute": rates.OutputPerMinute,
+	}
+	response.ModelTokenRates = modelRates
 
 	// Get top users
-	topUsers, err := tas.getTopUsers(10)
+	topUsers, err := tas.getTopUsers(ctx, ks, 10)
 	if err == nil {
 		response.TopUsers = topUsers
 	}
 
 	// Get model usage
-	modelUsage, err := tas.getModelUsage()
+	modelUsage, err := tas.getModelUsage(ctx, ks)
 	if err == nil {
 		response.ModelUsage = modelUsage
 	}
 
+	// Error rate across all classified errors since capture began
+	var totalRequests int64
+	for _, stats := range modelUsage {
+		totalRequests += stats.TotalRequests
+	}
+	if totalRequests > 0 {
+		totalErrors, _ := tas.redis.Get(ctx, ks.Key("errors:total:count")).Float64()
+		response.ErrorRate = totalErrors / float64(totalRequests)
+	}
+
+	// Error rates over the last minute, five minutes and hour
+	errorRates, err := tas.getErrorRates(ctx, ks)
+	if err == nil {
+		response.ErrorRates = errorRates
+	}
+
+	// Get usage by client application
+	clientUsage, err := tas.getUsageStats(ctx, ks, "clients", "client")
+	if err == nil {
+		response.ClientUsage = clientUsage
+	}
+
 	return response, nil
 }
 
-// getTopUsers retrieves top users by token usage
-func (tas *TokenAnalyticsService) getTopUsers(limit int) ([]UserStats, error) {
-	userKeys, err := tas.redis.Keys(tas.ctx, "user:*:tokens").Result()
+// getTokenRates returns the overall and per-model token rates from the
+// per-minute counters
+func (tas *TokenAnalyticsService) getTokenRates(ctx context.Context, ks capture.Keyspace) (capture.TokenRate, map[string]capture.TokenRate, error) {
+	minutes := capture.RateMinutes(time.Now())
+	pipe := tas.redis.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(minutes))
+	for i, minute := range minutes {
+		cmds[i] = pipe.HGetAll(ctx, capture.MinuteKey(ks, minute))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return capture.TokenRate{}, nil, err
+	}
+
+	buckets := make([]map[string]string, len(cmds))
+	for i, cmd := range cmds {
+		buckets[i] = cmd.Val()
+	}
+	rates, modelRates := capture.SumTokenRates(buckets)
+	return rates, modelRates, nil
+}
+
+// getErrorRates returns the error rate of each capture.ErrorRateWindows
+// window from the per-minute counters
+func (tas *TokenAnalyticsService) getErrorRates(ctx context.Context, ks capture.Keyspace) (map[string]capture.ErrorRate, error) {
+	minutes := capture.ErrorRateMinutes(time.Now())
+	pipe := tas.redis.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(minutes))
+	for i, minute := range minutes {
+		cmds[i] = pipe.HGetAll(ctx, capture.MinuteKey(ks, minute))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	buckets := make([]map[string]string, len(cmds))
+	for i, cmd := range cmds {
+		buckets[i] = cmd.Val()
+	}
+	return capture.SumErrorRates(buckets), nil
+}
+
+// getTopUsers retrieves the users with the most tokens from the all-time leaderboard
+func (tas *TokenAnalyticsService) getTopUsers(ctx context.Context, ks capture.Keyspace, limit int) ([]UserStats, error) {
+	userIDs, err := tas.redis.ZRevRange(ctx, ks.Key("leaderboard:users:tokens:all"), 0, int64(limit-1)).Result()
 	if err != nil {
 		return nil, err
 	}
 
-	var users []UserStats
-	for _, key := range userKeys {
-		userID := strings.Split(key, ":")[1]
-		
-		userData, err := tas.redis.HGetAll(tas.ctx, key).Result()
-		if err != nil {
+	return tas.loadUserStats(ctx, ks, userIDs)
+}
+
+// loadUserStats reads the stats of the given users, in order, skipping users
+// whose hash no longer exists
+func (tas *TokenAnalyticsService) loadUserStats(ctx context.Context, ks capture.Keyspace, userIDs []string) ([]UserStats, error) {
+	pipe := tas.redis.Pipeline()
+	userCmds := make([]*redis.MapStringStringCmd, len(userIDs))
+	for i, userID := range userIDs {
+		userCmds[i] = pipe.HGetAll(ctx, ks.Key("user:%s:tokens", userID))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	users := []UserStats{}
+	for i, userID := range userIDs {
+		userData := userCmds[i].Val()
+		if len(userData) == 0 {
 			continue
 		}
 
@@ -270,6 +474,7 @@ func (tas *TokenAnalyticsService) getTopUsers(limit int) ([]UserStats, error) {
 		outputTokens, _ := strconv.ParseInt(userData["total_output_tokens"], 10, 64)
 		totalRequests, _ := strconv.ParseInt(userData["total_requests"], 10, 64)
 		avgTokensPerRequest, _ := strconv.ParseFloat(userData["avg_tokens_per_request"], 64)
+		totalCost, _ := strconv.ParseFloat(userData["total_cost_usd"], 64)
 
 		users = append(users, UserStats{
 			UserID:              userID,
@@ -277,49 +482,168 @@ func (tas *TokenAnalyticsService) getTopUsers(limit int) ([]UserStats, error) {
 			TotalOutputTokens:   outputTokens,
 			TotalSessions:       totalRequests, // Approximation
 			AvgTokensPerRequest: avgTokensPerRequest,
+			TotalCostUSD:        totalCost,
 			LastSeen:            userData["last_seen"],
 		})
 	}
 
-	// Limit results
-	if len(users) > limit {
-		users = users[:limit]
+	return users, nil
+}
+
+// getModelUsage retrieves model usage statistics, with response time
+// percentiles over each model's most recent successful requests
+func (tas *TokenAnalyticsService) getModelUsage(ctx context.Context, ks capture.Keyspace) (map[string]ModelStats, error) {
+	usage, err := tas.getUsageStats(ctx, ks, "models", "model")
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := tas.redis.Pipeline()
+	sampleCmds := make(map[string]*redis.StringSliceCmd, len(usage))
+	for model := range usage {
+		sampleCmds[model] = pipe.LRange(ctx, capture.LatencyKey(ks, model), 0, -1)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
 	}
 
-	return users, nil
+	for model, cmd := range sampleCmds {
+		stats := usage[model]
+		percentiles := capture.Percentiles(cmd.Val(), 0.95, 0.99)
+		stats.ResponseTimeP95, stats.ResponseTimeP99 = percentiles[0], percentiles[1]
+		usage[model] = stats
+	}
+	return usage, nil
 }
 
-// getModelUsage retrieves model usage statistics
-func (tas *TokenAnalyticsService) getModelUsage() (map[string]ModelStats, error) {
-	modelKeys, err := tas.redis.Keys(tas.ctx, "model:*:usage").Result()
+// getUsageStats retrieves usage statistics from the <kind>:<name>:usage hashes
+// of the names listed in the index set, keyed by name
+func (tas *TokenAnalyticsService) getUsageStats(ctx context.Context, ks capture.Keyspace, index, kind string) (map[string]ModelStats, error) {
+	names, err := tas.redis.SMembers(ctx, ks.Key(index)).Result()
 	if err != nil {
 		return nil, err
 	}
 
+	pipe := tas.redis.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(names))
+	for i, name := range names {
+		cmds[i] = pipe.HGetAll(ctx, ks.Key("%s:%s:usage", kind, name))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
 	usage := make(map[string]ModelStats)
-	for _, key := range modelKeys {
-		modelName := strings.Split(key, ":")[1]
-		
-		modelData, err := tas.redis.HGetAll(tas.ctx, key).Result()
-		if err != nil {
+	for i, name := range names {
+		data := cmds[i].Val()
+		if len(data) == 0 {
 			continue
 		}
+		usage[name] = parseModelStats(data)
+	}
 
-		totalRequests, _ := strconv.ParseInt(modelData["total_requests"], 10, 64)
-		totalInputTokens, _ := strconv.ParseInt(modelData["total_input_tokens"], 10, 64)
-		totalOutputTokens, _ := strconv.ParseInt(modelData["total_output_tokens"], 10, 64)
-		avgResponseTime, _ := strconv.ParseFloat(modelData["avg_response_time"], 64)
-
-		usage[modelName] = ModelStats{
-			TotalRequests:      totalRequests,
-			TotalInputTokens:   totalInputTokens,
-			TotalOutputTokens:  totalOutputTokens,
-			AvgResponseTime:    avgResponseTime,
-			AvgTokensPerSecond: 0.0, // Calculate if needed
+	return usage, nil
+}
+
+// parseModelStats converts a model or client usage hash to ModelStats
+func parseModelStats(data map[string]string) ModelStats {
+	totalRequests, _ := strconv.ParseInt(data["total_requests"], 10, 64)
+	totalInputTokens, _ := strconv.ParseInt(data["total_input_tokens"], 10, 64)
+	totalOutputTokens, _ := strconv.ParseInt(data["total_output_tokens"], 10, 64)
+	avgResponseTime, _ := strconv.ParseFloat(data["avg_response_time"], 64)
+	totalCost, _ := strconv.ParseFloat(data["total_cost_usd"], 64)
+
+	return ModelStats{
+		TotalRequests:      totalRequests,
+		TotalInputTokens:   totalInputTokens,
+		TotalOutputTokens:  totalOutputTokens,
+		AvgResponseTime:    avgResponseTime,
+		AvgTokensPerSecond: 0.0, // Calculate if needed
+		TotalCostUSD:       totalCost,
+	}
+}
+
+// GetUserCost returns a user's spend for a month (YYYYMM) and their lifetime total
+func (tas *TokenAnalyticsService) GetUserCost(ctx context.Context, ks capture.Keyspace, userID, month string) (*UserCost, error) {
+	cost, err := tas.redis.HGet(ctx, ks.Key("costs:monthly:%s", month), userID).Float64()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	totalCost, err := tas.redis.HGet(ctx, ks.Key("user:%s:tokens", userID), "total_cost_usd").Float64()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	return &UserCost{
+		UserID:       userID,
+		Month:        month,
+		CostUSD:      cost,
+		TotalCostUSD: totalCost,
+	}, nil
+}
+
+// GetActiveRequests returns the live progress of in-flight streamed responses
+func (tas *TokenAnalyticsService) GetActiveRequests(ctx context.Context, ks capture.Keyspace) ([]ActiveRequest, error) {
+	// Drop requests that stopped reporting without finishing
+	cutoff := time.Now().Add(-activeRequestTimeout).Unix()
+	tas.redis.ZRemRangeByScore(ctx, ks.Key("requests:active"), "-inf", strconv.FormatInt(cutoff, 10))
+
+	requestIDs, err := tas.redis.ZRevRange(ctx, ks.Key("requests:active"), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := tas.redis.Pipeline()
+	liveCmds := make([]*redis.MapStringStringCmd, len(requestIDs))
+	for i, requestID := range requestIDs {
+		liveCmds[i] = pipe.HGetAll(ctx, ks.Key("request:%s:live", requestID))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	requests := []ActiveRequest{}
+	for i, requestID := range requestIDs {
+		data := liveCmds[i].Val()
+		if len(data) == 0 {
+			continue
 		}
+
+		startedAt, _ := strconv.ParseInt(data["started_at"], 10, 64)
+		updatedAt, _ := strconv.ParseInt(data["updated_at"], 10, 64)
+		outputTokens, _ := strconv.ParseInt(data["output_tokens"], 10, 64)
+		chunks, _ := strconv.ParseInt(data["chunks"], 10, 64)
+		ttft, _ := strconv.ParseInt(data["time_to_first_token_ms"], 10, 64)
+		tokensPerSecond, _ := strconv.ParseFloat(data["tokens_per_second"], 64)
+		chunksPerSecond, _ := strconv.ParseFloat(data["chunks_per_second"], 64)
+
+		requests = append(requests, ActiveRequest{
+			RequestID:          requestID,
+			SessionID:          data["session_id"],
+			UserID:             data["user_id"],
+			Model:              data["model"],
+			StartedAt:          startedAt,
+			UpdatedAt:          updatedAt,
+			OutputTokens:       outputTokens,
+			Chunks:             chunks,
+			TimeToFirstTokenMs: ttft,
+			TokensPerSecond:    tokensPerSecond,
+			ChunksPerSecond:    chunksPerSecond,
+		})
 	}
 
-	return usage, nil
+	return requests, nil
+}
+
+// tenantKeyspace returns the keyspace selected by the tenant query parameter,
+// writing an error response if the tenant is invalid
+func tenantKeyspace(w http.ResponseWriter, r *http.Request) (capture.Keyspace, bool) {
+	tenant := r.URL.Query().Get("tenant")
+	if tenant != "" && !capture.ValidTenant(tenant) {
+		http.Error(w, "Invalid tenant", http.StatusBadRequest)
+		return "", false
+	}
+	return capture.TenantKeyspace(tenant), true
 }
 
 // HTTP handlers
@@ -327,48 +651,350 @@ func (tas *TokenAnalyticsService) analyticsHandler(w http.ResponseWriter, r *htt
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 
-	analytics, err := tas.GetAnalytics()
+	ks, ok := tenantKeyspace(w, r)
+	if !ok {
+		return
+	}
+
+	from, to, windowed, err := parseWindow(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	analytics, err := tas.GetAnalytics(r.Context(), ks)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to get analytics: %v", err), http.StatusInternalServerError)
 		return
 	}
 
+	// Usage within the requested time range, alongside the all-time aggregates
+	if windowed {
+		if analytics.Window, err = tas.GetWindowUsage(r.Context(), ks, from, to); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to get usage: %v", err), http.StatusInternalServerError)
+			return
+		}
+	}
+
 	json.NewEncoder(w).Encode(analytics)
 }
 
+func (tas *TokenAnalyticsService) activeRequestsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	ks, ok := tenantKeyspace(w, r)
+	if !ok {
+		return
+	}
+
+	requests, err := tas.GetActiveRequests(r.Context(), ks)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get active requests: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(requests)
+}
+
+func (tas *TokenAnalyticsService) userCostHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	ks, ok := tenantKeyspace(w, r)
+	if !ok {
+		return
+	}
+
+	month := r.URL.Query().Get("month")
+	if month == "" {
+		month = time.Now().UTC().Format("200601")
+	} else if _, err := time.Parse("200601", month); err != nil {
+		http.Error(w, "Invalid month, expected YYYYMM", http.StatusBadRequest)
+		return
+	}
+
+	cost, err := tas.GetUserCost(r.Context(), ks, r.PathValue("id"), month)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get user cost: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(cost)
+}
+
 func (tas *TokenAnalyticsService) healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	if !tas.redisMonitor.Available() {
+		json.NewEncoder(w).Encode(map[string]string{"status": "degraded", "redis": "unavailable"})
+		return
+	}
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok"})
 }
 
+// requireRedis answers requests with 503 Service Unavailable while Redis is
+// unreachable, rather than letting each handler fail on it
+func (tas *TokenAnalyticsService) requireRedis(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !tas.redisMonitor.Available() {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, "Analytics unavailable: Redis is unreachable", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func main() {
+	logger.InitFromEnv("token-analytics")
+
 	// Get configuration from environment
-	redisAddr := getEnvOrDefault("REDIS_ADDR", "localhost:6379")
-	redisPassword := getEnvOrDefault("REDIS_PASSWORD", "")
-	redisDB, _ := strconv.Atoi(getEnvOrDefault("REDIS_DB", "0"))
+	redisOptions, err := redisconn.OptionsFromEnv()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid Redis configuration")
+	}
 	port := getEnvOrDefault("ANALYTICS_PORT", "8081")
 
-	log.Printf("Starting Token Analytics Service on port %s", port)
-	log.Printf("Connecting to Redis at %s", redisAddr)
+	log.Info().Str("port", port).Stringer("redis", redisOptions).Msg("Starting Token Analytics Service")
 
-	// Create analytics service
-	service := NewTokenAnalyticsService(redisAddr, redisPassword, redisDB)
+	// Create analytics service, which starts degraded if Redis is not up in time
+	connectTimeout, _ := strconv.Atoi(getEnvOrDefault("REDIS_CONNECT_TIMEOUT_SECONDS", "30"))
+	healthInterval, _ := strconv.Atoi(getEnvOrDefault("REDIS_HEALTH_CHECK_INTERVAL_SECONDS", "5"))
+	service := NewTokenAnalyticsService(redisOptions,
+		time.Duration(connectTimeout)*time.Second, time.Duration(healthInterval)*time.Second)
+	service.adminToken = getEnvOrDefault("ANALYTICS_ADMIN_TOKEN", "")
+	if service.adminToken == "" {
+		log.Warn().Msg("ANALYTICS_ADMIN_TOKEN is not set, budget changes and the audit log are disabled")
+	}
+	service.liveInterval = parseLiveInterval()
+
+	// Bound the user_id values of the per-user token metric
+	userLabels, err := parseUserLabelConfig()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid user metric settings")
+	}
+	service.userTokens.configure(userLabels)
+
+	// Copy rollups to Postgres for reporting beyond the Redis retention
+	if postgresURL := getEnvOrDefault("POSTGRES_URL", ""); postgresURL != "" {
+		archive, err := postgres.Connect(postgresURL)
+		if err == nil {
+			_, err = postgres.Migrate(archive)
+		}
+		if err != nil {
+			log.Fatal().Err(err).Msg("Failed to set up the Postgres archive")
+		}
+		defer archive.Close()
+		service.archive = archive
+		log.Info().Msg("Archiving rollups in Postgres")
+	}
+
+	// Roll completed hours and days up into compact long-lived aggregates
+	service.rollupRetention = parseRollupRetention()
+	go service.rollUpPeriodically()
+
+	// Export daily usage as Parquet to S3-compatible storage for lakehouse pipelines
+	if bucket := getEnvOrDefault("EXPORT_S3_BUCKET", ""); bucket != "" {
+		store, err := s3.NewClient(s3.Config{
+			Endpoint:  getEnvOrDefault("EXPORT_S3_ENDPOINT", ""),
+			Region:    getEnvOrDefault("EXPORT_S3_REGION", "us-east-1"),
+			Bucket:    bucket,
+			AccessKey: getEnvOrDefault("EXPORT_S3_ACCESS_KEY_ID", os.Getenv("AWS_ACCESS_KEY_ID")),
+			SecretKey: getEnvOrDefault("EXPORT_S3_SECRET_ACCESS_KEY", os.Getenv("AWS_SECRET_ACCESS_KEY")),
+			PathStyle: getEnvOrDefault("EXPORT_S3_PATH_STYLE", "true") == "true",
+		})
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid Parquet export settings")
+		}
+		go NewParquetExporter(service, store, getEnvOrDefault("EXPORT_S3_PREFIX", "aiwatch")).Run()
+		log.Info().Str("bucket", bucket).Msg("Exporting daily usage as Parquet")
+	}
+
+	// Evaluate budgets so the chat backend can warn or block over-budget requests
+	budgetInterval, _ := strconv.Atoi(getEnvOrDefault("BUDGET_EVAL_INTERVAL_SECONDS", "30"))
+	if budgetInterval <= 0 {
+		budgetInterval = 30
+	}
+	go service.evaluateBudgetsPeriodically(time.Duration(budgetInterval) * time.Second)
+
+	// Annotate Grafana dashboards with model changes and alerts
+	service.annotator = grafana.NewAnnotator(getEnvOrDefault("GRAFANA_URL", ""), getEnvOrDefault("GRAFANA_API_TOKEN", ""), "aiwatch")
+	if service.annotator != nil {
+		go service.watchModels()
+	}
+
+	// Evaluate alert rules in-process and page through the configured notifiers
+	if path := getEnvOrDefault("ALERT_RULES_FILE", ""); path != "" {
+		config, err := alerting.LoadConfig(path)
+		if err == nil {
+			err = validateAlertRules(config.Rules)
+		}
+		if err != nil {
+			log.Fatal().Err(err).Str("path", path).Msg("Failed to load alert rules")
+		}
+		notifiers := make([]alerting.Notifier, 0, len(config.Notifiers))
+		for _, notifierConfig := range config.Notifiers {
+			notifier, err := alerting.NewNotifier(notifierConfig)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Invalid alert notifier")
+			}
+			notifiers = append(notifiers, notifier)
+		}
+		if service.annotator != nil {
+			notifiers = append(notifiers, alerting.NewGrafanaNotifier(service.annotator))
+		}
+		notifiers = append(notifiers, activityNotifier{redis: service.redis})
+
+		alertInterval, _ := strconv.Atoi(getEnvOrDefault("ALERT_EVAL_INTERVAL_SECONDS", "30"))
+		if alertInterval <= 0 {
+			alertInterval = 30
+		}
+		service.alerts = alerting.NewEvaluator(config.Rules, notifiers, service.sampleAlertMetric, prometheus.DefaultRegisterer)
+		go service.alerts.Run(context.Background(), time.Duration(alertInterval)*time.Second)
+		log.Info().Int("rules", len(config.Rules)).Int("notifiers", len(notifiers)).Msg("Evaluating alert rules")
+	}
+
+	// Cache responses briefly so dashboard polling does not recompute them,
+	// optionally sharing them between replicas through Redis
+	var sharedCache *redis.Client
+	if getEnvOrDefault("ANALYTICS_CACHE_REDIS", "false") == "true" {
+		sharedCache = service.redis
+	}
+	service.cache = newResponseCache(parseCacheTTL(), sharedCache)
+
+	// Trace requests and the Redis calls they make, continuing the trace of
+	// callers that send a traceparent header
+	var tracingCleanup func()
+	if enabled, _ := strconv.ParseBool(getEnvOrDefault("TRACING_ENABLED", "false")); enabled {
+		tracingConfig, err := tracing.ConfigFromEnv("jaeger:4318")
+		if err == nil {
+			tracingCleanup, err = tracing.SetupTracing("token-analytics", tracingConfig)
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to set up tracing")
+		} else {
+			tracing.InstrumentRedis(service.redis)
+			log.Info().Str("protocol", tracingConfig.Protocol).Str("endpoint", tracingConfig.Endpoint).Msg("Tracing enabled")
+		}
+	}
+
+	// Go runtime and process metrics, to correlate latency incidents with
+	// GC pauses, scheduler latency, memory or file descriptor pressure
+	metrics.RegisterRuntimeCollectors(prometheus.DefaultRegisterer)
+
+	// Push the Prometheus metrics to an OpenTelemetry Collector as well, when
+	// OTEL_METRICS_EXPORTER=otlp
+	metricsCleanup, err := otelmetrics.SetupFromEnv("token-analytics", prometheus.DefaultGatherer)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to set up metrics export")
+	}
+
+	// Report panics and 5xx responses to a Sentry-compatible DSN, when
+	// SENTRY_DSN is set
+	reporter, err := errorreport.NewFromEnv("token-analytics")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid error reporting settings")
+	}
 
 	// Setup HTTP routes
 	mux := http.NewServeMux()
-	mux.HandleFunc("/analytics", service.analyticsHandler)
-	mux.HandleFunc("/health", service.healthHandler)
-	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/analytics", service.cached(service.analyticsHandler))
+	mux.HandleFunc("/analytics/requests/active", service.activeRequestsHandler)
+	mux.HandleFunc("/analytics/sessions/active", service.activeSessionsHandler)
+	mux.HandleFunc("/analytics/costs", service.cached(service.costsHandler))
+	mux.HandleFunc("/analytics/errors", service.cached(service.errorsHandler))
+	mux.HandleFunc("/analytics/clients", service.cached(service.clientsHandler))
+	mux.HandleFunc("/analytics/usage", service.cached(service.usageHandler))
+	mux.HandleFunc("/analytics/usage/daily", service.cached(service.dailyUsageHandler))
+	mux.HandleFunc("/analytics/export", service.exportHandler)
+	mux.HandleFunc("/analytics/models/{name...}", service.cached(service.modelHandler))
+	mux.HandleFunc("/analytics/users", service.cached(service.usersHandler))
+	mux.HandleFunc("/analytics/users/{id}/cost", service.cached(service.userCostHandler))
+	mux.HandleFunc("/analytics/leaderboards/{board}", service.cached(service.leaderboardHandler))
+	mux.HandleFunc("/analytics/budgets", service.budgetsHandler)
+	mux.HandleFunc("/analytics/alerts", service.alertsHandler)
+	mux.HandleFunc("/analytics/audit", service.auditHandler)
+	mux.HandleFunc("/events", service.eventsHandler)
+	mux.HandleFunc("/analytics/ws", service.wsHandler)
+	mux.HandleFunc("/analytics/stream", service.streamHandler)
+
+	// Ready once Redis answers
+	readiness := health.NewReadiness(2 * time.Second)
+	readiness.Add("redis", service.redisMonitor.Ping)
+
+	// Report the service's health to the backend's /api/v1/system/status
+	heartbeatInterval, err := strconv.Atoi(getEnvOrDefault("HEARTBEAT_INTERVAL_SECONDS", "10"))
+	if err != nil || heartbeatInterval <= 0 {
+		log.Fatal().Str("value", os.Getenv("HEARTBEAT_INTERVAL_SECONDS")).Msg("Invalid HEARTBEAT_INTERVAL_SECONDS")
+	}
+	heartbeat := health.StartHeartbeat(service.redis, "token-analytics", map[string]bool{
+		"tracing":             tracingCleanup != nil,
+		"error_reporting":     reporter != nil,
+		"alerts":              service.alerts != nil,
+		"grafana_annotations": service.annotator != nil,
+		"postgres_archive":    service.archive != nil,
+		"shared_cache":        sharedCache != nil,
+	}, readiness, time.Duration(heartbeatInterval)*time.Second)
+
+	// Log every API call, sampling the high-volume endpoints
+	accessLogConfig, err := middleware.AccessLogConfigFromEnv("/analytics=0.1,/analytics/requests/active=0.01,/analytics/sessions/active=0.01")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid access log settings")
+	}
+
+	// Health and metrics stay up while Redis is unreachable
+	root := http.NewServeMux()
+	api := http.Handler(mux)
+	if reporter != nil {
+		api = middleware.ErrorReporting(reporter)(api)
+	}
+	handler := middleware.AccessLog(accessLogConfig)(service.requireRedis(api))
+	handler = middleware.RequestIDMiddleware(middleware.LoggingMiddleware(handler))
+	if tracingCleanup != nil {
+		handler = middleware.TracingMiddleware(handler)
+	}
+	root.Handle("/", handler)
+	root.HandleFunc("/health", service.healthHandler)
+	root.HandleFunc("/healthz", health.HandleLiveness())
+	root.HandleFunc("/readyz", health.HandleReadiness(readiness))
+	root.Handle("/metrics", promhttp.Handler())
 
 	// Start server
 	server := &http.Server{
 		Addr:    ":" + port,
-		Handler: mux,
+		Handler: root,
 	}
 
-	log.Printf("Token Analytics Service running on :%s", port)
-	log.Fatal(server.ListenAndServe())
+	go func() {
+		log.Info().Str("port", port).Msg("Token Analytics Service running")
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal().Err(err).Msg("Server failed")
+		}
+	}()
+
+	// Stop on SIGINT or SIGTERM, letting requests in flight finish and
+	// flushing their spans
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	log.Info().Msg("Shutting down...")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Error().Err(err).Msg("Server forced to shutdown")
+	}
+	heartbeat.Close()
+	if reporter != nil {
+		reporter.Close(5 * time.Second)
+	}
+	if metricsCleanup != nil {
+		metricsCleanup()
+	}
+	if tracingCleanup != nil {
+		tracingCleanup()
+	}
 }
 
 func getEnvOrDefault(key, defaultValue string) string {
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+	"github.com/redis/go-redis/v9"
+)
+
+// LatencyBucket counts the responses no slower than LeMs; the last bucket has
+// no upper bound and reports LeMs as -1
+type LatencyBucket struct {
+	LeMs  int64 `json:"le_ms"`
+	Count int64 `json:"count"`
+}
+
+// ModelWindow is a model's activity within a time range
+type ModelWindow struct {
+	From              time.Time       `json:"from"`
+	To                time.Time       `json:"to"`
+	Requests          int64           `json:"requests"`
+	InputTokens       int64           `json:"input_tokens"`
+	OutputTokens      int64           `json:"output_tokens"`
+	TokensPerSecond   float64         `json:"tokens_per_second"`
+	CostUSD           float64         `json:"cost_usd"`
+	AvgResponseTimeMs float64         `json:"avg_response_time_ms"`
+	ResponseTimeP50   float64         `json:"response_time_p50_ms"`
+	ResponseTimeP95   float64         `json:"response_time_p95_ms"`
+	ResponseTimeP99   float64         `json:"response_time_p99_ms"`
+	Errors            int64           `json:"errors"`
+	ErrorRate         float64         `json:"error_rate"`
+	Latency           []LatencyBucket `json:"latency"`
+	Hourly            []HourlyUsage   `json:"hourly"`
+}
+
+// ModelDetail is a model's all-time usage and its activity within a window
+type ModelDetail struct {
+	Model   string      `json:"model"`
+	AllTime ModelStats  `json:"all_time"`
+	Window  ModelWindow `json:"window"`
+}
+
+// GetModelDetail joins a model's usage hash with its hourly rollups over the
+// hours overlapping [from, to). It returns nil if the model has never been used.
+func (tas *TokenAnalyticsService) GetModelDetail(ctx context.Context, ks capture.Keyspace, model string, from, to time.Time) (*ModelDetail, error) {
+	known, err := tas.redis.SIsMember(ctx, ks.Key("models"), model).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !known {
+		return nil, nil
+	}
+
+	from, to, hours := windowHours(from, to)
+
+	pipe := tas.redis.Pipeline()
+	usageCmd := pipe.HGetAll(ctx, ks.Key("model:%s:usage", model))
+	latencyCmd := pipe.LRange(ctx, capture.LatencyKey(ks, model), 0, -1)
+	cmds := make([]*redis.MapStringStringCmd, len(hours))
+	for i, hour := range hours {
+		cmds[i] = pipe.HGetAll(ctx, capture.ModelHourlyKey(ks, model, hour))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	window := ModelWindow{From: from, To: to, Hourly: make([]HourlyUsage, 0, len(hours))}
+	bounds := append(append([]int64{}, capture.LatencyBucketsMs...), -1)
+	counts := make([]int64, len(bounds))
+	var responseTime float64
+	for i, hour := range hours {
+		data := cmds[i].Val()
+		requests, _ := strconv.ParseInt(data["requests"], 10, 64)
+		inputTokens, _ := strconv.ParseInt(data["input_tokens"], 10, 64)
+		outputTokens, _ := strconv.ParseInt(data["output_tokens"], 10, 64)
+		cost, _ := strconv.ParseFloat(data["cost_usd"], 64)
+		hourResponseTime, _ := strconv.ParseFloat(data["response_time_ms"], 64)
+		errors, _ := strconv.ParseInt(data["errors"], 10, 64)
+
+		window.Hourly = append(window.Hourly, HourlyUsage{
+			Hour:         hour,
+			Requests:     requests,
+			InputTokens:  inputTokens,
+			OutputTokens: outputTokens,
+			CostUSD:      cost,
+		})
+		window.Requests += requests
+		window.InputTokens += inputTokens
+		window.OutputTokens += outputTokens
+		window.CostUSD += cost
+		window.Errors += errors
+		responseTime += hourResponseTime
+
+		for j, bound := range bounds {
+			count, _ := strconv.ParseInt(data[capture.LatencyBucketField(bound)], 10, 64)
+			counts[j] += count
+		}
+	}
+
+	window.Latency = make([]LatencyBucket, len(bounds))
+	for j, bound := range bounds {
+		window.Latency[j] = LatencyBucket{LeMs: bound, Count: counts[j]}
+	}
+	if seconds := to.Sub(from).Seconds(); seconds > 0 {
+		window.TokensPerSecond = float64(window.InputTokens+window.OutputTokens) / seconds
+	}
+	if window.Requests > 0 {
+		window.AvgResponseTimeMs = responseTime / float64(window.Requests)
+		window.ErrorRate = float64(window.Errors) / float64(window.Requests)
+	}
+	window.ResponseTimeP50 = bucketQuantile(window.Latency, 0.50)
+	window.ResponseTimeP95 = bucketQuantile(window.Latency, 0.95)
+	window.ResponseTimeP99 = bucketQuantile(window.Latency, 0.99)
+
+	allTime := parseModelStats(usageCmd.Val())
+	percentiles := capture.Percentiles(latencyCmd.Val(), 0.95, 0.99)
+	allTime.ResponseTimeP95, allTime.ResponseTimeP99 = percentiles[0], percentiles[1]
+
+	return &ModelDetail{
+		Model:   model,
+		AllTime: allTime,
+		Window:  window,
+	}, nil
+}
+
+// bucketQuantile estimates a quantile from latency buckets by linear
+// interpolation within the bucket that contains it, as Prometheus'
+// histogram_quantile does. Quantiles in the unbounded bucket report the
+// highest finite bound.
+func bucketQuantile(buckets []LatencyBucket, q float64) float64 {
+	var total int64
+	for _, b := range buckets {
+		total += b.Count
+	}
+	if total == 0 {
+		return 0
+	}
+
+	rank := q * float64(total)
+	var cumulative int64
+	var lower float64
+	for _, b := range buckets {
+		if b.LeMs < 0 {
+			return lower
+		}
+		upper := float64(b.LeMs)
+		if float64(cumulative+b.Count) >= rank && b.Count > 0 {
+			return lower + (upper-lower)*(rank-float64(cumulative))/float64(b.Count)
+		}
+		cumulative += b.Count
+		lower = upper
+	}
+	return lower
+}
+
+// modelHandler serves /analytics/models/{name}?from=RFC3339&to=RFC3339,
+// defaulting to the last 24 hours
+func (tas *TokenAnalyticsService) modelHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	ks, ok := tenantKeyspace(w, r)
+	if !ok {
+		return
+	}
+
+	from, to, _, err := parseWindow(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	detail, err := tas.GetModelDetail(r.Context(), ks, r.PathValue("name"), from, to)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get model analytics: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if detail == nil {
+		http.Error(w, "Model not found", http.StatusNotFound)
+		return
+	}
+
+	json.NewEncoder(w).Encode(detail)
+}
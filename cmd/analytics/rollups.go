@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+	"github.com/ajeetraina/genai-app-demo/pkg/logger"
+	"github.com/redis/go-redis/v9"
+)
+
+// Rollup scheduling. Hours are rolled up rollupDelay after they end, leaving
+// time for buffered captures to land, and missed hours are caught up within
+// rollupLookback.
+const (
+	rollupInterval = 5 * time.Minute
+	rollupDelay    = 5 * time.Minute
+	rollupLookback = 48 * time.Hour
+)
+
+// Rollup is the compact aggregate of an hour or day of usage
+type Rollup struct {
+	Requests     int64   `json:"requests" redis:"requests"`
+	InputTokens  int64   `json:"input_tokens" redis:"input_tokens"`
+	OutputTokens int64   `json:"output_tokens" redis:"output_tokens"`
+	CostUSD      float64 `json:"cost_usd" redis:"cost_usd"`
+	Errors       int64   `json:"errors" redis:"errors"`
+	UniqueUsers  int64   `json:"unique_users" redis:"unique_users"`
+}
+
+// add accumulates another rollup's totals, leaving unique users alone since
+// they cannot be summed
+func (r *Rollup) add(other Rollup) {
+	r.Requests += other.Requests
+	r.InputTokens += other.InputTokens
+	r.OutputTokens += other.OutputTokens
+	r.CostUSD += other.CostUSD
+	r.Errors += other.Errors
+}
+
+// rollUpPeriodically rolls up every tenant's completed hours and days
+func (tas *TokenAnalyticsService) rollUpPeriodically() {
+	ticker := time.NewTicker(rollupInterval)
+	defer ticker.Stop()
+
+	tas.rollUpTenants()
+	for range ticker.C {
+		tas.rollUpTenants()
+	}
+}
+
+// rollUpTenants rolls up the default tenant and every tenant with data
+func (tas *TokenAnalyticsService) rollUpTenants() {
+	if !tas.redisMonitor.Available() {
+		return
+	}
+	tenants, err := tas.redis.SMembers(tas.ctx, "tenants").Result()
+	if err != nil {
+		logger.Component("rollups").Error().Err(err).Msg("Failed to list tenants for rollups")
+		return
+	}
+	for _, tenant := range append([]string{""}, tenants...) {
+		if err := tas.RollUp(tas.ctx, capture.TenantKeyspace(tenant), time.Now()); err != nil {
+			logger.Component("rollups").Error().Err(err).Str("tenant", tenant).Msg("Failed to roll up usage")
+		}
+		if tas.archive != nil {
+			if err := tas.archiveRollups(tas.ctx, tenant, time.Now()); err != nil {
+				logger.Component("rollups").Error().Err(err).Str("tenant", tenant).Msg("Failed to archive rollups")
+			}
+		}
+	}
+}
+
+// RollUp writes the hourly rollups of the completed hours in the lookback that
+// have none, then the daily rollups of the completed days
+func (tas *TokenAnalyticsService) RollUp(ctx context.Context, ks capture.Keyspace, now time.Time) error {
+	end := now.UTC().Add(-rollupDelay).Truncate(time.Hour)
+	_, _, hours := windowHours(end.Add(-rollupLookback), end)
+
+	pipe := tas.redis.Pipeline()
+	exists := make([]*redis.IntCmd, len(hours))
+	for i, hour := range hours {
+		exists[i] = pipe.Exists(ctx, capture.HourlyRollupKey(ks, hour))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	models, err := tas.redis.SMembers(ctx, ks.Key("models")).Result()
+	if err != nil {
+		return err
+	}
+	for i, hour := range hours {
+		if exists[i].Val() == 0 {
+			if err := tas.rollUpHour(ctx, ks, models, hour); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Days that ended before the last rolled up hour
+	lastDay := end.Truncate(24 * time.Hour)
+	for day := lastDay.Add(-rollupLookback).Truncate(24 * time.Hour); day.Before(lastDay); day = day.Add(24 * time.Hour) {
+		n, err := tas.redis.Exists(ctx, capture.DailyRollupKey(ks, day)).Result()
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			if err := tas.rollUpDay(ctx, ks, day); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// rollUpHour writes an hour's rollup
+func (tas *TokenAnalyticsService) rollUpHour(ctx context.Context, ks capture.Keyspace, models []string, hour time.Time) error {
+	rollups, err := tas.readHours(ctx, ks, models, []time.Time{hour})
+	if err != nil {
+		return err
+	}
+	return tas.writeRollup(ctx, capture.HourlyRollupKey(ks, hour), rollups[0])
+}
+
+// readHours aggregates each hour's counters, the errors of its models and its
+// unique users
+func (tas *TokenAnalyticsService) readHours(ctx context.Context, ks capture.Keyspace, models []string, hours []time.Time) ([]Rollup, error) {
+	pipe := tas.redis.Pipeline()
+	totalsCmds := make([]*redis.MapStringStringCmd, len(hours))
+	usersCmds := make([]*redis.IntCmd, len(hours))
+	errorCmds := make([][]*redis.StringCmd, len(hours))
+	for i, hour := range hours {
+		totalsCmds[i] = pipe.HGetAll(ctx, ks.Key("tokens:hourly:%s", hour.Format("2006010215")))
+		usersCmds[i] = pipe.PFCount(ctx, capture.HourlyUsersKey(ks, hour))
+		errorCmds[i] = make([]*redis.StringCmd, len(models))
+		for j, model := range models {
+			errorCmds[i][j] = pipe.HGet(ctx, capture.ModelHourlyKey(ks, model, hour), "errors")
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	rollups := make([]Rollup, len(hours))
+	for i := range hours {
+		if err := totalsCmds[i].Scan(&rollups[i]); err != nil {
+			return nil, err
+		}
+		rollups[i].UniqueUsers = usersCmds[i].Val()
+		for _, cmd := range errorCmds[i] {
+			errors, _ := cmd.Int64()
+			rollups[i].Errors += errors
+		}
+	}
+	return rollups, nil
+}
+
+// rollUpDay sums a day's hourly rollups and counts its unique users
+func (tas *TokenAnalyticsService) rollUpDay(ctx context.Context, ks capture.Keyspace, day time.Time) error {
+	_, _, hours := windowHours(day, day.Add(24*time.Hour))
+
+	pipe := tas.redis.Pipeline()
+	hourCmds := make([]*redis.MapStringStringCmd, len(hours))
+	for i, hour := range hours {
+		hourCmds[i] = pipe.HGetAll(ctx, capture.HourlyRollupKey(ks, hour))
+	}
+	usersCmd := pipe.PFCount(ctx, hourlyUsersKeys(ks, hours)...)
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return err
+	}
+
+	var rollup Rollup
+	for _, cmd := range hourCmds {
+		var hourly Rollup
+		if err := cmd.Scan(&hourly); err != nil {
+			return err
+		}
+		rollup.add(hourly)
+	}
+	rollup.UniqueUsers = usersCmd.Val()
+
+	return tas.writeRollup(ctx, capture.DailyRollupKey(ks, day), rollup)
+}
+
+// hourlyUsersKeys returns the unique user HyperLogLogs of the hours
+func hourlyUsersKeys(ks capture.Keyspace, hours []time.Time) []string {
+	keys := make([]string, len(hours))
+	for i, hour := range hours {
+		keys[i] = capture.HourlyUsersKey(ks, hour)
+	}
+	return keys
+}
+
+// writeRollup stores a rollup for the rollup retention
+func (tas *TokenAnalyticsService) writeRollup(ctx context.Context, key string, rollup Rollup) error {
+	pipe := tas.redis.TxPipeline()
+	pipe.HSet(ctx, key, rollup)
+	pipe.Expire(ctx, key, tas.rollupRetention)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// DailyUsage is the usage of one UTC day
+type DailyUsage struct {
+	Date string `json:"date"`
+	Rollup
+}
+
+// GetDailyUsage returns the usage of each UTC day overlapping [from, to) from
+// the daily rollups. Days not rolled up yet, such as today, are summed from
+// their hours.
+func (tas *TokenAnalyticsService) GetDailyUsage(ctx context.Context, ks capture.Keyspace, from, to time.Time) ([]DailyUsage, error) {
+	var days []time.Time
+	for day := from.UTC().Truncate(24 * time.Hour); day.Before(to); day = day.Add(24 * time.Hour) {
+		days = append(days, day)
+	}
+
+	pipe := tas.redis.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(days))
+	for i, day := range days {
+		cmds[i] = pipe.HGetAll(ctx, capture.DailyRollupKey(ks, day))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	var models []string
+	usage := make([]DailyUsage, len(days))
+	for i, day := range days {
+		usage[i].Date = day.Format("2006-01-02")
+		if len(cmds[i].Val()) > 0 {
+			if err := cmds[i].Scan(&usage[i].Rollup); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		if models == nil {
+			var err error
+			if models, err = tas.redis.SMembers(ctx, ks.Key("models")).Result(); err != nil {
+				return nil, err
+			}
+		}
+		_, _, hours := windowHours(day, day.Add(24*time.Hour))
+		rollups, err := tas.readHours(ctx, ks, models, hours)
+		if err != nil {
+			return nil, err
+		}
+		for _, rollup := range rollups {
+			usage[i].add(rollup)
+		}
+		usage[i].UniqueUsers, _ = tas.redis.PFCount(ctx, hourlyUsersKeys(ks, hours)...).Result()
+	}
+	return usage, nil
+}
+
+// dailyUsageHandler serves /analytics/usage/daily?from=RFC3339&to=RFC3339,
+// defaulting to the last 24 hours
+func (tas *TokenAnalyticsService) dailyUsageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	ks, ok := tenantKeyspace(w, r)
+	if !ok {
+		return
+	}
+
+	from, to, _, err := parseWindow(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	usage, err := tas.GetDailyUsage(r.Context(), ks, from, to)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get daily usage: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"days": usage})
+}
+
+// parseRollupRetention reads ROLLUP_RETENTION_DAYS, defaulting to 400 days so
+// rollups support year-over-year comparisons
+func parseRollupRetention() time.Duration {
+	days, _ := strconv.Atoi(getEnvOrDefault("ROLLUP_RETENTION_DAYS", "400"))
+	if days <= 0 {
+		days = 400
+	}
+	return time.Duration(days) * 24 * time.Hour
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+	"github.com/redis/go-redis/v9"
+)
+
+// maxActiveSessions bounds the sessions returned by /analytics/sessions/active
+const maxActiveSessions = 1000
+
+// ActiveSession is a session that has not yet been closed for inactivity,
+// with its running totals. In-flight fields cover responses still streaming,
+// whose tokens are not in the totals until they complete.
+type ActiveSession struct {
+	SessionID            string  `json:"session_id"`
+	UserID               string  `json:"user_id"`
+	Model                string  `json:"model"`
+	StartedAt            int64   `json:"started_at"`
+	LastActivity         int64   `json:"last_activity"`
+	TotalRequests        int64   `json:"total_requests"`
+	TotalInputTokens     int64   `json:"total_input_tokens"`
+	TotalOutputTokens    int64   `json:"total_output_tokens"`
+	TotalCostUSD         float64 `json:"total_cost_usd"`
+	InFlightRequests     int64   `json:"in_flight_requests"`
+	InFlightOutputTokens int64   `json:"in_flight_output_tokens"`
+}
+
+// GetActiveSessions returns the active sessions, most recently active first
+func (tas *TokenAnalyticsService) GetActiveSessions(ctx context.Context, ks capture.Keyspace, limit int) ([]ActiveSession, error) {
+	sessionIDs, err := tas.redis.SMembers(ctx, ks.Key("sessions:active")).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := tas.redis.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(sessionIDs))
+	for i, sessionID := range sessionIDs {
+		cmds[i] = pipe.HGetAll(ctx, ks.Key("session:%s:tokens", sessionID))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	inFlight, err := tas.GetActiveRequests(ctx, ks)
+	if err != nil {
+		return nil, err
+	}
+	streaming := make(map[string][]ActiveRequest)
+	for _, request := range inFlight {
+		streaming[request.SessionID] = append(streaming[request.SessionID], request)
+	}
+
+	sessions := []ActiveSession{}
+	for i, sessionID := range sessionIDs {
+		data := cmds[i].Val()
+		if len(data) == 0 {
+			continue
+		}
+
+		session := ActiveSession{
+			SessionID: sessionID,
+			UserID:    data["user_id"],
+			Model:     data["model"],
+		}
+		session.StartedAt, _ = strconv.ParseInt(data["started_at"], 10, 64)
+		session.LastActivity, _ = strconv.ParseInt(data["last_activity"], 10, 64)
+		session.TotalRequests, _ = strconv.ParseInt(data["total_requests"], 10, 64)
+		session.TotalInputTokens, _ = strconv.ParseInt(data["total_input_tokens"], 10, 64)
+		session.TotalOutputTokens, _ = strconv.ParseInt(data["total_output_tokens"], 10, 64)
+		session.TotalCostUSD, _ = strconv.ParseFloat(data["total_cost_usd"], 64)
+		for _, request := range streaming[sessionID] {
+			session.InFlightRequests++
+			session.InFlightOutputTokens += request.OutputTokens
+			if request.UpdatedAt > session.LastActivity {
+				session.LastActivity = request.UpdatedAt
+			}
+		}
+		sessions = append(sessions, session)
+	}
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastActivity > sessions[j].LastActivity
+	})
+	if len(sessions) > limit {
+		sessions = sessions[:limit]
+	}
+	return sessions, nil
+}
+
+// activeSessionsHandler serves /analytics/sessions/active?limit=N
+func (tas *TokenAnalyticsService) activeSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	ks, ok := tenantKeyspace(w, r)
+	if !ok {
+		return
+	}
+
+	limit, err := queryInt(r.URL.Query().Get("limit"), 100)
+	if err != nil || limit <= 0 || limit > maxActiveSessions {
+		http.Error(w, fmt.Sprintf("Invalid limit, expected 1 to %d", maxActiveSessions), http.StatusBadRequest)
+		return
+	}
+
+	sessions, err := tas.GetActiveSessions(r.Context(), ks, limit)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get active sessions: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(sessions)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+	"github.com/redis/go-redis/v9"
+)
+
+// Server-Sent Events timing. Metrics are polled every streamPollInterval and
+// only sent when they change; a comment is sent on quiet streams so proxies
+// keep them open.
+const (
+	streamPollInterval = 2 * time.Second
+	streamKeepAlive    = 15 * time.Second
+	streamRetryMs      = 5000
+)
+
+// StreamActiveUsers is the payload of active_users events
+type StreamActiveUsers struct {
+	ActiveUsers5m  int64 `json:"active_users_5m"`
+	ActiveUsers1h  int64 `json:"active_users_1h"`
+	ActiveSessions int64 `json:"active_sessions"`
+}
+
+// StreamErrors is the payload of errors events
+type StreamErrors struct {
+	Total    int64            `json:"total"`
+	ByStatus map[string]int64 `json:"by_status"`
+}
+
+// streamEvents reads the current value of each streamed event, keyed by event name
+func (tas *TokenAnalyticsService) streamEvents(ctx context.Context, ks capture.Keyspace) (map[string]interface{}, error) {
+	pipe := tas.redis.Pipeline()
+	activeUsers5m := pipe.SCard(ctx, ks.Key("users:active:5m"))
+	activeUsers1h := pipe.SCard(ctx, ks.Key("users:active:1h"))
+	activeSessions := pipe.SCard(ctx, ks.Key("sessions:active"))
+	totalErrors := pipe.Get(ctx, ks.Key("errors:total:count"))
+	statusErrors := make([]*redis.StringCmd, len(capture.ErrorStatuses))
+	for i, status := range capture.ErrorStatuses {
+		statusErrors[i] = pipe.Get(ctx, ks.Key("errors:%s:count", status))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	rates, _, err := tas.getTokenRates(ctx, ks)
+	if err != nil {
+		return nil, err
+	}
+
+	errorCounts := StreamErrors{ByStatus: make(map[string]int64, len(statusErrors))}
+	errorCounts.Total, _ = totalErrors.Int64()
+	for i, status := range capture.ErrorStatuses {
+		errorCounts.ByStatus[string(status)], _ = statusErrors[i].Int64()
+	}
+
+	return map[string]interface{}{
+		"active_users": StreamActiveUsers{
+			ActiveUsers5m:  activeUsers5m.Val(),
+			ActiveUsers1h:  activeUsers1h.Val(),
+			ActiveSessions: activeSessions.Val(),
+		},
+		"token_rates": map[string]float64{
+			"input_per_minute":  rates.InputPerMinute,
+			"output_per_minute": rates.OutputPerMinute,
+		},
+		"errors": errorCounts,
+	}, nil
+}
+
+// streamHandler serves /analytics/stream, emitting active_users, token_rates
+// and errors Server-Sent Events whenever their values change. Every event is
+// sent once when the stream opens.
+func (tas *TokenAnalyticsService) streamHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	ks, ok := tenantKeyspace(w, r)
+	if !ok {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	fmt.Fprintf(w, "retry: %d\n\n", streamRetryMs)
+	flusher.Flush()
+
+	ticker := time.NewTicker(streamPollInterval)
+	defer ticker.Stop()
+
+	sent := map[string]string{}
+	lastWrite := time.Now()
+	for {
+		events, err := tas.streamEvents(r.Context(), ks)
+		if err == nil {
+			for _, name := range []string{"active_users", "token_rates", "errors"} {
+				data, _ := json.Marshal(events[name])
+				if sent[name] == string(data) {
+					continue
+				}
+				sent[name] = string(data)
+				fmt.Fprintf(w, "event: %s\ndata: %s\n\n", name, data)
+				lastWrite = time.Now()
+			}
+		}
+		if time.Since(lastWrite) >= streamKeepAlive {
+			fmt.Fprint(w, ": keepalive\n\n")
+			lastWrite = time.Now()
+		}
+		flusher.Flush()
+
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+	"github.com/redis/go-redis/v9"
+)
+
+// maxWindow bounds the time range a usage query may cover
+const maxWindow = 366 * 24 * time.Hour
+
+// HourlyUsage is the usage recorded in one UTC hour
+type HourlyUsage struct {
+	Hour         time.Time `json:"hour"`
+	Requests     int64     `json:"requests"`
+	InputTokens  int64     `json:"input_tokens"`
+	OutputTokens int64     `json:"output_tokens"`
+	CostUSD      float64   `json:"cost_usd"`
+}
+
+// WindowUsage is the usage within a time range, built from the hourly rollups.
+// The range is widened to whole UTC hours.
+type WindowUsage struct {
+	From         time.Time     `json:"from"`
+	To           time.Time     `json:"to"`
+	Requests     int64         `json:"requests"`
+	InputTokens  int64         `json:"input_tokens"`
+	OutputTokens int64         `json:"output_tokens"`
+	TotalTokens  int64         `json:"total_tokens"`
+	CostUSD      float64       `json:"cost_usd"`
+	Hourly       []HourlyUsage `json:"hourly"`
+}
+
+// GetWindowUsage sums the tokens:hourly:* rollups of the hours overlapping
+// [from, to), reading the longer-lived rollup:hourly:* aggregates of hours
+// past the hourly retention
+func (tas *TokenAnalyticsService) GetWindowUsage(ctx context.Context, ks capture.Keyspace, from, to time.Time) (*WindowUsage, error) {
+	from, to, hours := windowHours(from, to)
+
+	pipe := tas.redis.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(hours))
+	for i, hour := range hours {
+		cmds[i] = pipe.HGetAll(ctx, ks.Key("tokens:hourly:%s", hour.Format("2006010215")))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	pipe = tas.redis.Pipeline()
+	expired := 0
+	for i, hour := range hours {
+		if len(cmds[i].Val()) == 0 {
+			cmds[i] = pipe.HGetAll(ctx, capture.HourlyRollupKey(ks, hour))
+			expired++
+		}
+	}
+	if expired > 0 {
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return nil, err
+		}
+	}
+
+	usage := &WindowUsage{From: from, To: to, Hourly: make([]HourlyUsage, 0, len(hours))}
+	for i, hour := range hours {
+		data := cmds[i].Val()
+		requests, _ := strconv.ParseInt(data["requests"], 10, 64)
+		inputTokens, _ := strconv.ParseInt(data["input_tokens"], 10, 64)
+		outputTokens, _ := strconv.ParseInt(data["output_tokens"], 10, 64)
+		cost, _ := strconv.ParseFloat(data["cost_usd"], 64)
+
+		usage.Hourly = append(usage.Hourly, HourlyUsage{
+			Hour:         hour,
+			Requests:     requests,
+			InputTokens:  inputTokens,
+			OutputTokens: outputTokens,
+			CostUSD:      cost,
+		})
+		usage.Requests += requests
+		usage.InputTokens += inputTokens
+		usage.OutputTokens += outputTokens
+		usage.CostUSD += cost
+	}
+	usage.TotalTokens = usage.InputTokens + usage.OutputTokens
+
+	return usage, nil
+}
+
+// windowHours widens [from, to) to whole UTC hours and lists the hours it covers
+func windowHours(from, to time.Time) (time.Time, time.Time, []time.Time) {
+	from = from.UTC().Truncate(time.Hour)
+	if end := to.UTC().Truncate(time.Hour); end.Before(to) {
+		to = end.Add(time.Hour)
+	} else {
+		to = end
+	}
+
+	var hours []time.Time
+	for hour := from; hour.Before(to); hour = hour.Add(time.Hour) {
+		hours = append(hours, hour)
+	}
+	return from, to, hours
+}
+
+// parseWindow reads the from and to query parameters as RFC 3339 timestamps.
+// It reports whether either was given; a missing to defaults to now and a
+// missing from to 24 hours before to.
+func parseWindow(r *http.Request) (from, to time.Time, ok bool, err error) {
+	query := r.URL.Query()
+	fromValue, toValue := query.Get("from"), query.Get("to")
+
+	to = time.Now()
+	if toValue != "" {
+		if to, err = time.Parse(time.RFC3339, toValue); err != nil {
+			return from, to, true, fmt.Errorf("invalid to, expected an RFC 3339 timestamp")
+		}
+	}
+	from = to.Add(-24 * time.Hour)
+	if fromValue != "" {
+		if from, err = time.Parse(time.RFC3339, fromValue); err != nil {
+			return from, to, true, fmt.Errorf("invalid from, expected an RFC 3339 timestamp")
+		}
+	}
+
+	if !from.Before(to) {
+		return from, to, true, fmt.Errorf("from must be before to")
+	}
+	if to.Sub(from) > maxWindow {
+		return from, to, true, fmt.Errorf("time range must not exceed %d days", int(maxWindow.Hours()/24))
+	}
+	return from, to, fromValue != "" || toValue != "", nil
+}
+
+// usageHandler serves /analytics/usage?from=RFC3339&to=RFC3339, defaulting to
+// the last 24 hours
+func (tas *TokenAnalyticsService) usageHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	ks, ok := tenantKeyspace(w, r)
+	if !ok {
+		return
+	}
+
+	from, to, _, err := parseWindow(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	usage, err := tas.GetWindowUsage(r.Context(), ks, from, to)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get usage: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(usage)
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// otherUsers is the user_id label the tokens of users without their own
+// series are summed under
+const otherUsers = "other"
+
+// User label modes of token_analytics_user_tokens_total
+const (
+	// userLabelsTop gives the top N users by total tokens their own series
+	userLabelsTop = "top"
+	// userLabelsAllowlist gives only the listed users their own series
+	userLabelsAllowlist = "allowlist"
+	// userLabelsOff exports no per-user series
+	userLabelsOff = "off"
+)
+
+// userLabelConfig bounds the user_id values of the per-user token metric,
+// so the number of users does not decide Prometheus' series count
+type userLabelConfig struct {
+	Mode      string
+	TopN      int
+	Allowlist []string
+}
+
+// budget is the most user_id values the config exports, "other" included
+func (c userLabelConfig) budget() int {
+	switch c.Mode {
+	case userLabelsTop:
+		return c.TopN + 1
+	case userLabelsAllowlist:
+		return len(c.Allowlist) + 1
+	}
+	return 0
+}
+
+// parseUserLabelConfig reads USER_METRICS_LABELS, USER_METRICS_TOP_N and
+// USER_METRICS_ALLOWLIST
+func parseUserLabelConfig() (userLabelConfig, error) {
+	config := userLabelConfig{Mode: getEnvOrDefault("USER_METRICS_LABELS", userLabelsTop)}
+	switch config.Mode {
+	case userLabelsTop:
+		topN, err := strconv.Atoi(getEnvOrDefault("USER_METRICS_TOP_N", "20"))
+		if err != nil || topN <= 0 {
+			return config, fmt.Errorf("USER_METRICS_TOP_N must be a positive number")
+		}
+		config.TopN = topN
+	case userLabelsAllowlist:
+		for _, userID := range strings.Split(getEnvOrDefault("USER_METRICS_ALLOWLIST", ""), ",") {
+			if userID = strings.TrimSpace(userID); userID != "" {
+				config.Allowlist = append(config.Allowlist, userID)
+			}
+		}
+		if len(config.Allowlist) == 0 {
+			return config, fmt.Errorf("USER_METRICS_ALLOWLIST must list users when USER_METRICS_LABELS=allowlist")
+		}
+	case userLabelsOff:
+	default:
+		return config, fmt.Errorf("USER_METRICS_LABELS must be top, allowlist or off, got %q", config.Mode)
+	}
+	return config, nil
+}
+
+// userTokens are a user label's all-time token totals
+type userTokens struct {
+	input  float64
+	output float64
+}
+
+// userTokensCollector exports token_analytics_user_tokens_total from the
+// per-user totals last read from Redis, limited by its userLabelConfig
+type userTokensCollector struct {
+	desc        *prometheus.Desc
+	labelBudget prometheus.Gauge
+	labelValues prometheus.Gauge
+	foldedUsers prometheus.Gauge
+
+	mu     sync.Mutex
+	config userLabelConfig
+	totals map[string]userTokens
+}
+
+func newUserTokensCollector() *userTokensCollector {
+	return &userTokensCollector{
+		desc: prometheus.NewDesc("token_analytics_user_tokens_total",
+			"Total tokens processed per user, for the users selected by USER_METRICS_LABELS and \"other\"",
+			[]string{"user_id", "direction"}, nil),
+		labelBudget: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "token_analytics_user_label_budget",
+			Help: "Most user_id values token_analytics_user_tokens_total may export, other included",
+		}),
+		labelValues: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "token_analytics_user_label_values",
+			Help: "user_id values token_analytics_user_tokens_total currently exports",
+		}),
+		foldedUsers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "token_analytics_user_label_folded_users",
+			Help: "Users whose tokens are counted under user_id=\"other\"",
+		}),
+		config: userLabelConfig{Mode: userLabelsTop, TopN: 20},
+	}
+}
+
+// configure replaces the label config, dropping the series of the old one
+func (c *userTokensCollector) configure(config userLabelConfig) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.config = config
+	c.totals = nil
+	c.labelBudget.Set(float64(config.budget()))
+	c.labelValues.Set(0)
+}
+
+// Describe implements prometheus.Collector
+func (c *userTokensCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+	c.labelBudget.Describe(ch)
+	c.labelValues.Describe(ch)
+	c.foldedUsers.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (c *userTokensCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	for userID, tokens := range c.totals {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, tokens.input, userID, "input")
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.CounterValue, tokens.output, userID, "output")
+	}
+	c.mu.Unlock()
+	c.labelBudget.Collect(ch)
+	c.labelValues.Collect(ch)
+	c.foldedUsers.Collect(ch)
+}
+
+// updateUserTokenMetrics refreshes the per-user token totals. Users without
+// a series of their own are summed under "other" as the tokens of all models
+// less those of the labelled users.
+func (tas *TokenAnalyticsService) updateUserTokenMetrics(ctx context.Context, models map[string]ModelStats) error {
+	c := tas.userTokens
+	c.mu.Lock()
+	config := c.config
+	c.mu.Unlock()
+	if config.Mode == userLabelsOff {
+		return nil
+	}
+
+	userIDs := config.Allowlist
+	if config.Mode == userLabelsTop {
+		var err error
+		userIDs, err = tas.redis.ZRevRange(ctx, "leaderboard:users:tokens:all", 0, int64(config.TopN-1)).Result()
+		if err != nil {
+			return err
+		}
+	}
+	users, err := tas.loadUserStats(ctx, "", userIDs)
+	if err != nil {
+		return err
+	}
+	userCount, err := tas.redis.ZCard(ctx, "leaderboard:users:tokens:all").Result()
+	if err != nil {
+		return err
+	}
+
+	totals := make(map[string]userTokens, len(users)+1)
+	var labelled userTokens
+	for _, user := range users {
+		tokens := totals[user.UserID]
+		tokens.input += float64(user.TotalInputTokens)
+		tokens.output += float64(user.TotalOutputTokens)
+		totals[user.UserID] = tokens
+		labelled.input += float64(user.TotalInputTokens)
+		labelled.output += float64(user.TotalOutputTokens)
+	}
+	var other userTokens
+	for _, stats := range models {
+		other.input += float64(stats.TotalInputTokens)
+		other.output += float64(stats.TotalOutputTokens)
+	}
+	tokens := totals[otherUsers]
+	tokens.input += max(other.input-labelled.input, 0)
+	tokens.output += max(other.output-labelled.output, 0)
+	totals[otherUsers] = tokens
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.totals = totals
+	c.labelValues.Set(float64(len(totals)))
+	c.foldedUsers.Set(float64(max(userCount-int64(len(users)), 0)))
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+	"github.com/redis/go-redis/v9"
+)
+
+// userSortKeys maps the sort_by values of the users listing to the sorted
+// sets ranking users by that value
+var userSortKeys = map[string]string{
+	"total_tokens":  "leaderboard:users:tokens:all",
+	"input_tokens":  "users:rank:input_tokens",
+	"output_tokens": "users:rank:output_tokens",
+	"cost":          "users:rank:cost_usd",
+	"last_seen":     "users:last_seen",
+}
+
+// UserList is a page of users sorted in descending order
+type UserList struct {
+	Users  []UserStats `json:"users"`
+	Total  int64       `json:"total"`
+	Limit  int         `json:"limit"`
+	Offset int         `json:"offset"`
+	SortBy string      `json:"sort_by"`
+	Since  *time.Time  `json:"since,omitempty"`
+}
+
+// ListUsers returns a page of users sorted by sortBy, highest first. When
+// since is set only users active since then are listed, and Total counts
+// only those users.
+func (tas *TokenAnalyticsService) ListUsers(ctx context.Context, ks capture.Keyspace, sortBy string, since time.Time, limit, offset int) (*UserList, error) {
+	sortKey := ks.Key(userSortKeys[sortBy])
+	list := &UserList{Limit: limit, Offset: offset, SortBy: sortBy}
+
+	var userIDs []string
+	if since.IsZero() {
+		total, err := tas.redis.ZCard(ctx, sortKey).Result()
+		if err != nil {
+			return nil, err
+		}
+		list.Total = total
+
+		userIDs, err = tas.redis.ZRevRange(ctx, sortKey, int64(offset), int64(offset+limit-1)).Result()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		list.Since = &since
+
+		active, err := tas.redis.ZRangeByScore(ctx, ks.Key("users:last_seen"), &redis.ZRangeBy{
+			Min: strconv.FormatInt(since.Unix(), 10),
+			Max: "+inf",
+		}).Result()
+		if err != nil {
+			return nil, err
+		}
+		list.Total = int64(len(active))
+
+		if userIDs, err = tas.sortUsers(ctx, sortKey, active); err != nil {
+			return nil, err
+		}
+		if offset >= len(userIDs) {
+			userIDs = nil
+		} else {
+			userIDs = userIDs[offset:min(offset+limit, len(userIDs))]
+		}
+	}
+
+	users, err := tas.loadUserStats(ctx, ks, userIDs)
+	if err != nil {
+		return nil, err
+	}
+	list.Users = users
+	return list, nil
+}
+
+// sortUsers orders users by their score in sortKey, highest first, breaking
+// ties by user ID
+func (tas *TokenAnalyticsService) sortUsers(ctx context.Context, sortKey string, userIDs []string) ([]string, error) {
+	if len(userIDs) == 0 {
+		return userIDs, nil
+	}
+
+	scores, err := tas.redis.ZMScore(ctx, sortKey, userIDs...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	order := make([]int, len(userIDs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(a, b int) bool {
+		i, j := order[a], order[b]
+		if scores[i] != scores[j] {
+			return scores[i] > scores[j]
+		}
+		return userIDs[i] < userIDs[j]
+	})
+
+	sorted := make([]string, len(userIDs))
+	for i, idx := range order {
+		sorted[i] = userIDs[idx]
+	}
+	return sorted, nil
+}
+
+// usersHandler serves /analytics/users?limit=N&offset=N&sort_by=total_tokens|input_tokens|output_tokens|cost|last_seen&since=RFC3339
+func (tas *TokenAnalyticsService) usersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	ks, ok := tenantKeyspace(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	sortBy := query.Get("sort_by")
+	if sortBy == "" {
+		sortBy = "total_tokens"
+	}
+	if _, ok := userSortKeys[sortBy]; !ok {
+		http.Error(w, "Invalid sort_by, expected total_tokens, input_tokens, output_tokens, cost or last_seen", http.StatusBadRequest)
+		return
+	}
+
+	limit, err := queryInt(query.Get("limit"), 10)
+	if err != nil || limit <= 0 || limit > 1000 {
+		http.Error(w, "Invalid limit, expected 1 to 1000", http.StatusBadRequest)
+		return
+	}
+	offset, err := queryInt(query.Get("offset"), 0)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid offset", http.StatusBadRequest)
+		return
+	}
+
+	var since time.Time
+	if value := query.Get("since"); value != "" {
+		if since, err = time.Parse(time.RFC3339, value); err != nil {
+			http.Error(w, "Invalid since, expected an RFC 3339 timestamp", http.StatusBadRequest)
+			return
+		}
+	}
+
+	users, err := tas.ListUsers(r.Context(), ks, sortBy, since, limit, offset)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list users: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(users)
+}
+
+// queryInt parses an integer query parameter, returning def if it is empty
+func queryInt(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	return strconv.Atoi(value)
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -13,14 +15,26 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+	"github.com/ajeetraina/genai-app-demo/pkg/errorreport"
+	"github.com/ajeetraina/genai-app-demo/pkg/health"
+	"github.com/ajeetraina/genai-app-demo/pkg/jwtauth"
+	"github.com/ajeetraina/genai-app-demo/pkg/logger"
+	"github.com/ajeetraina/genai-app-demo/pkg/metrics"
 	"github.com/ajeetraina/genai-app-demo/pkg/middleware"
+	"github.com/ajeetraina/genai-app-demo/pkg/otelmetrics"
+	"github.com/ajeetraina/genai-app-demo/pkg/redact"
+	"github.com/ajeetraina/genai-app-demo/pkg/redisconn"
+	"github.com/ajeetraina/genai-app-demo/pkg/slo"
+	"github.com/ajeetraina/genai-app-demo/pkg/tokenizer"
 	"github.com/ajeetraina/genai-app-demo/pkg/tracing"
+	"github.com/openai/openai-go"
+	"github.com/openai/openai-go/option"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	dto "github.com/prometheus/client_model/go"
-	"github.com/openai/openai-go"
-	"github.com/openai/openai-go/option"
+	"github.com/rs/zerolog/log"
 )
 
 // Create a custom registry for metrics
@@ -36,6 +50,13 @@ type ChatRequest struct {
 	Messages []Message `json:"messages"`
 	Message  string    `json:"message"`
 	Format   string    `json:"format,omitempty"` // Optional format parameter
+
+	// Temperature overrides the model's sampling temperature, from 0 to 2
+	Temperature *float64 `json:"temperature,omitempty"`
+
+	// TimeoutMs is how long the client waits for the response, like the
+	// X-Request-Timeout-Ms header
+	TimeoutMs int `json:"timeout_ms,omitempty"`
 }
 
 type MetricLog struct {
@@ -137,6 +158,41 @@ var (
 		[]string{"model"},
 	)
 
+	// Model calls slower than SLOW_MODEL_CALL_THRESHOLD_MS
+	slowModelCalls = promautoFactory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "genai_app_slow_model_calls_total",
+			Help: "Total number of model calls exceeding the slow call threshold",
+		},
+		[]string{"model", "task_type"},
+	)
+
+	// Requests whose time budget ran out, by the stage it ran out in
+	deadlineExceeded = promautoFactory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "genai_app_deadline_exceeded_total",
+			Help: "Total number of requests that ran out of their time budget, by stage",
+		},
+		[]string{"stage"},
+	)
+
+	// Outcome of the live model backend checks of /health?deep=true
+	modelBackendUp = promautoFactory.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "genai_app_model_backend_up",
+			Help: "Whether the model backend served the model at its last live check",
+		},
+		[]string{"model", "url"},
+	)
+
+	modelBackendCheckLatency = promautoFactory.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "genai_app_model_backend_check_latency_seconds",
+			Help: "Latency of the last live check of the model backend",
+		},
+		[]string{"model", "url"},
+	)
+
 	// LlamaCpp metrics
 	llamacppContextSize = promautoFactory.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -311,7 +367,8 @@ func getLlamaCppMetrics(model string) *LlamaCppMetrics {
 }
 
 func main() {
-	log.Println("Starting GenAI App with observability")
+	logger.InitFromEnv("genai-app")
+	log.Info().Msg("Starting GenAI App with observability")
 
 	// Get configuration from environment
 	baseURL := os.Getenv("BASE_URL")
@@ -323,37 +380,350 @@ func main() {
 	var tracingCleanup func()
 
 	if tracingEnabled {
-		otlpEndpoint := getEnvOrDefault("OTLP_ENDPOINT", "jaeger:4318")
-		log.Printf("Setting up tracing with endpoint: %s", otlpEndpoint)
-
-		cleanup, err := tracing.SetupTracing("genai-app", otlpEndpoint)
+		// Exporter, headers and sampling follow the OTEL_* variables
+		var cleanup func()
+		tracingConfig, err := tracing.ConfigFromEnv("jaeger:4318")
+		if err == nil {
+			log.Info().Str("protocol", tracingConfig.Protocol).Str("endpoint", tracingConfig.Endpoint).Msg("Setting up tracing")
+			cleanup, err = tracing.SetupTracing("genai-app", tracingConfig)
+		}
 		if err != nil {
-			log.Printf("Failed to set up tracing: %v", err)
+			log.Error().Err(err).Msg("Failed to set up tracing")
 		} else {
 			tracingCleanup = cleanup
 			defer tracingCleanup()
-			log.Println("Tracing initialized successfully")
+			log.Info().Msg("Tracing initialized successfully")
 		}
 	}
 
+	// Go runtime and process metrics, to correlate latency incidents with
+	// GC pauses, scheduler latency, memory or file descriptor pressure
+	metrics.RegisterRuntimeCollectors(registry)
+
+	// Push the Prometheus metrics to an OpenTelemetry Collector as well, when
+	// OTEL_METRICS_EXPORTER=otlp
+	if metricsCleanup, err := otelmetrics.SetupFromEnv("genai-app", registry); err != nil {
+		log.Error().Err(err).Msg("Failed to set up metrics export")
+	} else if metricsCleanup != nil {
+		defer metricsCleanup()
+	}
+
+	// Report panics and 5xx responses to a Sentry-compatible DSN, when
+	// SENTRY_DSN is set
+	reporter, err := errorreport.NewFromEnv("genai-app")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid error reporting settings")
+	}
+	if reporter != nil {
+		defer reporter.Close(5 * time.Second)
+	}
+
+	// Token capture setup (optional, requires Redis)
+	var tokenCapture *capture.BufferedWriter
+	var liveTracker *capture.LiveTracker
+	var captureService *capture.TokenCaptureService
+	var retention *capture.Retention
+	readiness := health.NewReadiness(2 * time.Second)
+	if os.Getenv("REDIS_ADDR") != "" || os.Getenv("REDIS_SENTINEL_ADDRS") != "" {
+		redisOptions, err := redisconn.OptionsFromEnv()
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid Redis configuration")
+		}
+		requestDays, _ := strconv.Atoi(getEnvOrDefault("RETENTION_REQUEST_DAYS", "7"))
+		sessionDays, _ := strconv.Atoi(getEnvOrDefault("RETENTION_SESSION_DAYS", "30"))
+		hourlyDays, _ := strconv.Atoi(getEnvOrDefault("RETENTION_HOURLY_DAYS", "90"))
+		service := capture.NewTokenCaptureService(redisOptions, capture.Retention{
+			Request: time.Duration(requestDays) * 24 * time.Hour,
+			Session: time.Duration(sessionDays) * 24 * time.Hour,
+			Hourly:  time.Duration(hourlyDays) * 24 * time.Hour,
+		})
+		defer service.Close()
+		captureService = service
+		service.InstrumentRedis(registry)
+
+		// Start even if Redis is not up yet; captured records are held in
+		// the buffer until it is reachable
+		connectTimeout, _ := strconv.Atoi(getEnvOrDefault("REDIS_CONNECT_TIMEOUT_SECONDS", "30"))
+		healthInterval, _ := strconv.Atoi(getEnvOrDefault("REDIS_HEALTH_CHECK_INTERVAL_SECONDS", "5"))
+		err = service.WaitForRedis(time.Duration(connectTimeout) * time.Second)
+		if err != nil {
+			log.Warn().Err(err).Msg("Token capture degraded until Redis is reachable")
+		}
+		redisMonitor := service.MonitorRedis(err == nil, time.Duration(healthInterval)*time.Second, registry)
+		defer redisMonitor.Close()
+		readiness.Add("redis", redisMonitor.Ping)
+
+		if captureContent, _ := strconv.ParseBool(getEnvOrDefault("CAPTURE_CONTENT", "false")); captureContent {
+			content, err := capture.NewContentCipher(os.Getenv("CAPTURE_CONTENT_KEY"))
+			if err != nil {
+				log.Error().Err(err).Msg("Content capture disabled")
+			} else {
+				service.SetContentCipher(content)
+				log.Info().Msg("Content capture enabled, prompts and responses are stored encrypted")
+			}
+
+			var customPatterns map[string]string
+			if patterns := os.Getenv("PII_CUSTOM_PATTERNS"); patterns != "" {
+				if err := json.Unmarshal([]byte(patterns), &customPatterns); err != nil {
+					log.Warn().Err(err).Msg("Ignoring PII_CUSTOM_PATTERNS")
+				}
+			}
+			var rules []string
+			if ruleList := getEnvOrDefault("PII_REDACTION_RULES", strings.Join(redact.DefaultRules, ",")); ruleList != "none" {
+				rules = strings.Split(ruleList, ",")
+			}
+			redactor, err := redact.New(rules, customPatterns)
+			if err != nil {
+				log.Fatal().Err(err).Msg("Invalid PII redaction settings")
+			}
+			service.SetRedactor(redactor)
+		}
+
+		if priceTableFile := os.Getenv("PRICE_TABLE_FILE"); priceTableFile != "" {
+			prices, err := capture.LoadPriceTable(priceTableFile)
+			if err != nil {
+				log.Error().Err(err).Msg("Cost attribution disabled")
+			} else {
+				service.SetPriceTable(prices)
+				log.Info().Int("models", len(prices)).Str("path", priceTableFile).Msg("Loaded prices")
+			}
+		}
+		effective := service.Retention()
+		retention = &effective
+
+		if sampleRate, err := strconv.ParseFloat(getEnvOrDefault("CAPTURE_REQUEST_SAMPLE_RATE", "1"), 64); err != nil {
+			log.Warn().Err(err).Msg("Ignoring CAPTURE_REQUEST_SAMPLE_RATE")
+		} else {
+			service.SetSampleRate(sampleRate)
+			if service.SampleRate() < 1 {
+				log.Info().Float64("sample_rate", service.SampleRate()).Msg("Storing per-request records for a sample of requests")
+			}
+		}
+
+		// The event sink and webhooks are set up before the buffered writer so
+		// they are closed after it and receive its final flush
+		if sink := os.Getenv("EVENT_SINK"); sink != "" {
+			publisher, err := capture.NewEventPublisher(sink, os.Getenv("EVENT_SINK_URL"),
+				getEnvOrDefault("EVENT_SINK_TOPIC", "genai.token_metrics"))
+			if err != nil {
+				log.Error().Err(err).Msg("Event sink disabled")
+			} else {
+				defer publisher.Close()
+				service.AddEventPublisher(publisher)
+				log.Info().Str("sink", sink).Msg("Publishing token metrics")
+			}
+		}
+
+		if postgresURL := os.Getenv("POSTGRES_URL"); postgresURL != "" {
+			archive, err := capture.NewPostgresPublisher(postgresURL)
+			if err != nil {
+				log.Error().Err(err).Msg("Postgres archive disabled")
+			} else {
+				defer archive.Close()
+				service.AddEventPublisher(archive)
+				log.Info().Msg("Archiving request records in Postgres")
+			}
+		}
+
+		if clickHouseURL := os.Getenv("CLICKHOUSE_URL"); clickHouseURL != "" {
+			batchSize, _ := strconv.Atoi(getEnvOrDefault("CLICKHOUSE_BATCH_SIZE", "10000"))
+			flushSeconds, _ := strconv.Atoi(getEnvOrDefault("CLICKHOUSE_FLUSH_INTERVAL_SECONDS", "5"))
+			clickHouse, err := capture.NewClickHousePublisher(capture.ClickHouseConfig{
+				URL:           clickHouseURL,
+				Database:      os.Getenv("CLICKHOUSE_DATABASE"),
+				Table:         os.Getenv("CLICKHOUSE_TABLE"),
+				User:          os.Getenv("CLICKHOUSE_USER"),
+				Password:      os.Getenv("CLICKHOUSE_PASSWORD"),
+				BatchSize:     batchSize,
+				FlushInterval: time.Duration(flushSeconds) * time.Second,
+			})
+			if err != nil {
+				log.Error().Err(err).Msg("ClickHouse sink disabled")
+			} else {
+				defer clickHouse.Close()
+				service.AddEventPublisher(clickHouse)
+				log.Info().Msg("Streaming token metrics to ClickHouse")
+			}
+		}
+
+		if webhookURLs := os.Getenv("WEBHOOK_URLS"); webhookURLs != "" {
+			sendRequests, _ := strconv.ParseBool(getEnvOrDefault("WEBHOOK_SEND_REQUESTS", "true"))
+			dailyThreshold, _ := strconv.ParseInt(getEnvOrDefault("WEBHOOK_DAILY_USER_TOKEN_THRESHOLD", "0"), 10, 64)
+			urls := strings.Split(webhookURLs, ",")
+			webhooks := capture.NewWebhookNotifier(capture.WebhookConfig{
+				URLs:                urls,
+				Secret:              os.Getenv("WEBHOOK_SECRET"),
+				SendRequests:        sendRequests,
+				DailyTokenThreshold: dailyThreshold,
+			}, registry)
+			defer webhooks.Close()
+			service.SetWebhooks(webhooks)
+			log.Info().Int("urls", len(urls)).Msg("Posting capture events to webhooks")
+		}
+
+		bufferSize, _ := strconv.Atoi(getEnvOrDefault("CAPTURE_BUFFER_SIZE", "10000"))
+		batchSize, _ := strconv.Atoi(getEnvOrDefault("CAPTURE_BATCH_SIZE", "100"))
+		flushIntervalMs, _ := strconv.Atoi(getEnvOrDefault("CAPTURE_FLUSH_INTERVAL_MS", "500"))
+
+		tokenCapture = capture.NewBufferedWriter(service, bufferSize, batchSize,
+			time.Duration(flushIntervalMs)*time.Millisecond, registry)
+		defer tokenCapture.Close()
+
+		liveIntervalMs, _ := strconv.Atoi(getEnvOrDefault("CAPTURE_LIVE_INTERVAL_MS", "1000"))
+		liveTracker = capture.NewLiveTracker(service, time.Duration(liveIntervalMs)*time.Millisecond)
+
+		idleTimeoutMin, _ := strconv.Atoi(getEnvOrDefault("SESSION_IDLE_TIMEOUT_MINUTES", "30"))
+		reapIntervalSec, _ := strconv.Atoi(getEnvOrDefault("SESSION_REAP_INTERVAL_SECONDS", "60"))
+		sessionReaper := capture.NewSessionReaper(service, time.Duration(idleTimeoutMin)*time.Minute,
+			time.Duration(reapIntervalSec)*time.Second, registry)
+		defer sessionReaper.Close()
+
+		if mode := os.Getenv("ORPHAN_SWEEP_MODE"); mode != "" {
+			sweepIntervalMin, _ := strconv.Atoi(getEnvOrDefault("ORPHAN_SWEEP_INTERVAL_MINUTES", "60"))
+			orphanSweeper, err := capture.NewOrphanSweeper(service, mode, time.Duration(sweepIntervalMin)*time.Minute, registry)
+			if err != nil {
+				log.Error().Err(err).Msg("Orphan sweeper disabled")
+			} else {
+				defer orphanSweeper.Close()
+				log.Info().Int("interval_minutes", sweepIntervalMin).Str("mode", mode).Msg("Sweeping orphaned request records")
+			}
+		}
+
+		log.Info().Stringer("redis", redisOptions).Msg("Token capture enabled")
+	}
+
+	// Tokenizers used when the model server does not report usage
+	tokenizers := tokenizer.NewRegistry(os.Getenv("TOKENIZER_DIR"))
+	log.Info().Str("model", model).Str("tokenizer", tokenizers.ForModel(model).Name()).Msg("Token counting tokenizer selected")
+
 	// Create OpenAI client
+	// Model requests carry the trace context, so the model runner's spans
+	// join the chat request's trace
 	client := openai.NewClient(
 		option.WithBaseURL(baseURL),
 		option.WithAPIKey(apiKey),
+		option.WithHTTPClient(&http.Client{Transport: tracing.Transport(nil)}),
 	)
 
+	// The service is ready once the model server answers, and Redis too when
+	// token capture is enabled
+	readiness.Add("model", func(ctx context.Context) error {
+		_, err := client.Models.List(ctx, option.WithMaxRetries(0))
+		return err
+	})
+
+	// /health?deep=true checks that each model backend serves its model,
+	// reusing the results briefly; HEALTH_DEEP=true makes that the default
+	modelProbe, err := newModelProbe(client, model, baseURL, apiKey)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid model health check settings")
+	}
+	deepHealthDefault, _ := strconv.ParseBool(getEnvOrDefault("HEALTH_DEEP", "false"))
+	// Model backends the checks find down, or back up, show in the
+	// default tenant's activity feed
+	if captureService != nil {
+		modelProbe.OnChange(func(status health.ModelStatus) {
+			event := capture.ActivityEvent{
+				Type:    capture.ActivityModelAvailable,
+				Subject: status.Model,
+				Message: fmt.Sprintf("Model %s is available again at %s", status.Model, status.URL),
+				Data:    map[string]string{"url": status.URL},
+			}
+			if status.Status != "ok" {
+				event.Type = capture.ActivityModelUnavailable
+				event.Message = fmt.Sprintf("Model %s is unavailable at %s", status.Model, status.URL)
+				event.Data["error"] = status.Error
+			}
+			captureService.PublishActivity(context.Background(), event)
+		})
+	}
+
 	// Create router
 	mux := http.NewServeMux()
 
 	// Apply middleware
+	tenantAPIKeys := parseTenantAPIKeys(os.Getenv("TENANT_API_KEYS"))
+	// Log every API call, sampling the high-volume endpoints
+	accessLogConfig, err := middleware.AccessLogConfigFromEnv("/metrics/summary=0.01")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid access log settings")
+	}
+	// Model calls slower than the threshold are logged and counted; 0 turns
+	// the slow call log off
+	slowModelCallMs, err := strconv.Atoi(getEnvOrDefault("SLOW_MODEL_CALL_THRESHOLD_MS", "10000"))
+	if err != nil || slowModelCallMs < 0 {
+		log.Fatal().Str("value", os.Getenv("SLOW_MODEL_CALL_THRESHOLD_MS")).Msg("Invalid SLOW_MODEL_CALL_THRESHOLD_MS")
+	}
+	slowModelCall := time.Duration(slowModelCallMs) * time.Millisecond
+	deadlines, err := middleware.DeadlineConfigFromEnv()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid request timeout settings")
+	}
+	// Bearer JWTs are validated against the JWKS of JWT_JWKS_URL or
+	// JWT_ISSUER, and name the user whose tokens are captured
+	jwtVerifier, err := jwtauth.NewFromEnv()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid JWT settings")
+	}
+	jwtRequired, _ := strconv.ParseBool(getEnvOrDefault("JWT_REQUIRED", "false"))
+	if jwtVerifier == nil && jwtRequired {
+		log.Fatal().Msg("JWT_REQUIRED needs JWT_JWKS_URL or JWT_ISSUER")
+	}
+	if jwtVerifier != nil {
+		log.Info().Bool("required", jwtRequired).Msg("Validating JWT bearer tokens")
+	}
+	// Objectives in SLO_CONFIG_FILE get error budget burn rate metrics
+	var sloTracker *slo.Tracker
+	if path := os.Getenv("SLO_CONFIG_FILE"); path != "" {
+		sloConfig, err := slo.LoadConfig(path)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", path).Msg("Invalid SLO config")
+		}
+		sloTracker = slo.NewTracker(sloConfig, registry)
+		log.Info().Int("objectives", len(sloConfig.Objectives)).Msg("SLO tracking enabled")
+	}
 	handlersChain := func(h http.Handler) http.Handler {
+		if reporter != nil {
+			h = middleware.ErrorReporting(reporter)(h)
+		}
+		if sloTracker != nil {
+			h = middleware.SLOMiddleware(sloTracker)(h)
+		}
 		h = middleware.MetricsMiddleware(requestCounter, requestDuration, activeRequests)(h)
+		h = middleware.AccessLog(accessLogConfig)(h)
+		h = middleware.LoggingMiddleware(h)
+		if tokenCapture != nil {
+			h = middleware.CaptureMiddleware(tenantAPIKeys)(h)
+		}
+		if jwtVerifier != nil {
+			h = middleware.JWTAuth(jwtVerifier, jwtRequired)(h)
+		}
+		h = middleware.RequestIDMiddleware(h)
 		if tracingEnabled {
 			h = middleware.TracingMiddleware(h)
 		}
 		return h
 	}
 
+	// Every service writes a heartbeat to Redis, which /api/v1/system/status
+	// combines into the status of the whole stack
+	if captureService != nil {
+		heartbeatInterval, err := strconv.Atoi(getEnvOrDefault("HEARTBEAT_INTERVAL_SECONDS", "10"))
+		if err != nil || heartbeatInterval <= 0 {
+			log.Fatal().Str("value", os.Getenv("HEARTBEAT_INTERVAL_SECONDS")).Msg("Invalid HEARTBEAT_INTERVAL_SECONDS")
+		}
+		heartbeat := captureService.StartHeartbeat("genai-app", map[string]bool{
+			"token_capture":   true,
+			"tracing":         tracingEnabled,
+			"error_reporting": reporter != nil,
+			"slo":             sloTracker != nil,
+		}, readiness, time.Duration(heartbeatInterval)*time.Second)
+		defer heartbeat.Close()
+
+		services := strings.Split(getEnvOrDefault("SYSTEM_STATUS_SERVICES", "genai-app,token-analytics,redis-timeseries-service"), ",")
+		mux.HandleFunc("/api/v1/system/status", captureService.HandleSystemStatus(services))
+	}
+
 	// Add CORS handler
 	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == http.MethodOptions {
@@ -365,11 +735,14 @@ func main() {
 		}
 	})
 
+	// Liveness and readiness probes for orchestrators
+	mux.HandleFunc("/healthz", health.HandleLiveness())
+	mux.HandleFunc("/readyz", health.HandleReadiness(readiness))
+
 	// Add health check endpoint
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.WriteHeader(http.StatusOK)
 		
 		// Check if the model is a llama.cpp model
 		isLlamaCpp := strings.Contains(strings.ToLower(model), "llama") || 
@@ -406,7 +779,64 @@ func main() {
 			"status": "ok",
 			"model_info": modelInfo,
 		}
-		
+
+		// Live checks of the model backends; the service is unavailable
+		// when none of them serves its model
+		status := http.StatusOK
+		deep := deepHealthDefault
+		if value := r.URL.Query().Get("deep"); value != "" {
+			deep, _ = strconv.ParseBool(value)
+		}
+		if deep {
+			models := modelProbe.Run(r.Context())
+			for _, backend := range models {
+				up := 0.0
+				if backend.Status == "ok" {
+					up = 1
+				}
+				modelBackendUp.WithLabelValues(backend.Model, backend.URL).Set(up)
+				modelBackendCheckLatency.WithLabelValues(backend.Model, backend.URL).Set(backend.LatencyMs / 1000)
+			}
+			response["models"] = models
+			response["status"] = health.ModelsStatus(models)
+			if response["status"] == "unavailable" {
+				status = http.StatusServiceUnavailable
+			}
+		}
+
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(response)
+	})
+
+	// Add user data endpoints for erasure and subject access requests, which
+	// need the BACKEND_ADMIN_TOKEN bearer token. Users with a validated JWT
+	// may also export their own data and replay their own sessions.
+	if captureService != nil {
+		adminToken := os.Getenv("BACKEND_ADMIN_TOKEN")
+		if adminToken == "" {
+			log.Warn().Msg("BACKEND_ADMIN_TOKEN is not set, user data endpoints only serve users with a validated JWT")
+		}
+		mux.HandleFunc("/api/v1/users/{id}/data", handleDeleteUserData(captureService, adminToken))
+		mux.HandleFunc("/api/v1/users/{id}/export", handleExportUserData(captureService, adminToken))
+		mux.HandleFunc("/api/v1/sessions/{id}/requests", handleReplaySession(captureService, adminToken))
+	}
+
+	// Add config endpoint reporting the effective capture settings
+	mux.HandleFunc("/config", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+
+		response := map[string]interface{}{
+			"model":                 model,
+			"token_capture_enabled": tokenCapture != nil,
+		}
+		if retention != nil {
+			response["retention"] = retention
+		}
+		if captureService != nil {
+			response["request_sample_rate"] = captureService.SampleRate()
+		}
+
 		json.NewEncoder(w).Encode(response)
 	})
 
@@ -527,7 +957,7 @@ func main() {
 	})
 
 	// Add chat endpoint with advanced tracing
-	mux.HandleFunc("/chat", handleChat(client, model, baseURL))
+	mux.HandleFunc("/chat", handleChat(client, model, baseURL, slowModelCall, deadlines, tokenizers, tokenCapture, liveTracker, captureService))
 
 	// Create HTTP server
 	server := &http.Server{
@@ -544,17 +974,17 @@ func main() {
 	}
 	
 	go func() {
-		log.Println("Starting metrics server on :9090")
+		log.Info().Str("addr", ":9090").Msg("Starting metrics server")
 		if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Failed to start metrics server: %v", err)
+			log.Fatal().Err(err).Msg("Failed to start metrics server")
 		}
 	}()
 
 	// Start the main server
 	go func() {
-		log.Println("Starting server on :8080")
+		log.Info().Str("addr", ":8080").Msg("Starting server")
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Failed to start server: %v", err)
+			log.Fatal().Err(err).Msg("Failed to start server")
 		}
 	}()
 
@@ -562,7 +992,7 @@ func main() {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
-	log.Println("Shutting down server...")
+	log.Info().Msg("Shutting down server...")
 
 	// Shutdown the server with a timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -570,13 +1000,348 @@ func main() {
 
 	// Shutdown servers
 	if err := server.Shutdown(ctx); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+		log.Fatal().Err(err).Msg("Server forced to shutdown")
 	}
 	if err := metricsServer.Shutdown(ctx); err != nil {
-		log.Fatalf("Metrics server forced to shutdown: %v", err)
+		log.Fatal().Err(err).Msg("Metrics server forced to shutdown")
 	}
 
-	log.Println("Server exiting")
+	log.Info().Msg("Server exiting")
+}
+
+// handleDeleteUserData removes all captured data for a user and reports what was deleted
+func handleDeleteUserData(service *capture.TokenCaptureService, adminToken string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !isAdmin(r, adminToken) {
+			unauthorized(w)
+			return
+		}
+
+		userID := r.PathValue("id")
+		if userID == "" {
+			http.Error(w, "User ID is required", http.StatusBadRequest)
+			return
+		}
+
+		report, err := service.DeleteUserData(requestTenant(r), userID)
+		if err != nil {
+			log.Ctx(r.Context()).Error().Err(err).Str("user_id", userID).Msg("Error deleting user data")
+			http.Error(w, "Failed to delete user data", http.StatusInternalServerError)
+			return
+		}
+		log.Ctx(r.Context()).Info().
+			Str("user_id", userID).
+			Int("requests", report.RequestsDeleted).
+			Int("sessions", report.SessionsDeleted).
+			Int64("keys", report.KeysDeleted).
+			Msg("Deleted user data")
+		reportJSON, _ := json.Marshal(report)
+		recordAudit(r, service, capture.AuditUserDelete, "user:"+userID, reportJSON)
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	}
+}
+
+// handleReplaySession returns a session and its requests in the order they were made
+func handleReplaySession(service *capture.TokenCaptureService, adminToken string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		sessionID := r.PathValue("id")
+		if sessionID == "" {
+			http.Error(w, "Session ID is required", http.StatusBadRequest)
+			return
+		}
+		admin := isAdmin(r, adminToken)
+		if !admin && (middleware.AuthenticatedUser(r.Context()) == "" || !isOwnTenant(r)) {
+			unauthorized(w)
+			return
+		}
+
+		replay, err := service.ReplaySession(requestTenant(r), sessionID)
+		if err != nil {
+			log.Ctx(r.Context()).Error().Err(err).Str("session_id", sessionID).Msg("Error replaying session")
+			http.Error(w, "Failed to load session", http.StatusInternalServerError)
+			return
+		}
+		// Other users' sessions are reported as missing, so their IDs
+		// cannot be probed
+		if !replay.Found() || (!admin && !isUser(r, replay.UserID())) {
+			http.Error(w, "Session not found", http.StatusNotFound)
+			return
+		}
+		recordAudit(r, service, capture.AuditSessionReplay, "session:"+sessionID, []byte(r.URL.RawQuery))
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(replay)
+	}
+}
+
+// handleExportUserData returns all captured data for a user as JSON, or as a
+// zip archive of CSV files when format=csv
+func handleExportUserData(service *capture.TokenCaptureService, adminToken string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		userID := r.PathValue("id")
+		if userID == "" {
+			http.Error(w, "User ID is required", http.StatusBadRequest)
+			return
+		}
+		if !isAdmin(r, adminToken) && !(isUser(r, userID) && isOwnTenant(r)) {
+			unauthorized(w)
+			return
+		}
+
+		export, err := service.ExportUserData(requestTenant(r), userID)
+		if err != nil {
+			log.Ctx(r.Context()).Error().Err(err).Str("user_id", userID).Msg("Error exporting user data")
+			http.Error(w, "Failed to export user data", http.StatusInternalServerError)
+			return
+		}
+
+		switch r.URL.Query().Get("format") {
+		case "", "json":
+			recordAudit(r, service, capture.AuditUserExport, "user:"+userID, []byte(r.URL.RawQuery))
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "user-"+userID+".json"))
+			json.NewEncoder(w).Encode(export)
+		case "csv":
+			recordAudit(r, service, capture.AuditUserExport, "user:"+userID, []byte(r.URL.RawQuery))
+			w.Header().Set("Content-Type", "application/zip")
+			w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "user-"+userID+".zip"))
+			if err := export.WriteCSVArchive(w); err != nil {
+				log.Ctx(r.Context()).Error().Err(err).Str("user_id", userID).Msg("Error writing export archive")
+			}
+		default:
+			http.Error(w, "Unsupported format, use json or csv", http.StatusBadRequest)
+		}
+	}
+}
+
+// recordAudit appends a data access or change made by the request to the
+// audit log. A failure is logged rather than failing the request.
+func recordAudit(r *http.Request, service *capture.TokenCaptureService, action, resource string, payload []byte) {
+	entry := middleware.AuditEntry(r, action, resource, requestTenant(r))
+	if err := service.RecordAudit(r.Context(), entry, payload); err != nil {
+		log.Ctx(r.Context()).Error().Err(err).Str("action", action).Str("resource", resource).Msg("Failed to record audit entry")
+	}
+}
+
+// classifyError maps the outcome of a model request to a capture status
+func classifyError(ctx context.Context, err error) capture.Status {
+	if err == nil {
+		return capture.StatusSuccess
+	}
+
+	var apiErr *openai.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusTooManyRequests:
+			return capture.StatusRateLimited
+		case http.StatusRequestTimeout, http.StatusGatewayTimeout:
+			return capture.StatusUpstreamTimeout
+		}
+		return capture.StatusUpstreamError
+	}
+
+	// A cancelled request context means the client went away
+	if errors.Is(err, context.Canceled) || errors.Is(ctx.Err(), context.Canceled) {
+		return capture.StatusCancelled
+	}
+
+	var netErr net.Error
+	if errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return capture.StatusUpstreamTimeout
+	}
+	return capture.StatusUpstreamError
+}
+
+// requestTenant returns the tenant resolved for the request by the capture middleware
+func requestTenant(r *http.Request) string {
+	if info, ok := capture.RequestInfoFromContext(r.Context()); ok {
+		return info.Tenant
+	}
+	return ""
+}
+
+// isAdmin reports whether the request carries the admin token, as a bearer
+// token or, for deployments where JWT_REQUIRED reserves the Authorization
+// header for JWTs, in X-Admin-Token. No request is an admin when the token
+// is not configured.
+func isAdmin(r *http.Request, adminToken string) bool {
+	if adminToken == "" {
+		return false
+	}
+	token := r.Header.Get("X-Admin-Token")
+	if token == "" {
+		token, _ = strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// isUser reports whether the request carries a validated JWT naming userID
+func isUser(r *http.Request, userID string) bool {
+	user := middleware.AuthenticatedUser(r.Context())
+	return user != "" && user == userID
+}
+
+// isOwnTenant reports whether a user may serve themselves from the request's
+// tenant: the default tenant, or one bound by a tenant API key or the tenant
+// claim of the validated token. A tenant named only in X-Tenant-ID could be
+// anyone's, so reading its data needs the admin token.
+func isOwnTenant(r *http.Request) bool {
+	return requestTenant(r) == "" || middleware.TenantAuthenticated(r.Context())
+}
+
+// unauthorized rejects a request that lacks the credentials of an endpoint
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Bearer`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+// parseTenantAPIKeys parses a comma-separated list of apikey=tenant pairs
+func parseTenantAPIKeys(value string) map[string]string {
+	tenantAPIKeys := make(map[string]string)
+	for _, pair := range strings.Split(value, ",") {
+		key, tenant, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok || key == "" {
+			continue
+		}
+		if !capture.ValidTenant(tenant) {
+			log.Warn().Str("tenant", tenant).Msg("Ignoring invalid tenant in TENANT_API_KEYS")
+			continue
+		}
+		tenantAPIKeys[key] = tenant
+	}
+	return tenantAPIKeys
+}
+
+// newModelProbe sets up the live checks of the configured model backend and
+// of the extra backends in HEALTH_MODEL_BACKENDS, whose results are reused
+// for HEALTH_MODEL_CACHE_SECONDS
+func newModelProbe(client *openai.Client, model, baseURL, apiKey string) (*health.ModelProbe, error) {
+	backends, err := health.ParseModelBackends(os.Getenv("HEALTH_MODEL_BACKENDS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid HEALTH_MODEL_BACKENDS: %w", err)
+	}
+	cacheSeconds, err := strconv.Atoi(getEnvOrDefault("HEALTH_MODEL_CACHE_SECONDS", "10"))
+	if err != nil || cacheSeconds < 0 {
+		return nil, fmt.Errorf("HEALTH_MODEL_CACHE_SECONDS must be a number of seconds")
+	}
+
+	probe := health.NewModelProbe(5*time.Second, time.Duration(cacheSeconds)*time.Second)
+	probe.Add(health.ModelBackend{Model: model, URL: baseURL, Check: modelServedCheck(client, model)})
+	for _, backend := range backends {
+		backendClient := openai.NewClient(
+			option.WithBaseURL(backend.URL),
+			option.WithAPIKey(apiKey),
+			option.WithHTTPClient(&http.Client{Transport: tracing.Transport(nil)}),
+		)
+		backend.Check = modelServedCheck(backendClient, backend.Model)
+		probe.Add(backend)
+	}
+	return probe, nil
+}
+
+// modelServedCheck checks that the model server lists the model
+func modelServedCheck(client *openai.Client, model string) health.Check {
+	return func(ctx context.Context) error {
+		page, err := client.Models.List(ctx, option.WithMaxRetries(0))
+		if err != nil {
+			return err
+		}
+		for _, served := range page.Data {
+			if served.ID == model {
+				return nil
+			}
+		}
+		return fmt.Errorf("model %s is not served", model)
+	}
+}
+
+// writeError replies with a JSON error carrying the request's correlation ID,
+// which users can quote when reporting a failure
+func writeError(w http.ResponseWriter, r *http.Request, message string, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":      message,
+		"request_id": middleware.RequestID(r.Context()),
+	})
+}
+
+// writeStreamError reports an error that ends a chat response. Once part of
+// the response has been streamed its status has gone out, so the error is
+// sent as an SSE error event instead.
+func writeStreamError(w http.ResponseWriter, r *http.Request, message string, status int, streamed bool) {
+	if !streamed {
+		writeError(w, r, message, status)
+		return
+	}
+	data, _ := json.Marshal(map[string]string{
+		"error":      message,
+		"request_id": middleware.RequestID(r.Context()),
+	})
+	fmt.Fprintf(w, "\n\nevent: error\ndata: %s\n\n", data)
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// slowModelCallInfo describes a model call that exceeded the slow call threshold
+type slowModelCallInfo struct {
+	Model        string
+	ModelURL     string
+	TaskType     string
+	PromptTokens int
+	PromptChars  int
+	OutputTokens int
+	Duration     time.Duration
+	FirstToken   time.Duration
+	Err          error
+}
+
+// recordSlowModelCall logs and counts a slow model call. The request-scoped
+// logger adds the request and trace IDs, so the line leads straight to the
+// call's trace.
+func recordSlowModelCall(ctx context.Context, call slowModelCallInfo) {
+	slowModelCalls.WithLabelValues(call.Model, call.TaskType).Inc()
+
+	event := log.Ctx(ctx).Warn().
+		Str("model", call.Model).
+		Str("model_url", call.ModelURL).
+		Str("task_type", call.TaskType).
+		Int("prompt_tokens", call.PromptTokens).
+		Int("prompt_chars", call.PromptChars).
+		Int("output_tokens", call.OutputTokens).
+		Dur("duration", call.Duration)
+	if call.FirstToken > 0 {
+		event = event.Dur("time_to_first_token", call.FirstToken)
+	}
+	if call.Err != nil {
+		event = event.Err(call.Err)
+	}
+	event.Msg("Slow model call")
+}
+
+// chatTaskType names the kind of work a chat request asks of the model
+func chatTaskType(req ChatRequest, useMarkdown bool) string {
+	if useMarkdown {
+		return "markdown"
+	}
+	return "chat"
 }
 
 // getEnvOrDefault gets an environment variable or returns a default value
@@ -589,11 +1354,13 @@ func getEnvOrDefault(key, defaultValue string) string {
 }
 
 // handleChat handles the chat endpoint with simple tracing
-func handleChat(client *openai.Client, model string, apiBaseURL string) http.HandlerFunc {
+func handleChat(client *openai.Client, model string, apiBaseURL string, slowModelCall time.Duration, deadlines middleware.DeadlineConfig, tokenizers *tokenizer.Registry, tokenCapture *capture.BufferedWriter, liveTracker *capture.LiveTracker, budgets *capture.TokenCaptureService) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		received := time.Now()
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-API-Key, X-Tenant-ID, X-Request-ID, X-User-ID, X-Session-ID, X-Client-App, X-App-Version, X-Request-Timeout-Ms, traceparent, tracestate")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Budget-Warning, X-Budget-Exceeded, X-Request-ID")
 
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusOK)
@@ -601,17 +1368,52 @@ func handleChat(client *openai.Client, model string, apiBaseURL string) http.Han
 		}
 
 		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
 		var req ChatRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			log.Printf("Invalid request body: %v", err)
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			log.Ctx(r.Context()).Warn().Err(err).Msg("Invalid request body")
+			writeError(w, r, "Invalid request body", http.StatusBadRequest)
 			requestCounter.WithLabelValues(r.Method, r.URL.Path, fmt.Sprintf("%d", http.StatusBadRequest)).Inc()
 			return
 		}
+		if req.Temperature != nil && (*req.Temperature < 0 || *req.Temperature > 2) {
+			writeError(w, r, "Temperature must be between 0 and 2", http.StatusBadRequest)
+			requestCounter.WithLabelValues(r.Method, r.URL.Path, fmt.Sprintf("%d", http.StatusBadRequest)).Inc()
+			return
+		}
+
+		// The client's timeout bounds every stage of the request, so no work
+		// continues after the client has given up on it
+		headerTimeout, err := middleware.RequestTimeout(r)
+		if err != nil || req.TimeoutMs < 0 {
+			writeError(w, r, "Timeout must be a positive number of milliseconds", http.StatusBadRequest)
+			requestCounter.WithLabelValues(r.Method, r.URL.Path, fmt.Sprintf("%d", http.StatusBadRequest)).Inc()
+			return
+		}
+		budget := deadlines.Budget(received, headerTimeout, time.Duration(req.TimeoutMs)*time.Millisecond)
+
+		// Consult the budgets evaluated by the analytics service; a failed
+		// check lets the request through rather than blocking all traffic
+		if info, ok := capture.RequestInfoFromContext(r.Context()); ok && budgets != nil {
+			checkCtx, cancel := budget.Context(r.Context())
+			action, field, err := budgets.CheckBudgets(checkCtx, info.Tenant, info.UserID, model)
+			cancel()
+			if err != nil {
+				log.Ctx(r.Context()).Warn().Err(err).Msg("Failed to check budgets")
+			}
+			switch action {
+			case capture.BudgetBlock:
+				w.Header().Set("X-Budget-Exceeded", field)
+				writeError(w, r, fmt.Sprintf("Budget exceeded for %s", field), http.StatusTooManyRequests)
+				requestCounter.WithLabelValues(r.Method, r.URL.Path, fmt.Sprintf("%d", http.StatusTooManyRequests)).Inc()
+				return
+			case capture.BudgetWarn:
+				w.Header().Set("X-Budget-Warning", field)
+			}
+		}
 
 		// Set headers for SSE
 		w.Header().Set("Content-Type", "text/event-stream")
@@ -619,24 +1421,29 @@ func handleChat(client *openai.Client, model string, apiBaseURL string) http.Han
 		w.Header().Set("Connection", "keep-alive")
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 
-		// Count input tokens (rough estimate)
+		// Count input tokens locally; replaced by the upstream usage when the
+		// model server reports it
+		tok := tokenizers.ForModel(model)
 		inputTokens := 0
+		promptChars := len(req.Message)
 		for _, msg := range req.Messages {
-			inputTokens += len(msg.Content) / 4 // Rough estimate
+			inputTokens += tok.CountTokens(msg.Content)
+			promptChars += len(msg.Content)
 		}
-		inputTokens += len(req.Message) / 4
-		
-		// Track metrics for input tokens
-		chatTokensCounter.WithLabelValues("input", model).Add(float64(inputTokens))
+		inputTokens += tok.CountTokens(req.Message)
 
 		// Start model timing
 		start := time.Now()
 		modelStartTime := time.Now()
 		var firstTokenTime time.Time
-		outputTokens := 0
+		var output strings.Builder
+		var usage openai.CompletionUsage
 
+		// The conversation is kept as sent, for content capture
 		var messages []openai.ChatCompletionMessageParamUnion
+		var conversation []capture.ContentMessage
 		for _, msg := range req.Messages {
+			conversation = append(conversation, capture.ContentMessage{Role: msg.Role, Content: msg.Content})
 			var message openai.ChatCompletionMessageParamUnion
 			switch msg.Role {
 			case "user":
@@ -666,8 +1473,9 @@ func handleChat(client *openai.Client, model string, apiBaseURL string) http.Han
 		// If markdown is requested, modify the system prompt
 		if useMarkdown {
 			// Prepend a system message to request markdown formatting
-			systemMsg := openai.SystemMessage("Please format your response using markdown. Use proper headings, bullet points, numbered lists, code blocks with syntax highlighting, and tables where appropriate.")
-			messages = append([]openai.ChatCompletionMessageParamUnion{systemMsg}, messages...)
+			systemPrompt := "Please format your response using markdown. Use proper headings, bullet points, numbered lists, code blocks with syntax highlighting, and tables where appropriate."
+			messages = append([]openai.ChatCompletionMessageParamUnion{openai.SystemMessage(systemPrompt)}, messages...)
+			conversation = append([]capture.ContentMessage{{Role: "system", Content: systemPrompt}}, conversation...)
 		}
 
 		// Add the user message to the conversation
@@ -676,16 +1484,62 @@ func handleChat(client *openai.Client, model string, apiBaseURL string) http.Han
 		param := openai.ChatCompletionNewParams{
 			Messages: openai.F(messages),
 			Model:    openai.F(model),
+			StreamOptions: openai.F(openai.ChatCompletionStreamOptionsParam{
+				IncludeUsage: openai.F(true),
+			}),
+		}
+		if req.Temperature != nil {
+			param.Temperature = openai.F(*req.Temperature)
 		}
 
 		// Set prompt evaluation start time for llama.cpp metrics
 		promptEvalStartTime := time.Now()
 
-		ctx := r.Context()
-		stream := client.Chat.Completions.NewStreaming(ctx, param)
+		// The model call gets whatever time is left, and tells the model
+		// server how much that is
+		if budget.Remaining() == 0 {
+			deadlineExceeded.WithLabelValues(middleware.StageModel).Inc()
+			writeError(w, r, "Request deadline exceeded before the model call", http.StatusGatewayTimeout)
+			requestCounter.WithLabelValues(r.Method, r.URL.Path, fmt.Sprintf("%d", http.StatusGatewayTimeout)).Inc()
+			return
+		}
+		modelCtx, cancelModel := budget.Context(r.Context())
+		defer cancelModel()
+
+		// The model call gets its own span, annotated with the gen_ai.*
+		// attributes that LLM views in tracing backends understand
+		ctx, chatSpan := tracing.StartChatSpan(modelCtx, tracing.ChatRequest{
+			System:      "openai",
+			Model:       model,
+			BaseURL:     apiBaseURL,
+			Temperature: req.Temperature,
+		})
+		var chatResponse tracing.ChatResponse
+		stream := client.Chat.Completions.NewStreaming(ctx, param,
+			option.WithHeader(middleware.TimeoutHeader, strconv.FormatInt(budget.Remaining().Milliseconds(), 10)))
+
+		// Publish progress for live dashboards while the response streams
+		var live *capture.LiveRequest
+		if liveTracker != nil {
+			if info, ok := capture.RequestInfoFromContext(ctx); ok {
+				live = liveTracker.Start(info, model)
+				defer live.Finish()
+			}
+		}
 
 		for stream.Next() {
 			chunk := stream.Current()
+			chatResponse.ID, chatResponse.Model = chunk.ID, chunk.Model
+			for _, choice := range chunk.Choices {
+				if choice.FinishReason != "" {
+					chatResponse.FinishReasons = append(chatResponse.FinishReasons, string(choice.FinishReason))
+				}
+			}
+
+			// The final chunk carries the usage when include_usage is honoured
+			if chunk.Usage.TotalTokens > 0 {
+				usage = chunk.Usage
+			}
 
 			// Record first token time
 			if firstTokenTime.IsZero() && len(chunk.Choices) > 0 && chunk.Choices[0].Delta.Content != "" {
@@ -701,16 +1555,29 @@ func handleChat(client *openai.Client, model string, apiBaseURL string) http.Han
 
 			// Stream each chunk as it arrives
 			if len(chunk.Choices) > 0 && chunk.Choices[0].Delta.Content != "" {
-				outputTokens++
+				output.WriteString(chunk.Choices[0].Delta.Content)
+				if live != nil {
+					live.AddChunk(tok.CountTokens(chunk.Choices[0].Delta.Content))
+				}
 				_, err := fmt.Fprintf(w, "%s", chunk.Choices[0].Delta.Content)
 				if err != nil {
-					log.Printf("Error writing to stream: %v", err)
+					log.Ctx(r.Context()).Warn().Err(err).Msg("Error writing to stream")
+					tracing.EndChatSpan(chatSpan, chatResponse, err)
 					return
 				}
 				w.(http.Flusher).Flush()
 			}
 		}
 
+		// Prefer the token counts reported by the model server
+		outputTokens := tok.CountTokens(output.String())
+		if usage.TotalTokens > 0 {
+			inputTokens = int(usage.PromptTokens)
+			outputTokens = int(usage.CompletionTokens)
+		}
+		chatResponse.InputTokens, chatResponse.OutputTokens = inputTokens, outputTokens
+		tracing.EndChatSpan(chatSpan, chatResponse, stream.Err())
+
 		// Calculate tokens per second for llama.cpp metrics
 		if strings.Contains(strings.ToLower(model), "llama") || 
 		   strings.Contains(apiBaseURL, "llama.cpp") {
@@ -723,19 +1590,72 @@ func handleChat(client *openai.Client, model string, apiBaseURL string) http.Han
 
 		// Record metrics
 		requestDuration.WithLabelValues(r.Method, r.URL.Path).Observe(time.Since(start).Seconds())
-		requestCounter.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+		if stream.Err() == nil {
+			requestCounter.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+		}
+		chatTokensCounter.WithLabelValues("input", model).Add(float64(inputTokens))
 		chatTokensCounter.WithLabelValues("output", model).Add(float64(outputTokens))
+		middleware.RecordTokens(r.Context(), inputTokens, outputTokens)
 		modelLatency.WithLabelValues(model, "inference").Observe(time.Since(modelStartTime).Seconds())
 		
 		if !firstTokenTime.IsZero() {
 			ttft := firstTokenTime.Sub(modelStartTime).Seconds()
-			log.Printf("Time to first token: %.3f seconds", ttft)
+			log.Ctx(r.Context()).Debug().Float64("ttft_seconds", ttft).Msg("Time to first token")
 			firstTokenLatency.WithLabelValues(model).Observe(ttft)
 		}
 
+		if modelDuration := time.Since(modelStartTime); slowModelCall > 0 && modelDuration > slowModelCall {
+			var ttft time.Duration
+			if !firstTokenTime.IsZero() {
+				ttft = firstTokenTime.Sub(modelStartTime)
+			}
+			recordSlowModelCall(r.Context(), slowModelCallInfo{
+				Model:        model,
+				ModelURL:     apiBaseURL,
+				TaskType:     chatTaskType(req, useMarkdown),
+				PromptTokens: inputTokens,
+				PromptChars:  promptChars,
+				OutputTokens: outputTokens,
+				Duration:     modelDuration,
+				FirstToken:   ttft,
+				Err:          stream.Err(),
+			})
+		}
+
+		// Store token metrics for the analytics services
+		if tokenCapture != nil {
+			if info, ok := capture.RequestInfoFromContext(r.Context()); ok {
+				metrics := info.NewTokenMetrics(model)
+				metrics.InputTokens = inputTokens
+				metrics.OutputTokens = outputTokens
+				metrics.ResponseTimeMs = float64(time.Since(modelStartTime).Milliseconds())
+				if !firstTokenTime.IsZero() {
+					metrics.FirstTokenMs = float64(firstTokenTime.Sub(modelStartTime).Milliseconds())
+					if generationTime := time.Since(firstTokenTime).Seconds(); generationTime > 0 {
+						metrics.TokensPerSecond = float64(outputTokens) / generationTime
+					}
+				}
+				metrics.Prompt = userMessage
+				metrics.Messages = conversation
+				metrics.Response = output.String()
+				metrics.Status = classifyError(ctx, stream.Err())
+				tokenCapture.Capture(metrics)
+			}
+		}
+
 		if err := stream.Err(); err != nil {
-			log.Printf("Error in stream: %v", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			errorCounter.WithLabelValues(string(classifyError(ctx, err))).Inc()
+			if errors.Is(modelCtx.Err(), context.DeadlineExceeded) {
+				deadlineExceeded.WithLabelValues(middleware.StageModel).Inc()
+				log.Ctx(r.Context()).Warn().Err(err).Dur("timeout", budget.Deadline().Sub(received)).Msg("Request deadline exceeded during the model call")
+				writeStreamError(w, r, "Request deadline exceeded", http.StatusGatewayTimeout, output.Len() > 0)
+				requestCounter.WithLabelValues(r.Method, r.URL.Path, fmt.Sprintf("%d", http.StatusGatewayTimeout)).Inc()
+				return
+			}
+			log.Ctx(r.Context()).Error().Err(err).Msg("Error in stream")
+			middleware.ReportError(r.Context(), err)
+			writeStreamError(w, r, "Internal server error", http.StatusInternalServerError, output.Len() > 0)
+			requestCounter.WithLabelValues(r.Method, r.URL.Path, fmt.Sprintf("%d", http.StatusInternalServerError)).Inc()
 			return
 		}
 	}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+	"github.com/ajeetraina/genai-app-demo/pkg/logger"
+	"github.com/ajeetraina/genai-app-demo/pkg/postgres"
+	"github.com/ajeetraina/genai-app-demo/pkg/redisconn"
+	"github.com/rs/zerolog/log"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "report the records that would be migrated without changing them")
+	flag.Parse()
+	logger.InitFromEnv("migrate")
+
+	redisOptions, err := redisconn.OptionsFromEnv()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid Redis configuration")
+	}
+	service := capture.NewTokenCaptureService(redisOptions, capture.Retention{})
+	defer service.Close()
+	if err := service.WaitForRedis(0); err != nil {
+		log.Fatal().Err(err).Msg("Failed to connect")
+	}
+
+	for _, migration := range capture.Migrations {
+		log.Info().Int("version", migration.Version).Msg(migration.Description)
+	}
+
+	report, err := service.MigrateRecords(*dryRun)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Migration failed")
+	}
+
+	if postgresURL := os.Getenv("POSTGRES_URL"); postgresURL != "" {
+		migratePostgres(postgresURL, *dryRun)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(report)
+}
+
+// migratePostgres applies, or with dryRun lists, the Postgres archive's
+// schema migrations
+func migratePostgres(url string, dryRun bool) {
+	migrations, err := postgres.Migrations()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to read Postgres migrations")
+	}
+	if dryRun {
+		for _, migration := range migrations {
+			log.Info().Str("migration", migration.Name).Msg("Postgres migration, applied only if not yet recorded in schema_migrations")
+		}
+		return
+	}
+
+	conn, err := postgres.Connect(url)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to connect to Postgres")
+	}
+	defer conn.Close()
+	applied, err := postgres.Migrate(conn)
+	for _, migration := range applied {
+		log.Info().Str("migration", migration.Name).Msg("Applied Postgres migration")
+	}
+	if err != nil {
+		log.Fatal().Err(err).Msg("Postgres migration failed")
+	}
+	if len(applied) == 0 {
+		log.Info().Msg("Postgres schema is up to date")
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/alerting"
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+	"github.com/redis/go-redis/v9"
+)
+
+// alertRulesKey holds the series alert rules, as JSON keyed by rule name
+const alertRulesKey = "timeseries:alert_rules"
+
+// defaultAlertWindow is the window of rules that do not set one
+const defaultAlertWindow = 5 * time.Minute
+
+// alertAggregations are the TS.RANGE aggregations rules may use
+var alertAggregations = map[string]bool{
+	"avg": true, "sum": true, "min": true, "max": true, "range": true, "count": true,
+	"first": true, "last": true, "std.p": true, "std.s": true, "var.p": true, "var.s": true, "twa": true,
+}
+
+// SeriesAlertRule raises an alert when a series, aggregated over Window,
+// stays above or below a threshold for the rule's duration. The rule's
+// metric is the key of the series, in the rule's tenant.
+type SeriesAlertRule struct {
+	alerting.Rule
+	Aggregation string            `json:"aggregation"`
+	Window      alerting.Duration `json:"window"`
+}
+
+// validateAlertRule checks a rule and fills in its defaults
+func validateAlertRule(rule *SeriesAlertRule) error {
+	if rule.Name == "" || strings.ContainsAny(rule.Name, " \t\r\n") {
+		return fmt.Errorf("name must be non-empty and contain no whitespace")
+	}
+	if rule.Metric == "" || strings.ContainsAny(rule.Metric, " \t\r\n") || strings.HasPrefix(rule.Metric, "tenant:") {
+		return fmt.Errorf("metric must be a series key without whitespace or a tenant prefix")
+	}
+	if rule.Tenant != "" && !capture.ValidTenant(rule.Tenant) {
+		return fmt.Errorf("invalid tenant %q", rule.Tenant)
+	}
+	if rule.Model != "" {
+		return fmt.Errorf("series rules cannot be narrowed to a model")
+	}
+	if rule.Aggregation == "" {
+		rule.Aggregation = "avg"
+	}
+	if !alertAggregations[rule.Aggregation] {
+		return fmt.Errorf("unknown aggregation %q", rule.Aggregation)
+	}
+	if rule.Window.Duration == 0 {
+		rule.Window.Duration = defaultAlertWindow
+	}
+	if rule.Window.Duration < time.Millisecond || rule.For.Duration < 0 {
+		return fmt.Errorf("window must be positive and for must not be negative")
+	}
+	if rule.Comparator == "" {
+		rule.Comparator = alerting.Above
+	}
+	if rule.Comparator != alerting.Above && rule.Comparator != alerting.Below {
+		return fmt.Errorf("invalid comparator %q, expected above or below", rule.Comparator)
+	}
+	if rule.Severity == "" {
+		rule.Severity = "warning"
+	}
+	return nil
+}
+
+// alertRules returns the stored rules, ordered by name
+func (ts *RedisTimeSeriesService) alertRules(ctx context.Context) ([]SeriesAlertRule, error) {
+	stored, err := ts.redis.HGetAll(ctx, alertRulesKey).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	rules := make([]SeriesAlertRule, 0, len(stored))
+	for name, encoded := range stored {
+		var rule SeriesAlertRule
+		if err := json.Unmarshal([]byte(encoded), &rule); err != nil {
+			return nil, fmt.Errorf("invalid alert rule %s: %v", name, err)
+		}
+		rules = append(rules, rule)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Name < rules[j].Name })
+	return rules, nil
+}
+
+// evaluateAlerts loads the rules and evaluates them once. It runs on the
+// metrics collection goroutine after each collection.
+func (ts *RedisTimeSeriesService) evaluateAlerts(now time.Time) error {
+	rules, err := ts.alertRules(ts.ctx)
+	if err != nil {
+		return fmt.Errorf("failed to load alert rules: %v", err)
+	}
+
+	byName := make(map[string]SeriesAlertRule, len(rules))
+	plain := make([]alerting.Rule, 0, len(rules))
+	for _, rule := range rules {
+		byName[rule.Name] = rule
+		plain = append(plain, rule.Rule)
+	}
+	ts.alertRulesByName = byName
+	ts.alerts.SetRules(plain)
+	ts.alerts.Evaluate(ts.ctx, now)
+	return nil
+}
+
+// sampleAlertRule aggregates a rule's series over the rule's window, ending
+// now. A window without samples cannot be evaluated, except by count.
+func (ts *RedisTimeSeriesService) sampleAlertRule(ctx context.Context, plain alerting.Rule) (float64, error) {
+	rule, ok := ts.alertRulesByName[plain.Name]
+	if !ok {
+		return 0, fmt.Errorf("unknown rule %q", plain.Name)
+	}
+
+	window := rule.Window.Milliseconds()
+	now := time.Now().UnixMilli()
+	key := capture.TenantKeyspace(rule.Tenant).Key("%s", rule.Metric)
+	result, err := ts.seriesRedis.Do(ctx, "TS.RANGE", key, now-window+1, now,
+		"ALIGN", "start", "AGGREGATION", rule.Aggregation, window).Slice()
+	if err != nil {
+		return 0, err
+	}
+	samples := parseTSSamples(result)
+	if len(samples) == 0 {
+		if rule.Aggregation == "count" {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("no samples of %s in the last %s", rule.Metric, rule.Window.Duration)
+	}
+	return samples[len(samples)-1].Value, nil
+}
+
+// alertRulesHandler serves /alerts/rules. GET lists the rules, PUT creates
+// or replaces a rule from a SeriesAlertRule body and DELETE removes the rule
+// named by ?name=. Changes apply from the next collection.
+func (ts *RedisTimeSeriesService) alertRulesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodGet:
+		rules, err := ts.alertRules(r.Context())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list alert rules: %v", err), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(rules)
+
+	case http.MethodPut:
+		if !ts.authorizeAdmin(w, r) {
+			return
+		}
+		var rule SeriesAlertRule
+		if err := json.NewDecoder(r.Body).Decode(&rule); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := validateAlertRule(&rule); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		encoded, err := json.Marshal(rule)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to encode alert rule: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if err := ts.redis.HSet(r.Context(), alertRulesKey, rule.Name, encoded).Err(); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to save alert rule: %v", err), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(rule)
+
+	case http.MethodDelete:
+		if !ts.authorizeAdmin(w, r) {
+			return
+		}
+		removed, err := ts.redis.HDel(r.Context(), alertRulesKey, r.URL.Query().Get("name")).Result()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to delete alert rule: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if removed == 0 {
+			http.Error(w, "Alert rule not found", http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// alertsHandler serves GET /alerts?state=, listing the state of each rule
+// as of the last collection, optionally only those firing or pending
+func (ts *RedisTimeSeriesService) alertsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	state := r.URL.Query().Get("state")
+	rules := []alerting.RuleStatus{}
+	for _, status := range ts.alerts.States() {
+		if state == "" || status.State == state {
+			rules = append(rules, status)
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"rules": rules})
+}
+
+// authorizeAdmin checks the TIMESERIES_ADMIN_TOKEN bearer token of requests
+// that change alert rules or series
+func (ts *RedisTimeSeriesService) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	return authorizeBearer(w, r, ts.adminToken, "TIMESERIES_ADMIN_TOKEN")
+}
+
+// authorizeBearer checks that the request's bearer token is token, the value
+// of the setting named env. Requests are refused while the token is not
+// configured.
+func authorizeBearer(w http.ResponseWriter, r *http.Request, token, env string) bool {
+	if token == "" {
+		http.Error(w, fmt.Sprintf("Endpoint is disabled, set %s", env), http.StatusServiceUnavailable)
+		return false
+	}
+	bearer := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(bearer), []byte(token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer`)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
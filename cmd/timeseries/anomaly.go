@@ -0,0 +1,333 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+	"github.com/ajeetraina/genai-app-demo/pkg/logger"
+	"github.com/redis/go-redis/v9"
+)
+
+// Metrics watched for anomalies
+const (
+	anomalyTokensPerMinute = "tokens_per_minute"
+	anomalyErrorRate       = "error_rate"
+	anomalyLatency         = "avg_latency_ms"
+)
+
+// anomalyRetention is how long anomaly events are kept, matching the
+// retention of the metrics time-series
+const anomalyRetention = 24 * time.Hour
+
+// anomalySeriesTTL is how long a series' baseline survives without samples
+const anomalySeriesTTL = 24 * time.Hour
+
+// Anomaly is an unusual spike in a tenant's, model's or user's metric
+type Anomaly struct {
+	Timestamp int64   `json:"timestamp"`
+	Metric    string  `json:"metric"`
+	Scope     string  `json:"scope"`
+	Subject   string  `json:"subject,omitempty"`
+	Value     float64 `json:"value"`
+	Expected  float64 `json:"expected"`
+	StdDev    float64 `json:"stddev"`
+	ZScore    float64 `json:"z_score"`
+}
+
+// ewma is the exponentially weighted mean and variance of a series
+type ewma struct {
+	mean     float64
+	variance float64
+	samples  int
+	updated  time.Time
+}
+
+// counterSample is the last reading of a cumulative counter
+type counterSample struct {
+	value float64
+	at    time.Time
+}
+
+// AnomalyDetector flags samples that exceed the EWMA baseline of their series
+// by more than threshold standard deviations. It is only used by the metrics
+// collection goroutine.
+type AnomalyDetector struct {
+	alpha     float64
+	threshold float64
+	warmup    int
+
+	series   map[string]*ewma
+	counters map[string]counterSample
+}
+
+// NewAnomalyDetector creates a detector with smoothing factor alpha that
+// flags z-scores above threshold once a series has warmup samples
+func NewAnomalyDetector(alpha, threshold float64, warmup int) *AnomalyDetector {
+	return &AnomalyDetector{
+		alpha:     alpha,
+		threshold: threshold,
+		warmup:    warmup,
+		series:    make(map[string]*ewma),
+		counters:  make(map[string]counterSample),
+	}
+}
+
+// Observe adds a sample to the series identified by the anomaly's tenant,
+// scope, subject and metric, returning true with the anomaly's baseline
+// filled in if the sample is a spike. The sample is folded into the
+// baseline either way, so a sustained change becomes the new normal.
+func (d *AnomalyDetector) Observe(tenant string, anomaly *Anomaly, now time.Time) bool {
+	key := fmt.Sprintf("%s|%s|%s|%s", tenant, anomaly.Scope, anomaly.Subject, anomaly.Metric)
+	s, ok := d.series[key]
+	if !ok {
+		d.series[key] = &ewma{mean: anomaly.Value, samples: 1, updated: now}
+		return false
+	}
+
+	// Floor the deviation so a perfectly flat series does not turn every
+	// small change into an infinite z-score
+	stddev := math.Sqrt(s.variance)
+	deviation := math.Max(stddev, 0.05*math.Abs(s.mean))
+	if deviation == 0 {
+		deviation = 1
+	}
+	z := (anomaly.Value - s.mean) / deviation
+	spike := s.samples >= d.warmup && z > d.threshold
+
+	anomaly.Expected = s.mean
+	anomaly.StdDev = stddev
+	anomaly.ZScore = z
+
+	diff := anomaly.Value - s.mean
+	s.mean += d.alpha * diff
+	s.variance = (1 - d.alpha) * (s.variance + d.alpha*diff*diff)
+	s.samples++
+	s.updated = now
+
+	return spike
+}
+
+// delta returns how much a cumulative counter grew since its last reading and
+// the seconds elapsed, or false on its first reading
+func (d *AnomalyDetector) delta(key string, value float64, now time.Time) (float64, float64, bool) {
+	last, ok := d.counters[key]
+	d.counters[key] = counterSample{value: value, at: now}
+	if !ok || value < last.value {
+		return 0, 0, false
+	}
+	return value - last.value, now.Sub(last.at).Seconds(), true
+}
+
+// prune forgets series and counters that have not been updated recently
+func (d *AnomalyDetector) prune(now time.Time) {
+	for key, s := range d.series {
+		if now.Sub(s.updated) > anomalySeriesTTL {
+			delete(d.series, key)
+		}
+	}
+	for key, c := range d.counters {
+		if now.Sub(c.at) > 2*time.Hour {
+			delete(d.counters, key)
+		}
+	}
+}
+
+// detectAnomalies samples a tenant's token rates, per-model error rates and
+// latencies and per-user token usage, and records any spikes
+func (ts *RedisTimeSeriesService) detectAnomalies(tenant string, now time.Time) {
+	ks := capture.TenantKeyspace(tenant)
+	models, err := ts.redis.SMembers(ts.ctx, ks.Key("models")).Result()
+	if err != nil {
+		logger.Component("anomaly").Error().Err(err).Str("tenant", tenant).Msg("Failed to list models for anomaly detection")
+		return
+	}
+
+	pipe := ts.redis.Pipeline()
+	minutes := capture.RateMinutes(now)
+	minuteCmds := make([]*redis.MapStringStringCmd, len(minutes))
+	for i, minute := range minutes {
+		minuteCmds[i] = pipe.HGetAll(ts.ctx, capture.MinuteKey(ks, minute))
+	}
+	hourlyCmds := make(map[string]*redis.SliceCmd, len(models))
+	for _, model := range models {
+		hourlyCmds[model] = pipe.HMGet(ts.ctx, capture.ModelHourlyKey(ks, model, now), "requests", "errors", "response_time_ms")
+	}
+	dailyKey := ks.Key("tokens:daily:%s", now.UTC().Format("20060102"))
+	dailyCmd := pipe.HGetAll(ts.ctx, dailyKey)
+	if _, err := pipe.Exec(ts.ctx); err != nil && err != redis.Nil {
+		logger.Component("anomaly").Error().Err(err).Str("tenant", tenant).Msg("Failed to read metrics for anomaly detection")
+		return
+	}
+
+	var anomalies []Anomaly
+	observe := func(scope, subject, metric string, value float64) {
+		anomaly := Anomaly{
+			Timestamp: now.UnixMilli(),
+			Metric:    metric,
+			Scope:     scope,
+			Subject:   subject,
+			Value:     value,
+		}
+		if ts.anomalies.Observe(tenant, &anomaly, now) {
+			anomalies = append(anomalies, anomaly)
+		}
+	}
+
+	// Token throughput of the tenant and of each model
+	buckets := make([]map[string]string, len(minuteCmds))
+	for i, cmd := range minuteCmds {
+		buckets[i] = cmd.Val()
+	}
+	total, modelRates := capture.SumTokenRates(buckets)
+	observe("tenant", "", anomalyTokensPerMinute, total.InputPerMinute+total.OutputPerMinute)
+	for _, model := range models {
+		rate := modelRates[model]
+		observe("model", model, anomalyTokensPerMinute, rate.InputPerMinute+rate.OutputPerMinute)
+	}
+
+	// Error rate and mean latency of the requests completed since the last
+	// sample, from the growth of each model's current hourly rollup
+	var tenantRequests, tenantErrors, tenantLatency float64
+	for model, cmd := range hourlyCmds {
+		hourlyKey := capture.ModelHourlyKey(ks, model, now)
+		values := cmd.Val()
+		counts := make([]float64, len(values))
+		for i, value := range values {
+			if s, ok := value.(string); ok {
+				counts[i], _ = strconv.ParseFloat(s, 64)
+			}
+		}
+		requests, _, ok := ts.anomalies.delta(hourlyKey+"|requests", counts[0], now)
+		errors, _, _ := ts.anomalies.delta(hourlyKey+"|errors", counts[1], now)
+		latency, _, _ := ts.anomalies.delta(hourlyKey+"|response_time_ms", counts[2], now)
+		if !ok || requests == 0 {
+			continue
+		}
+		observe("model", model, anomalyErrorRate, errors/requests)
+		observe("model", model, anomalyLatency, latency/requests)
+		tenantRequests += requests
+		tenantErrors += errors
+		tenantLatency += latency
+	}
+	if tenantRequests > 0 {
+		observe("tenant", "", anomalyErrorRate, tenantErrors/tenantRequests)
+		observe("tenant", "", anomalyLatency, tenantLatency/tenantRequests)
+	}
+
+	// Token usage of each user active today
+	for userID, value := range dailyCmd.Val() {
+		tokens, _ := strconv.ParseFloat(value, 64)
+		used, seconds, ok := ts.anomalies.delta(dailyKey+"|"+userID, tokens, now)
+		if !ok || seconds <= 0 {
+			continue
+		}
+		observe("user", userID, anomalyTokensPerMinute, used/seconds*60)
+	}
+
+	if len(anomalies) > 0 {
+		ts.recordAnomalies(ks, anomalies, now)
+	}
+}
+
+// recordAnomalies stores anomaly events in the tenant's anomalies sorted set,
+// scored by timestamp, dropping events past the retention
+func (ts *RedisTimeSeriesService) recordAnomalies(ks capture.Keyspace, anomalies []Anomaly, now time.Time) {
+	key := ks.Key("anomalies")
+	pipe := ts.redis.Pipeline()
+	for _, anomaly := range anomalies {
+		data, _ := json.Marshal(anomaly)
+		pipe.ZAdd(ts.ctx, key, redis.Z{Score: float64(anomaly.Timestamp), Member: data})
+		ts.anomaliesDetected.WithLabelValues(anomaly.Metric, anomaly.Scope).Inc()
+		logger.Component("anomaly").Warn().
+			Str("scope", anomaly.Scope).
+			Str("metric", anomaly.Metric).
+			Str("subject", anomaly.Subject).
+			Float64("value", anomaly.Value).
+			Float64("expected", anomaly.Expected).
+			Float64("z_score", anomaly.ZScore).
+			Msg("Anomaly detected")
+	}
+	pipe.ZRemRangeByScore(ts.ctx, key, "-inf", strconv.FormatInt(now.Add(-anomalyRetention).UnixMilli(), 10))
+	if _, err := pipe.Exec(ts.ctx); err != nil {
+		logger.Component("anomaly").Error().Err(err).Msg("Failed to record anomalies")
+	}
+}
+
+// GetAnomalies returns a tenant's anomalies since a Unix millisecond
+// timestamp, newest first, optionally filtered by metric, scope and subject
+func (ts *RedisTimeSeriesService) GetAnomalies(ctx context.Context, ks capture.Keyspace, since int64, metric, scope, subject string, limit int) ([]Anomaly, error) {
+	members, err := ts.redis.ZRevRangeByScore(ctx, ks.Key("anomalies"), &redis.ZRangeBy{
+		Min: strconv.FormatInt(since, 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	anomalies := []Anomaly{}
+	for _, member := range members {
+		var anomaly Anomaly
+		if err := json.Unmarshal([]byte(member), &anomaly); err != nil {
+			continue
+		}
+		if (metric != "" && anomaly.Metric != metric) ||
+			(scope != "" && anomaly.Scope != scope) ||
+			(subject != "" && anomaly.Subject != subject) {
+			continue
+		}
+		anomalies = append(anomalies, anomaly)
+		if len(anomalies) == limit {
+			break
+		}
+	}
+	return anomalies, nil
+}
+
+// anomaliesHandler serves /anomalies?since=&metric=&scope=&subject=&limit=,
+// defaulting to the last 24 hours and 100 events
+func (ts *RedisTimeSeriesService) anomaliesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	query := r.URL.Query()
+	tenant := query.Get("tenant")
+	if tenant != "" && !capture.ValidTenant(tenant) {
+		http.Error(w, "Invalid tenant", http.StatusBadRequest)
+		return
+	}
+
+	since := time.Now().Add(-anomalyRetention).UnixMilli()
+	if value := query.Get("since"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid since, expected Unix milliseconds", http.StatusBadRequest)
+			return
+		}
+		since = parsed
+	}
+
+	limit := 100
+	if value := query.Get("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > 1000 {
+			http.Error(w, "Invalid limit, expected 1 to 1000", http.StatusBadRequest)
+			return
+		}
+		limit = parsed
+	}
+
+	anomalies, err := ts.GetAnomalies(r.Context(), capture.TenantKeyspace(tenant), since,
+		query.Get("metric"), query.Get("scope"), query.Get("subject"), limit)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to get anomalies: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{"anomalies": anomalies})
+}
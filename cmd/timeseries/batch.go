@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+)
+
+// maxBatchSize bounds the data points accepted by one /add-batch request
+const maxBatchSize = 10000
+
+// BatchError reports a data point of a batch that was not added
+type BatchError struct {
+	Index int    `json:"index"`
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+// BatchResult is the outcome of adding a batch of data points
+type BatchResult struct {
+	Added  int          `json:"added"`
+	Errors []BatchError `json:"errors"`
+}
+
+// AddDataPoints adds a batch of data points to a tenant's series with a
+// single TS.MADD, or one per point when series are sharded. Points with no
+// timestamp are stamped with the current time. Points rejected individually,
+// such as those for series that do not exist, are reported in the result
+// rather than failing the batch. Labels are ignored; they are set when a
+// series is created.
+func (ts *RedisTimeSeriesService) AddDataPoints(ctx context.Context, ks capture.Keyspace, metrics []TimeSeriesMetric) (*BatchResult, error) {
+	start := time.Now()
+	defer func() {
+		ts.timeSeriesLatency.WithLabelValues("madd").Observe(time.Since(start).Seconds())
+	}()
+
+	now := time.Now().UnixMilli()
+	args := make([]interface{}, 0, 1+3*len(metrics))
+	args = append(args, "TS.MADD")
+	for _, metric := range metrics {
+		timestamp := metric.Timestamp
+		if timestamp == 0 {
+			timestamp = now
+		}
+		args = append(args, ks.Key("%s", metric.Key), timestamp, metric.Value)
+	}
+
+	var result []interface{}
+	var err error
+	if !ts.seriesSharded() {
+		result, err = ts.redis.Do(ctx, args...).Slice()
+	} else {
+		result, err = ts.shardedMAdd(ctx, args[1:])
+	}
+
+	status := "success"
+	if err != nil {
+		status = "error"
+	}
+	ts.timeSeriesOperations.WithLabelValues("madd", status).Inc()
+
+	if err != nil {
+		return nil, err
+	}
+
+	batch := &BatchResult{Errors: []BatchError{}}
+	for i, reply := range result {
+		if err, ok := reply.(error); ok {
+			batch.Errors = append(batch.Errors, BatchError{Index: i, Key: metrics[i].Key, Error: err.Error()})
+			continue
+		}
+		batch.Added++
+	}
+	return batch, nil
+}
+
+// addBatchHandler serves POST /add-batch?tenant=, taking a JSON array of
+// TimeSeriesMetric whose keys start with pushKeyPrefix
+func (ts *RedisTimeSeriesService) addBatchHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !ts.authorizePush(w, r) {
+		return
+	}
+
+	tenant := r.URL.Query().Get("tenant")
+	if tenant != "" && !capture.ValidTenant(tenant) {
+		http.Error(w, "Invalid tenant", http.StatusBadRequest)
+		return
+	}
+
+	var metrics []TimeSeriesMetric
+	if err := json.NewDecoder(r.Body).Decode(&metrics); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if len(metrics) == 0 || len(metrics) > maxBatchSize {
+		http.Error(w, fmt.Sprintf("Invalid batch, expected 1 to %d data points", maxBatchSize), http.StatusBadRequest)
+		return
+	}
+	for i, metric := range metrics {
+		if _, err := validatePush(metric); err != nil {
+			http.Error(w, fmt.Sprintf("Data point %d: %v", i, err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := ts.AddDataPoints(r.Context(), capture.TenantKeyspace(tenant), metrics)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to add data points: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(result)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// errCardinalityLimit is returned when creating a series would exceed a
+// cardinality limit
+var errCardinalityLimit = errors.New("cardinality limit exceeded")
+
+// cardinalityLimits guards against runaway series creation, such as a label
+// taking a new value for every user, by capping the series a tenant may have
+// and the labels each may carry. A tenant's series keys are scanned when it
+// is first written to and again after each collection, so several replicas
+// may together overshoot the limit by the series they create in between.
+type cardinalityLimits struct {
+	maxSeries int
+	maxLabels int
+
+	mu    sync.Mutex
+	known map[string]map[string]bool // series keys by tenant
+
+	seriesGauge     *prometheus.GaugeVec
+	rejectedCounter *prometheus.CounterVec
+}
+
+// newCardinalityLimits creates limits of maxSeries series per tenant and
+// maxLabels labels per series, either disabled when 0, or nil when both are
+func newCardinalityLimits(maxSeries, maxLabels int) *cardinalityLimits {
+	if maxSeries <= 0 && maxLabels <= 0 {
+		return nil
+	}
+	seriesGauge := prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "redis_timeseries_series",
+			Help: "Number of time-series per tenant, as last scanned",
+		},
+		[]string{"tenant"},
+	)
+	rejectedCounter := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "redis_timeseries_cardinality_rejections_total",
+			Help: "Series creations rejected by cardinality limit",
+		},
+		[]string{"limit"},
+	)
+	prometheus.MustRegister(seriesGauge, rejectedCounter)
+
+	return &cardinalityLimits{
+		maxSeries:       maxSeries,
+		maxLabels:       maxLabels,
+		known:           make(map[string]map[string]bool),
+		seriesGauge:     seriesGauge,
+		rejectedCounter: rejectedCounter,
+	}
+}
+
+// parseCardinalityLimits reads the cardinality limits, 10000 series per
+// tenant and 32 labels per series by default
+func parseCardinalityLimits() (maxSeries, maxLabels int) {
+	maxSeries, err := strconv.Atoi(getEnvOrDefault("TIMESERIES_MAX_SERIES_PER_TENANT", "10000"))
+	if err != nil || maxSeries < 0 {
+		maxSeries = 10000
+	}
+	maxLabels, err = strconv.Atoi(getEnvOrDefault("TIMESERIES_MAX_LABELS_PER_SERIES", "32"))
+	if err != nil || maxLabels < 0 {
+		maxLabels = 32
+	}
+	return maxSeries, maxLabels
+}
+
+// checkLabels rejects a series with more labels than the limit
+func (c *cardinalityLimits) checkLabels(key string, labels int) error {
+	if c == nil || c.maxLabels <= 0 || labels <= c.maxLabels {
+		return nil
+	}
+	c.rejectedCounter.WithLabelValues("labels").Inc()
+	return fmt.Errorf("%w: series %s would have %d labels, more than the limit of %d",
+		errCardinalityLimit, key, labels, c.maxLabels)
+}
+
+// set records a tenant's series keys
+func (c *cardinalityLimits) set(tenant string, keys []string) {
+	known := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		known[key] = true
+	}
+	c.mu.Lock()
+	c.known[tenant] = known
+	c.mu.Unlock()
+	c.seriesGauge.WithLabelValues(tenant).Set(float64(len(keys)))
+}
+
+// forget drops a deleted series from its tenant's count
+func (c *cardinalityLimits) forget(tenant, key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if known := c.known[tenant]; known[key] {
+		delete(known, key)
+		c.seriesGauge.WithLabelValues(tenant).Set(float64(len(known)))
+	}
+}
+
+// allowSeries checks that a tenant may write to the series at key, with
+// labels labels should it be created. Series that already exist are always
+// allowed.
+func (ts *RedisTimeSeriesService) allowSeries(ctx context.Context, tenant, key string, labels int) error {
+	c := ts.cardinality
+	if c == nil {
+		return nil
+	}
+	c.mu.Lock()
+	_, loaded := c.known[tenant]
+	c.mu.Unlock()
+	if !loaded && c.maxSeries > 0 {
+		keys, err := ts.seriesKeys(ctx, tenant)
+		if err != nil {
+			return fmt.Errorf("failed to count series: %v", err)
+		}
+		c.set(tenant, keys)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	known := c.known[tenant]
+	if known[key] {
+		return nil
+	}
+	if err := c.checkLabels(key, labels); err != nil {
+		return err
+	}
+	if c.maxSeries <= 0 {
+		return nil
+	}
+	if len(known) >= c.maxSeries {
+		c.rejectedCounter.WithLabelValues("series").Inc()
+		return fmt.Errorf("%w: tenant %q is at its limit of %d series", errCardinalityLimit, tenant, c.maxSeries)
+	}
+	known[key] = true
+	c.seriesGauge.WithLabelValues(tenant).Set(float64(len(known)))
+	return nil
+}
+
+// refreshCardinality rescans a tenant's series keys, picking up series
+// created and deleted elsewhere
+func (ts *RedisTimeSeriesService) refreshCardinality(tenant string) {
+	if ts.cardinality == nil {
+		return
+	}
+	keys, err := ts.seriesKeys(ts.ctx, tenant)
+	if err != nil {
+		logger.Component("cardinality").Warn().Err(err).Str("tenant", tenant).Msg("Failed to count series")
+		return
+	}
+	ts.cardinality.set(tenant, keys)
+}
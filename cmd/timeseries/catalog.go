@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+	"github.com/redis/go-redis/v9"
+)
+
+// SeriesInfo describes a stored series, from TS.INFO
+type SeriesInfo struct {
+	Key            string            `json:"key"`
+	Labels         map[string]string `json:"labels"`
+	TotalSamples   int64             `json:"total_samples"`
+	MemoryUsage    int64             `json:"memory_usage_bytes"`
+	FirstTimestamp int64             `json:"first_timestamp"`
+	LastTimestamp  int64             `json:"last_timestamp"`
+	RetentionMs    int64             `json:"retention_ms"`
+	ChunkCount     int64             `json:"chunk_count"`
+}
+
+// parseTSInfo parses the field, value pairs of a TS.INFO reply
+func parseTSInfo(key string, reply interface{}) SeriesInfo {
+	info := SeriesInfo{Key: key, Labels: map[string]string{}}
+	fields, _ := reply.([]interface{})
+	for i := 0; i+1 < len(fields); i += 2 {
+		name, _ := fields[i].(string)
+		value, _ := fields[i+1].(int64)
+		switch name {
+		case "labels":
+			info.Labels = parseTSLabels(fields[i+1])
+		case "totalSamples":
+			info.TotalSamples = value
+		case "memoryUsage":
+			info.MemoryUsage = value
+		case "firstTimestamp":
+			info.FirstTimestamp = value
+		case "lastTimestamp":
+			info.LastTimestamp = value
+		case "retentionTime":
+			info.RetentionMs = value
+		case "chunkCount":
+			info.ChunkCount = value
+		}
+	}
+	return info
+}
+
+// SeriesInfo describes a tenant's series, or returns nil when it does not
+// exist
+func (ts *RedisTimeSeriesService) SeriesInfo(ctx context.Context, tenant, key string) (*SeriesInfo, error) {
+	reply, err := ts.seriesRedis.Do(ctx, "TS.INFO", capture.TenantKeyspace(tenant).Key("%s", key)).Result()
+	if isRedisReplyError(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	info := parseTSInfo(key, reply)
+	return &info, nil
+}
+
+// Catalog describes every series of a tenant, ordered by key
+func (ts *RedisTimeSeriesService) Catalog(ctx context.Context, tenant string) ([]SeriesInfo, error) {
+	keys, err := ts.seriesKeys(ctx, tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	ks := capture.TenantKeyspace(tenant)
+	pipe := ts.seriesRedis.Pipeline()
+	replies := make([]*redis.Cmd, len(keys))
+	for i, key := range keys {
+		replies[i] = pipe.Do(ctx, "TS.INFO", ks.Key("%s", key))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !isRedisReplyError(err) {
+		return nil, err
+	}
+
+	catalog := make([]SeriesInfo, 0, len(keys))
+	for i, key := range keys {
+		// Skip series deleted since the scan
+		if reply, err := replies[i].Result(); err == nil {
+			catalog = append(catalog, parseTSInfo(key, reply))
+		}
+	}
+	return catalog, nil
+}
+
+// seriesInfoHandler serves GET /series/{key}/info?tenant=
+func (ts *RedisTimeSeriesService) seriesInfoHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	tenant := r.URL.Query().Get("tenant")
+	if tenant != "" && !capture.ValidTenant(tenant) {
+		http.Error(w, "Invalid tenant", http.StatusBadRequest)
+		return
+	}
+	key := r.PathValue("key")
+
+	info, err := ts.SeriesInfo(r.Context(), tenant, key)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to describe series: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if info == nil {
+		http.Error(w, fmt.Sprintf("Series %s not found", key), http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(info)
+}
+
+// catalogHandler serves GET /series/catalog?tenant=, describing every series
+// of the tenant with its labels, sample count and memory usage
+func (ts *RedisTimeSeriesService) catalogHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	tenant := r.URL.Query().Get("tenant")
+	if tenant != "" && !capture.ValidTenant(tenant) {
+		http.Error(w, "Invalid tenant", http.StatusBadRequest)
+		return
+	}
+
+	catalog, err := ts.Catalog(r.Context(), tenant)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to list series: %v", err), http.StatusInternalServerError)
+		return
+	}
+	var totalSamples, memoryUsage int64
+	for _, info := range catalog {
+		totalSamples += info.TotalSamples
+		memoryUsage += info.MemoryUsage
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"series":             catalog,
+		"total_samples":      totalSamples,
+		"memory_usage_bytes": memoryUsage,
+	})
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LoadSeriesConfig reads the series definitions from a YAML file of the form
+//
+//	default_retention: 24h
+//	series:
+//	  - key: metrics:tokens:input_rate
+//	    retention: 7d
+//	    labels:
+//	      metric_type: token_rate
+//
+// Retentions are Go durations, optionally in days ("7d"), or "0" to keep
+// samples forever. Series without a retention get default_retention, which
+// defaults to 24 hours. Built-in series the file does not list keep their
+// built-in settings, so the collected metrics always have a series; listed
+// ones take the file's retention and labels.
+func LoadSeriesConfig(path string) ([]SeriesDefinition, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	document, err := parseYAML(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid series config: %v", err)
+	}
+	root, ok := document.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid series config: expected a mapping at the top level")
+	}
+	if err := checkFields(root, "the top level", "default_retention", "series"); err != nil {
+		return nil, err
+	}
+
+	defaultRetention := int64(defaultRetentionMs)
+	if value, ok := root["default_retention"]; ok {
+		if defaultRetention, err = parseRetention(value); err != nil {
+			return nil, fmt.Errorf("invalid default_retention: %v", err)
+		}
+	}
+
+	entries, ok := root["series"].([]interface{})
+	if !ok {
+		if _, present := root["series"]; present {
+			return nil, fmt.Errorf("series must be a list")
+		}
+	}
+
+	configured := make(map[string]SeriesDefinition, len(entries))
+	for i, entry := range entries {
+		fields, ok := entry.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("series %d: expected a mapping", i)
+		}
+		if err := checkFields(fields, fmt.Sprintf("series %d", i), "key", "retention", "labels"); err != nil {
+			return nil, err
+		}
+
+		key, _ := fields["key"].(string)
+		definition := SeriesDefinition{Key: key, RetentionMs: defaultRetention, Labels: map[string]string{}}
+		if value, ok := fields["retention"]; ok {
+			if definition.RetentionMs, err = parseRetention(value); err != nil {
+				return nil, fmt.Errorf("series %s: invalid retention: %v", key, err)
+			}
+		}
+		if value, ok := fields["labels"]; ok {
+			labels, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("series %s: labels must be a mapping", key)
+			}
+			for name, labelValue := range labels {
+				text, ok := labelValue.(string)
+				if !ok {
+					return nil, fmt.Errorf("series %s: label %s must be a string", key, name)
+				}
+				definition.Labels[name] = text
+			}
+		}
+
+		if err := validateSeries(definition); err != nil {
+			return nil, fmt.Errorf("series %d: %v", i, err)
+		}
+		if _, ok := configured[key]; ok {
+			return nil, fmt.Errorf("series %s is defined more than once", key)
+		}
+		configured[key] = definition
+	}
+
+	definitions := make([]SeriesDefinition, 0, len(builtinSeries)+len(configured))
+	for _, builtin := range builtinSeries {
+		if definition, ok := configured[builtin.Key]; ok {
+			builtin = definition
+			delete(configured, builtin.Key)
+		}
+		definitions = append(definitions, builtin)
+	}
+	keys := make([]string, 0, len(configured))
+	for key := range configured {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		definitions = append(definitions, configured[key])
+	}
+	return definitions, nil
+}
+
+// checkFields rejects fields other than those allowed, catching typos
+func checkFields(fields map[string]interface{}, where string, allowed ...string) error {
+	for name := range fields {
+		known := false
+		for _, field := range allowed {
+			known = known || name == field
+		}
+		if !known {
+			return fmt.Errorf("unknown field %q in %s, expected %s", name, where, strings.Join(allowed, ", "))
+		}
+	}
+	return nil
+}
+
+// parseRetention parses a retention such as "24h", "7d" or "0" into milliseconds
+func parseRetention(value interface{}) (int64, error) {
+	text, ok := value.(string)
+	if !ok || text == "" {
+		return 0, fmt.Errorf("expected a duration such as 24h or 7d")
+	}
+	if text == "0" {
+		return 0, nil
+	}
+
+	var duration time.Duration
+	if days, found := strings.CutSuffix(text, "d"); found {
+		n, err := strconv.Atoi(days)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", text)
+		}
+		duration = time.Duration(n) * 24 * time.Hour
+	} else {
+		var err error
+		if duration, err = time.ParseDuration(text); err != nil {
+			return 0, fmt.Errorf("invalid duration %q", text)
+		}
+	}
+	if duration <= 0 {
+		return 0, fmt.Errorf("duration %q must be positive", text)
+	}
+	return duration.Milliseconds(), nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+)
+
+// maxFilledPoints bounds the buckets a filled query may return
+const maxFilledPoints = 11000
+
+// fills are the ways empty buckets of an aggregated query can be filled.
+// Buckets filled with null are represented by NaN until they are encoded.
+var fills = map[string]bool{"null": true, "zero": true, "previous": true, "linear": true}
+
+// validateQuery checks the options a range query adds to TS.RANGE
+func validateQuery(query TimeSeriesQuery) error {
+	if err := validateTransform(query.Transform); err != nil {
+		return err
+	}
+	aggregated := query.Aggregation != "" && query.BucketDuration > 0
+	if query.Align != "" {
+		if !aggregated {
+			return fmt.Errorf("align needs an aggregation and bucket_duration")
+		}
+		switch query.Align {
+		case "start", "end", "-", "+":
+		default:
+			if _, err := strconv.ParseInt(query.Align, 10, 64); err != nil {
+				return fmt.Errorf("invalid align %q, expected start, end or a timestamp", query.Align)
+			}
+		}
+	}
+	if query.Fill != "" {
+		if !fills[query.Fill] {
+			return fmt.Errorf("unknown fill %q, expected null, zero, previous or linear", query.Fill)
+		}
+		if !aggregated {
+			return fmt.Errorf("fill needs an aggregation and bucket_duration")
+		}
+		end := min(query.EndTime, time.Now().UnixMilli())
+		if (end-query.StartTime)/query.BucketDuration > maxFilledPoints {
+			return fmt.Errorf("fill would return more than %d buckets", maxFilledPoints)
+		}
+	}
+	return nil
+}
+
+// alignment returns the timestamp a query's buckets are aligned to, 0 (the
+// TS.RANGE default) unless the query sets align
+func alignment(query TimeSeriesQuery) int64 {
+	switch query.Align {
+	case "start", "-":
+		return query.StartTime
+	case "end", "+":
+		return query.EndTime
+	}
+	align, _ := strconv.ParseInt(query.Align, 10, 64)
+	return align
+}
+
+// bucketStart returns the start of the bucket containing t, for buckets of
+// size aligned to align
+func bucketStart(t, align, size int64) int64 {
+	offset := (t - align) % size
+	if offset < 0 {
+		offset += size
+	}
+	return t - offset
+}
+
+// fillPoints returns a point for every bucket from the one containing start
+// to the one containing end, or now if that is earlier, taking the
+// aggregated points where there are some and filling the other buckets
+func fillPoints(points []DataPoint, fill string, start, end, align, size int64) []DataPoint {
+	end = min(end, time.Now().UnixMilli())
+	values := make(map[int64]float64, len(points))
+	for _, point := range points {
+		values[point.Timestamp] = point.Value
+	}
+
+	var filled []DataPoint
+	for t := bucketStart(start, align, size); t <= end; t += size {
+		value, ok := values[t]
+		if !ok {
+			value = math.NaN()
+			if fill == "zero" {
+				value = 0
+			}
+		}
+		filled = append(filled, DataPoint{Timestamp: t, Value: value})
+	}
+
+	switch fill {
+	case "previous":
+		// Buckets before the first point stay null
+		for i := 1; i < len(filled); i++ {
+			if _, ok := values[filled[i].Timestamp]; !ok {
+				filled[i].Value = filled[i-1].Value
+			}
+		}
+	case "linear":
+		// Buckets before the first point and after the last stay null
+		previous := -1
+		for i := range filled {
+			if _, ok := values[filled[i].Timestamp]; !ok {
+				continue
+			}
+			if previous >= 0 {
+				from, to := filled[previous], filled[i]
+				for j := previous + 1; j < i; j++ {
+					fraction := float64(filled[j].Timestamp-from.Timestamp) / float64(to.Timestamp-from.Timestamp)
+					filled[j].Value = from.Value + fraction*(to.Value-from.Value)
+				}
+			}
+			previous = i
+		}
+	}
+	if filled == nil {
+		filled = []DataPoint{}
+	}
+	return filled
+}
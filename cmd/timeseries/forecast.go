@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+)
+
+// maxForecastPoints bounds the points a forecast projects
+const maxForecastPoints = 1000
+
+// errShortHistory is returned when a series has too little history for the
+// forecast asked for
+var errShortHistory = errors.New("not enough history")
+
+// ForecastQuery asks for a series to be projected horizon ahead from its
+// history, averaged (or aggregated otherwise) into buckets of step
+type ForecastQuery struct {
+	Tenant      string
+	Key         string
+	Method      string
+	Aggregation string
+	Step        time.Duration
+	History     time.Duration
+	Horizon     time.Duration
+	// Season and the smoothing factors are used by holt-winters only
+	Season             time.Duration
+	Alpha, Beta, Gamma float64
+}
+
+// Forecast is a projection of a series
+type Forecast struct {
+	Key      string      `json:"key"`
+	Method   string      `json:"method"`
+	StepMs   int64       `json:"step_ms"`
+	History  []DataPoint `json:"history"`
+	Forecast []DataPoint `json:"forecast"`
+}
+
+// parseForecastQuery reads a forecast query from the request parameters
+func parseForecastQuery(r *http.Request) (ForecastQuery, error) {
+	params := r.URL.Query()
+	query := ForecastQuery{
+		Tenant:      params.Get("tenant"),
+		Key:         params.Get("key"),
+		Method:      params.Get("method"),
+		Aggregation: params.Get("aggregation"),
+		Step:        time.Hour,
+		History:     7 * 24 * time.Hour,
+		Season:      24 * time.Hour,
+		Alpha:       0.5,
+		Beta:        0.1,
+		Gamma:       0.3,
+	}
+	if query.Tenant != "" && !capture.ValidTenant(query.Tenant) {
+		return query, fmt.Errorf("invalid tenant")
+	}
+	if query.Key == "" {
+		return query, fmt.Errorf("missing key parameter")
+	}
+	if query.Method == "" {
+		query.Method = "linear"
+	}
+	if query.Method != "linear" && query.Method != "holt-winters" {
+		return query, fmt.Errorf("unknown method %q, expected linear or holt-winters", query.Method)
+	}
+	if query.Aggregation == "" {
+		query.Aggregation = "avg"
+	}
+	if !alertAggregations[query.Aggregation] {
+		return query, fmt.Errorf("unknown aggregation %q", query.Aggregation)
+	}
+
+	durations := []struct {
+		name  string
+		value *time.Duration
+	}{
+		{"horizon", &query.Horizon},
+		{"step", &query.Step},
+		{"history", &query.History},
+		{"season", &query.Season},
+	}
+	for _, d := range durations {
+		text := params.Get(d.name)
+		if text == "" {
+			continue
+		}
+		value, err := parsePromDuration(text)
+		if err != nil || value < time.Second {
+			return query, fmt.Errorf("invalid %s %q", d.name, text)
+		}
+		*d.value = value
+	}
+	if query.Horizon == 0 {
+		return query, fmt.Errorf("missing horizon parameter")
+	}
+	if query.Horizon < query.Step || query.Horizon/query.Step > maxForecastPoints {
+		return query, fmt.Errorf("horizon must be between one and %d steps", maxForecastPoints)
+	}
+	if query.Method == "holt-winters" && query.Season/query.Step < 2 {
+		return query, fmt.Errorf("season must span at least two steps")
+	}
+
+	factors := []struct {
+		name  string
+		value *float64
+	}{
+		{"alpha", &query.Alpha},
+		{"beta", &query.Beta},
+		{"gamma", &query.Gamma},
+	}
+	for _, f := range factors {
+		text := params.Get(f.name)
+		if text == "" {
+			continue
+		}
+		value, err := strconv.ParseFloat(text, 64)
+		if err != nil || value <= 0 || value >= 1 {
+			return query, fmt.Errorf("invalid %s %q, expected a number between 0 and 1", f.name, text)
+		}
+		*f.value = value
+	}
+	return query, nil
+}
+
+// Forecast projects a series from its bucketed history
+func (ts *RedisTimeSeriesService) Forecast(ctx context.Context, query ForecastQuery) (*Forecast, error) {
+	step := query.Step.Milliseconds()
+	now := time.Now().UnixMilli()
+	response, err := ts.QueryRange(ctx, TimeSeriesQuery{
+		Tenant:         query.Tenant,
+		Key:            query.Key,
+		StartTime:      now - query.History.Milliseconds(),
+		EndTime:        now,
+		Aggregation:    query.Aggregation,
+		BucketDuration: step,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	history := response.Data
+	if len(history) < 2 {
+		return nil, fmt.Errorf("%w to forecast %s", errShortHistory, query.Key)
+	}
+	points := int(query.Horizon / query.Step)
+	last := history[len(history)-1].Timestamp
+
+	var values []float64
+	switch query.Method {
+	case "holt-winters":
+		values, err = holtWinters(fillGaps(history, step), int(query.Season/query.Step),
+			query.Alpha, query.Beta, query.Gamma, points)
+	default:
+		values = linearForecast(history, last, step, points)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	forecast := &Forecast{Key: query.Key, Method: query.Method, StepMs: step, History: history}
+	for i, value := range values {
+		forecast.Forecast = append(forecast.Forecast, DataPoint{Timestamp: last + int64(i+1)*step, Value: value})
+	}
+	return forecast, nil
+}
+
+// linearForecast fits a least-squares line to history and extends it by
+// points steps after last
+func linearForecast(history []DataPoint, last, step int64, points int) []float64 {
+	// Timestamps relative to the first sample keep the sums small
+	origin := history[0].Timestamp
+	var sumX, sumY, sumXX, sumXY float64
+	for _, point := range history {
+		x := float64(point.Timestamp - origin)
+		sumX += x
+		sumY += point.Value
+		sumXX += x * x
+		sumXY += x * point.Value
+	}
+	n := float64(len(history))
+	slope := 0.0
+	if denominator := n*sumXX - sumX*sumX; denominator != 0 {
+		slope = (n*sumXY - sumX*sumY) / denominator
+	}
+	intercept := (sumY - slope*sumX) / n
+
+	values := make([]float64, points)
+	for i := range values {
+		x := float64(last + int64(i+1)*step - origin)
+		values[i] = intercept + slope*x
+	}
+	return values
+}
+
+// fillGaps returns the values of history at every step from its first to
+// its last bucket, carrying the previous value over buckets without samples
+func fillGaps(history []DataPoint, step int64) []float64 {
+	first, last := history[0].Timestamp, history[len(history)-1].Timestamp
+	values := make([]float64, 0, (last-first)/step+1)
+	i := 0
+	for t := first; t <= last; t += step {
+		for i+1 < len(history) && history[i+1].Timestamp <= t {
+			i++
+		}
+		values = append(values, history[i].Value)
+	}
+	return values
+}
+
+// holtWinters projects values points steps ahead with additive triple
+// exponential smoothing, for series that repeat every season steps
+func holtWinters(values []float64, season int, alpha, beta, gamma float64, points int) ([]float64, error) {
+	if season < 2 {
+		return nil, fmt.Errorf("season must span at least two steps")
+	}
+	if len(values) < 2*season {
+		return nil, fmt.Errorf("%w: holt-winters needs two seasons, have %d of %d steps", errShortHistory, len(values), 2*season)
+	}
+
+	// Start from the first season's mean, the change between the first two
+	// seasons' means and each step's offset from the first mean
+	var first, second float64
+	for i := 0; i < season; i++ {
+		first += values[i]
+		second += values[season+i]
+	}
+	first /= float64(season)
+	second /= float64(season)
+	level, trend := first, (second-first)/float64(season)
+	seasonal := make([]float64, season)
+	for i := range seasonal {
+		seasonal[i] = values[i] - first
+	}
+
+	for t, value := range values {
+		previous := level
+		level = alpha*(value-seasonal[t%season]) + (1-alpha)*(level+trend)
+		trend = beta*(level-previous) + (1-beta)*trend
+		seasonal[t%season] = gamma*(value-level) + (1-gamma)*seasonal[t%season]
+	}
+
+	forecast := make([]float64, points)
+	for h := range forecast {
+		forecast[h] = level + float64(h+1)*trend + seasonal[(len(values)+h)%season]
+	}
+	return forecast, nil
+}
+
+// forecastHandler serves GET /forecast?key=&horizon=, projecting a series
+// for capacity and budget planning. method is linear (the default) or
+// holt-winters, fitted to history (default 7d) bucketed by step (default 1h);
+// holt-winters assumes the series repeats every season (default 1d).
+func (ts *RedisTimeSeriesService) forecastHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	query, err := parseForecastQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	forecast, err := ts.Forecast(r.Context(), query)
+	if errors.Is(err, errShortHistory) {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to forecast: %v", err), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(forecast)
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+)
+
+// importBatchSize is how many imported data points are added per TS.MADD
+const importBatchSize = 1000
+
+// maxImportErrors bounds the errors an import reports individually; later
+// ones are only counted
+const maxImportErrors = 100
+
+// ImportProgress reports how far an import has got. One is written after
+// each batch and a final one with Done set.
+type ImportProgress struct {
+	Lines  int           `json:"lines"`
+	Added  int           `json:"added"`
+	Failed int           `json:"failed"`
+	Errors []ImportError `json:"errors,omitempty"`
+	Done   bool          `json:"done"`
+}
+
+// ImportError reports a line that was not imported
+type ImportError struct {
+	Line  int    `json:"line"`
+	Key   string `json:"key,omitempty"`
+	Error string `json:"error"`
+}
+
+// importReader reads data points from an import body one line at a time
+type importReader interface {
+	// next returns the next data point and its line number, io.EOF at the
+	// end, a lineError for a line that cannot be parsed, or another error
+	// when the rest of the body cannot be read
+	next() (TimeSeriesMetric, int, error)
+}
+
+// lineError reports a line of an import that cannot be parsed
+type lineError struct {
+	message string
+}
+
+func (e *lineError) Error() string {
+	return e.message
+}
+
+// ndjsonImport reads one TimeSeriesMetric JSON object per line
+type ndjsonImport struct {
+	scanner *bufio.Scanner
+	line    int
+}
+
+func (n *ndjsonImport) next() (TimeSeriesMetric, int, error) {
+	for n.scanner.Scan() {
+		n.line++
+		text := strings.TrimSpace(n.scanner.Text())
+		if text == "" {
+			continue
+		}
+		var metric TimeSeriesMetric
+		if err := json.Unmarshal([]byte(text), &metric); err != nil {
+			return metric, n.line, &lineError{fmt.Sprintf("invalid JSON: %v", err)}
+		}
+		return metric, n.line, nil
+	}
+	if err := n.scanner.Err(); err != nil {
+		return TimeSeriesMetric{}, n.line, err
+	}
+	return TimeSeriesMetric{}, n.line, io.EOF
+}
+
+// csvImport reads key,timestamp,value rows, skipping a header row
+type csvImport struct {
+	reader *csv.Reader
+}
+
+func (c *csvImport) next() (TimeSeriesMetric, int, error) {
+	for {
+		record, err := c.reader.Read()
+		if err == io.EOF {
+			return TimeSeriesMetric{}, 0, io.EOF
+		}
+		if parseErr, ok := err.(*csv.ParseError); ok {
+			return TimeSeriesMetric{}, parseErr.Line, err
+		}
+		if err != nil {
+			return TimeSeriesMetric{}, 0, err
+		}
+		line, _ := c.reader.FieldPos(0)
+		if line == 1 && strings.EqualFold(strings.TrimSpace(record[0]), "key") {
+			continue
+		}
+		if len(record) != 3 {
+			return TimeSeriesMetric{}, line, &lineError{"expected key,timestamp,value"}
+		}
+		metric := TimeSeriesMetric{Key: strings.TrimSpace(record[0])}
+		if metric.Timestamp, err = strconv.ParseInt(strings.TrimSpace(record[1]), 10, 64); err != nil {
+			return metric, line, &lineError{fmt.Sprintf("invalid timestamp %q", record[1])}
+		}
+		if metric.Value, err = strconv.ParseFloat(strings.TrimSpace(record[2]), 64); err != nil {
+			return metric, line, &lineError{fmt.Sprintf("invalid value %q", record[2])}
+		}
+		return metric, line, nil
+	}
+}
+
+// validateImport checks an imported data point. Historical points must
+// carry their timestamp.
+func validateImport(metric TimeSeriesMetric) error {
+	if metric.Key == "" || strings.ContainsAny(metric.Key, " \t\r\n") || strings.HasPrefix(metric.Key, "tenant:") {
+		return fmt.Errorf("key must be a series key without whitespace or a tenant prefix")
+	}
+	if metric.Timestamp <= 0 {
+		return fmt.Errorf("timestamp must be a positive Unix time in milliseconds")
+	}
+	return nil
+}
+
+// importHandler serves POST /import?tenant=&format=, adding historical data
+// points to existing series. The body is NDJSON TimeSeriesMetric objects, or
+// with format=csv (or a text/csv Content-Type) key,timestamp,value rows.
+// Progress is streamed back as NDJSON ImportProgress lines.
+func (ts *RedisTimeSeriesService) importHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !ts.authorizeAdmin(w, r) {
+		return
+	}
+
+	tenant := r.URL.Query().Get("tenant")
+	if tenant != "" && !capture.ValidTenant(tenant) {
+		http.Error(w, "Invalid tenant", http.StatusBadRequest)
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "ndjson"
+		if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+			format = "csv"
+		}
+	}
+	var reader importReader
+	switch format {
+	case "ndjson":
+		scanner := bufio.NewScanner(r.Body)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		reader = &ndjsonImport{scanner: scanner}
+	case "csv":
+		csvReader := csv.NewReader(r.Body)
+		csvReader.FieldsPerRecord = -1
+		csvReader.ReuseRecord = true
+		reader = &csvImport{reader: csvReader}
+	default:
+		http.Error(w, "Invalid format, expected ndjson or csv", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	progress := ImportProgress{Errors: []ImportError{}}
+	fail := func(line int, key string, err string) {
+		progress.Failed++
+		if len(progress.Errors) < maxImportErrors {
+			progress.Errors = append(progress.Errors, ImportError{Line: line, Key: key, Error: err})
+		}
+	}
+
+	ks := capture.TenantKeyspace(tenant)
+	batch := make([]TimeSeriesMetric, 0, importBatchSize)
+	lines := make([]int, 0, importBatchSize)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		result, err := ts.AddDataPoints(r.Context(), ks, batch)
+		if err != nil {
+			return err
+		}
+		progress.Added += result.Added
+		for _, e := range result.Errors {
+			fail(lines[e.Index], e.Key, e.Error)
+		}
+		batch, lines = batch[:0], lines[:0]
+
+		encoder.Encode(progress)
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	var failure error
+	for {
+		metric, line, err := reader.next()
+		if err == io.EOF {
+			break
+		}
+		if line > 0 {
+			progress.Lines = line
+		}
+		if _, ok := err.(*lineError); !ok && err != nil {
+			// The rest of the body cannot be read reliably
+			failure = err
+			break
+		}
+		if err == nil {
+			err = validateImport(metric)
+		}
+		if err != nil {
+			fail(line, metric.Key, err.Error())
+			continue
+		}
+
+		batch = append(batch, metric)
+		lines = append(lines, line)
+		if len(batch) == importBatchSize {
+			if failure = flush(); failure != nil {
+				break
+			}
+		}
+	}
+	if failure == nil {
+		failure = flush()
+	}
+	if progress.Added > 0 {
+		ts.queryCache.clear()
+	}
+
+	progress.Done = true
+	if failure != nil {
+		fail(progress.Lines, "", fmt.Sprintf("import stopped: %v", failure))
+	}
+	encoder.Encode(progress)
+}
@@ -4,25 +4,96 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"log"
+	"math"
+	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
 	"strconv"
+	"syscall"
 	"time"
 
-	"github.com/go-redis/redis/v8"
+	"github.com/ajeetraina/genai-app-demo/pkg/alerting"
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+	"github.com/ajeetraina/genai-app-demo/pkg/errorreport"
+	"github.com/ajeetraina/genai-app-demo/pkg/health"
+	"github.com/ajeetraina/genai-app-demo/pkg/logger"
+	"github.com/ajeetraina/genai-app-demo/pkg/metrics"
+	"github.com/ajeetraina/genai-app-demo/pkg/middleware"
+	"github.com/ajeetraina/genai-app-demo/pkg/otelmetrics"
+	"github.com/ajeetraina/genai-app-demo/pkg/redisconn"
+	"github.com/ajeetraina/genai-app-demo/pkg/tracing"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
 )
 
 // RedisTimeSeriesService provides time-series analytics using Redis TimeSeries
 type RedisTimeSeriesService struct {
 	redis *redis.Client
 	ctx   context.Context
+
+	// seriesRedis holds the series: redis itself, or seriesRing or
+	// seriesCluster when series are sharded across several Redis instances.
+	// Analytics data, alert rules and series definitions always stay in redis.
+	seriesRedis   redis.UniversalClient
+	seriesRing    *redis.Ring
+	seriesCluster *redis.ClusterClient
+
+	// initializedTenants records the tenants whose series have been created.
+	// It is only touched by the metrics collection goroutine.
+	initializedTenants map[string]bool
+
+	// redisMonitor tracks whether Redis is reachable. initializedGeneration
+	// is its generation when initializedTenants was last valid; a Redis
+	// restart may have lost the series, so they are created again.
+	redisMonitor          *redisconn.Monitor
+	initializedGeneration uint64
+
+	// collectRequests asks the metrics collection goroutine for an immediate
+	// collection, whose error is sent back on the given channel
+	collectRequests chan chan error
+
+	// pushToken is the bearer token required to push data points; pushing is
+	// disabled while it is unset
+	pushToken string
+
+	// queryCache, when set, holds recent range query results
+	queryCache *queryCache
+
+	// cardinality, when set, limits the series pushed and remote-written
+	cardinality *cardinalityLimits
+
+	// remoteWriteMatch, when set, selects the metric names stored from
+	// Prometheus remote writes
+	remoteWriteMatch *regexp.Regexp
+
+	// alerts evaluates the series alert rules after each collection.
+	// alertRulesByName holds the rules it last loaded; like
+	// initializedTenants it is only touched by the metrics collection
+	// goroutine.
+	alerts           *alerting.Evaluator
+	alertRulesByName map[string]SeriesAlertRule
+
+	// adminToken is the bearer token required to change alert rules and the
+	// series config; those endpoints are disabled while it is unset
+	adminToken string
+
+	// series are the built-in series with any overrides and additions from
+	// the series config file
+	series []SeriesDefinition
+
+	// anomalies flags spikes in the sampled metrics when set. Like
+	// initializedTenants it is only touched by the metrics collection goroutine.
+	anomalies *AnomalyDetector
 	
 	// Prometheus metrics
 	timeSeriesOperations *prometheus.CounterVec
 	timeSeriesLatency    *prometheus.HistogramVec
+	anomaliesDetected    *prometheus.CounterVec
+	remoteWriteSamples   *prometheus.CounterVec
 }
 
 // TimeSeriesMetric represents a time-series data point
@@ -35,11 +106,15 @@ type TimeSeriesMetric struct {
 
 // TimeSeriesQuery represents a query for time-series data
 type TimeSeriesQuery struct {
+	Tenant    string `json:"tenant,omitempty"`
 	Key       string `json:"key"`
 	StartTime int64  `json:"start_time"`
 	EndTime   int64  `json:"end_time"`
 	Aggregation string `json:"aggregation,omitempty"` // avg, sum, min, max, count
 	BucketDuration int64 `json:"bucket_duration,omitempty"` // in milliseconds
+	Transform string `json:"transform,omitempty"` // rate, delta, cumsum
+	Fill string `json:"fill,omitempty"` // null, zero, previous, linear
+	Align string `json:"align,omitempty"` // start, end or a timestamp
 }
 
 // TimeSeriesResponse represents the response for time-series queries
@@ -54,18 +129,30 @@ type DataPoint struct {
 	Value     float64 `json:"value"`
 }
 
-// NewRedisTimeSeriesService creates a new time-series service
-func NewRedisTimeSeriesService(redisAddr, redisPassword string, redisDB int) *RedisTimeSeriesService {
-	rdb := redis.NewClient(&redis.Options{
-		Addr:     redisAddr,
-		Password: redisPassword,
-		DB:       redisDB,
-	})
+// MarshalJSON encodes NaN, which stands for a missing value, as null
+func (p DataPoint) MarshalJSON() ([]byte, error) {
+	if math.IsNaN(p.Value) {
+		return []byte(fmt.Sprintf(`{"timestamp":%d,"value":null}`, p.Timestamp)), nil
+	}
+	type plain DataPoint
+	return json.Marshal(plain(p))
+}
+
+// NewRedisTimeSeriesService creates a new time-series service that maintains
+// the given series, waiting up to connectTimeout for Redis. If Redis is not up
+// by then the service starts degraded and creates the series once a health
+// check, every healthInterval, succeeds. Series are kept in the same Redis
+// unless shards are given.
+func NewRedisTimeSeriesService(options redisconn.Options, shards SeriesShards, series []SeriesDefinition, connectTimeout, healthInterval time.Duration) *RedisTimeSeriesService {
+	// The TS.* replies are parsed in their RESP2 shape
+	options.Protocol = 2
+	rdb := options.NewClient()
+	redisconn.Instrument(rdb, "default", prometheus.DefaultRegisterer)
 
 	ctx := context.Background()
-	_, err := rdb.Ping(ctx).Result()
+	err := redisconn.Wait(ctx, rdb, connectTimeout)
 	if err != nil {
-		log.Fatalf("Failed to connect to Redis: %v", err)
+		log.Warn().Err(err).Msg("Redis unavailable, starting degraded")
 	}
 
 	// Initialize Prometheus metrics
@@ -86,112 +173,76 @@ func NewRedisTimeSeriesService(redisAddr, redisPassword string, redisDB int) *Re
 		[]string{"operation"},
 	)
 
+	anomaliesDetected := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "redis_timeseries_anomalies_total",
+			Help: "Total number of usage anomalies detected",
+		},
+		[]string{"metric", "scope"},
+	)
+
+	remoteWriteSamples := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "redis_timeseries_remote_write_samples_total",
+			Help: "Total number of Prometheus remote-write samples by result",
+		},
+		[]string{"result"},
+	)
+
 	// Register metrics
-	prometheus.MustRegister(timeSeriesOperations, timeSeriesLatency)
+	prometheus.MustRegister(timeSeriesOperations, timeSeriesLatency, anomaliesDetected, remoteWriteSamples)
 
 	service := &RedisTimeSeriesService{
 		redis:                rdb,
+		seriesRedis:          rdb,
 		ctx:                  ctx,
+		initializedTenants:   make(map[string]bool),
+		series:               series,
 		timeSeriesOperations: timeSeriesOperations,
 		timeSeriesLatency:    timeSeriesLatency,
+		anomaliesDetected:    anomaliesDetected,
+		remoteWriteSamples:   remoteWriteSamples,
+		redisMonitor:         redisconn.NewMonitor(rdb, err == nil, healthInterval, prometheus.DefaultRegisterer),
+		collectRequests:      make(chan chan error),
+	}
+	switch {
+	case len(shards.Addrs) > 0:
+		service.seriesRing = newSeriesRing(shards.Addrs, options)
+		service.seriesRedis = service.seriesRing
+	case len(shards.ClusterAddrs) > 0:
+		service.seriesCluster = newSeriesCluster(shards.ClusterAddrs, options)
+		service.seriesRedis = service.seriesCluster
 	}
+	if service.seriesRedis != redis.UniversalClient(rdb) {
+		redisconn.Instrument(service.seriesRedis, "series", prometheus.DefaultRegisterer)
+	}
+	service.alerts = alerting.NewEvaluator(nil, nil, service.sampleAlertRule, prometheus.DefaultRegisterer)
 
-	// Initialize time-series keys
-	service.initializeTimeSeries()
+	// Initialize time-series keys, or leave it to the metrics collection
+	// once Redis is reachable
+	if err == nil {
+		service.initializeTimeSeries("")
+	}
 
 	return service
 }
 
-// initializeTimeSeries creates time-series keys with appropriate retention and labels
-func (ts *RedisTimeSeriesService) initializeTimeSeries() {
-	timeSeries := map[string]map[string]interface{}{
-		"metrics:tokens:input_rate": {
-			"RETENTION": 86400000, // 24 hours in milliseconds
-			"LABELS": map[string]string{
-				"metric_type": "token_rate",
-				"direction":   "input",
-			},
-		},
-		"metrics:tokens:output_rate": {
-			"RETENTION": 86400000,
-			"LABELS": map[string]string{
-				"metric_type": "token_rate",
-				"direction":   "output",
-			},
-		},
-		"metrics:users:active_5m": {
-			"RETENTION": 86400000,
-			"LABELS": map[string]string{
-				"metric_type": "user_activity",
-				"window":      "5m",
-			},
-		},
-		"metrics:users:active_1h": {
-			"RETENTION": 86400000,
-			"LABELS": map[string]string{
-				"metric_type": "user_activity",
-				"window":      "1h",
-			},
-		},
-		"metrics:response_time:p95": {
-			"RETENTION": 86400000,
-			"LABELS": map[string]string{
-				"metric_type": "response_time",
-				"percentile":  "95",
-			},
-		},
-		"metrics:response_time:p99": {
-			"RETENTION": 86400000,
-			"LABELS": map[string]string{
-				"metric_type": "response_time",
-				"percentile":  "99",
-			},
-		},
-		"metrics:error_rate": {
-			"RETENTION": 86400000,
-			"LABELS": map[string]string{
-				"metric_type": "error_rate",
-			},
-		},
-		"metrics:memory:redis_used": {
-			"RETENTION": 604800000, // 7 days
-			"LABELS": map[string]string{
-				"metric_type": "memory",
-				"component":   "redis",
-			},
-		},
-		"metrics:cpu:usage": {
-			"RETENTION": 604800000,
-			"LABELS": map[string]string{
-				"metric_type": "system",
-				"component":   "cpu",
-			},
-		},
+// initializeTimeSeries creates a tenant's built-in series and those added
+// through the series API, with their retention and labels
+func (ts *RedisTimeSeriesService) initializeTimeSeries(tenant string) {
+	definitions, err := ts.seriesDefinitions(ts.ctx)
+	if err != nil {
+		log.Warn().Err(err).Msg("Failed to load series definitions")
+		definitions = ts.series
 	}
-
-	for key, config := range timeSeries {
-		// Create time-series with labels and retention
-		args := []interface{}{"TS.CREATE", key}
-		
-		if retention, ok := config["RETENTION"]; ok {
-			args = append(args, "RETENTION", retention)
-		}
-		
-		if labels, ok := config["LABELS"].(map[string]string); ok {
-			args = append(args, "LABELS")
-			for labelKey, labelValue := range labels {
-				args = append(args, labelKey, labelValue)
-			}
-		}
-
-		// Execute create command (ignore if already exists)
-		err := ts.redis.Do(ts.ctx, args...).Err()
-		if err != nil && err.Error() != "TSDB: key already exists" {
-			log.Printf("Warning: Failed to create time-series %s: %v", key, err)
+	for _, definition := range definitions {
+		if err := ts.createSeries(ts.ctx, tenant, definition); err != nil {
+			log.Warn().Err(err).Str("tenant", tenant).Str("key", definition.Key).Msg("Failed to create time-series")
 		}
 	}
 
-	log.Println("Time-series initialization completed")
+	ts.initializedTenants[tenant] = true
+	log.Info().Str("tenant", tenant).Msg("Time-series initialization completed")
 }
 
 // AddDataPoint adds a data point to a time-series
@@ -206,7 +257,7 @@ func (ts *RedisTimeSeriesService) AddDataPoint(key string, timestamp int64, valu
 		timestamp = time.Now().UnixMilli()
 	}
 
-	err := ts.redis.Do(ts.ctx, "TS.ADD", key, timestamp, value).Err()
+	err := ts.seriesRedis.Do(ts.ctx, "TS.ADD", key, timestamp, value).Err()
 	
 	status := "success"
 	if err != nil {
@@ -217,21 +268,25 @@ func (ts *RedisTimeSeriesService) AddDataPoint(key string, timestamp int64, valu
 	return err
 }
 
-// QueryRange queries time-series data for a range
-func (ts *RedisTimeSeriesService) QueryRange(query TimeSeriesQuery) (*TimeSeriesResponse, error) {
+// queryRange queries time-series data for a range from Redis
+func (ts *RedisTimeSeriesService) queryRange(ctx context.Context, query TimeSeriesQuery) (*TimeSeriesResponse, error) {
 	start := time.Now()
 	defer func() {
 		ts.timeSeriesLatency.WithLabelValues("query_range").Observe(time.Since(start).Seconds())
 	}()
 
-	args := []interface{}{"TS.RANGE", query.Key, query.StartTime, query.EndTime}
+	key := capture.TenantKeyspace(query.Tenant).Key("%s", query.Key)
+	args := []interface{}{"TS.RANGE", key, query.StartTime, query.EndTime}
 
 	// Add aggregation if specified
 	if query.Aggregation != "" && query.BucketDuration > 0 {
+		if query.Align != "" {
+			args = append(args, "ALIGN", query.Align)
+		}
 		args = append(args, "AGGREGATION", query.Aggregation, query.BucketDuration)
 	}
 
-	result, err := ts.redis.Do(ts.ctx, args...).Result()
+	result, err := ts.seriesRedis.Do(ctx, args...).Result()
 	
 	status := "success"
 	if err != nil {
@@ -271,7 +326,7 @@ func (ts *RedisTimeSeriesService) QueryRange(query TimeSeriesQuery) (*TimeSeries
 }
 
 // QueryMultiRange queries multiple time-series
-func (ts *RedisTimeSeriesService) QueryMultiRange(queries []TimeSeriesQuery) (map[string]*TimeSeriesResponse, error) {
+func (ts *RedisTimeSeriesService) QueryMultiRange(ctx context.Context, queries []TimeSeriesQuery) (map[string]*TimeSeriesResponse, error) {
 	start := time.Now()
 	defer func() {
 		ts.timeSeriesLatency.WithLabelValues("query_multi_range").Observe(time.Since(start).Seconds())
@@ -280,7 +335,7 @@ func (ts *RedisTimeSeriesService) QueryMultiRange(queries []TimeSeriesQuery) (ma
 	results := make(map[string]*TimeSeriesResponse)
 	
 	for _, query := range queries {
-		response, err := ts.QueryRange(query)
+		response, err := ts.QueryRange(ctx, query)
 		if err != nil {
 			ts.timeSeriesOperations.WithLabelValues("query_multi_range", "error").Inc()
 			return nil, fmt.Errorf("failed to query %s: %v", query.Key, err)
@@ -293,13 +348,13 @@ func (ts *RedisTimeSeriesService) QueryMultiRange(queries []TimeSeriesQuery) (ma
 }
 
 // GetLatestValue gets the latest value for a time-series
-func (ts *RedisTimeSeriesService) GetLatestValue(key string) (*DataPoint, error) {
+func (ts *RedisTimeSeriesService) GetLatestValue(ctx context.Context, ks capture.Keyspace, key string) (*DataPoint, error) {
 	start := time.Now()
 	defer func() {
 		ts.timeSeriesLatency.WithLabelValues("get_latest").Observe(time.Since(start).Seconds())
 	}()
 
-	result, err := ts.redis.Do(ts.ctx, "TS.GET", key).Result()
+	result, err := ts.seriesRedis.Do(ctx, "TS.GET", ks.Key("%s", key)).Result()
 	
 	status := "success"
 	if err != nil {
@@ -328,46 +383,168 @@ func (ts *RedisTimeSeriesService) GetLatestValue(key string) (*DataPoint, error)
 	return nil, fmt.Errorf("invalid response format")
 }
 
-// UpdateMetricsFromRedis updates time-series from current Redis analytics data
+// UpdateMetricsFromRedis updates time-series from current Redis analytics
+// data for the default tenant and every tenant that has captured data
 func (ts *RedisTimeSeriesService) UpdateMetricsFromRedis() error {
-	timestamp := time.Now().UnixMilli()
+	if !ts.redisMonitor.Available() {
+		return nil
+	}
+	if generation := ts.redisMonitor.Generation(); generation != ts.initializedGeneration {
+		ts.initializedTenants = make(map[string]bool)
+		ts.initializedGeneration = generation
+	}
 
-	// Get active users
-	activeUsers5m, _ := ts.redis.SCard(ts.ctx, "users:active:5m").Result()
-	activeUsers1h, _ := ts.redis.SCard(ts.ctx, "users:active:1h").Result()
+	tenants, err := ts.redis.SMembers(ts.ctx, "tenants").Result()
+	if err != nil {
+		return fmt.Errorf("failed to list tenants: %v", err)
+	}
 
-	// Add to time-series
-	ts.AddDataPoint("metrics:users:active_5m", timestamp, float64(activeUsers5m))
-	ts.AddDataPoint("metrics:users:active_1h", timestamp, float64(activeUsers1h))
+	now := time.Now()
+	timestamp := now.UnixMilli()
+	for _, tenant := range append([]string{""}, tenants...) {
+		if tenant != "" && !capture.ValidTenant(tenant) {
+			continue
+		}
+		if !ts.initializedTenants[tenant] {
+			ts.initializeTimeSeries(tenant)
+		}
+		ts.updateTenantMetrics(capture.TenantKeyspace(tenant), timestamp)
+		ts.refreshCardinality(tenant)
+		if ts.anomalies != nil {
+			ts.detectAnomalies(tenant, now)
+		}
+	}
+	if ts.anomalies != nil {
+		ts.anomalies.prune(now)
+	}
+
+	// Evaluate the alert rules against the series just written
+	return ts.evaluateAlerts(now)
+}
 
-	// Get token rates (approximate from recent data)
-	inputTokens, _ := ts.redis.Get(ts.ctx, "tokens:input:count").Float64()
-	outputTokens, _ := ts.redis.Get(ts.ctx, "tokens:output:count").Float64()
+// updateTenantMetrics records the current analytics counters of a tenant
+func (ts *RedisTimeSeriesService) updateTenantMetrics(ks capture.Keyspace, timestamp int64) {
+	// Read the current analytics counters in one round trip
+	pipe := ts.redis.Pipeline()
+	activeUsers5mCmd := pipe.SCard(ts.ctx, ks.Key("users:active:5m"))
+	activeUsers1hCmd := pipe.SCard(ts.ctx, ks.Key("users:active:1h"))
+	// The error rate minutes start with the token rate minutes
+	minutes := capture.ErrorRateMinutes(time.Now())
+	minuteCmds := make([]*redis.MapStringStringCmd, len(minutes))
+	for i, minute := range minutes {
+		minuteCmds[i] = pipe.HGetAll(ts.ctx, capture.MinuteKey(ks, minute))
+	}
+	pipe.Exec(ts.ctx)
 
-	ts.AddDataPoint("metrics:tokens:input_rate", timestamp, inputTokens)
-	ts.AddDataPoint("metrics:tokens:output_rate", timestamp, outputTokens)
+	// Get active users
+	activeUsers5m := activeUsers5mCmd.Val()
+	activeUsers1h := activeUsers1hCmd.Val()
 
-	// Get error rate
-	errorCount, _ := ts.redis.Get(ts.ctx, "errors:total:count").Float64()
-	ts.AddDataPoint("metrics:error_rate", timestamp, errorCount)
+	// Add to time-series
+	ts.AddDataPoint(ks.Key("metrics:users:active_5m"), timestamp, float64(activeUsers5m))
+	ts.AddDataPoint(ks.Key("metrics:users:active_1h"), timestamp, float64(activeUsers1h))
 
-	return nil
+	// Token rates in tokens per minute, averaged over the last few complete minutes
+	buckets := make([]map[string]string, len(minuteCmds))
+	for i, cmd := range minuteCmds {
+		buckets[i] = cmd.Val()
+	}
+	rates, _ := capture.SumTokenRates(buckets[:capture.TokenRateMinutes])
+	ts.AddDataPoint(ks.Key("metrics:tokens:input_rate"), timestamp, rates.InputPerMinute)
+	ts.AddDataPoint(ks.Key("metrics:tokens:output_rate"), timestamp, rates.OutputPerMinute)
+
+	// Share of requests that failed over the last minute, five minutes and hour
+	errorRates := capture.SumErrorRates(buckets)
+	ts.AddDataPoint(ks.Key("metrics:error_rate"), timestamp, errorRates["5m"].Rate)
+	ts.AddDataPoint(ks.Key("metrics:error_rate:1m"), timestamp, errorRates["1m"].Rate)
+	ts.AddDataPoint(ks.Key("metrics:error_rate:1h"), timestamp, errorRates["1h"].Rate)
+
+	// Response time percentiles over the last few complete minutes
+	if err := ts.recordResponseTimePercentiles(ks, time.Now(), timestamp); err != nil {
+		log.Error().Err(err).Msg("Error computing response time percentiles")
+	}
 }
 
-// StartMetricsCollection starts background metrics collection
-func (ts *RedisTimeSeriesService) StartMetricsCollection() {
-	ticker := time.NewTicker(30 * time.Second) // Collect every 30 seconds
+// StartMetricsCollection starts background metrics collection every
+// interval, varied randomly by up to jitter (a fraction of the interval) so
+// replicas started together do not all query Redis at once. Collections
+// requested through /collect run on the same goroutine, between the
+// scheduled ones.
+func (ts *RedisTimeSeriesService) StartMetricsCollection(interval time.Duration, jitter float64) {
+	timer := time.NewTimer(jitteredInterval(interval, jitter))
 	go func() {
-		for range ticker.C {
-			if err := ts.UpdateMetricsFromRedis(); err != nil {
-				log.Printf("Error updating time-series metrics: %v", err)
+		for {
+			select {
+			case <-timer.C:
+				if err := ts.UpdateMetricsFromRedis(); err != nil {
+					log.Error().Err(err).Msg("Error updating time-series metrics")
+				}
+				timer.Reset(jitteredInterval(interval, jitter))
+			case reply := <-ts.collectRequests:
+				reply <- ts.UpdateMetricsFromRedis()
 			}
 		}
 	}()
 }
 
+// jitteredInterval returns interval shifted randomly by up to jitter times
+// interval either way
+func jitteredInterval(interval time.Duration, jitter float64) time.Duration {
+	spread := int64(float64(interval) * jitter)
+	if spread <= 0 {
+		return interval
+	}
+	return interval + time.Duration(rand.Int63n(2*spread+1)-spread)
+}
+
+// Collect runs a metrics collection immediately on the collection goroutine
+// and waits for it to finish
+func (ts *RedisTimeSeriesService) Collect(ctx context.Context) error {
+	reply := make(chan error, 1)
+	select {
+	case ts.collectRequests <- reply:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-reply:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
 // HTTP Handlers
 
+// collectHandler serves POST /collect, collecting metrics immediately rather
+// than waiting for the next scheduled collection
+func (ts *RedisTimeSeriesService) collectHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	start := time.Now()
+	if err := ts.Collect(r.Context()); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to collect metrics: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":      "collected",
+		"duration_ms": time.Since(start).Milliseconds(),
+	})
+}
+
 func (ts *RedisTimeSeriesService) queryHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.Header().Set("Access-Control-Allow-Origin", "*")
@@ -384,8 +561,12 @@ func (ts *RedisTimeSeriesService) queryHandler(w http.ResponseWriter, r *http.Re
 		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
 		return
 	}
+	if err := validateQuery(query); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	response, err := ts.QueryRange(query)
+	response, err := ts.QueryRange(r.Context(), query)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Query failed: %v", err), http.StatusInternalServerError)
 		return
@@ -410,8 +591,14 @@ func (ts *RedisTimeSeriesService) multiQueryHandler(w http.ResponseWriter, r *ht
 		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
 		return
 	}
+	for _, query := range queries {
+		if err := validateQuery(query); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
 
-	responses, err := ts.QueryMultiRange(queries)
+	responses, err := ts.QueryMultiRange(r.Context(), queries)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Multi-query failed: %v", err), http.StatusInternalServerError)
 		return
@@ -430,7 +617,13 @@ func (ts *RedisTimeSeriesService) latestHandler(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	dataPoint, err := ts.GetLatestValue(key)
+	tenant := r.URL.Query().Get("tenant")
+	if tenant != "" && !capture.ValidTenant(tenant) {
+		http.Error(w, "Invalid tenant", http.StatusBadRequest)
+		return
+	}
+
+	dataPoint, err := ts.GetLatestValue(r.Context(), capture.TenantKeyspace(tenant), key)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to get latest value: %v", err), http.StatusInternalServerError)
 		return
@@ -442,41 +635,263 @@ func (ts *RedisTimeSeriesService) latestHandler(w http.ResponseWriter, r *http.R
 func (ts *RedisTimeSeriesService) healthHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
+	if !ts.redisMonitor.Available() {
+		json.NewEncoder(w).Encode(map[string]string{"status": "degraded", "service": "redis-timeseries", "redis": "unavailable"})
+		return
+	}
 	json.NewEncoder(w).Encode(map[string]string{"status": "ok", "service": "redis-timeseries"})
 }
 
+// pingSeries checks every Redis instance holding sharded series
+func (ts *RedisTimeSeriesService) pingSeries(ctx context.Context) error {
+	ping := func(ctx context.Context, shard *redis.Client) error {
+		return shard.Ping(ctx).Err()
+	}
+	switch {
+	case ts.seriesRing != nil:
+		return ts.seriesRing.ForEachShard(ctx, ping)
+	case ts.seriesCluster != nil:
+		return ts.seriesCluster.ForEachShard(ctx, ping)
+	}
+	return nil
+}
+
+// requireRedis answers requests with 503 Service Unavailable while Redis is
+// unreachable, rather than letting each handler fail on it
+func (ts *RedisTimeSeriesService) requireRedis(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ts.redisMonitor.Available() {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Retry-After", "5")
+			http.Error(w, "Time-series unavailable: Redis is unreachable", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func main() {
+	logger.InitFromEnv("redis-timeseries-service")
+
 	// Get configuration from environment
-	redisAddr := getEnvOrDefault("REDIS_ADDR", "localhost:6379")
-	redisPassword := getEnvOrDefault("REDIS_PASSWORD", "")
-	redisDB, _ := strconv.Atoi(getEnvOrDefault("REDIS_DB", "0"))
+	redisOptions, err := redisconn.OptionsFromEnv()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid Redis configuration")
+	}
 	port := getEnvOrDefault("TIMESERIES_PORT", "8082")
 
-	log.Printf("Starting Redis TimeSeries Service on port %s", port)
-	log.Printf("Connecting to Redis at %s", redisAddr)
+	log.Info().Str("port", port).Stringer("redis", redisOptions).Msg("Starting Redis TimeSeries Service")
+
+	// Series retentions and labels can be tuned per environment in a config file
+	series := builtinSeries
+	if path := getEnvOrDefault("TIMESERIES_CONFIG", ""); path != "" {
+		var err error
+		if series, err = LoadSeriesConfig(path); err != nil {
+			log.Fatal().Err(err).Str("path", path).Msg("Failed to load series config")
+		}
+		log.Info().Int("series", len(series)).Str("path", path).Msg("Loaded series definitions")
+	}
+
+	// Create time-series service, which starts degraded if Redis is not up in time
+	connectTimeout, _ := strconv.Atoi(getEnvOrDefault("REDIS_CONNECT_TIMEOUT_SECONDS", "30"))
+	healthInterval, _ := strconv.Atoi(getEnvOrDefault("REDIS_HEALTH_CHECK_INTERVAL_SECONDS", "5"))
+	// Series can be spread over several Redis instances, or a Redis Cluster,
+	// for high cardinality
+	shards := SeriesShards{
+		Addrs:        parseShardAddrs(getEnvOrDefault("TIMESERIES_REDIS_SHARDS", "")),
+		ClusterAddrs: parseShardAddrs(getEnvOrDefault("TIMESERIES_REDIS_CLUSTER_ADDRS", "")),
+	}
+	switch {
+	case len(shards.Addrs) > 0 && len(shards.ClusterAddrs) > 0:
+		log.Fatal().Msg("Set only one of TIMESERIES_REDIS_SHARDS and TIMESERIES_REDIS_CLUSTER_ADDRS")
+	case len(shards.Addrs) > 0:
+		log.Info().Strs("shards", shards.Addrs).Msg("Sharding series across Redis instances")
+	case len(shards.ClusterAddrs) > 0:
+		log.Info().Strs("cluster", shards.ClusterAddrs).Msg("Keeping series in a Redis Cluster")
+	}
+	service := NewRedisTimeSeriesService(redisOptions, shards, series,
+		time.Duration(connectTimeout)*time.Second, time.Duration(healthInterval)*time.Second)
+
+	// Flag spikes in token usage, error rate and latency per tenant, model and user
+	if getEnvOrDefault("ANOMALY_DETECTION_ENABLED", "true") == "true" {
+		alpha, _ := strconv.ParseFloat(getEnvOrDefault("ANOMALY_EWMA_ALPHA", "0.1"), 64)
+		if alpha <= 0 || alpha > 1 {
+			alpha = 0.1
+		}
+		threshold, _ := strconv.ParseFloat(getEnvOrDefault("ANOMALY_Z_THRESHOLD", "3"), 64)
+		if threshold <= 0 {
+			threshold = 3
+		}
+		warmup, _ := strconv.Atoi(getEnvOrDefault("ANOMALY_WARMUP_SAMPLES", "10"))
+		service.anomalies = NewAnomalyDetector(alpha, threshold, warmup)
+	}
 
-	// Create time-series service
-	service := NewRedisTimeSeriesService(redisAddr, redisPassword, redisDB)
+	service.pushToken = getEnvOrDefault("TIMESERIES_PUSH_TOKEN", "")
+	service.adminToken = getEnvOrDefault("TIMESERIES_ADMIN_TOKEN", "")
+	if service.pushToken == "" {
+		log.Warn().Msg("TIMESERIES_PUSH_TOKEN is not set, pushes and remote writes are disabled")
+	}
+	if service.adminToken == "" {
+		log.Warn().Msg("TIMESERIES_ADMIN_TOKEN is not set, alert rule, series and import changes are disabled")
+	}
+	service.queryCache = newQueryCache(parseQueryCacheTTL())
+	service.cardinality = newCardinalityLimits(parseCardinalityLimits())
+	if pattern := getEnvOrDefault("TIMESERIES_REMOTE_WRITE_MATCH", ""); pattern != "" {
+		match, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid TIMESERIES_REMOTE_WRITE_MATCH")
+		}
+		service.remoteWriteMatch = match
+	}
 
 	// Start background metrics collection
-	service.StartMetricsCollection()
+	collectInterval, _ := strconv.Atoi(getEnvOrDefault("TIMESERIES_COLLECT_INTERVAL_SECONDS", "30"))
+	if collectInterval <= 0 {
+		collectInterval = 30
+	}
+	collectJitter, _ := strconv.ParseFloat(getEnvOrDefault("TIMESERIES_COLLECT_JITTER", "0.1"), 64)
+	if collectJitter < 0 || collectJitter >= 1 {
+		collectJitter = 0.1
+	}
+	service.StartMetricsCollection(time.Duration(collectInterval)*time.Second, collectJitter)
+
+	// Trace requests and the Redis calls they make, continuing the trace of
+	// callers that send a traceparent header
+	var tracingCleanup func()
+	if enabled, _ := strconv.ParseBool(getEnvOrDefault("TRACING_ENABLED", "false")); enabled {
+		tracingConfig, err := tracing.ConfigFromEnv("jaeger:4318")
+		if err == nil {
+			tracingCleanup, err = tracing.SetupTracing("redis-timeseries-service", tracingConfig)
+		}
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to set up tracing")
+		} else {
+			tracing.InstrumentRedis(service.redis)
+			if service.seriesRedis != redis.UniversalClient(service.redis) {
+				tracing.InstrumentRedis(service.seriesRedis)
+			}
+			log.Info().Str("protocol", tracingConfig.Protocol).Str("endpoint", tracingConfig.Endpoint).Msg("Tracing enabled")
+		}
+	}
+
+	// Go runtime and process metrics, to correlate latency incidents with
+	// GC pauses, scheduler latency, memory or file descriptor pressure
+	metrics.RegisterRuntimeCollectors(prometheus.DefaultRegisterer)
+
+	// Push the Prometheus metrics to an OpenTelemetry Collector as well, when
+	// OTEL_METRICS_EXPORTER=otlp
+	metricsCleanup, err := otelmetrics.SetupFromEnv("redis-timeseries-service", prometheus.DefaultGatherer)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to set up metrics export")
+	}
+
+	// Report panics and 5xx responses to a Sentry-compatible DSN, when
+	// SENTRY_DSN is set
+	reporter, err := errorreport.NewFromEnv("redis-timeseries-service")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid error reporting settings")
+	}
 
 	// Setup HTTP routes
 	mux := http.NewServeMux()
 	mux.HandleFunc("/query", service.queryHandler)
+	mux.HandleFunc("/add", service.addHandler)
+	mux.HandleFunc("/add-batch", service.addBatchHandler)
+	mux.HandleFunc("/import", service.importHandler)
+	mux.HandleFunc("/api/v1/write", service.remoteWriteHandler)
+	mux.HandleFunc("/api/v1/query", service.promQueryHandler)
+	mux.HandleFunc("/api/v1/query_range", service.promQueryRangeHandler)
+	mux.HandleFunc("/api/v1/labels", service.promLabelsHandler)
+	mux.HandleFunc("/api/v1/label/{name}/values", service.promLabelValuesHandler)
+	mux.HandleFunc("/series", service.seriesHandler)
+	mux.HandleFunc("/series/trim", service.trimHandler)
+	mux.HandleFunc("GET /series/catalog", service.catalogHandler)
+	mux.HandleFunc("GET /series/{key}/info", service.seriesInfoHandler)
 	mux.HandleFunc("/multi-query", service.multiQueryHandler)
 	mux.HandleFunc("/latest", service.latestHandler)
-	mux.HandleFunc("/health", service.healthHandler)
-	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/forecast", service.forecastHandler)
+	mux.HandleFunc("GET /export/openmetrics", service.openMetricsHandler)
+	mux.HandleFunc("/anomalies", service.anomaliesHandler)
+	mux.HandleFunc("/collect", service.collectHandler)
+	mux.HandleFunc("/alerts", service.alertsHandler)
+	mux.HandleFunc("/alerts/rules", service.alertRulesHandler)
+
+	// Ready once Redis, and every instance of a sharded series store, answers
+	readiness := health.NewReadiness(2 * time.Second)
+	readiness.Add("redis", service.redisMonitor.Ping)
+	if service.seriesRedis != redis.UniversalClient(service.redis) {
+		readiness.Add("series_redis", service.pingSeries)
+	}
+
+	// Report the service's health to the backend's /api/v1/system/status
+	heartbeatInterval, err := strconv.Atoi(getEnvOrDefault("HEARTBEAT_INTERVAL_SECONDS", "10"))
+	if err != nil || heartbeatInterval <= 0 {
+		log.Fatal().Str("value", os.Getenv("HEARTBEAT_INTERVAL_SECONDS")).Msg("Invalid HEARTBEAT_INTERVAL_SECONDS")
+	}
+	heartbeat := health.StartHeartbeat(service.redis, "redis-timeseries-service", map[string]bool{
+		"tracing":           tracingCleanup != nil,
+		"error_reporting":   reporter != nil,
+		"anomaly_detection": service.anomalies != nil,
+		"sharded_series":    service.seriesRedis != redis.UniversalClient(service.redis),
+	}, readiness, time.Duration(heartbeatInterval)*time.Second)
+
+	// Log every API call, sampling the high-volume endpoints
+	accessLogConfig, err := middleware.AccessLogConfigFromEnv("/add=0.01,/add-batch=0.1,/api/v1/write=0.1,/latest=0.1")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid access log settings")
+	}
+
+	// Health and metrics stay up while Redis is unreachable
+	root := http.NewServeMux()
+	api := http.Handler(mux)
+	if reporter != nil {
+		api = middleware.ErrorReporting(reporter)(api)
+	}
+	handler := middleware.AccessLog(accessLogConfig)(service.requireRedis(api))
+	handler = middleware.RequestIDMiddleware(middleware.LoggingMiddleware(handler))
+	if tracingCleanup != nil {
+		handler = middleware.TracingMiddleware(handler)
+	}
+	root.Handle("/", handler)
+	root.HandleFunc("/health", service.healthHandler)
+	root.HandleFunc("/healthz", health.HandleLiveness())
+	root.HandleFunc("/readyz", health.HandleReadiness(readiness))
+	root.Handle("/metrics", promhttp.Handler())
 
 	// Start server
 	server := &http.Server{
 		Addr:    ":" + port,
-		Handler: mux,
+		Handler: root,
 	}
 
-	log.Printf("Redis TimeSeries Service running on :%s", port)
-	log.Fatal(server.ListenAndServe())
+	go func() {
+		log.Info().Str("port", port).Msg("Redis TimeSeries Service running")
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal().Err(err).Msg("Server failed")
+		}
+	}()
+
+	// Stop on SIGINT or SIGTERM, letting requests in flight finish and
+	// flushing their spans
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	log.Info().Msg("Shutting down...")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.Error().Err(err).Msg("Server forced to shutdown")
+	}
+	heartbeat.Close()
+	if reporter != nil {
+		reporter.Close(5 * time.Second)
+	}
+	if metricsCleanup != nil {
+		metricsCleanup()
+	}
+	if tracingCleanup != nil {
+		tracingCleanup()
+	}
 }
 
 func getEnvOrDefault(key, defaultValue string) string {
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+	"github.com/redis/go-redis/v9"
+)
+
+// exportPipelineSize bounds the series read per pipeline by the export
+const exportPipelineSize = 500
+
+// invalidMetricChars and invalidLabelChars match the characters Prometheus
+// does not allow in metric and label names
+var (
+	invalidMetricChars = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+	invalidLabelChars  = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+)
+
+// labelFilter is a RedisTimeSeries filter expression, such as
+// metric_type=token_rate, source!=prometheus, window=(1m,5m) or percentile=
+type labelFilter struct {
+	label  string
+	negate bool
+	values []string
+}
+
+// parseLabelFilters parses filter expressions, each possibly holding several
+// separated by spaces
+func parseLabelFilters(expressions []string) ([]labelFilter, error) {
+	var filters []labelFilter
+	for _, expression := range expressions {
+		for _, text := range strings.Fields(expression) {
+			i := strings.IndexByte(text, '=')
+			if i <= 0 {
+				return nil, fmt.Errorf("invalid filter %q, expected label=value or label!=value", text)
+			}
+			filter := labelFilter{label: text[:i], values: []string{text[i+1:]}}
+			if strings.HasSuffix(filter.label, "!") {
+				filter.label, filter.negate = strings.TrimSuffix(filter.label, "!"), true
+			}
+			if value := filter.values[0]; strings.HasPrefix(value, "(") && strings.HasSuffix(value, ")") {
+				filter.values = strings.Split(value[1:len(value)-1], ",")
+			}
+			if filter.label == "" {
+				return nil, fmt.Errorf("invalid filter %q, missing label", text)
+			}
+			filters = append(filters, filter)
+		}
+	}
+	return filters, nil
+}
+
+// matches reports whether labels pass the filter. An empty value stands for
+// a missing label.
+func (f labelFilter) matches(labels map[string]string) bool {
+	value := labels[f.label]
+	for _, v := range f.values {
+		if value == v {
+			return !f.negate
+		}
+	}
+	return f.negate
+}
+
+// exportedSeries is the latest sample of a series, named for Prometheus
+type exportedSeries struct {
+	name   string
+	labels map[string]string
+	sample DataPoint
+}
+
+// ExportSeries reads the latest sample of each of a tenant's series whose
+// labels pass the filters. Series stored from Prometheus remote writes keep
+// their metric name; others are named by their key, with characters
+// Prometheus does not allow replaced by underscores.
+func (ts *RedisTimeSeriesService) ExportSeries(ctx context.Context, tenant string, filters []labelFilter) ([]exportedSeries, error) {
+	keys, err := ts.seriesKeys(ctx, tenant)
+	if err != nil {
+		return nil, err
+	}
+
+	ks := capture.TenantKeyspace(tenant)
+	var exported []exportedSeries
+	for start := 0; start < len(keys); start += exportPipelineSize {
+		chunk := keys[start:min(start+exportPipelineSize, len(keys))]
+		pipe := ts.seriesRedis.Pipeline()
+		infos := make([]*redis.Cmd, len(chunk))
+		latest := make([]*redis.Cmd, len(chunk))
+		for i, key := range chunk {
+			infos[i] = pipe.Do(ctx, "TS.INFO", ks.Key("%s", key))
+			latest[i] = pipe.Do(ctx, "TS.GET", ks.Key("%s", key))
+		}
+		if _, err := pipe.Exec(ctx); err != nil && !isRedisReplyError(err) {
+			return nil, err
+		}
+
+		for i, key := range chunk {
+			// Skip series deleted since the scan
+			if infos[i].Err() != nil || latest[i].Err() != nil {
+				continue
+			}
+			labels := parseTSInfo(key, infos[i].Val()).Labels
+			passes := true
+			for _, filter := range filters {
+				passes = passes && filter.matches(labels)
+			}
+			samples := parseTSSamples([]interface{}{latest[i].Val()})
+			if !passes || len(samples) == 0 {
+				continue
+			}
+
+			name := key
+			if labels["source"] == "prometheus" && labels["name"] != "" {
+				name = labels["name"]
+				delete(labels, "name")
+				delete(labels, "source")
+			}
+			delete(labels, "tenant")
+			name = invalidMetricChars.ReplaceAllString(name, "_")
+			if name[0] >= '0' && name[0] <= '9' {
+				name = "_" + name
+			}
+			exported = append(exported, exportedSeries{
+				name:   name,
+				labels: labels,
+				sample: samples[0],
+			})
+		}
+	}
+	sort.SliceStable(exported, func(i, j int) bool { return exported[i].name < exported[j].name })
+	return exported, nil
+}
+
+// escapeLabelValue escapes a label value for the text exposition formats
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// writeOpenMetrics renders series in the OpenMetrics text format. Their
+// meaning is not recorded with them, so every family has type unknown.
+func writeOpenMetrics(w *strings.Builder, series []exportedSeries) {
+	family := ""
+	for _, s := range series {
+		if s.name != family {
+			family = s.name
+			fmt.Fprintf(w, "# TYPE %s unknown\n", family)
+		}
+		names := make([]string, 0, len(s.labels))
+		for name := range s.labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		pairs := make([]string, 0, len(names))
+		for _, name := range names {
+			label := invalidLabelChars.ReplaceAllString(name, "_")
+			if label[0] >= '0' && label[0] <= '9' {
+				label = "_" + label
+			}
+			pairs = append(pairs, fmt.Sprintf(`%s="%s"`, label, escapeLabelValue(s.labels[name])))
+		}
+
+		w.WriteString(s.name)
+		if len(pairs) > 0 {
+			w.WriteString("{" + strings.Join(pairs, ",") + "}")
+		}
+		fmt.Fprintf(w, " %s %s\n", formatPromValue(s.sample.Value), formatPromValue(float64(s.sample.Timestamp)/1000))
+	}
+	w.WriteString("# EOF\n")
+}
+
+// openMetricsHandler serves GET /export/openmetrics?tenant=&filter=, the
+// latest sample of each stored series in the OpenMetrics text format, so
+// any Prometheus-compatible scraper can collect them
+func (ts *RedisTimeSeriesService) openMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	tenant := r.URL.Query().Get("tenant")
+	if tenant != "" && !capture.ValidTenant(tenant) {
+		http.Error(w, "Invalid tenant", http.StatusBadRequest)
+		return
+	}
+	filters, err := parseLabelFilters(r.URL.Query()["filter"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	series, err := ts.ExportSeries(r.Context(), tenant, filters)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to export series: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	var body strings.Builder
+	writeOpenMetrics(&body, series)
+	w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+	w.Write([]byte(body.String()))
+}
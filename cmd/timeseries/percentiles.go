@@ -0,0 +1,75 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+	"github.com/redis/go-redis/v9"
+)
+
+// responseTimeQuantiles are the quantiles written to the
+// metrics:response_time:p<percentile> series
+var responseTimeQuantiles = []struct {
+	key      string
+	quantile float64
+}{
+	{"metrics:response_time:p50", 0.5},
+	{"metrics:response_time:p95", 0.95},
+	{"metrics:response_time:p99", 0.99},
+}
+
+// mergeDigestsScript merges the latency digests that exist into a scratch
+// digest, reads its quantiles and deletes it again. Minutes without
+// successful requests have no digest, and TDIGEST.MERGE rejects missing keys.
+// KEYS[1] scratch key, KEYS[2...] minute digest keys
+// ARGV quantiles
+var mergeDigestsScript = redis.NewScript(`
+local sources = {}
+for i = 2, #KEYS do
+	if redis.call('EXISTS', KEYS[i]) == 1 then
+		table.insert(sources, KEYS[i])
+	end
+end
+if #sources == 0 then
+	return {}
+end
+redis.call('TDIGEST.MERGE', KEYS[1], #sources, unpack(sources))
+local quantiles = redis.call('TDIGEST.QUANTILE', KEYS[1], unpack(ARGV))
+redis.call('DEL', KEYS[1])
+return quantiles
+`)
+
+// recordResponseTimePercentiles writes the response time percentiles of a
+// tenant's successful requests over the last complete minutes, merged from
+// the per-minute digests the capture keeps. Nothing is written when there
+// were no successful requests.
+func (ts *RedisTimeSeriesService) recordResponseTimePercentiles(ks capture.Keyspace, now time.Time, timestamp int64) error {
+	minutes := capture.LatencyDigestWindow(now)
+	keys := make([]string, 0, len(minutes)+1)
+	keys = append(keys, ks.Key("latency:digest:window"))
+	for _, minute := range minutes {
+		keys = append(keys, capture.LatencyDigestKey(ks, minute))
+	}
+	quantiles := make([]interface{}, len(responseTimeQuantiles))
+	for i, q := range responseTimeQuantiles {
+		quantiles[i] = q.quantile
+	}
+
+	values, err := mergeDigestsScript.Run(ts.ctx, ts.redis, keys, quantiles...).StringSlice()
+	if err != nil {
+		return err
+	}
+	for i, text := range values {
+		if i >= len(responseTimeQuantiles) {
+			break
+		}
+		value, err := strconv.ParseFloat(text, 64)
+		if err != nil || math.IsNaN(value) {
+			continue
+		}
+		ts.AddDataPoint(ks.Key(responseTimeQuantiles[i].key), timestamp, value)
+	}
+	return nil
+}
@@ -0,0 +1,383 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+	"github.com/redis/go-redis/v9"
+)
+
+// fetchSeries reads the samples between from and to of a tenant's series
+// matching a selector. Series stored from Prometheus remote writes are found
+// by their name label; other series are named by their key, such as
+// metrics:tokens:input_rate.
+func (ts *RedisTimeSeriesService) fetchSeries(ctx context.Context, tenant string, sel *vectorSelector, from, to int64) ([]fetchedSeries, error) {
+	if from < 0 {
+		from = 0
+	}
+	var found collector[fetchedSeries]
+	err := ts.forEachSeriesShard(ctx, func(ctx context.Context, client *redis.Client) error {
+		result, err := client.Do(ctx, "TS.MRANGE", from, to, "WITHLABELS",
+			"FILTER", "name="+sel.name, "source=prometheus", "tenant="+tenant).Slice()
+		if err != nil {
+			return err
+		}
+		for _, item := range result {
+			reply, ok := item.([]interface{})
+			if !ok || len(reply) != 3 {
+				continue
+			}
+			labels := parseTSLabels(reply[1])
+			delete(labels, "name")
+			delete(labels, "source")
+			delete(labels, "tenant")
+			labels["__name__"] = sel.name
+			found.add(fetchedSeries{labels: labels, samples: parseTSSamples(reply[2])})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	series := found.items
+
+	if !strings.HasPrefix(sel.name, remoteWriteKeyPrefix) {
+		key := capture.TenantKeyspace(tenant).Key("%s", sel.name)
+		pipe := ts.seriesRedis.Pipeline()
+		samples := pipe.Do(ctx, "TS.RANGE", key, from, to)
+		info := pipe.Do(ctx, "TS.INFO", key)
+		if _, err := pipe.Exec(ctx); err != nil && !isRedisReplyError(err) {
+			return nil, err
+		}
+		// A missing key simply has no series
+		if samples.Err() == nil && info.Err() == nil {
+			labels := map[string]string{}
+			fields, _ := info.Val().([]interface{})
+			for i := 0; i+1 < len(fields); i += 2 {
+				if name, _ := fields[i].(string); name == "labels" {
+					labels = parseTSLabels(fields[i+1])
+				}
+			}
+			delete(labels, "tenant")
+			labels["__name__"] = sel.name
+			series = append(series, fetchedSeries{labels: labels, samples: parseTSSamples(samples.Val())})
+		}
+	}
+
+	matched := series[:0]
+	for _, s := range series {
+		ok := true
+		for _, matcher := range sel.matchers {
+			ok = ok && matcher.matches(s.labels[matcher.name])
+		}
+		if ok {
+			matched = append(matched, s)
+		}
+	}
+	sort.Slice(matched, func(i, j int) bool { return labelsKey(matched[i].labels) < labelsKey(matched[j].labels) })
+	return matched, nil
+}
+
+// parseTSLabels parses the [[name, value], ...] labels of a TS.* reply
+func parseTSLabels(reply interface{}) map[string]string {
+	labels := map[string]string{}
+	pairs, _ := reply.([]interface{})
+	for _, pair := range pairs {
+		if pair, ok := pair.([]interface{}); ok && len(pair) == 2 {
+			name, _ := pair[0].(string)
+			value, _ := pair[1].(string)
+			labels[name] = value
+		}
+	}
+	return labels
+}
+
+// parseTSSamples parses the [[timestamp, "value"], ...] samples of a TS.* reply
+func parseTSSamples(reply interface{}) []DataPoint {
+	items, _ := reply.([]interface{})
+	samples := make([]DataPoint, 0, len(items))
+	for _, item := range items {
+		if item, ok := item.([]interface{}); ok && len(item) == 2 {
+			timestamp, _ := item[0].(int64)
+			text, _ := item[1].(string)
+			if value, err := strconv.ParseFloat(text, 64); err == nil {
+				samples = append(samples, DataPoint{Timestamp: timestamp, Value: value})
+			}
+		}
+	}
+	return samples
+}
+
+// seriesKeys lists the keys of a tenant's series, without the tenant prefix
+func (ts *RedisTimeSeriesService) seriesKeys(ctx context.Context, tenant string) ([]string, error) {
+	prefix := string(capture.TenantKeyspace(tenant))
+	var found collector[string]
+	err := ts.forEachSeriesShard(ctx, func(ctx context.Context, client *redis.Client) error {
+		var cursor uint64
+		for {
+			page, next, err := client.ScanType(ctx, cursor, prefix+"*", 1000, "TSDB-TYPE").Result()
+			if err != nil {
+				return err
+			}
+			for _, key := range page {
+				key = strings.TrimPrefix(key, prefix)
+				if tenant == "" && strings.HasPrefix(key, "tenant:") {
+					continue
+				}
+				found.add(key)
+			}
+			if cursor = next; cursor == 0 {
+				return nil
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	keys := found.items
+	sort.Strings(keys)
+	return keys, nil
+}
+
+// seriesNames lists the metric names of a tenant's series
+func (ts *RedisTimeSeriesService) seriesNames(ctx context.Context, tenant string) ([]string, error) {
+	keys, err := ts.seriesKeys(ctx, tenant)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for _, name := range keys {
+		if rest, ok := strings.CutPrefix(name, remoteWriteKeyPrefix); ok {
+			// prom:<name>:<label hash>
+			if i := strings.LastIndexByte(rest, ':'); i > 0 {
+				name = rest[:i]
+			}
+		}
+		seen[name] = true
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// parsePromTime parses a Prometheus API timestamp, in Unix seconds or
+// RFC 3339, into Unix milliseconds
+func parsePromTime(text string) (int64, error) {
+	if seconds, err := strconv.ParseFloat(text, 64); err == nil {
+		return int64(math.Round(seconds * 1000)), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, text)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time %q", text)
+	}
+	return t.UnixMilli(), nil
+}
+
+// parsePromStep parses a query step, in seconds or as a duration, into
+// milliseconds
+func parsePromStep(text string) (int64, error) {
+	if seconds, err := strconv.ParseFloat(text, 64); err == nil && seconds > 0 {
+		return int64(math.Round(seconds * 1000)), nil
+	}
+	step, err := parsePromDuration(text)
+	if err != nil || step <= 0 {
+		return 0, fmt.Errorf("invalid step %q", text)
+	}
+	return step.Milliseconds(), nil
+}
+
+// formatPromValue formats a sample value the way the Prometheus API does
+func formatPromValue(value float64) string {
+	switch {
+	case math.IsNaN(value):
+		return "NaN"
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+// promValue renders a point as a [seconds, "value"] pair
+func promValue(point DataPoint) []interface{} {
+	return []interface{}{float64(point.Timestamp) / 1000, formatPromValue(point.Value)}
+}
+
+func writePromData(w http.ResponseWriter, data interface{}) {
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "success", "data": data})
+}
+
+func writePromError(w http.ResponseWriter, status int, errorType string, err error) {
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "error", "errorType": errorType, "error": err.Error()})
+}
+
+// promMatrix renders results as a Prometheus matrix
+func promMatrix(results []promResult) map[string]interface{} {
+	series := make([]map[string]interface{}, 0, len(results))
+	for _, result := range results {
+		values := make([][]interface{}, 0, len(result.points))
+		for _, point := range result.points {
+			values = append(values, promValue(point))
+		}
+		series = append(series, map[string]interface{}{"metric": result.labels, "values": values})
+	}
+	return map[string]interface{}{"resultType": "matrix", "result": series}
+}
+
+// evaluator returns an evaluator reading a tenant's series
+func (ts *RedisTimeSeriesService) evaluator(ctx context.Context, tenant string) *promEvaluator {
+	return &promEvaluator{fetch: func(sel *vectorSelector, from, to int64) ([]fetchedSeries, error) {
+		return ts.fetchSeries(ctx, tenant, sel, from, to)
+	}}
+}
+
+// promRequest parses the query and tenant common to the query endpoints
+func promRequest(w http.ResponseWriter, r *http.Request) (interface{}, string, bool) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	tenant := r.FormValue("tenant")
+	if tenant != "" && !capture.ValidTenant(tenant) {
+		writePromError(w, http.StatusBadRequest, "bad_data", fmt.Errorf("invalid tenant"))
+		return nil, "", false
+	}
+	expr, err := parsePromQL(r.FormValue("query"))
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", fmt.Errorf("invalid query: %v", err))
+		return nil, "", false
+	}
+	return expr, tenant, true
+}
+
+// promQueryHandler serves the Prometheus instant query API,
+// /api/v1/query?query=&time=
+func (ts *RedisTimeSeriesService) promQueryHandler(w http.ResponseWriter, r *http.Request) {
+	expr, tenant, ok := promRequest(w, r)
+	if !ok {
+		return
+	}
+	at := time.Now().UnixMilli()
+	if text := r.FormValue("time"); text != "" {
+		var err error
+		if at, err = parsePromTime(text); err != nil {
+			writePromError(w, http.StatusBadRequest, "bad_data", err)
+			return
+		}
+	}
+
+	// A range vector selector returns its raw samples
+	if sel, ok := expr.(*vectorSelector); ok && sel.rangeMs > 0 {
+		series, err := ts.fetchSeries(r.Context(), tenant, sel, at-sel.rangeMs+1, at)
+		if err != nil {
+			writePromError(w, http.StatusInternalServerError, "execution", err)
+			return
+		}
+		results := make([]promResult, 0, len(series))
+		for _, s := range series {
+			if len(s.samples) > 0 {
+				results = append(results, promResult{labels: s.labels, points: s.samples})
+			}
+		}
+		writePromData(w, promMatrix(results))
+		return
+	}
+
+	results, err := ts.evaluator(r.Context(), tenant).eval(expr, []int64{at})
+	if err != nil {
+		writePromError(w, http.StatusUnprocessableEntity, "execution", err)
+		return
+	}
+	vector := make([]map[string]interface{}, 0, len(results))
+	for _, result := range results {
+		vector = append(vector, map[string]interface{}{"metric": result.labels, "value": promValue(result.points[0])})
+	}
+	writePromData(w, map[string]interface{}{"resultType": "vector", "result": vector})
+}
+
+// promQueryRangeHandler serves the Prometheus range query API,
+// /api/v1/query_range?query=&start=&end=&step=
+func (ts *RedisTimeSeriesService) promQueryRangeHandler(w http.ResponseWriter, r *http.Request) {
+	expr, tenant, ok := promRequest(w, r)
+	if !ok {
+		return
+	}
+	start, err := parsePromTime(r.FormValue("start"))
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	end, err := parsePromTime(r.FormValue("end"))
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	step, err := parsePromStep(r.FormValue("step"))
+	if err != nil {
+		writePromError(w, http.StatusBadRequest, "bad_data", err)
+		return
+	}
+	if end < start {
+		writePromError(w, http.StatusBadRequest, "bad_data", fmt.Errorf("end is before start"))
+		return
+	}
+	if (end-start)/step >= maxQueryPoints {
+		writePromError(w, http.StatusBadRequest, "bad_data", fmt.Errorf("exceeded maximum resolution of %d points per series, increase the step", maxQueryPoints))
+		return
+	}
+
+	var steps []int64
+	for t := start; t <= end; t += step {
+		steps = append(steps, t)
+	}
+	results, err := ts.evaluator(r.Context(), tenant).eval(expr, steps)
+	if err != nil {
+		writePromError(w, http.StatusUnprocessableEntity, "execution", err)
+		return
+	}
+	writePromData(w, promMatrix(results))
+}
+
+// promLabelsHandler serves /api/v1/labels. Only the metric name label is
+// listed, which is what query editors need to offer metrics.
+func (ts *RedisTimeSeriesService) promLabelsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	writePromData(w, []string{"__name__"})
+}
+
+// promLabelValuesHandler serves /api/v1/label/__name__/values?tenant=, the
+// metric names of a tenant's series. Other labels have no values listed.
+func (ts *RedisTimeSeriesService) promLabelValuesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	if r.PathValue("name") != "__name__" {
+		writePromData(w, []string{})
+		return
+	}
+	tenant := r.FormValue("tenant")
+	if tenant != "" && !capture.ValidTenant(tenant) {
+		writePromError(w, http.StatusBadRequest, "bad_data", fmt.Errorf("invalid tenant"))
+		return
+	}
+	names, err := ts.seriesNames(r.Context(), tenant)
+	if err != nil {
+		writePromError(w, http.StatusInternalServerError, "execution", err)
+		return
+	}
+	writePromData(w, names)
+}
@@ -0,0 +1,629 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lookbackDelta is how far back an instant selector looks for a sample, as
+// in Prometheus
+const lookbackDelta = 5 * time.Minute
+
+// maxQueryPoints bounds the steps of a range query, as in Prometheus
+const maxQueryPoints = 11000
+
+// promFunctions are the supported range-vector functions; quantile_over_time
+// takes a parameter before its range vector
+var promFunctions = map[string]bool{
+	"rate": true, "increase": true,
+	"avg_over_time": true, "sum_over_time": true, "min_over_time": true,
+	"max_over_time": true, "count_over_time": true, "quantile_over_time": true,
+}
+
+// promAggregations are the supported aggregation operators; quantile takes a
+// parameter before its vector
+var promAggregations = map[string]bool{
+	"sum": true, "avg": true, "min": true, "max": true, "count": true, "quantile": true,
+}
+
+// labelMatcher is a label matcher of a selector, such as job=~"api.*"
+type labelMatcher struct {
+	name  string
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+func (m labelMatcher) matches(value string) bool {
+	switch m.op {
+	case "=":
+		return value == m.value
+	case "!=":
+		return value != m.value
+	case "=~":
+		return m.re.MatchString(value)
+	default:
+		return !m.re.MatchString(value)
+	}
+}
+
+// vectorSelector selects the series of one metric, over rangeMs when it is a
+// range vector
+type vectorSelector struct {
+	name     string
+	matchers []labelMatcher
+	rangeMs  int64
+}
+
+// callExpr applies a range-vector function
+type callExpr struct {
+	function string
+	param    float64
+	arg      *vectorSelector
+}
+
+// aggregateExpr aggregates a vector, grouping by the labels in by
+type aggregateExpr struct {
+	op    string
+	param float64
+	by    []string
+	arg   interface{}
+}
+
+// parsePromQL parses the supported PromQL subset: vector selectors whose
+// metric name is given, the functions in promFunctions over range vectors,
+// and the aggregations in promAggregations with an optional by clause
+func parsePromQL(query string) (interface{}, error) {
+	p := &promParser{input: query}
+	expr, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return nil, fmt.Errorf("unexpected %q at position %d", p.input[p.pos:], p.pos)
+	}
+	return expr, nil
+}
+
+type promParser struct {
+	input string
+	pos   int
+}
+
+func (p *promParser) skipSpace() {
+	for p.pos < len(p.input) && strings.ContainsRune(" \t\r\n", rune(p.input[p.pos])) {
+		p.pos++
+	}
+}
+
+// peek returns the next character after any space, or 0 at the end
+func (p *promParser) peek() byte {
+	p.skipSpace()
+	if p.pos < len(p.input) {
+		return p.input[p.pos]
+	}
+	return 0
+}
+
+func (p *promParser) expect(c byte) error {
+	if p.peek() != c {
+		return fmt.Errorf("expected %q at position %d", c, p.pos)
+	}
+	p.pos++
+	return nil
+}
+
+func isIdentChar(c byte, first bool) bool {
+	return c == '_' || c == ':' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+}
+
+func (p *promParser) ident() string {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.input) && isIdentChar(p.input[p.pos], p.pos == start) {
+		p.pos++
+	}
+	return p.input[start:p.pos]
+}
+
+func (p *promParser) number() (float64, error) {
+	p.skipSpace()
+	start := p.pos
+	for p.pos < len(p.input) && strings.ContainsRune("0123456789.eE+-", rune(p.input[p.pos])) {
+		p.pos++
+	}
+	value, err := strconv.ParseFloat(p.input[start:p.pos], 64)
+	if err != nil {
+		return 0, fmt.Errorf("expected a number at position %d", start)
+	}
+	return value, nil
+}
+
+func (p *promParser) str() (string, error) {
+	quote := p.peek()
+	if quote != '"' && quote != '\'' && quote != '`' {
+		return "", fmt.Errorf("expected a string at position %d", p.pos)
+	}
+	start := p.pos
+	for p.pos++; p.pos < len(p.input); p.pos++ {
+		switch p.input[p.pos] {
+		case '\\':
+			p.pos++
+		case quote:
+			p.pos++
+			text := p.input[start:p.pos]
+			if quote == '\'' {
+				text = `"` + strings.ReplaceAll(strings.ReplaceAll(text[1:len(text)-1], `\'`, `'`), `"`, `\"`) + `"`
+			}
+			value, err := strconv.Unquote(text)
+			if err != nil {
+				return "", fmt.Errorf("invalid string %s", p.input[start:p.pos])
+			}
+			return value, nil
+		}
+	}
+	return "", fmt.Errorf("unterminated string at position %d", start)
+}
+
+func (p *promParser) expr() (interface{}, error) {
+	if p.peek() == '{' {
+		return p.selector("")
+	}
+	start := p.pos
+	name := p.ident()
+	if name == "" {
+		return nil, fmt.Errorf("expected an expression at position %d", start)
+	}
+
+	switch {
+	case promAggregations[name] && (p.peek() == '(' || p.hasBy()):
+		return p.aggregate(name)
+	case promFunctions[name] && p.peek() == '(':
+		return p.call(name)
+	}
+	return p.selector(name)
+}
+
+// hasBy reports whether a by clause follows
+func (p *promParser) hasBy() bool {
+	p.skipSpace()
+	rest, found := strings.CutPrefix(p.input[p.pos:], "by")
+	return found && strings.HasPrefix(strings.TrimLeft(rest, " \t\r\n"), "(")
+}
+
+func (p *promParser) labelList() ([]string, error) {
+	p.ident() // by
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+	var labels []string
+	for p.peek() != ')' {
+		label := p.ident()
+		if label == "" {
+			return nil, fmt.Errorf("expected a label name at position %d", p.pos)
+		}
+		labels = append(labels, label)
+		if p.peek() != ',' {
+			break
+		}
+		p.pos++
+	}
+	return labels, p.expect(')')
+}
+
+func (p *promParser) aggregate(op string) (interface{}, error) {
+	agg := &aggregateExpr{op: op}
+	var err error
+	if p.hasBy() {
+		if agg.by, err = p.labelList(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+	if op == "quantile" {
+		if agg.param, err = p.number(); err != nil {
+			return nil, err
+		}
+		if err := p.expect(','); err != nil {
+			return nil, err
+		}
+	}
+	if agg.arg, err = p.expr(); err != nil {
+		return nil, err
+	}
+	if sel, ok := agg.arg.(*vectorSelector); ok && sel.rangeMs > 0 {
+		return nil, fmt.Errorf("%s expects an instant vector", op)
+	}
+	if err := p.expect(')'); err != nil {
+		return nil, err
+	}
+	if agg.by == nil && p.hasBy() {
+		if agg.by, err = p.labelList(); err != nil {
+			return nil, err
+		}
+	}
+	return agg, nil
+}
+
+func (p *promParser) call(function string) (interface{}, error) {
+	call := &callExpr{function: function}
+	if err := p.expect('('); err != nil {
+		return nil, err
+	}
+	var err error
+	if function == "quantile_over_time" {
+		if call.param, err = p.number(); err != nil {
+			return nil, err
+		}
+		if err := p.expect(','); err != nil {
+			return nil, err
+		}
+	}
+	arg, err := p.expr()
+	if err != nil {
+		return nil, err
+	}
+	sel, ok := arg.(*vectorSelector)
+	if !ok || sel.rangeMs == 0 {
+		return nil, fmt.Errorf("%s expects a range vector selector such as metric[5m]", function)
+	}
+	call.arg = sel
+	return call, p.expect(')')
+}
+
+func (p *promParser) selector(name string) (interface{}, error) {
+	sel := &vectorSelector{name: name}
+	if p.peek() == '{' {
+		p.pos++
+		for p.peek() != '}' {
+			label := p.ident()
+			if label == "" {
+				return nil, fmt.Errorf("expected a label name at position %d", p.pos)
+			}
+			p.skipSpace()
+			var op string
+			for _, candidate := range []string{"=~", "!~", "!=", "="} {
+				if strings.HasPrefix(p.input[p.pos:], candidate) {
+					op = candidate
+					break
+				}
+			}
+			if op == "" {
+				return nil, fmt.Errorf("expected a label matcher operator at position %d", p.pos)
+			}
+			p.pos += len(op)
+			value, err := p.str()
+			if err != nil {
+				return nil, err
+			}
+
+			matcher := labelMatcher{name: label, op: op, value: value}
+			if op == "=~" || op == "!~" {
+				if matcher.re, err = regexp.Compile("^(?:" + value + ")$"); err != nil {
+					return nil, fmt.Errorf("invalid regular expression %q: %v", value, err)
+				}
+			}
+			if label == "__name__" {
+				if op != "=" || (sel.name != "" && sel.name != value) {
+					return nil, fmt.Errorf("the metric name must be matched exactly, once")
+				}
+				sel.name = value
+			} else {
+				sel.matchers = append(sel.matchers, matcher)
+			}
+			if p.peek() != ',' {
+				break
+			}
+			p.pos++
+		}
+		if err := p.expect('}'); err != nil {
+			return nil, err
+		}
+	}
+	if sel.name == "" {
+		return nil, fmt.Errorf("selectors must name a metric")
+	}
+
+	if p.peek() == '[' {
+		p.pos++
+		end := strings.IndexByte(p.input[p.pos:], ']')
+		if end < 0 {
+			return nil, fmt.Errorf("unterminated range at position %d", p.pos)
+		}
+		duration, err := parsePromDuration(strings.TrimSpace(p.input[p.pos : p.pos+end]))
+		if err != nil || duration <= 0 {
+			return nil, fmt.Errorf("invalid range %q", p.input[p.pos:p.pos+end])
+		}
+		sel.rangeMs = duration.Milliseconds()
+		p.pos += end + 1
+	}
+	return sel, nil
+}
+
+// promDurationPattern matches Prometheus durations such as 5m or 1h30m
+var promDurationPattern = regexp.MustCompile(`^(?:\d+(?:ms|s|m|h|d|w|y))+$`)
+var promDurationPart = regexp.MustCompile(`(\d+)(ms|s|m|h|d|w|y)`)
+
+// parsePromDuration parses a Prometheus duration
+func parsePromDuration(text string) (time.Duration, error) {
+	if !promDurationPattern.MatchString(text) {
+		return 0, fmt.Errorf("invalid duration %q", text)
+	}
+	units := map[string]time.Duration{
+		"ms": time.Millisecond, "s": time.Second, "m": time.Minute, "h": time.Hour,
+		"d": 24 * time.Hour, "w": 7 * 24 * time.Hour, "y": 365 * 24 * time.Hour,
+	}
+	var total time.Duration
+	for _, part := range promDurationPart.FindAllStringSubmatch(text, -1) {
+		n, err := strconv.ParseInt(part[1], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", text)
+		}
+		total += time.Duration(n) * units[part[2]]
+	}
+	return total, nil
+}
+
+// fetchedSeries is a stored series with its labels, including __name__
+type fetchedSeries struct {
+	labels  map[string]string
+	samples []DataPoint
+}
+
+// promResult is a series of an evaluated expression, with a point per step
+// where it has a value
+type promResult struct {
+	labels map[string]string
+	points []DataPoint
+}
+
+// promEvaluator evaluates parsed expressions at a series of steps, reading
+// samples between two timestamps with fetch
+type promEvaluator struct {
+	fetch func(sel *vectorSelector, from, to int64) ([]fetchedSeries, error)
+}
+
+func (e *promEvaluator) eval(expr interface{}, steps []int64) ([]promResult, error) {
+	first, last := steps[0], steps[len(steps)-1]
+	switch expr := expr.(type) {
+	case *vectorSelector:
+		if expr.rangeMs > 0 {
+			return nil, fmt.Errorf("range vectors can only be evaluated by an instant query or passed to a function")
+		}
+		series, err := e.fetch(expr, first-lookbackDelta.Milliseconds(), last)
+		if err != nil {
+			return nil, err
+		}
+		results := make([]promResult, 0, len(series))
+		for _, s := range series {
+			result := promResult{labels: s.labels}
+			for _, t := range steps {
+				window := samplesIn(s.samples, t-lookbackDelta.Milliseconds(), t)
+				if len(window) > 0 {
+					result.points = append(result.points, DataPoint{Timestamp: t, Value: window[len(window)-1].Value})
+				}
+			}
+			if len(result.points) > 0 {
+				results = append(results, result)
+			}
+		}
+		return results, nil
+
+	case *callExpr:
+		series, err := e.fetch(expr.arg, first-expr.arg.rangeMs, last)
+		if err != nil {
+			return nil, err
+		}
+		results := make([]promResult, 0, len(series))
+		for _, s := range series {
+			result := promResult{labels: withoutName(s.labels)}
+			for _, t := range steps {
+				window := samplesIn(s.samples, t-expr.arg.rangeMs, t)
+				if value, ok := applyFunction(expr, window, t-expr.arg.rangeMs, t); ok {
+					result.points = append(result.points, DataPoint{Timestamp: t, Value: value})
+				}
+			}
+			if len(result.points) > 0 {
+				results = append(results, result)
+			}
+		}
+		return results, nil
+
+	case *aggregateExpr:
+		inputs, err := e.eval(expr.arg, steps)
+		if err != nil {
+			return nil, err
+		}
+		groups := map[string]*promResult{}
+		values := map[string]map[int64][]float64{}
+		var order []string
+		for _, input := range inputs {
+			labels := map[string]string{}
+			for _, name := range expr.by {
+				if value, ok := input.labels[name]; ok {
+					labels[name] = value
+				}
+			}
+			key := labelsKey(labels)
+			if _, ok := groups[key]; !ok {
+				groups[key] = &promResult{labels: labels}
+				values[key] = map[int64][]float64{}
+				order = append(order, key)
+			}
+			for _, point := range input.points {
+				values[key][point.Timestamp] = append(values[key][point.Timestamp], point.Value)
+			}
+		}
+		sort.Strings(order)
+		results := make([]promResult, 0, len(order))
+		for _, key := range order {
+			group := groups[key]
+			for _, t := range steps {
+				if vs := values[key][t]; len(vs) > 0 {
+					group.points = append(group.points, DataPoint{Timestamp: t, Value: aggregate(expr.op, expr.param, vs)})
+				}
+			}
+			results = append(results, *group)
+		}
+		return results, nil
+	}
+	return nil, fmt.Errorf("unsupported expression")
+}
+
+// samplesIn returns the samples in the range (from, to]
+func samplesIn(samples []DataPoint, from, to int64) []DataPoint {
+	start := sort.Search(len(samples), func(i int) bool { return samples[i].Timestamp > from })
+	end := sort.Search(len(samples), func(i int) bool { return samples[i].Timestamp > to })
+	return samples[start:end]
+}
+
+func withoutName(labels map[string]string) map[string]string {
+	result := make(map[string]string, len(labels))
+	for name, value := range labels {
+		if name != "__name__" {
+			result[name] = value
+		}
+	}
+	return result
+}
+
+// labelsKey identifies a label set
+func labelsKey(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name + "\x00" + labels[name] + "\x00")
+	}
+	return b.String()
+}
+
+// applyFunction evaluates a range-vector function over the samples of the
+// window (from, to]
+func applyFunction(call *callExpr, window []DataPoint, from, to int64) (float64, bool) {
+	if len(window) == 0 {
+		return 0, false
+	}
+	values := make([]float64, len(window))
+	for i, sample := range window {
+		values[i] = sample.Value
+	}
+	switch call.function {
+	case "rate", "increase":
+		if len(window) < 2 {
+			return 0, false
+		}
+		return extrapolatedRate(window, from, to, call.function == "rate"), true
+	case "quantile_over_time":
+		return quantile(call.param, values), true
+	default:
+		return aggregate(strings.TrimSuffix(call.function, "_over_time"), 0, values), true
+	}
+}
+
+// extrapolatedRate computes rate or increase the way Prometheus does: the
+// increase between the first and last samples, corrected for counter resets
+// and extrapolated towards the edges of the window
+func extrapolatedRate(samples []DataPoint, from, to int64, isRate bool) float64 {
+	first, last := samples[0], samples[len(samples)-1]
+	increase := last.Value - first.Value
+	for i := 1; i < len(samples); i++ {
+		if samples[i].Value < samples[i-1].Value {
+			increase += samples[i-1].Value
+		}
+	}
+
+	durationToStart := float64(first.Timestamp-from) / 1000
+	durationToEnd := float64(to-last.Timestamp) / 1000
+	sampledInterval := float64(last.Timestamp-first.Timestamp) / 1000
+	if sampledInterval == 0 {
+		return 0
+	}
+	averageInterval := sampledInterval / float64(len(samples)-1)
+
+	// Counters cannot extrapolate below zero
+	if increase > 0 && first.Value >= 0 {
+		if durationToZero := sampledInterval * (first.Value / increase); durationToZero < durationToStart {
+			durationToStart = durationToZero
+		}
+	}
+
+	threshold := averageInterval * 1.1
+	extrapolatedInterval := sampledInterval
+	if durationToStart < threshold {
+		extrapolatedInterval += durationToStart
+	} else {
+		extrapolatedInterval += averageInterval / 2
+	}
+	if durationToEnd < threshold {
+		extrapolatedInterval += durationToEnd
+	} else {
+		extrapolatedInterval += averageInterval / 2
+	}
+
+	increase *= extrapolatedInterval / sampledInterval
+	if isRate {
+		increase /= float64(to-from) / 1000
+	}
+	return increase
+}
+
+// aggregate combines values with sum, avg, min, max, count or quantile
+func aggregate(op string, param float64, values []float64) float64 {
+	switch op {
+	case "quantile":
+		return quantile(param, values)
+	case "count":
+		return float64(len(values))
+	case "min", "max":
+		result := values[0]
+		for _, v := range values[1:] {
+			if (op == "min" && v < result) || (op == "max" && v > result) {
+				result = v
+			}
+		}
+		return result
+	}
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	if op == "avg" {
+		return sum / float64(len(values))
+	}
+	return sum
+}
+
+// quantile returns the q-quantile of values, interpolating between the
+// nearest ranks as Prometheus does
+func quantile(q float64, values []float64) float64 {
+	switch {
+	case math.IsNaN(q):
+		return math.NaN()
+	case q < 0:
+		return math.Inf(-1)
+	case q > 1:
+		return math.Inf(1)
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	rank := q * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := lower + 1
+	if upper > len(sorted)-1 {
+		upper = len(sorted) - 1
+	}
+	weight := rank - math.Floor(rank)
+	return sorted[lower]*(1-weight) + sorted[upper]*weight
+}
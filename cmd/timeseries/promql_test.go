@@ -0,0 +1,330 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// formatExpr renders a parsed expression canonically, to compare parses
+func formatExpr(expr interface{}) string {
+	switch expr := expr.(type) {
+	case *vectorSelector:
+		text := expr.name
+		if len(expr.matchers) > 0 {
+			parts := make([]string, len(expr.matchers))
+			for i, m := range expr.matchers {
+				parts[i] = m.name + m.op + strconv.Quote(m.value)
+			}
+			text += "{" + strings.Join(parts, ",") + "}"
+		}
+		if expr.rangeMs > 0 {
+			text += fmt.Sprintf("[%dms]", expr.rangeMs)
+		}
+		return text
+	case *callExpr:
+		if expr.function == "quantile_over_time" {
+			return fmt.Sprintf("%s(%g, %s)", expr.function, expr.param, formatExpr(expr.arg))
+		}
+		return fmt.Sprintf("%s(%s)", expr.function, formatExpr(expr.arg))
+	case *aggregateExpr:
+		text := expr.op
+		if expr.by != nil {
+			text += " by (" + strings.Join(expr.by, ",") + ")"
+		}
+		if expr.op == "quantile" {
+			return fmt.Sprintf("%s (%g, %s)", text, expr.param, formatExpr(expr.arg))
+		}
+		return fmt.Sprintf("%s (%s)", text, formatExpr(expr.arg))
+	}
+	return fmt.Sprintf("%T", expr)
+}
+
+func TestParsePromQL(t *testing.T) {
+	tests := []struct {
+		query string
+		want  string
+	}{
+		{"up", "up"},
+		{"  up  ", "up"},
+		{"job:requests:rate5m", "job:requests:rate5m"},
+		{`up{job="api"}`, `up{job="api"}`},
+		{`up{job="api",}`, `up{job="api"}`},
+		{`up{}`, "up"},
+		{`{__name__="up", job!="batch"}`, `up{job!="batch"}`},
+		{`up{__name__="up"}`, "up"},
+		{`up{job=~"api|web", env!~'dev.*'}`, `up{job=~"api|web",env!~"dev.*"}`},
+		{`up{path="a\"b"}`, `up{path="a\"b"}`},
+		{`up{path='it\'s "x"'}`, `up{path="it's \"x\""}`},
+		{"up{path=`C:\\dir`}", `up{path="C:\\dir"}`},
+		{"up[5m]", "up[300000ms]"},
+		{"up[1h30m]", "up[5400000ms]"},
+		{"up[ 500ms ]", "up[500ms]"},
+		{"rate(http_requests_total[5m])", "rate(http_requests_total[300000ms])"},
+		{`increase(http_requests_total{code="500"}[1d])`, `increase(http_requests_total{code="500"}[86400000ms])`},
+		{"quantile_over_time(0.9, latency[10m])", "quantile_over_time(0.9, latency[600000ms])"},
+		{"sum(up)", "sum (up)"},
+		{"sum by (job, env) (up)", "sum by (job,env) (up)"},
+		{"sum(up) by (job)", "sum by (job) (up)"},
+		{"sum by () (up)", "sum (up)"},
+		{"quantile(0.99, up)", "quantile (0.99, up)"},
+		{"max(sum by (job) (rate(x[1m])))", "max (sum by (job) (rate(x[60000ms])))"},
+		{"count(\n  up\n)", "count (up)"},
+		{"sum", "sum"},
+		{"rate", "rate"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			expr, err := parsePromQL(tt.query)
+			if err != nil {
+				t.Fatalf("parsePromQL() error = %v", err)
+			}
+			if got := formatExpr(expr); got != tt.want {
+				t.Errorf("parsePromQL() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParsePromQLErrors(t *testing.T) {
+	tests := []struct {
+		query   string
+		wantErr string
+	}{
+		{"", "expected an expression"},
+		{"42", "expected an expression"},
+		{`up{job="api"`, `expected '}'`},
+		{`up{job}`, "expected a label matcher operator"},
+		{`up{job=api}`, "expected a string"},
+		{`up{job="api}`, "unterminated string"},
+		{`up{job="\q"}`, "invalid string"},
+		{`up{job=~"("}`, "invalid regular expression"},
+		{`up{="x"}`, "expected a label name"},
+		{`{job="api"}`, "selectors must name a metric"},
+		{`{__name__=~"up.*"}`, "the metric name must be matched exactly"},
+		{`up{__name__="down"}`, "the metric name must be matched exactly"},
+		{"up[5m", "unterminated range"},
+		{"up[5x]", "invalid range"},
+		{"up[0s]", "invalid range"},
+		{"up[]", "invalid range"},
+		{"rate(up)", "rate expects a range vector selector"},
+		{"rate(sum(up))", "rate expects a range vector selector"},
+		{"rate(up[5m]", "expected ')'"},
+		{"quantile_over_time(up[5m])", "expected a number"},
+		{"sum(up[5m])", "sum expects an instant vector"},
+		{"sum(up", "expected ')'"},
+		{"sum by (job (up)", "expected ')'"},
+		{"sum by (1) (up)", "expected a label name"},
+		{"quantile(up)", "expected a number"},
+		{"quantile(0.5 up)", "expected ','"},
+		{"sum by job (up)", "unexpected"},
+		{"up + 1", "unexpected"},
+		{`up{job="a"}}`, "unexpected"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			expr, err := parsePromQL(tt.query)
+			if err == nil {
+				t.Fatalf("parsePromQL() = %s, want an error", formatExpr(expr))
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parsePromQL() error = %q, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// testSeries are fixed series sampled every 15 seconds over the first ten
+// minutes
+var testSeries = func() []fetchedSeries {
+	counter := func(labels map[string]string, perSecond float64) fetchedSeries {
+		s := fetchedSeries{labels: labels}
+		for t := int64(0); t <= 600_000; t += 15_000 {
+			s.samples = append(s.samples, DataPoint{Timestamp: t, Value: perSecond * float64(t) / 1000})
+		}
+		return s
+	}
+	gauge := func(labels map[string]string, values ...float64) fetchedSeries {
+		s := fetchedSeries{labels: labels}
+		for i, v := range values {
+			s.samples = append(s.samples, DataPoint{Timestamp: int64(i+1) * 15_000, Value: v})
+		}
+		return s
+	}
+	return []fetchedSeries{
+		counter(map[string]string{"__name__": "requests_total", "job": "api", "instance": "a"}, 1),
+		counter(map[string]string{"__name__": "requests_total", "job": "api", "instance": "b"}, 2),
+		counter(map[string]string{"__name__": "requests_total", "job": "worker", "instance": "c"}, 0),
+		gauge(map[string]string{"__name__": "resets_total", "instance": "a"}, 20, 5, 15, 25),
+		gauge(map[string]string{"__name__": "temperature", "room": "kitchen"}, 20, 22, 21, 25),
+		gauge(map[string]string{"__name__": "temperature", "room": "hall"}, 18, 18, 19, 17),
+	}
+}()
+
+// fetchTestSeries returns the samples in (from, to] of the test series
+// selected by sel
+func fetchTestSeries(sel *vectorSelector, from, to int64) ([]fetchedSeries, error) {
+	var result []fetchedSeries
+	for _, s := range testSeries {
+		matches := s.labels["__name__"] == sel.name
+		for _, m := range sel.matchers {
+			matches = matches && m.matches(s.labels[m.name])
+		}
+		if matches {
+			result = append(result, fetchedSeries{labels: s.labels, samples: samplesIn(s.samples, from, to)})
+		}
+	}
+	return result, nil
+}
+
+// formatResults renders results as sorted lines of labels and values
+func formatResults(results []promResult) []string {
+	var lines []string
+	for _, r := range results {
+		labels := make([]string, 0, len(r.labels))
+		for name, value := range r.labels {
+			labels = append(labels, name+"="+value)
+		}
+		sort.Strings(labels)
+		values := make([]string, len(r.points))
+		for i, p := range r.points {
+			values[i] = fmt.Sprintf("%d:%s", p.Timestamp/1000, strconv.FormatFloat(math.Round(p.Value*1000)/1000, 'f', -1, 64))
+		}
+		lines = append(lines, "{"+strings.Join(labels, ",")+"} "+strings.Join(values, " "))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+func TestPromEvaluate(t *testing.T) {
+	tests := []struct {
+		query string
+		steps []int64 // seconds
+		want  []string
+	}{
+		{`requests_total{job="api"}`, []int64{300}, []string{
+			"{__name__=requests_total,instance=a,job=api} 300:300",
+			"{__name__=requests_total,instance=b,job=api} 300:600",
+		}},
+		// Between samples an instant selector takes the last one
+		{`requests_total{instance="a"}`, []int64{7, 60, 61}, []string{"{__name__=requests_total,instance=a,job=api} 7:0 60:60 61:60"}},
+		// Samples go stale once they are five minutes old
+		{`requests_total{instance="a"}`, []int64{899, 900}, []string{"{__name__=requests_total,instance=a,job=api} 899:600"}},
+		{`requests_total{job=~"work.*"}`, []int64{300}, []string{"{__name__=requests_total,instance=c,job=worker} 300:0"}},
+		{`missing_metric`, []int64{300}, nil},
+
+		{`rate(requests_total{instance="a"}[1m])`, []int64{300}, []string{"{instance=a,job=api} 300:1"}},
+		{`rate(requests_total{job="api"}[5m])`, []int64{300, 600}, []string{
+			"{instance=a,job=api} 300:1 600:1",
+			"{instance=b,job=api} 300:2 600:2",
+		}},
+		{`increase(requests_total{instance="b"}[1m])`, []int64{300}, []string{"{instance=b,job=api} 300:120"}},
+		// Extrapolation stops where the counter would have been zero
+		{`increase(requests_total{instance="a"}[1m])`, []int64{30}, []string{"{instance=a,job=api} 30:30"}},
+		// A reset from 20 to 5 counts as an increase of 5, not of -15
+		{`increase(resets_total[1m])`, []int64{60}, []string{"{instance=a} 60:33.333"}},
+		// rate needs two samples in the window
+		{`rate(requests_total{instance="a"}[10s])`, []int64{300}, nil},
+
+		{`avg_over_time(temperature{room="kitchen"}[1m])`, []int64{60}, []string{"{room=kitchen} 60:22"}},
+		{`min_over_time(temperature{room="kitchen"}[1m])`, []int64{60}, []string{"{room=kitchen} 60:20"}},
+		{`max_over_time(temperature{room="kitchen"}[1m])`, []int64{60}, []string{"{room=kitchen} 60:25"}},
+		{`sum_over_time(temperature{room="kitchen"}[30s])`, []int64{60}, []string{"{room=kitchen} 60:46"}},
+		{`count_over_time(temperature[1m])`, []int64{30, 60}, []string{"{room=hall} 30:2 60:4", "{room=kitchen} 30:2 60:4"}},
+		{`quantile_over_time(0.5, temperature{room="hall"}[1m])`, []int64{60}, []string{"{room=hall} 60:18"}},
+		{`quantile_over_time(0.25, temperature{room="kitchen"}[1m])`, []int64{60}, []string{"{room=kitchen} 60:20.75"}},
+
+		{`sum(requests_total)`, []int64{300}, []string{"{} 300:900"}},
+		{`sum by (job) (requests_total)`, []int64{300}, []string{"{job=api} 300:900", "{job=worker} 300:0"}},
+		{`sum by (job) (rate(requests_total[1m]))`, []int64{300}, []string{"{job=api} 300:3", "{job=worker} 300:0"}},
+		{`avg(temperature)`, []int64{15, 60}, []string{"{} 15:19 60:21"}},
+		{`min(temperature) by (room)`, []int64{45}, []string{"{room=hall} 45:19", "{room=kitchen} 45:21"}},
+		{`max(temperature)`, []int64{45}, []string{"{} 45:21"}},
+		{`count(requests_total)`, []int64{300}, []string{"{} 300:3"}},
+		{`count by (missing) (requests_total)`, []int64{300}, []string{"{} 300:3"}},
+		{`quantile(0.5, requests_total)`, []int64{300}, []string{"{} 300:300"}},
+		{`max(sum by (job) (requests_total))`, []int64{300}, []string{"{} 300:900"}},
+	}
+	e := &promEvaluator{fetch: fetchTestSeries}
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.query, tt.steps), func(t *testing.T) {
+			expr, err := parsePromQL(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			steps := make([]int64, len(tt.steps))
+			for i, s := range tt.steps {
+				steps[i] = s * 1000
+			}
+			results, err := e.eval(expr, steps)
+			if err != nil {
+				t.Fatalf("eval() error = %v", err)
+			}
+			got := formatResults(results)
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("eval() =\n%s\nwant\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestPromEvaluateErrors(t *testing.T) {
+	e := &promEvaluator{fetch: fetchTestSeries}
+	expr, _ := parsePromQL("requests_total[5m]")
+	if _, err := e.eval(expr, []int64{300_000}); err == nil {
+		t.Error("eval() of a range vector succeeded, want an error")
+	}
+
+	failure := errors.New("redis unavailable")
+	e = &promEvaluator{fetch: func(*vectorSelector, int64, int64) ([]fetchedSeries, error) { return nil, failure }}
+	for _, query := range []string{"up", "rate(up[1m])", "sum by (job) (up)"} {
+		expr, _ := parsePromQL(query)
+		if _, err := e.eval(expr, []int64{300_000}); !errors.Is(err, failure) {
+			t.Errorf("eval(%s) error = %v, want the fetch error", query, err)
+		}
+	}
+}
+
+func TestQuantile(t *testing.T) {
+	values := []float64{4, 1, 3, 2}
+	tests := []struct {
+		q    float64
+		want float64
+	}{
+		{0, 1}, {1, 4}, {0.5, 2.5}, {0.25, 1.75},
+		{-0.1, math.Inf(-1)}, {1.1, math.Inf(1)},
+	}
+	for _, tt := range tests {
+		if got := quantile(tt.q, values); got != tt.want {
+			t.Errorf("quantile(%g) = %g, want %g", tt.q, got, tt.want)
+		}
+	}
+	if got := quantile(math.NaN(), values); !math.IsNaN(got) {
+		t.Errorf("quantile(NaN) = %g, want NaN", got)
+	}
+	if values[0] != 4 {
+		t.Error("quantile() sorted its input")
+	}
+}
+
+func TestParsePromDuration(t *testing.T) {
+	tests := map[string]int64{
+		"1ms": 1, "30s": 30_000, "5m": 300_000, "1h30m": 5_400_000,
+		"2d": 172_800_000, "1w": 604_800_000, "1y": 31_536_000_000,
+	}
+	for text, want := range tests {
+		got, err := parsePromDuration(text)
+		if err != nil || got.Milliseconds() != want {
+			t.Errorf("parsePromDuration(%q) = %v, %v, want %dms", text, got, err, want)
+		}
+	}
+	for _, text := range []string{"", "5", "m", "5M", "1.5h", "-5m", "5m "} {
+		if _, err := parsePromDuration(text); err == nil {
+			t.Errorf("parsePromDuration(%q) succeeded, want an error", text)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+)
+
+// pushKeyPrefix namespaces the series other services push through /add, so
+// they cannot write to the series the metrics collection maintains
+const pushKeyPrefix = "custom:"
+
+// pushKeyPattern is the form of a pushed series key, after its prefix
+var pushKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,200}$`)
+
+// pushLabelPattern is the form of the names and values of pushed labels
+var pushLabelPattern = regexp.MustCompile(`^[A-Za-z0-9_.:/-]{1,100}$`)
+
+// validatePush checks a data point pushed through /add and returns its labels
+// as strings
+func validatePush(metric TimeSeriesMetric) (map[string]string, error) {
+	name, found := strings.CutPrefix(metric.Key, pushKeyPrefix)
+	if !found || !pushKeyPattern.MatchString(name) {
+		return nil, fmt.Errorf("key must be %s followed by letters, digits and _ . : -", pushKeyPrefix)
+	}
+	if metric.Timestamp < 0 {
+		return nil, fmt.Errorf("timestamp must not be negative")
+	}
+	if math.IsNaN(metric.Value) || math.IsInf(metric.Value, 0) {
+		return nil, fmt.Errorf("value must be a finite number")
+	}
+
+	labels := make(map[string]string, len(metric.Labels))
+	for name, value := range metric.Labels {
+		var text string
+		switch value := value.(type) {
+		case string:
+			text = value
+		case float64, bool:
+			text = fmt.Sprint(value)
+		default:
+			return nil, fmt.Errorf("label %q must be a string, number or boolean", name)
+		}
+		if !pushLabelPattern.MatchString(name) || !pushLabelPattern.MatchString(text) {
+			return nil, fmt.Errorf("label %q must have a non-empty name and value of letters, digits and _ . : / -", name)
+		}
+		if name == "tenant" || name == "source" {
+			return nil, fmt.Errorf("the %s label is set by the service", name)
+		}
+		labels[name] = text
+	}
+	return labels, nil
+}
+
+// PushDataPoint adds a data point pushed by another service to a tenant's
+// series. A series that does not exist yet is created with the default
+// retention and the point's labels, plus source=push and the tenant; the
+// labels of an existing series are left as they are.
+func (ts *RedisTimeSeriesService) PushDataPoint(ctx context.Context, tenant string, metric TimeSeriesMetric, labels map[string]string) (int64, error) {
+	start := time.Now()
+	defer func() {
+		ts.timeSeriesLatency.WithLabelValues("push").Observe(time.Since(start).Seconds())
+	}()
+
+	timestamp := metric.Timestamp
+	if timestamp == 0 {
+		timestamp = time.Now().UnixMilli()
+	}
+
+	// The series gets source and tenant labels besides the point's
+	count := len(labels) + 1
+	if tenant != "" {
+		count++
+	}
+	if err := ts.allowSeries(ctx, tenant, metric.Key, count); err != nil {
+		ts.timeSeriesOperations.WithLabelValues("push", "rejected").Inc()
+		return timestamp, err
+	}
+
+	key := capture.TenantKeyspace(tenant).Key("%s", metric.Key)
+	args := []interface{}{"TS.ADD", key, timestamp, metric.Value, "RETENTION", defaultRetentionMs, "LABELS", "source", "push"}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		args = append(args, name, labels[name])
+	}
+	if tenant != "" {
+		args = append(args, "tenant", tenant)
+	}
+
+	err := ts.seriesRedis.Do(ctx, args...).Err()
+
+	status := "success"
+	if err != nil {
+		status = "error"
+	}
+	ts.timeSeriesOperations.WithLabelValues("push", status).Inc()
+
+	return timestamp, err
+}
+
+// authorizePush checks the TIMESERIES_PUSH_TOKEN bearer token of pushed
+// data points
+func (ts *RedisTimeSeriesService) authorizePush(w http.ResponseWriter, r *http.Request) bool {
+	return authorizeBearer(w, r, ts.pushToken, "TIMESERIES_PUSH_TOKEN")
+}
+
+// addHandler serves POST /add?tenant=, taking a TimeSeriesMetric whose key
+// starts with pushKeyPrefix
+func (ts *RedisTimeSeriesService) addHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !ts.authorizePush(w, r) {
+		return
+	}
+
+	tenant := r.URL.Query().Get("tenant")
+	if tenant != "" && !capture.ValidTenant(tenant) {
+		http.Error(w, "Invalid tenant", http.StatusBadRequest)
+		return
+	}
+
+	var metric TimeSeriesMetric
+	if err := json.NewDecoder(r.Body).Decode(&metric); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	labels, err := validatePush(metric)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	timestamp, err := ts.PushDataPoint(r.Context(), tenant, metric, labels)
+	if errors.Is(err, errCardinalityLimit) {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to add data point: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(DataPoint{Timestamp: timestamp, Value: metric.Value})
+}
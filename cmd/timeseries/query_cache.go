@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// minQueryCacheTTL is how long raw and finely bucketed query results are
+// cached; coarser buckets are cached for one bucket, up to the cache's maxTTL
+const minQueryCacheTTL = 5 * time.Second
+
+// queryCache holds recent range query results so identical Grafana panel
+// refreshes do not each query Redis. Dashboards with relative ranges shift
+// their range on every refresh, so ranges are widened to multiples of the
+// entry's TTL before querying and each response is trimmed back to the range
+// requested. Results may therefore lag Redis by up to the TTL.
+type queryCache struct {
+	maxTTL time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cachedQuery
+
+	requestsCounter *prometheus.CounterVec
+}
+
+type cachedQuery struct {
+	data    []DataPoint
+	expires time.Time
+}
+
+// newQueryCache creates a cache keeping results for at most maxTTL, or nil
+// when maxTTL is not positive
+func newQueryCache(maxTTL time.Duration) *queryCache {
+	if maxTTL <= 0 {
+		return nil
+	}
+	requestsCounter := prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "redis_timeseries_query_cache_requests_total",
+			Help: "Range queries by query cache result",
+		},
+		[]string{"result"},
+	)
+	prometheus.MustRegister(requestsCounter)
+
+	return &queryCache{
+		maxTTL:          maxTTL,
+		entries:         make(map[string]cachedQuery),
+		requestsCounter: requestsCounter,
+	}
+}
+
+// parseQueryCacheTTL reads the longest time range query results are cached
+func parseQueryCacheTTL() time.Duration {
+	seconds, err := strconv.Atoi(getEnvOrDefault("TIMESERIES_QUERY_CACHE_MAX_TTL_SECONDS", "60"))
+	if err != nil || seconds < 0 {
+		seconds = 60
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// ttl is how long a query's result is cached: one bucket of an aggregated
+// query, within minQueryCacheTTL and the cache's maxTTL
+func (c *queryCache) ttl(query TimeSeriesQuery) time.Duration {
+	ttl := minQueryCacheTTL
+	if query.Aggregation != "" && query.BucketDuration > 0 {
+		ttl = time.Duration(query.BucketDuration) * time.Millisecond
+	}
+	if ttl < minQueryCacheTTL {
+		ttl = minQueryCacheTTL
+	}
+	if ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+	return ttl
+}
+
+// widen returns query with its range extended to multiples of step
+func widen(query TimeSeriesQuery, step time.Duration) TimeSeriesQuery {
+	ms := step.Milliseconds()
+	query.StartTime -= query.StartTime % ms
+	if rest := query.EndTime % ms; rest != 0 {
+		query.EndTime += ms - rest
+	}
+	return query
+}
+
+// get returns the cached data for key
+func (c *queryCache) get(key string) ([]DataPoint, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[key]
+	if !ok || !time.Now().Before(entry.expires) {
+		return nil, false
+	}
+	return entry.data, true
+}
+
+// put caches data under key for ttl, dropping expired entries
+func (c *queryCache) put(key string, data []DataPoint, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	for k, e := range c.entries {
+		if !now.Before(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cachedQuery{data: data, expires: now.Add(ttl)}
+}
+
+// clear drops every cached result, after series are deleted or trimmed
+func (c *queryCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]cachedQuery)
+}
+
+// cachedQueryRange queries time-series data for a range, through the query
+// cache when one is configured
+func (ts *RedisTimeSeriesService) cachedQueryRange(ctx context.Context, query TimeSeriesQuery) (*TimeSeriesResponse, error) {
+	c := ts.queryCache
+	if c == nil || query.StartTime < 0 || query.EndTime < query.StartTime {
+		return ts.queryRange(ctx, query)
+	}
+
+	ttl := c.ttl(query)
+	widened := widen(query, ttl)
+	key := fmt.Sprintf("%s\x00%s\x00%d\x00%d\x00%s\x00%d\x00%s", query.Tenant, query.Key,
+		widened.StartTime, widened.EndTime, query.Aggregation, query.BucketDuration, query.Align)
+
+	data, hit := c.get(key)
+	if hit {
+		c.requestsCounter.WithLabelValues("hit").Inc()
+	} else {
+		c.requestsCounter.WithLabelValues("miss").Inc()
+		response, err := ts.queryRange(ctx, widened)
+		if err != nil {
+			return nil, err
+		}
+		data = response.Data
+		c.put(key, data, ttl)
+	}
+
+	// Aggregated points are stamped with the start of their bucket, so keep
+	// the bucket that contains the requested start
+	from := query.StartTime
+	if query.Aggregation != "" && query.BucketDuration > 0 {
+		from = bucketStart(from, alignment(query), query.BucketDuration)
+	}
+	response := &TimeSeriesResponse{Key: query.Key, Data: []DataPoint{}}
+	for _, point := range data {
+		if point.Timestamp >= from && point.Timestamp <= query.EndTime {
+			response.Data = append(response.Data, point)
+		}
+	}
+	return response, nil
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+	"github.com/klauspost/compress/snappy"
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// remoteWriteKeyPrefix namespaces the series written by Prometheus
+const remoteWriteKeyPrefix = "prom:"
+
+// Limits on a remote-write request, compressed and decompressed
+const (
+	maxRemoteWriteBytes        = 16 << 20
+	maxRemoteWriteDecodedBytes = 64 << 20
+)
+
+// promLabel and promSample mirror the Label and Sample messages of the
+// Prometheus remote-write protocol
+type promLabel struct {
+	Name  string
+	Value string
+}
+
+type promSample struct {
+	Value     float64
+	Timestamp int64
+}
+
+// promSeries mirrors the TimeSeries message; exemplars and native histograms
+// are not stored and are skipped when decoding
+type promSeries struct {
+	Labels  []promLabel
+	Samples []promSample
+}
+
+// RemoteWriteResult is the outcome of storing a remote-write request
+type RemoteWriteResult struct {
+	Added    int
+	Skipped  int
+	Rejected int
+	// Errors holds the first few reasons samples were rejected
+	Errors []string
+}
+
+// decodeWriteRequest decodes the series of a prometheus.WriteRequest,
+// ignoring its metadata
+func decodeWriteRequest(b []byte) ([]promSeries, error) {
+	var series []promSeries
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+		if num == 1 && typ == protowire.BytesType {
+			var message []byte
+			message, n = protowire.ConsumeBytes(b)
+			if n >= 0 {
+				s, err := decodeTimeSeries(message)
+				if err != nil {
+					return nil, err
+				}
+				series = append(series, s)
+			}
+		} else {
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return nil, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return series, nil
+}
+
+func decodeTimeSeries(b []byte) (promSeries, error) {
+	var series promSeries
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return series, protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			var message []byte
+			message, n = protowire.ConsumeBytes(b)
+			if n >= 0 {
+				label, err := decodeLabel(message)
+				if err != nil {
+					return series, err
+				}
+				series.Labels = append(series.Labels, label)
+			}
+		case num == 2 && typ == protowire.BytesType:
+			var message []byte
+			message, n = protowire.ConsumeBytes(b)
+			if n >= 0 {
+				sample, err := decodeSample(message)
+				if err != nil {
+					return series, err
+				}
+				series.Samples = append(series.Samples, sample)
+			}
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return series, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return series, nil
+}
+
+func decodeLabel(b []byte) (promLabel, error) {
+	var label promLabel
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return label, protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			label.Name, n = protowire.ConsumeString(b)
+		case num == 2 && typ == protowire.BytesType:
+			label.Value, n = protowire.ConsumeString(b)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return label, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return label, nil
+}
+
+func decodeSample(b []byte) (promSample, error) {
+	var sample promSample
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return sample, protowire.ParseError(n)
+		}
+		b = b[n:]
+		switch {
+		case num == 1 && typ == protowire.Fixed64Type:
+			var bits uint64
+			bits, n = protowire.ConsumeFixed64(b)
+			sample.Value = math.Float64frombits(bits)
+		case num == 2 && typ == protowire.VarintType:
+			var timestamp uint64
+			timestamp, n = protowire.ConsumeVarint(b)
+			sample.Timestamp = int64(timestamp)
+		default:
+			n = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if n < 0 {
+			return sample, protowire.ParseError(n)
+		}
+		b = b[n:]
+	}
+	return sample, nil
+}
+
+// remoteWriteSeries returns the Redis key and labels a Prometheus series is
+// stored under. The key is the metric name and a hash of the other labels.
+// The metric name is kept in the name label. Prometheus labels that clash
+// with those set by the service are renamed with an exported_ prefix, as
+// Prometheus does.
+func remoteWriteSeries(series promSeries) (string, string, []string) {
+	var name string
+	labels := make([]promLabel, 0, len(series.Labels))
+	for _, label := range series.Labels {
+		switch {
+		case label.Name == "__name__":
+			name = label.Value
+		case label.Value == "":
+		case label.Name == "name" || label.Name == "tenant" || label.Name == "source":
+			labels = append(labels, promLabel{Name: "exported_" + label.Name, Value: label.Value})
+		default:
+			labels = append(labels, label)
+		}
+	}
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+
+	hash := fnv.New64a()
+	args := []string{"name", name}
+	for _, label := range labels {
+		hash.Write([]byte(label.Name + "\x00" + label.Value + "\x00"))
+		args = append(args, label.Name, label.Value)
+	}
+	return name, fmt.Sprintf("%s%s:%016x", remoteWriteKeyPrefix, name, hash.Sum64()), args
+}
+
+// StoreRemoteWrite stores the samples of a remote-write request in a tenant's
+// series, creating each series on its first sample with the default
+// retention, its Prometheus labels, source=prometheus and the tenant.
+// Series whose metric name does not match match, when it is set, and stale
+// markers are skipped. Samples Redis rejects, such as those older than a
+// series' retention, are counted rather than failing the request.
+func (ts *RedisTimeSeriesService) StoreRemoteWrite(ctx context.Context, tenant string, series []promSeries, match *regexp.Regexp) (*RemoteWriteResult, error) {
+	start := time.Now()
+	defer func() {
+		ts.timeSeriesLatency.WithLabelValues("remote_write").Observe(time.Since(start).Seconds())
+	}()
+
+	ks := capture.TenantKeyspace(tenant)
+	result := &RemoteWriteResult{}
+	pipe := ts.seriesRedis.Pipeline()
+	var commands []interface{ Err() error }
+	for _, s := range series {
+		name, key, labels := remoteWriteSeries(s)
+		if name == "" || (match != nil && !match.MatchString(name)) {
+			result.Skipped += len(s.Samples)
+			continue
+		}
+		// labels holds name, value pairs, to which source and tenant are added
+		count := len(labels)/2 + 1
+		if tenant != "" {
+			count++
+		}
+		if err := ts.allowSeries(ctx, tenant, key, count); err != nil {
+			if !errors.Is(err, errCardinalityLimit) {
+				return nil, err
+			}
+			result.Rejected += len(s.Samples)
+			if len(result.Errors) < 5 {
+				result.Errors = append(result.Errors, err.Error())
+			}
+			continue
+		}
+
+		created := false
+		for _, sample := range s.Samples {
+			if math.IsNaN(sample.Value) {
+				// Stale markers, and NaN samples Redis cannot store
+				result.Skipped++
+				continue
+			}
+			args := []interface{}{"TS.ADD", ks.Key("%s", key), sample.Timestamp, sample.Value, "ON_DUPLICATE", "LAST"}
+			if !created {
+				// Labels only apply when TS.ADD creates the series
+				args = append(args, "RETENTION", defaultRetentionMs, "LABELS", "source", "prometheus")
+				for _, label := range labels {
+					args = append(args, label)
+				}
+				if tenant != "" {
+					args = append(args, "tenant", tenant)
+				}
+				created = true
+			}
+			commands = append(commands, pipe.Do(ctx, args...))
+		}
+	}
+	if len(commands) == 0 {
+		return result, nil
+	}
+
+	_, err := pipe.Exec(ctx)
+	if err != nil && ctx.Err() != nil {
+		ts.timeSeriesOperations.WithLabelValues("remote_write", "error").Inc()
+		return nil, ctx.Err()
+	}
+	for _, command := range commands {
+		if err := command.Err(); err != nil {
+			if !isRedisReplyError(err) {
+				ts.timeSeriesOperations.WithLabelValues("remote_write", "error").Inc()
+				return nil, err
+			}
+			result.Rejected++
+			if len(result.Errors) < 5 {
+				result.Errors = append(result.Errors, err.Error())
+			}
+			continue
+		}
+		result.Added++
+	}
+	ts.timeSeriesOperations.WithLabelValues("remote_write", "success").Inc()
+	return result, nil
+}
+
+// isRedisReplyError reports whether err is an error reply to one command,
+// rather than a failure to reach Redis
+func isRedisReplyError(err error) bool {
+	var replyErr redis.Error
+	return errors.As(err, &replyErr)
+}
+
+// remoteWriteHandler serves POST /api/v1/write?tenant=, the Prometheus
+// remote-write 1.0 protocol: a snappy-compressed prometheus.WriteRequest
+// protobuf. Malformed requests and rejected samples get 400, which
+// Prometheus does not retry; failures to reach Redis get 500, which it does.
+func (ts *RedisTimeSeriesService) remoteWriteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !ts.authorizePush(w, r) {
+		return
+	}
+	contentType := r.Header.Get("Content-Type")
+	if contentType != "" && (!strings.HasPrefix(contentType, "application/x-protobuf") || strings.Contains(contentType, "io.prometheus.write.v2")) {
+		http.Error(w, "Only remote-write 1.0 prometheus.WriteRequest bodies are supported", http.StatusUnsupportedMediaType)
+		return
+	}
+	if encoding := r.Header.Get("Content-Encoding"); encoding != "" && encoding != "snappy" {
+		http.Error(w, "Only snappy-encoded bodies are supported", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	tenant := r.URL.Query().Get("tenant")
+	if tenant != "" && !capture.ValidTenant(tenant) {
+		http.Error(w, "Invalid tenant", http.StatusBadRequest)
+		return
+	}
+
+	compressed, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxRemoteWriteBytes))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to read request body: %v", err), http.StatusBadRequest)
+		return
+	}
+	if length, err := snappy.DecodedLen(compressed); err != nil || length > maxRemoteWriteDecodedBytes {
+		http.Error(w, "Invalid or oversized snappy body", http.StatusBadRequest)
+		return
+	}
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid snappy body: %v", err), http.StatusBadRequest)
+		return
+	}
+	series, err := decodeWriteRequest(data)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid WriteRequest: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	result, err := ts.StoreRemoteWrite(r.Context(), tenant, series, ts.remoteWriteMatch)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to store samples: %v", err), http.StatusInternalServerError)
+		return
+	}
+	ts.remoteWriteSamples.WithLabelValues("added").Add(float64(result.Added))
+	ts.remoteWriteSamples.WithLabelValues("skipped").Add(float64(result.Skipped))
+	ts.remoteWriteSamples.WithLabelValues("rejected").Add(float64(result.Rejected))
+
+	if result.Rejected > 0 {
+		log.Ctx(r.Context()).Warn().Int("rejected", result.Rejected).Int("samples", result.Added+result.Rejected).Strs("errors", result.Errors).Msg("Remote write rejected samples")
+		http.Error(w, fmt.Sprintf("%d samples rejected: %s", result.Rejected, strings.Join(result.Errors, "; ")), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
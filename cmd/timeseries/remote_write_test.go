@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/klauspost/compress/snappy"
+)
+
+// writeRequest is a prometheus.WriteRequest as Prometheus encodes it, with
+// two series and the metadata it sends alongside them:
+//
+//	up{instance="localhost:9090", job="prometheus"} 1 @1700000000000, 0 @1700000015000
+//	http_requests_total{code="200"} 1027 @1700000000000, with an exemplar
+//	metadata: http_requests_total COUNTER "Total HTTP requests"
+var writeRequest = mustDecodeHex("" +
+	"0a63" + // timeseries
+	"0a0e0a085f5f6e616d655f5f12027570" + // label __name__="up"
+	"0a1a0a08696e7374616e6365120e6c6f63616c686f73743a39303930" + // label instance="localhost:9090"
+	"0a110a036a6f62120a70726f6d657468657573" + // label job="prometheus"
+	"121009000000000000f03f1080d095ffbc31" + // sample 1 @1700000000000
+	"12100900000000000000001098c596ffbc31" + // sample 0 @1700000015000
+	"0a63" + // timeseries
+	"0a1f0a085f5f6e616d655f5f1213687474705f72657175657374735f746f74616c" + // label __name__="http_requests_total"
+	"0a0b0a04636f64651203323030" + // label code="200"
+	"12100900000000000c90401080d095ffbc31" + // sample 1027 @1700000000000
+	"1a210a0f0a0874726163655f6964120361626311000000000000e03f1880d095ffbc31" + // exemplar
+	"1a2c08011213687474705f72657175657374735f746f74616c2213546f74616c2048545450207265717565737473") // metadata
+
+func mustDecodeHex(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+func TestDecodeWriteRequest(t *testing.T) {
+	series, err := decodeWriteRequest(writeRequest)
+	if err != nil {
+		t.Fatalf("decodeWriteRequest() error = %v", err)
+	}
+	want := []promSeries{
+		{
+			Labels: []promLabel{{"__name__", "up"}, {"instance", "localhost:9090"}, {"job", "prometheus"}},
+			Samples: []promSample{
+				{Value: 1, Timestamp: 1700000000000},
+				{Value: 0, Timestamp: 1700000015000},
+			},
+		},
+		{
+			Labels:  []promLabel{{"__name__", "http_requests_total"}, {"code", "200"}},
+			Samples: []promSample{{Value: 1027, Timestamp: 1700000000000}},
+		},
+	}
+	if !reflect.DeepEqual(series, want) {
+		t.Errorf("decodeWriteRequest() = %+v, want %+v", series, want)
+	}
+
+	if series, err := decodeWriteRequest(nil); err != nil || len(series) != 0 {
+		t.Errorf("decodeWriteRequest(empty) = %v, %v, want no series", series, err)
+	}
+}
+
+func TestDecodeWriteRequestTruncated(t *testing.T) {
+	// Only cuts between the top-level fields leave a valid message
+	boundaries := map[int]int{0: 0, 0x65: 1, 0xca: 2}
+	for size := 0; size < len(writeRequest); size++ {
+		series, err := decodeWriteRequest(writeRequest[:size])
+		count, ok := boundaries[size]
+		switch {
+		case ok && (err != nil || len(series) != count):
+			t.Errorf("truncated to %d bytes: got %d series, error %v, want %d series", size, len(series), err, count)
+		case !ok && err == nil:
+			t.Errorf("truncated to %d bytes: decoded %d series, want an error", size, len(series))
+		}
+	}
+}
+
+func TestDecodeWriteRequestMalformed(t *testing.T) {
+	tests := []struct {
+		name    string
+		hex     string
+		wantErr bool
+	}{
+		{"field number zero", "0000", true},
+		{"overlong length", "0affffffffffffffffffff01", true},
+		{"length past the end", "0a05", true},
+		{"unterminated group", "0b", true},
+		{"reserved wire type", "0f", true},
+		{"truncated label", "0a04" + "0a020a05", true},
+		{"truncated label value", "0a06" + "0a04" + "1205616263", true},
+		{"truncated sample value", "0a05" + "1203" + "0900", true},
+		{"truncated timestamp", "0a04" + "1202" + "10ff", true},
+		{"bad tag in sample", "0a04" + "1202" + "0000", true},
+		{"unknown fields are skipped", "1801" + "0a06" + "2801" + "1202" + "1005", false},
+		{"wrong wire type for timeseries", "0801", false},
+		{"sample value as varint", "0a04" + "1202" + "0801", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeWriteRequest(mustDecodeHex(tt.hex))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("decodeWriteRequest() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDecodeWriteRequestCorrupted(t *testing.T) {
+	// Corrupting any one byte may make the request invalid, but must not
+	// make decoding panic
+	for i := range writeRequest {
+		for _, value := range []byte{0x00, 0x7f, 0x80, 0xff} {
+			corrupted := append([]byte(nil), writeRequest...)
+			corrupted[i] = value
+			decodeWriteRequest(corrupted)
+		}
+	}
+}
+
+func FuzzDecodeWriteRequest(f *testing.F) {
+	f.Add(writeRequest)
+	f.Add([]byte{})
+	f.Add(mustDecodeHex("0affffffffffffffffffff01"))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decodeWriteRequest(data)
+	})
+}
+
+func TestRemoteWriteHandlerRejects(t *testing.T) {
+	ts := &RedisTimeSeriesService{pushToken: "secret"}
+	oversized := append([]byte{0x80, 0x80, 0x80, 0x80, 0x08}, make([]byte, 16)...)
+	tests := []struct {
+		name     string
+		method   string
+		query    string
+		token    string
+		headers  map[string]string
+		body     []byte
+		status   int
+		contains string
+	}{
+		{"GET", http.MethodGet, "", "secret", nil, nil, http.StatusMethodNotAllowed, "Method not allowed"},
+		{"no token", http.MethodPost, "", "", nil, snappy.Encode(nil, writeRequest), http.StatusUnauthorized, "Unauthorized"},
+		{"wrong token", http.MethodPost, "", "guess", nil, snappy.Encode(nil, writeRequest), http.StatusUnauthorized, "Unauthorized"},
+		{"JSON body", http.MethodPost, "", "secret", map[string]string{"Content-Type": "application/json"}, []byte("{}"), http.StatusUnsupportedMediaType, "remote-write 1.0"},
+		{"remote-write 2.0", http.MethodPost, "", "secret", map[string]string{"Content-Type": "application/x-protobuf;proto=io.prometheus.write.v2.Request"}, nil, http.StatusUnsupportedMediaType, "remote-write 1.0"},
+		{"gzip body", http.MethodPost, "", "secret", map[string]string{"Content-Encoding": "gzip"}, nil, http.StatusUnsupportedMediaType, "snappy"},
+		{"invalid tenant", http.MethodPost, "?tenant=bad%20tenant!", "secret", nil, snappy.Encode(nil, writeRequest), http.StatusBadRequest, "Invalid tenant"},
+		{"empty body", http.MethodPost, "", "secret", nil, nil, http.StatusBadRequest, "snappy"},
+		{"uncompressed body", http.MethodPost, "", "secret", nil, writeRequest, http.StatusBadRequest, "snappy"},
+		{"oversized decoded length", http.MethodPost, "", "secret", nil, oversized, http.StatusBadRequest, "oversized"},
+		{"truncated snappy", http.MethodPost, "", "secret", nil, snappy.Encode(nil, writeRequest)[:40], http.StatusBadRequest, "Invalid snappy body"},
+		{"truncated WriteRequest", http.MethodPost, "", "secret", nil, snappy.Encode(nil, writeRequest[:50]), http.StatusBadRequest, "Invalid WriteRequest"},
+		{"malformed WriteRequest", http.MethodPost, "", "secret", nil, snappy.Encode(nil, mustDecodeHex("0a04"+"0a020a05")), http.StatusBadRequest, "Invalid WriteRequest"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/api/v1/write"+tt.query, bytes.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/x-protobuf")
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+			if tt.token != "" {
+				r.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			w := httptest.NewRecorder()
+			ts.remoteWriteHandler(w, r)
+			if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.contains) {
+				t.Errorf("got %d %q, want %d containing %q", w.Code, w.Body.String(), tt.status, tt.contains)
+			}
+		})
+	}
+}
+
+func TestRemoteWriteHandlerDisabled(t *testing.T) {
+	ts := &RedisTimeSeriesService{}
+	r := httptest.NewRequest(http.MethodPost, "/api/v1/write", bytes.NewReader(snappy.Encode(nil, writeRequest)))
+	r.Header.Set("Authorization", "Bearer ")
+	w := httptest.NewRecorder()
+	ts.remoteWriteHandler(w, r)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("got %d, want 503 while TIMESERIES_PUSH_TOKEN is unset", w.Code)
+	}
+}
+
+func TestRemoteWriteSeries(t *testing.T) {
+	name, key, labels := remoteWriteSeries(promSeries{Labels: []promLabel{
+		{"__name__", "up"}, {"job", "api"}, {"name", "clash"}, {"empty", ""}, {"instance", "a:1"},
+	}})
+	if name != "up" || !strings.HasPrefix(key, "prom:up:") {
+		t.Errorf("remoteWriteSeries() name, key = %q, %q", name, key)
+	}
+	if want := []string{"name", "up", "exported_name", "clash", "instance", "a:1", "job", "api"}; !reflect.DeepEqual(labels, want) {
+		t.Errorf("remoteWriteSeries() labels = %q, want %q", labels, want)
+	}
+	// The key does not depend on the order labels are sent in
+	_, reordered, _ := remoteWriteSeries(promSeries{Labels: []promLabel{
+		{"instance", "a:1"}, {"name", "clash"}, {"job", "api"}, {"__name__", "up"},
+	}})
+	if reordered != key {
+		t.Errorf("key of reordered labels = %q, want %q", reordered, key)
+	}
+	_, other, _ := remoteWriteSeries(promSeries{Labels: []promLabel{{"__name__", "up"}, {"job", "web"}}})
+	if other == key {
+		t.Errorf("series with different labels share key %q", key)
+	}
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+	"github.com/redis/go-redis/v9"
+)
+
+// seriesDefinitionsKey holds the definitions of series added through the
+// series API, as JSON keyed by series key. Definitions apply to every tenant.
+const seriesDefinitionsKey = "timeseries:series"
+
+// defaultRetentionMs is the retention of series defined without one
+const defaultRetentionMs = 86400000 // 24 hours
+
+// SeriesDefinition describes a time-series created for every tenant
+type SeriesDefinition struct {
+	Key         string            `json:"key"`
+	RetentionMs int64             `json:"retention_ms"`
+	Labels      map[string]string `json:"labels"`
+	// Builtin is set on the built-in and configured series, as opposed to
+	// those added through the series API
+	Builtin bool `json:"builtin"`
+}
+
+// builtinSeries are the series the metrics collection writes to
+var builtinSeries = []SeriesDefinition{
+	{Key: "metrics:tokens:input_rate", RetentionMs: 86400000, Labels: map[string]string{"metric_type": "token_rate", "direction": "input"}},
+	{Key: "metrics:tokens:output_rate", RetentionMs: 86400000, Labels: map[string]string{"metric_type": "token_rate", "direction": "output"}},
+	{Key: "metrics:users:active_5m", RetentionMs: 86400000, Labels: map[string]string{"metric_type": "user_activity", "window": "5m"}},
+	{Key: "metrics:users:active_1h", RetentionMs: 86400000, Labels: map[string]string{"metric_type": "user_activity", "window": "1h"}},
+	{Key: "metrics:response_time:p50", RetentionMs: 86400000, Labels: map[string]string{"metric_type": "response_time", "percentile": "50"}},
+	{Key: "metrics:response_time:p95", RetentionMs: 86400000, Labels: map[string]string{"metric_type": "response_time", "percentile": "95"}},
+	{Key: "metrics:response_time:p99", RetentionMs: 86400000, Labels: map[string]string{"metric_type": "response_time", "percentile": "99"}},
+	{Key: "metrics:error_rate", RetentionMs: 86400000, Labels: map[string]string{"metric_type": "error_rate", "window": "5m"}},
+	{Key: "metrics:error_rate:1m", RetentionMs: 86400000, Labels: map[string]string{"metric_type": "error_rate", "window": "1m"}},
+	{Key: "metrics:error_rate:1h", RetentionMs: 86400000, Labels: map[string]string{"metric_type": "error_rate", "window": "1h"}},
+	{Key: "metrics:memory:redis_used", RetentionMs: 604800000, Labels: map[string]string{"metric_type": "memory", "component": "redis"}}, // 7 days
+	{Key: "metrics:cpu:usage", RetentionMs: 604800000, Labels: map[string]string{"metric_type": "system", "component": "cpu"}},
+}
+
+// validateSeries checks a definition before it is created
+func validateSeries(definition SeriesDefinition) error {
+	if definition.Key == "" || strings.ContainsAny(definition.Key, " \t\r\n") {
+		return fmt.Errorf("series key must be non-empty and contain no whitespace")
+	}
+	if strings.HasPrefix(definition.Key, "tenant:") {
+		return fmt.Errorf("series key must not carry a tenant prefix")
+	}
+	if definition.RetentionMs < 0 {
+		return fmt.Errorf("retention_ms must not be negative")
+	}
+	for name, value := range definition.Labels {
+		if name == "" || value == "" || strings.ContainsAny(name+value, " \t\r\n") {
+			return fmt.Errorf("label %q must have a non-empty name and value without whitespace", name)
+		}
+		if name == "tenant" {
+			return fmt.Errorf("the tenant label is set by the service")
+		}
+	}
+	return nil
+}
+
+// createSeries creates a definition's series in a tenant's keyspace, labelled
+// with the tenant. Series that already exist are altered to the definition's
+// retention and labels, so configuration changes apply on restart.
+func (ts *RedisTimeSeriesService) createSeries(ctx context.Context, tenant string, definition SeriesDefinition) error {
+	key := capture.TenantKeyspace(tenant).Key("%s", definition.Key)
+	args := []interface{}{"TS.CREATE", key, "RETENTION", definition.RetentionMs}
+
+	labels := make([]string, 0, len(definition.Labels))
+	for name := range definition.Labels {
+		labels = append(labels, name)
+	}
+	sort.Strings(labels)
+	if len(labels) > 0 || tenant != "" {
+		args = append(args, "LABELS")
+		for _, name := range labels {
+			args = append(args, name, definition.Labels[name])
+		}
+		if tenant != "" {
+			args = append(args, "tenant", tenant)
+		}
+	}
+
+	err := ts.seriesRedis.Do(ctx, args...).Err()
+	if err != nil && err.Error() == "TSDB: key already exists" {
+		args[0] = "TS.ALTER"
+		err = ts.seriesRedis.Do(ctx, args...).Err()
+	}
+	return err
+}
+
+// seriesDefinitions returns the built-in and configured series followed by
+// those added through the series API, in key order
+func (ts *RedisTimeSeriesService) seriesDefinitions(ctx context.Context) ([]SeriesDefinition, error) {
+	stored, err := ts.redis.HGetAll(ctx, seriesDefinitionsKey).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	definitions := make([]SeriesDefinition, 0, len(ts.series)+len(stored))
+	for _, definition := range ts.series {
+		definition.Builtin = true
+		definitions = append(definitions, definition)
+	}
+	keys := make([]string, 0, len(stored))
+	for key := range stored {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		var definition SeriesDefinition
+		if err := json.Unmarshal([]byte(stored[key]), &definition); err != nil {
+			return nil, fmt.Errorf("invalid definition of series %s: %v", key, err)
+		}
+		definitions = append(definitions, definition)
+	}
+	return definitions, nil
+}
+
+// AddSeries records a series definition and creates the series for the
+// default tenant and every known tenant. Tenants seen later get it when their
+// series are initialized.
+func (ts *RedisTimeSeriesService) AddSeries(ctx context.Context, definition SeriesDefinition) (bool, error) {
+	for _, builtin := range ts.series {
+		if builtin.Key == definition.Key {
+			return false, nil
+		}
+	}
+	definition.Builtin = false
+	if definition.RetentionMs == 0 {
+		definition.RetentionMs = defaultRetentionMs
+	}
+
+	encoded, err := json.Marshal(definition)
+	if err != nil {
+		return false, err
+	}
+	added, err := ts.redis.HSetNX(ctx, seriesDefinitionsKey, definition.Key, encoded).Result()
+	if err != nil || !added {
+		return false, err
+	}
+
+	tenants, err := ts.redis.SMembers(ctx, "tenants").Result()
+	if err != nil {
+		return true, err
+	}
+	for _, tenant := range append([]string{""}, tenants...) {
+		if tenant != "" && !capture.ValidTenant(tenant) {
+			continue
+		}
+		if err := ts.createSeries(ctx, tenant, definition); err != nil {
+			return true, err
+		}
+	}
+	return true, nil
+}
+
+// DeleteSeries deletes a tenant's series and reports whether it existed.
+// Series with a definition are created again empty, so the metrics
+// collection and later writes keep working; others are removed for good.
+func (ts *RedisTimeSeriesService) DeleteSeries(ctx context.Context, tenant, key string) (bool, error) {
+	deleted, err := ts.seriesRedis.Del(ctx, capture.TenantKeyspace(tenant).Key("%s", key)).Result()
+	if err != nil || deleted == 0 {
+		return false, err
+	}
+	ts.queryCache.clear()
+
+	definitions, err := ts.seriesDefinitions(ctx)
+	if err != nil {
+		return true, err
+	}
+	for _, definition := range definitions {
+		if definition.Key == key {
+			return true, ts.createSeries(ctx, tenant, definition)
+		}
+	}
+	ts.cardinality.forget(tenant, key)
+	return true, nil
+}
+
+// TrimSeries deletes a tenant's samples of a series older than before, in
+// Unix milliseconds, and returns how many were deleted
+func (ts *RedisTimeSeriesService) TrimSeries(ctx context.Context, tenant, key string, before int64) (int64, error) {
+	deleted, err := ts.seriesRedis.Do(ctx, "TS.DEL", capture.TenantKeyspace(tenant).Key("%s", key), 0, before-1).Int64()
+	if err != nil {
+		return 0, err
+	}
+	ts.queryCache.clear()
+	return deleted, nil
+}
+
+// seriesRequest reads the tenant and key of a request for one series
+func seriesRequest(w http.ResponseWriter, r *http.Request) (string, string, bool) {
+	tenant, key := r.URL.Query().Get("tenant"), r.URL.Query().Get("key")
+	if tenant != "" && !capture.ValidTenant(tenant) {
+		http.Error(w, "Invalid tenant", http.StatusBadRequest)
+		return "", "", false
+	}
+	if key == "" || strings.ContainsAny(key, " \t\r\n") || strings.HasPrefix(key, "tenant:") {
+		http.Error(w, "Invalid key", http.StatusBadRequest)
+		return "", "", false
+	}
+	return tenant, key, true
+}
+
+// trimHandler serves POST /series/trim?key=&tenant=&before=, deleting the
+// samples of a series older than before, in Unix milliseconds
+func (ts *RedisTimeSeriesService) trimHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+	if r.Method == http.MethodOptions {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if !ts.authorizeAdmin(w, r) {
+		return
+	}
+	tenant, key, ok := seriesRequest(w, r)
+	if !ok {
+		return
+	}
+	before, err := strconv.ParseInt(r.URL.Query().Get("before"), 10, 64)
+	if err != nil || before <= 0 {
+		http.Error(w, "Invalid before, expected a Unix timestamp in milliseconds", http.StatusBadRequest)
+		return
+	}
+
+	deleted, err := ts.TrimSeries(r.Context(), tenant, key, before)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to trim series: %v", err), http.StatusInternalServerError)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"key": key, "deleted": deleted})
+}
+
+// seriesHandler serves GET /series, listing the series created for every
+// tenant, POST /series, which adds one from a SeriesDefinition body, and
+// DELETE /series?key=&tenant=, which deletes a tenant's series
+func (ts *RedisTimeSeriesService) seriesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.WriteHeader(http.StatusOK)
+
+	case http.MethodGet:
+		definitions, err := ts.seriesDefinitions(r.Context())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to list series: %v", err), http.StatusInternalServerError)
+			return
+		}
+		json.NewEncoder(w).Encode(definitions)
+
+	case http.MethodPost:
+		if !ts.authorizeAdmin(w, r) {
+			return
+		}
+		var definition SeriesDefinition
+		if err := json.NewDecoder(r.Body).Decode(&definition); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request body: %v", err), http.StatusBadRequest)
+			return
+		}
+		if err := validateSeries(definition); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// Tenants' copies also get a tenant label
+		if err := ts.cardinality.checkLabels(definition.Key, len(definition.Labels)+1); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		added, err := ts.AddSeries(r.Context(), definition)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to create series: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !added {
+			http.Error(w, fmt.Sprintf("Series %s already exists", definition.Key), http.StatusConflict)
+			return
+		}
+
+		if definition.RetentionMs == 0 {
+			definition.RetentionMs = defaultRetentionMs
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(definition)
+
+	case http.MethodDelete:
+		if !ts.authorizeAdmin(w, r) {
+			return
+		}
+		tenant, key, ok := seriesRequest(w, r)
+		if !ok {
+			return
+		}
+		deleted, err := ts.DeleteSeries(r.Context(), tenant, key)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to delete series: %v", err), http.StatusInternalServerError)
+			return
+		}
+		if !deleted {
+			http.Error(w, fmt.Sprintf("Series %s not found", key), http.StatusNotFound)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/redisconn"
+	"github.com/redis/go-redis/v9"
+)
+
+// SeriesShards places series on other Redis instances than the analytics
+// data. At most one of the fields is set; with neither, series are kept with
+// the analytics data.
+type SeriesShards struct {
+	// Addrs are independent Redis instances series are spread over by key
+	Addrs []string
+	// ClusterAddrs are nodes of a Redis Cluster holding the series
+	ClusterAddrs []string
+}
+
+// parseShardAddrs reads a comma-separated list of Redis addresses
+func parseShardAddrs(text string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(text, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
+
+// newSeriesRing creates a ring placing each series on one of addrs by
+// rendezvous hashing of its key. Shards are named by address, so listing
+// them in another order does not move series. They are reached with the
+// main connection's password, database and TLS settings.
+func newSeriesRing(addrs []string, options redisconn.Options) *redis.Ring {
+	shards := make(map[string]string, len(addrs))
+	for _, addr := range addrs {
+		shards[addr] = addr
+	}
+	return redis.NewRing(&redis.RingOptions{
+		Addrs:     shards,
+		Password:  options.Password,
+		DB:        options.DB,
+		TLSConfig: options.TLS,
+		Protocol:  options.Protocol,
+	})
+}
+
+// newSeriesCluster creates a client for a Redis Cluster holding the series,
+// reached with the main connection's password and TLS settings. Clusters
+// have no databases other than 0.
+func newSeriesCluster(addrs []string, options redisconn.Options) *redis.ClusterClient {
+	return redis.NewClusterClient(&redis.ClusterOptions{
+		Addrs:     addrs,
+		Password:  options.Password,
+		TLSConfig: options.TLS,
+		Protocol:  options.Protocol,
+	})
+}
+
+// seriesSharded reports whether series are spread over several Redis
+// instances, so multi-key commands must be split by key
+func (ts *RedisTimeSeriesService) seriesSharded() bool {
+	return ts.seriesRing != nil || ts.seriesCluster != nil
+}
+
+// forEachSeriesShard calls fn with every Redis holding series, concurrently
+// when they are sharded, for commands that are not routed by key such as
+// SCAN and TS.MRANGE
+func (ts *RedisTimeSeriesService) forEachSeriesShard(ctx context.Context, fn func(ctx context.Context, client *redis.Client) error) error {
+	switch {
+	case ts.seriesRing != nil:
+		return ts.seriesRing.ForEachShard(ctx, fn)
+	case ts.seriesCluster != nil:
+		return ts.seriesCluster.ForEachMaster(ctx, fn)
+	default:
+		return fn(ctx, ts.redis)
+	}
+}
+
+// shardedMAdd adds TS.MADD key, timestamp, value triples with one TS.MADD
+// per point, so each is routed to its shard, and returns the
+// replies in order as a single TS.MADD would
+func (ts *RedisTimeSeriesService) shardedMAdd(ctx context.Context, triples []interface{}) ([]interface{}, error) {
+	pipe := ts.seriesRedis.Pipeline()
+	cmds := make([]*redis.Cmd, 0, len(triples)/3)
+	for i := 0; i+2 < len(triples); i += 3 {
+		cmds = append(cmds, pipe.Do(ctx, "TS.MADD", triples[i], triples[i+1], triples[i+2]))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && !isRedisReplyError(err) {
+		return nil, err
+	}
+
+	result := make([]interface{}, len(cmds))
+	for i, cmd := range cmds {
+		if replies, err := cmd.Slice(); err != nil {
+			result[i] = err
+		} else if len(replies) == 1 {
+			result[i] = replies[0]
+		}
+	}
+	return result, nil
+}
+
+// collector gathers results from concurrent shards
+type collector[T any] struct {
+	mu    sync.Mutex
+	items []T
+}
+
+func (c *collector[T]) add(items ...T) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.items = append(c.items, items...)
+}
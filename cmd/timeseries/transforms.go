@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// transforms compute a series from the points of a range query, so counters
+// can be shown as rates without each dashboard deriving them
+var transforms = map[string]func([]DataPoint) []DataPoint{
+	"rate":   ratePoints,
+	"delta":  deltaPoints,
+	"cumsum": cumulativeSum,
+}
+
+// validateTransform checks the transform of a query, which may be empty
+func validateTransform(transform string) error {
+	if _, ok := transforms[transform]; transform != "" && !ok {
+		return fmt.Errorf("unknown transform %q, expected rate, delta or cumsum", transform)
+	}
+	return nil
+}
+
+// QueryRange queries time-series data for a range, fills empty buckets and
+// applies the query's transform to the result
+func (ts *RedisTimeSeriesService) QueryRange(ctx context.Context, query TimeSeriesQuery) (*TimeSeriesResponse, error) {
+	if err := validateQuery(query); err != nil {
+		return nil, err
+	}
+	// Alignment to the start or end is resolved to a timestamp, so it
+	// survives the query cache widening the range
+	if query.Align != "" {
+		query.Align = strconv.FormatInt(alignment(query), 10)
+	}
+
+	response, err := ts.cachedQueryRange(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	data := response.Data
+	if query.Fill != "" {
+		data = fillPoints(data, query.Fill, query.StartTime, query.EndTime, alignment(query), query.BucketDuration)
+	}
+	if query.Transform != "" {
+		data = transforms[query.Transform](data)
+	}
+	return &TimeSeriesResponse{Key: response.Key, Data: data, Labels: response.Labels}, nil
+}
+
+// ratePoints returns the per-second increase between consecutive points,
+// stamped with the later one. A decrease is taken as a counter reset, so the
+// increase is the later value.
+func ratePoints(points []DataPoint) []DataPoint {
+	rates := []DataPoint{}
+	for i := 1; i < len(points); i++ {
+		elapsed := points[i].Timestamp - points[i-1].Timestamp
+		if elapsed <= 0 {
+			continue
+		}
+		increase := points[i].Value - points[i-1].Value
+		if increase < 0 {
+			increase = points[i].Value
+		}
+		rates = append(rates, DataPoint{Timestamp: points[i].Timestamp, Value: increase * 1000 / float64(elapsed)})
+	}
+	return rates
+}
+
+// deltaPoints returns the change between consecutive points, stamped with
+// the later one
+func deltaPoints(points []DataPoint) []DataPoint {
+	deltas := []DataPoint{}
+	for i := 1; i < len(points); i++ {
+		deltas = append(deltas, DataPoint{Timestamp: points[i].Timestamp, Value: points[i].Value - points[i-1].Value})
+	}
+	return deltas
+}
+
+// cumulativeSum returns the running total of the points. Null points stay
+// null and leave the total unchanged.
+func cumulativeSum(points []DataPoint) []DataPoint {
+	sums := make([]DataPoint, len(points))
+	total := 0.0
+	for i, point := range points {
+		if math.IsNaN(point.Value) {
+			sums[i] = point
+			continue
+		}
+		total += point.Value
+		sums[i] = DataPoint{Timestamp: point.Timestamp, Value: total}
+	}
+	return sums
+}
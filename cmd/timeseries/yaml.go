@@ -0,0 +1,283 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// yamlLine is a non-blank line of a YAML document with its comment removed
+type yamlLine struct {
+	number int
+	indent int
+	text   string
+}
+
+// parseYAML parses the block-style YAML subset used by the series config:
+// nested mappings, sequences introduced by "- ", single-line flow mappings
+// and sequences, comments and plain or quoted scalars. Mappings decode to
+// map[string]interface{}, sequences to []interface{} and scalars to string.
+func parseYAML(data string) (interface{}, error) {
+	var lines []yamlLine
+	for i, raw := range strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n") {
+		if strings.HasPrefix(raw, "---") || strings.HasPrefix(raw, "...") {
+			continue
+		}
+		text := strings.TrimRight(stripYAMLComment(raw), " \t")
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		trimmed := strings.TrimLeft(text, " ")
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, fmt.Errorf("line %d: tabs are not allowed for indentation", i+1)
+		}
+		lines = append(lines, yamlLine{number: i + 1, indent: len(text) - len(trimmed), text: trimmed})
+	}
+	if len(lines) == 0 {
+		return map[string]interface{}{}, nil
+	}
+
+	p := &yamlParser{lines: lines}
+	value, err := p.block(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, fmt.Errorf("line %d: unexpected indentation", p.lines[p.pos].number)
+	}
+	return value, nil
+}
+
+// stripYAMLComment removes a # comment that is outside quotes
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return line[:i]
+		}
+	}
+	return line
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// block parses the mapping or sequence whose entries start at indent
+func (p *yamlParser) block(indent int) (interface{}, error) {
+	if line := p.lines[p.pos]; line.text == "-" || strings.HasPrefix(line.text, "- ") {
+		return p.sequence(indent, false)
+	}
+	return p.mapping(indent)
+}
+
+// sequence parses the entries at indent. A compact sequence, one at its
+// key's indentation, ends at the next key of the enclosing mapping.
+func (p *yamlParser) sequence(indent int, compact bool) ([]interface{}, error) {
+	items := []interface{}{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", line.number)
+		}
+		if line.text != "-" && !strings.HasPrefix(line.text, "- ") {
+			if compact {
+				break
+			}
+			return nil, fmt.Errorf("line %d: expected a sequence entry", line.number)
+		}
+
+		item := strings.TrimSpace(strings.TrimPrefix(line.text, "-"))
+		switch {
+		case item == "":
+			// The entry is the nested block on the following lines
+			p.pos++
+			if p.pos >= len(p.lines) || p.lines[p.pos].indent <= indent {
+				items = append(items, "")
+				continue
+			}
+			value, err := p.block(p.lines[p.pos].indent)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, value)
+		case isYAMLMappingEntry(item):
+			// "- key: value" starts a mapping indented past the dash
+			p.lines[p.pos] = yamlLine{number: line.number, indent: indent + 2, text: item}
+			value, err := p.mapping(indent + 2)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, value)
+		default:
+			value, err := yamlScalar(item, line.number)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, value)
+			p.pos++
+		}
+	}
+	return items, nil
+}
+
+func (p *yamlParser) mapping(indent int) (map[string]interface{}, error) {
+	entries := map[string]interface{}{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, fmt.Errorf("line %d: unexpected indentation", line.number)
+		}
+		if !isYAMLMappingEntry(line.text) {
+			return nil, fmt.Errorf("line %d: expected key: value", line.number)
+		}
+
+		key, rest := splitYAMLEntry(line.text)
+		if _, ok := entries[key]; ok {
+			return nil, fmt.Errorf("line %d: duplicate key %q", line.number, key)
+		}
+		p.pos++
+
+		if rest != "" {
+			value, err := yamlScalar(rest, line.number)
+			if err != nil {
+				return nil, err
+			}
+			entries[key] = value
+			continue
+		}
+		// A nested block, which for sequences may sit at the key's indentation
+		if p.pos < len(p.lines) {
+			next := p.lines[p.pos]
+			isSequence := next.text == "-" || strings.HasPrefix(next.text, "- ")
+			if next.indent == indent && isSequence {
+				value, err := p.sequence(indent, true)
+				if err != nil {
+					return nil, err
+				}
+				entries[key] = value
+				continue
+			}
+			if next.indent > indent {
+				value, err := p.block(next.indent)
+				if err != nil {
+					return nil, err
+				}
+				entries[key] = value
+				continue
+			}
+		}
+		entries[key] = ""
+	}
+	return entries, nil
+}
+
+// isYAMLMappingEntry reports whether text is a key: value entry
+func isYAMLMappingEntry(text string) bool {
+	if text == "" || text[0] == '"' || text[0] == '\'' || text[0] == '{' || text[0] == '[' {
+		return false
+	}
+	i := strings.Index(text, ":")
+	return i > 0 && (i == len(text)-1 || text[i+1] == ' ')
+}
+
+// splitYAMLEntry splits a key: value entry at its first ": "
+func splitYAMLEntry(text string) (string, string) {
+	if strings.HasSuffix(text, ":") && !strings.Contains(text[:len(text)-1], ": ") {
+		return strings.TrimSpace(text[:len(text)-1]), ""
+	}
+	i := strings.Index(text, ": ")
+	return strings.TrimSpace(text[:i]), strings.TrimSpace(text[i+2:])
+}
+
+// yamlScalar parses a scalar or single-line flow collection
+func yamlScalar(text string, number int) (interface{}, error) {
+	switch {
+	case strings.HasPrefix(text, "{"):
+		if !strings.HasSuffix(text, "}") {
+			return nil, fmt.Errorf("line %d: unterminated flow mapping", number)
+		}
+		entries := map[string]interface{}{}
+		for _, part := range splitYAMLFlow(text[1 : len(text)-1]) {
+			if !isYAMLMappingEntry(part) {
+				return nil, fmt.Errorf("line %d: expected key: value in flow mapping", number)
+			}
+			key, rest := splitYAMLEntry(part)
+			value, err := yamlScalar(rest, number)
+			if err != nil {
+				return nil, err
+			}
+			entries[key] = value
+		}
+		return entries, nil
+	case strings.HasPrefix(text, "["):
+		if !strings.HasSuffix(text, "]") {
+			return nil, fmt.Errorf("line %d: unterminated flow sequence", number)
+		}
+		items := []interface{}{}
+		for _, part := range splitYAMLFlow(text[1 : len(text)-1]) {
+			value, err := yamlScalar(part, number)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, value)
+		}
+		return items, nil
+	case strings.HasPrefix(text, `"`):
+		value, err := strconv.Unquote(text)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid quoted string %s", number, text)
+		}
+		return value, nil
+	case strings.HasPrefix(text, "'"):
+		if len(text) < 2 || !strings.HasSuffix(text, "'") {
+			return nil, fmt.Errorf("line %d: invalid quoted string %s", number, text)
+		}
+		return strings.ReplaceAll(text[1:len(text)-1], "''", "'"), nil
+	case text == "|" || text == ">" || strings.HasPrefix(text, "&") || strings.HasPrefix(text, "*"):
+		return nil, fmt.Errorf("line %d: block scalars, anchors and aliases are not supported", number)
+	}
+	return text, nil
+}
+
+// splitYAMLFlow splits the inside of a flow collection at top-level commas
+func splitYAMLFlow(text string) []string {
+	var parts []string
+	var quote byte
+	depth, start := 0, 0
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '{' || c == '[':
+			depth++
+		case c == '}' || c == ']':
+			depth--
+		case c == ',' && depth == 0:
+			parts = append(parts, strings.TrimSpace(text[start:i]))
+			start = i + 1
+		}
+	}
+	if last := strings.TrimSpace(text[start:]); last != "" {
+		parts = append(parts, last)
+	}
+	return parts
+}
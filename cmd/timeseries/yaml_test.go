@@ -0,0 +1,105 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type yamlMap = map[string]interface{}
+type yamlList = []interface{}
+
+func TestParseYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want interface{}
+	}{
+		{"empty", "", yamlMap{}},
+		{"only comments", "# a comment\n\n   # another\n", yamlMap{}},
+		{"scalars stay strings", "a: 1\nb: two\nc: true\nd: 1.5", yamlMap{"a": "1", "b": "two", "c": "true", "d": "1.5"}},
+		{"empty value", "a:\nb: 1", yamlMap{"a": "", "b": "1"}},
+		{"nested mappings", "a:\n  b:\n    c: 1\n  d: 2\ne: 3", yamlMap{"a": yamlMap{"b": yamlMap{"c": "1"}, "d": "2"}, "e": "3"}},
+		{"document markers", "---\na: 1\n...", yamlMap{"a": "1"}},
+		{"CRLF line endings", "a: 1\r\nb:\r\n  c: 2\r\n", yamlMap{"a": "1", "b": yamlMap{"c": "2"}}},
+		{"value with colon", "url: http://redis:6379/0", yamlMap{"url": "http://redis:6379/0"}},
+		{"indented document", "  a: 1\n  b: 2", yamlMap{"a": "1", "b": "2"}},
+
+		{"trailing comment", "a: 1 # one\nb: 2", yamlMap{"a": "1", "b": "2"}},
+		{"hash without space", "a: x#y", yamlMap{"a": "x#y"}},
+		{"hash in double quotes", `a: "x # y"`, yamlMap{"a": "x # y"}},
+		{"hash in single quotes", "a: 'x # y' # comment", yamlMap{"a": "x # y"}},
+
+		{"double quoted", `a: "x: y"`, yamlMap{"a": "x: y"}},
+		{"double quoted escapes", `a: "tab\there\n"`, yamlMap{"a": "tab\there\n"}},
+		{"single quoted", "a: 'it''s'", yamlMap{"a": "it's"}},
+		{"quoted number", `a: "1"`, yamlMap{"a": "1"}},
+		{"empty quotes", `a: ""`, yamlMap{"a": ""}},
+
+		{"top-level sequence", "- a\n- b", yamlList{"a", "b"}},
+		{"indented sequence", "a:\n  - 1\n  - 2", yamlMap{"a": yamlList{"1", "2"}}},
+		{"sequence at key indentation", "a:\n- 1\n- 2\nb: 3", yamlMap{"a": yamlList{"1", "2"}, "b": "3"}},
+		{"sequence of mappings", "series:\n  - name: cpu\n    unit: percent\n  - name: mem", yamlMap{"series": yamlList{yamlMap{"name": "cpu", "unit": "percent"}, yamlMap{"name": "mem"}}}},
+		{"nested block entry", "-\n  a: 1\n- b", yamlList{yamlMap{"a": "1"}, "b"}},
+		{"empty entry", "- \n- b", yamlList{"", "b"}},
+		{"sequence of sequences", "-\n  - 1\n  - 2", yamlList{yamlList{"1", "2"}}},
+		{"quoted sequence entry", `- "a: b"`, yamlList{"a: b"}},
+
+		{"flow mapping", `labels: {env: prod, team: "a, b"}`, yamlMap{"labels": yamlMap{"env": "prod", "team": "a, b"}}},
+		{"flow sequence", "a: [1, 'two', [3, 4]]", yamlMap{"a": yamlList{"1", "two", yamlList{"3", "4"}}}},
+		{"empty flow collections", "a: {}\nb: []", yamlMap{"a": yamlMap{}, "b": yamlList{}}},
+		{"flow in sequence", "- {a: 1}\n- [x]", yamlList{yamlMap{"a": "1"}, yamlList{"x"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseYAML(tt.data)
+			if err != nil {
+				t.Fatalf("parseYAML() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseYAML() = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    string
+		wantErr string
+	}{
+		{"tab indentation", "a:\n\tb: 1", "line 2: tabs are not allowed"},
+		{"tab after spaces", "a:\n  \tb: 1", "line 2: tabs are not allowed"},
+		{"indented after scalar", "a: 1\n  b: 2", "line 2: unexpected indentation"},
+		{"inconsistent dedent", "a:\n    b: 1\n  c: 2", "line 3: unexpected indentation"},
+		{"over-indented sequence entry", "a:\n  - 1\n    - 2", "line 3: unexpected indentation"},
+		{"dedent below document", "  a: 1\nb: 2", "line 2: unexpected indentation"},
+		{"duplicate key", "a: 1\nb: 2\na: 3", `line 3: duplicate key "a"`},
+		{"bare scalar in mapping", "a: 1\njust text", "line 2: expected key: value"},
+		{"mapping after sequence", "- a\nb: 1", "line 2: expected a sequence entry"},
+		{"key without space", "a:1", "line 1: expected key: value"},
+		{"unterminated double quote", `a: "abc`, "line 1: invalid quoted string"},
+		{"bad escape", `a: "\q"`, "line 1: invalid quoted string"},
+		{"unterminated single quote", "a: 'abc", "line 1: invalid quoted string"},
+		{"unterminated flow mapping", "a: {b: 1", "line 1: unterminated flow mapping"},
+		{"unterminated flow sequence", "a: [1, 2", "line 1: unterminated flow sequence"},
+		{"flow mapping without key", "a: {b}", "line 1: expected key: value in flow mapping"},
+		{"nested flow error", "a: [1, 'x]", "line 1: invalid quoted string"},
+		{"literal block scalar", "a: |\n  text", "line 1: block scalars"},
+		{"folded block scalar", "a: >", "line 1: block scalars"},
+		{"anchor", "a: &x 1", "line 1: block scalars, anchors and aliases"},
+		{"alias", "b: *x", "line 1: block scalars, anchors and aliases"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseYAML(tt.data)
+			if err == nil {
+				t.Fatalf("parseYAML() = %#v, want an error", got)
+			}
+			if !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("parseYAML() error = %q, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -29,9 +29,21 @@ interface AnalyticsData {
   response_time_p95: number;
   response_time_p99: number;
   error_rate: number;
+  error_rates?: Record<string, ErrorRate>;
   timestamp: number;
 }
 
+interface ErrorRate {
+  requests: number;
+  errors: number;
+  rate: number;
+  by_status: Record<string, number>;
+}
+
+// recentErrorRate prefers the 5 minute error rate over the all-time one
+const recentErrorRate = (data: AnalyticsData): number =>
+  data.error_rates?.['5m']?.rate ?? data.error_rate;
+
 interface UserStats {
   user_id: string;
   total_input_tokens: number;
@@ -58,43 +70,65 @@ export const AnalyticsDashboard: React.FC = () => {
   const [historicalData, setHistoricalData] = useState<any[]>([]);
 
   useEffect(() => {
+    const applyAnalytics = (data: AnalyticsData) => {
+      setAnalyticsData(data);
+
+      // Add to historical data for trends
+      setHistoricalData(prev => [
+        ...prev.slice(-19), // Keep last 19 entries
+        {
+          time: new Date(data.timestamp * 1000).toLocaleTimeString(),
+          activeUsers5m: data.active_users_5m,
+          activeUsers1h: data.active_users_1h,
+          activeSessions: data.active_sessions,
+          inputRate: data.token_rates.input_per_minute,
+          outputRate: data.token_rates.output_per_minute,
+          responseTimeP95: data.response_time_p95,
+          errorRate: recentErrorRate(data) * 100, // Convert to percentage
+        }
+      ]);
+
+      setError(null);
+      setLoading(false);
+    };
+
     const fetchAnalytics = async () => {
       try {
         const response = await fetch('http://localhost:8081/analytics');
         if (!response.ok) throw new Error('Failed to fetch analytics');
-        
-        const data = await response.json();
-        setAnalyticsData(data);
-        
-        // Add to historical data for trends
-        setHistoricalData(prev => [
-          ...prev.slice(-19), // Keep last 19 entries
-          {
-            time: new Date(data.timestamp * 1000).toLocaleTimeString(),
-            activeUsers5m: data.active_users_5m,
-            activeUsers1h: data.active_users_1h,
-            activeSessions: data.active_sessions,
-            inputRate: data.token_rates.input_per_minute,
-            outputRate: data.token_rates.output_per_minute,
-            responseTimeP95: data.response_time_p95,
-            errorRate: data.error_rate * 100, // Convert to percentage
-          }
-        ]);
-        
-        setError(null);
+        applyAnalytics(await response.json());
       } catch (err) {
         setError(err instanceof Error ? err.message : 'Unknown error');
-      } finally {
         setLoading(false);
       }
     };
 
-    // Initial fetch
-    fetchAnalytics();
-    
-    // Set up polling every 10 seconds
-    const interval = setInterval(fetchAnalytics, 10000);
-    return () => clearInterval(interval);
+    // Live updates are pushed over a WebSocket: a snapshot, then deltas of the
+    // fields that changed. Fall back to polling every 10 seconds if it closes.
+    let current: AnalyticsData | null = null;
+    let interval: ReturnType<typeof setInterval> | undefined;
+    const startPolling = () => {
+      if (interval === undefined) {
+        fetchAnalytics();
+        interval = setInterval(fetchAnalytics, 10000);
+      }
+    };
+
+    const socket = new WebSocket('ws://localhost:8081/analytics/ws');
+    socket.onmessage = (event) => {
+      const message = JSON.parse(event.data);
+      current = message.type === 'snapshot' || current === null
+        ? message.data
+        : { ...current, ...message.data };
+      applyAnalytics(current as AnalyticsData);
+    };
+    socket.onclose = startPolling;
+
+    return () => {
+      socket.onclose = null;
+      socket.close();
+      if (interval !== undefined) clearInterval(interval);
+    };
   }, []);
 
   if (loading) {
@@ -191,10 +225,10 @@ export const AnalyticsDashboard: React.FC = () => {
         />
         <MetricCard
           title="Error Rate"
-          value={`${(analyticsData.error_rate * 100).toFixed(2)}%`}
+          value={`${(recentErrorRate(analyticsData) * 100).toFixed(2)}%`}
           icon={<AlertTriangle size={24} />}
-          trend={analyticsData.error_rate < 0.01 ? 'up' : 'down'}
-          subtitle={analyticsData.error_rate < 0.01 ? 'Healthy' : 'Needs Attention'}
+          trend={recentErrorRate(analyticsData) < 0.01 ? 'up' : 'down'}
+          subtitle={recentErrorRate(analyticsData) < 0.01 ? 'Healthy (last 5m)' : 'Needs Attention (last 5m)'}
         />
       </div>
 
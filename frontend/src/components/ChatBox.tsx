@@ -94,7 +94,9 @@ export default function ChatBox() {
       });
 
       if (response.status !== 200) {
-        setError(`Error: ${response.statusText || 'Failed to get response'}`);
+        // Quote the request ID so a reported failure can be found in the logs
+        const requestId = response.headers.get('X-Request-ID');
+        setError(`Error: ${response.statusText || 'Failed to get response'}${requestId ? ` (request ID ${requestId})` : ''}`);
         logError('api_error', response.status, currentInput.length);
         return;
       }
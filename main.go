@@ -2,9 +2,9 @@ package main
 
 import (
 	"context"
+	"errors"
 	"encoding/json"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"os/signal"
@@ -13,7 +13,13 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/ajeetraina/genai-app-demo/pkg/errorreport"
+	"github.com/ajeetraina/genai-app-demo/pkg/health"
+	"github.com/ajeetraina/genai-app-demo/pkg/logger"
+	"github.com/ajeetraina/genai-app-demo/pkg/metrics"
 	"github.com/ajeetraina/genai-app-demo/pkg/middleware"
+	"github.com/ajeetraina/genai-app-demo/pkg/otelmetrics"
+	"github.com/ajeetraina/genai-app-demo/pkg/slo"
 	"github.com/ajeetraina/genai-app-demo/pkg/tracing"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
@@ -21,6 +27,7 @@ import (
 	dto "github.com/prometheus/client_model/go"
 	"github.com/openai/openai-go"
 	"github.com/openai/openai-go/option"
+	"github.com/rs/zerolog/log"
 )
 
 // Create a custom registry for metrics
@@ -36,6 +43,13 @@ type ChatRequest struct {
 	Messages []Message `json:"messages"`
 	Message  string    `json:"message"`
 	Format   string    `json:"format,omitempty"` // Optional format parameter
+
+	// Temperature overrides the model's sampling temperature, from 0 to 2
+	Temperature *float64 `json:"temperature,omitempty"`
+
+	// TimeoutMs is how long the client waits for the response, like the
+	// X-Request-Timeout-Ms header
+	TimeoutMs int `json:"timeout_ms,omitempty"`
 }
 
 type MetricLog struct {
@@ -137,6 +151,41 @@ var (
 		[]string{"model"},
 	)
 
+	// Model calls slower than SLOW_MODEL_CALL_THRESHOLD_MS
+	slowModelCalls = promautoFactory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "genai_app_slow_model_calls_total",
+			Help: "Total number of model calls exceeding the slow call threshold",
+		},
+		[]string{"model", "task_type"},
+	)
+
+	// Requests whose time budget ran out, by the stage it ran out in
+	deadlineExceeded = promautoFactory.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "genai_app_deadline_exceeded_total",
+			Help: "Total number of requests that ran out of their time budget, by stage",
+		},
+		[]string{"stage"},
+	)
+
+	// Outcome of the live model backend checks of /health?deep=true
+	modelBackendUp = promautoFactory.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "genai_app_model_backend_up",
+			Help: "Whether the model backend served the model at its last live check",
+		},
+		[]string{"model", "url"},
+	)
+
+	modelBackendCheckLatency = promautoFactory.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "genai_app_model_backend_check_latency_seconds",
+			Help: "Latency of the last live check of the model backend",
+		},
+		[]string{"model", "url"},
+	)
+
 	// LlamaCpp metrics
 	llamacppContextSize = promautoFactory.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -311,7 +360,8 @@ func getLlamaCppMetrics(model string) *LlamaCppMetrics {
 }
 
 func main() {
-	log.Println("Starting GenAI App with observability")
+	logger.InitFromEnv("genai-app")
+	log.Info().Msg("Starting GenAI App with observability")
 
 	// Get configuration from environment
 	baseURL := os.Getenv("BASE_URL")
@@ -323,31 +373,109 @@ func main() {
 	var tracingCleanup func()
 
 	if tracingEnabled {
-		otlpEndpoint := getEnvOrDefault("OTLP_ENDPOINT", "jaeger:4318")
-		log.Printf("Setting up tracing with endpoint: %s", otlpEndpoint)
-
-		cleanup, err := tracing.SetupTracing("genai-app", otlpEndpoint)
+		// Exporter, headers and sampling follow the OTEL_* variables
+		var cleanup func()
+		tracingConfig, err := tracing.ConfigFromEnv("jaeger:4318")
+		if err == nil {
+			log.Info().Str("protocol", tracingConfig.Protocol).Str("endpoint", tracingConfig.Endpoint).Msg("Setting up tracing")
+			cleanup, err = tracing.SetupTracing("genai-app", tracingConfig)
+		}
 		if err != nil {
-			log.Printf("Failed to set up tracing: %v", err)
+			log.Error().Err(err).Msg("Failed to set up tracing")
 		} else {
 			tracingCleanup = cleanup
 			defer tracingCleanup()
-			log.Println("Tracing initialized successfully")
+			log.Info().Msg("Tracing initialized successfully")
 		}
 	}
 
+	// Go runtime and process metrics, to correlate latency incidents with
+	// GC pauses, scheduler latency, memory or file descriptor pressure
+	metrics.RegisterRuntimeCollectors(registry)
+
+	// Push the Prometheus metrics to an OpenTelemetry Collector as well, when
+	// OTEL_METRICS_EXPORTER=otlp
+	if metricsCleanup, err := otelmetrics.SetupFromEnv("genai-app", registry); err != nil {
+		log.Error().Err(err).Msg("Failed to set up metrics export")
+	} else if metricsCleanup != nil {
+		defer metricsCleanup()
+	}
+
+	// Report panics and 5xx responses to a Sentry-compatible DSN, when
+	// SENTRY_DSN is set
+	reporter, err := errorreport.NewFromEnv("genai-app")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid error reporting settings")
+	}
+	if reporter != nil {
+		defer reporter.Close(5 * time.Second)
+	}
+
 	// Create OpenAI client
+	// Model requests carry the trace context, so the model runner's spans
+	// join the chat request's trace
 	client := openai.NewClient(
 		option.WithBaseURL(baseURL),
 		option.WithAPIKey(apiKey),
+		option.WithHTTPClient(&http.Client{Transport: tracing.Transport(nil)}),
 	)
 
+	// The service is ready once the model server answers
+	readiness := health.NewReadiness(2 * time.Second)
+	readiness.Add("model", func(ctx context.Context) error {
+		_, err := client.Models.List(ctx, option.WithMaxRetries(0))
+		return err
+	})
+
+	// /health?deep=true checks that each model backend serves its model,
+	// reusing the results briefly; HEALTH_DEEP=true makes that the default
+	modelProbe, err := newModelProbe(client, model, baseURL, apiKey)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid model health check settings")
+	}
+	deepHealthDefault, _ := strconv.ParseBool(getEnvOrDefault("HEALTH_DEEP", "false"))
+
 	// Create router
 	mux := http.NewServeMux()
 
 	// Apply middleware
+	// Log every API call, sampling the high-volume endpoints
+	accessLogConfig, err := middleware.AccessLogConfigFromEnv("/metrics/summary=0.01")
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid access log settings")
+	}
+	// Model calls slower than the threshold are logged and counted; 0 turns
+	// the slow call log off
+	slowModelCallMs, err := strconv.Atoi(getEnvOrDefault("SLOW_MODEL_CALL_THRESHOLD_MS", "10000"))
+	if err != nil || slowModelCallMs < 0 {
+		log.Fatal().Str("value", os.Getenv("SLOW_MODEL_CALL_THRESHOLD_MS")).Msg("Invalid SLOW_MODEL_CALL_THRESHOLD_MS")
+	}
+	slowModelCall := time.Duration(slowModelCallMs) * time.Millisecond
+	deadlines, err := middleware.DeadlineConfigFromEnv()
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid request timeout settings")
+	}
+	// Objectives in SLO_CONFIG_FILE get error budget burn rate metrics
+	var sloTracker *slo.Tracker
+	if path := os.Getenv("SLO_CONFIG_FILE"); path != "" {
+		sloConfig, err := slo.LoadConfig(path)
+		if err != nil {
+			log.Fatal().Err(err).Str("path", path).Msg("Invalid SLO config")
+		}
+		sloTracker = slo.NewTracker(sloConfig, registry)
+		log.Info().Int("objectives", len(sloConfig.Objectives)).Msg("SLO tracking enabled")
+	}
 	handlersChain := func(h http.Handler) http.Handler {
+		if reporter != nil {
+			h = middleware.ErrorReporting(reporter)(h)
+		}
+		if sloTracker != nil {
+			h = middleware.SLOMiddleware(sloTracker)(h)
+		}
 		h = middleware.MetricsMiddleware(requestCounter, requestDuration, activeRequests)(h)
+		h = middleware.AccessLog(accessLogConfig)(h)
+		h = middleware.LoggingMiddleware(h)
+		h = middleware.RequestIDMiddleware(h)
 		if tracingEnabled {
 			h = middleware.TracingMiddleware(h)
 		}
@@ -365,11 +493,14 @@ func main() {
 		}
 	})
 
+	// Liveness and readiness probes for orchestrators
+	mux.HandleFunc("/healthz", health.HandleLiveness())
+	mux.HandleFunc("/readyz", health.HandleReadiness(readiness))
+
 	// Add health check endpoint
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Content-Type", "application/json")
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.WriteHeader(http.StatusOK)
 		
 		// Check if the model is a llama.cpp model
 		isLlamaCpp := strings.Contains(strings.ToLower(model), "llama") || 
@@ -406,7 +537,32 @@ func main() {
 			"status": "ok",
 			"model_info": modelInfo,
 		}
-		
+
+		// Live checks of the model backends; the service is unavailable
+		// when none of them serves its model
+		status := http.StatusOK
+		deep := deepHealthDefault
+		if value := r.URL.Query().Get("deep"); value != "" {
+			deep, _ = strconv.ParseBool(value)
+		}
+		if deep {
+			models := modelProbe.Run(r.Context())
+			for _, backend := range models {
+				up := 0.0
+				if backend.Status == "ok" {
+					up = 1
+				}
+				modelBackendUp.WithLabelValues(backend.Model, backend.URL).Set(up)
+				modelBackendCheckLatency.WithLabelValues(backend.Model, backend.URL).Set(backend.LatencyMs / 1000)
+			}
+			response["models"] = models
+			response["status"] = health.ModelsStatus(models)
+			if response["status"] == "unavailable" {
+				status = http.StatusServiceUnavailable
+			}
+		}
+
+		w.WriteHeader(status)
 		json.NewEncoder(w).Encode(response)
 	})
 
@@ -527,7 +683,7 @@ func main() {
 	})
 
 	// Add chat endpoint with advanced tracing
-	mux.HandleFunc("/chat", handleChat(client, model, baseURL))
+	mux.HandleFunc("/chat", handleChat(client, model, baseURL, slowModelCall, deadlines))
 
 	// Create HTTP server
 	server := &http.Server{
@@ -544,17 +700,17 @@ func main() {
 	}
 	
 	go func() {
-		log.Println("Starting metrics server on :9090")
+		log.Info().Str("addr", ":9090").Msg("Starting metrics server")
 		if err := metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Failed to start metrics server: %v", err)
+			log.Fatal().Err(err).Msg("Failed to start metrics server")
 		}
 	}()
 
 	// Start the main server
 	go func() {
-		log.Println("Starting server on :8080")
+		log.Info().Str("addr", ":8080").Msg("Starting server")
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Failed to start server: %v", err)
+			log.Fatal().Err(err).Msg("Failed to start server")
 		}
 	}()
 
@@ -562,7 +718,7 @@ func main() {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 	<-quit
-	log.Println("Shutting down server...")
+	log.Info().Msg("Shutting down server...")
 
 	// Shutdown the server with a timeout
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
@@ -570,13 +726,129 @@ func main() {
 
 	// Shutdown servers
 	if err := server.Shutdown(ctx); err != nil {
-		log.Fatalf("Server forced to shutdown: %v", err)
+		log.Fatal().Err(err).Msg("Server forced to shutdown")
 	}
 	if err := metricsServer.Shutdown(ctx); err != nil {
-		log.Fatalf("Metrics server forced to shutdown: %v", err)
+		log.Fatal().Err(err).Msg("Metrics server forced to shutdown")
+	}
+
+	log.Info().Msg("Server exiting")
+}
+
+// newModelProbe sets up the live checks of the configured model backend and
+// of the extra backends in HEALTH_MODEL_BACKENDS, whose results are reused
+// for HEALTH_MODEL_CACHE_SECONDS
+func newModelProbe(client *openai.Client, model, baseURL, apiKey string) (*health.ModelProbe, error) {
+	backends, err := health.ParseModelBackends(os.Getenv("HEALTH_MODEL_BACKENDS"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid HEALTH_MODEL_BACKENDS: %w", err)
+	}
+	cacheSeconds, err := strconv.Atoi(getEnvOrDefault("HEALTH_MODEL_CACHE_SECONDS", "10"))
+	if err != nil || cacheSeconds < 0 {
+		return nil, fmt.Errorf("HEALTH_MODEL_CACHE_SECONDS must be a number of seconds")
+	}
+
+	probe := health.NewModelProbe(5*time.Second, time.Duration(cacheSeconds)*time.Second)
+	probe.Add(health.ModelBackend{Model: model, URL: baseURL, Check: modelServedCheck(client, model)})
+	for _, backend := range backends {
+		backendClient := openai.NewClient(
+			option.WithBaseURL(backend.URL),
+			option.WithAPIKey(apiKey),
+			option.WithHTTPClient(&http.Client{Transport: tracing.Transport(nil)}),
+		)
+		backend.Check = modelServedCheck(backendClient, backend.Model)
+		probe.Add(backend)
+	}
+	return probe, nil
+}
+
+// modelServedCheck checks that the model server lists the model
+func modelServedCheck(client *openai.Client, model string) health.Check {
+	return func(ctx context.Context) error {
+		page, err := client.Models.List(ctx, option.WithMaxRetries(0))
+		if err != nil {
+			return err
+		}
+		for _, served := range page.Data {
+			if served.ID == model {
+				return nil
+			}
+		}
+		return fmt.Errorf("model %s is not served", model)
+	}
+}
+
+// writeError replies with a JSON error carrying the request's correlation ID,
+// which users can quote when reporting a failure
+func writeError(w http.ResponseWriter, r *http.Request, message string, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"error":      message,
+		"request_id": middleware.RequestID(r.Context()),
+	})
+}
+
+// writeStreamError reports an error that ends a chat response. Once part of
+// the response has been streamed its status has gone out, so the error is
+// sent as an SSE error event instead.
+func writeStreamError(w http.ResponseWriter, r *http.Request, message string, status int, streamed bool) {
+	if !streamed {
+		writeError(w, r, message, status)
+		return
+	}
+	data, _ := json.Marshal(map[string]string{
+		"error":      message,
+		"request_id": middleware.RequestID(r.Context()),
+	})
+	fmt.Fprintf(w, "\n\nevent: error\ndata: %s\n\n", data)
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
 	}
+}
 
-	log.Println("Server exiting")
+// slowModelCallInfo describes a model call that exceeded the slow call threshold
+type slowModelCallInfo struct {
+	Model        string
+	ModelURL     string
+	TaskType     string
+	PromptTokens int
+	PromptChars  int
+	OutputTokens int
+	Duration     time.Duration
+	FirstToken   time.Duration
+	Err          error
+}
+
+// recordSlowModelCall logs and counts a slow model call. The request-scoped
+// logger adds the request and trace IDs, so the line leads straight to the
+// call's trace.
+func recordSlowModelCall(ctx context.Context, call slowModelCallInfo) {
+	slowModelCalls.WithLabelValues(call.Model, call.TaskType).Inc()
+
+	event := log.Ctx(ctx).Warn().
+		Str("model", call.Model).
+		Str("model_url", call.ModelURL).
+		Str("task_type", call.TaskType).
+		Int("prompt_tokens", call.PromptTokens).
+		Int("prompt_chars", call.PromptChars).
+		Int("output_tokens", call.OutputTokens).
+		Dur("duration", call.Duration)
+	if call.FirstToken > 0 {
+		event = event.Dur("time_to_first_token", call.FirstToken)
+	}
+	if call.Err != nil {
+		event = event.Err(call.Err)
+	}
+	event.Msg("Slow model call")
+}
+
+// chatTaskType names the kind of work a chat request asks of the model
+func chatTaskType(req ChatRequest, useMarkdown bool) string {
+	if useMarkdown {
+		return "markdown"
+	}
+	return "chat"
 }
 
 // getEnvOrDefault gets an environment variable or returns a default value
@@ -589,11 +861,13 @@ func getEnvOrDefault(key, defaultValue string) string {
 }
 
 // handleChat handles the chat endpoint with simple tracing
-func handleChat(client *openai.Client, model string, apiBaseURL string) http.HandlerFunc {
+func handleChat(client *openai.Client, model string, apiBaseURL string, slowModelCall time.Duration, deadlines middleware.DeadlineConfig) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		received := time.Now()
 		w.Header().Set("Access-Control-Allow-Origin", "*")
 		w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
-		w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, X-Request-ID, X-Request-Timeout-Ms, traceparent, tracestate")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
 
 		if r.Method == http.MethodOptions {
 			w.WriteHeader(http.StatusOK)
@@ -601,18 +875,33 @@ func handleChat(client *openai.Client, model string, apiBaseURL string) http.Han
 		}
 
 		if r.Method != http.MethodPost {
-			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			writeError(w, r, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
 		var req ChatRequest
 		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-			log.Printf("Invalid request body: %v", err)
-			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			log.Ctx(r.Context()).Warn().Err(err).Msg("Invalid request body")
+			writeError(w, r, "Invalid request body", http.StatusBadRequest)
+			requestCounter.WithLabelValues(r.Method, r.URL.Path, fmt.Sprintf("%d", http.StatusBadRequest)).Inc()
+			return
+		}
+		if req.Temperature != nil && (*req.Temperature < 0 || *req.Temperature > 2) {
+			writeError(w, r, "Temperature must be between 0 and 2", http.StatusBadRequest)
 			requestCounter.WithLabelValues(r.Method, r.URL.Path, fmt.Sprintf("%d", http.StatusBadRequest)).Inc()
 			return
 		}
 
+		// The client's timeout bounds the model call, so it does not run on
+		// after the client has given up on it
+		headerTimeout, err := middleware.RequestTimeout(r)
+		if err != nil || req.TimeoutMs < 0 {
+			writeError(w, r, "Timeout must be a positive number of milliseconds", http.StatusBadRequest)
+			requestCounter.WithLabelValues(r.Method, r.URL.Path, fmt.Sprintf("%d", http.StatusBadRequest)).Inc()
+			return
+		}
+		budget := deadlines.Budget(received, headerTimeout, time.Duration(req.TimeoutMs)*time.Millisecond)
+
 		// Set headers for SSE
 		w.Header().Set("Content-Type", "text/event-stream")
 		w.Header().Set("Cache-Control", "no-cache")
@@ -621,8 +910,10 @@ func handleChat(client *openai.Client, model string, apiBaseURL string) http.Han
 
 		// Count input tokens (rough estimate)
 		inputTokens := 0
+		promptChars := len(req.Message)
 		for _, msg := range req.Messages {
 			inputTokens += len(msg.Content) / 4 // Rough estimate
+			promptChars += len(msg.Content)
 		}
 		inputTokens += len(req.Message) / 4
 		
@@ -677,15 +968,38 @@ func handleChat(client *openai.Client, model string, apiBaseURL string) http.Han
 			Messages: openai.F(messages),
 			Model:    openai.F(model),
 		}
+		if req.Temperature != nil {
+			param.Temperature = openai.F(*req.Temperature)
+		}
 
 		// Set prompt evaluation start time for llama.cpp metrics
 		promptEvalStartTime := time.Now()
 
-		ctx := r.Context()
-		stream := client.Chat.Completions.NewStreaming(ctx, param)
+		// The model call gets whatever time is left, and tells the model
+		// server how much that is
+		modelCtx, cancelModel := budget.Context(r.Context())
+		defer cancelModel()
+
+		// The model call gets its own span, annotated with the gen_ai.*
+		// attributes that LLM views in tracing backends understand
+		ctx, chatSpan := tracing.StartChatSpan(modelCtx, tracing.ChatRequest{
+			System:      "openai",
+			Model:       model,
+			BaseURL:     apiBaseURL,
+			Temperature: req.Temperature,
+		})
+		var chatResponse tracing.ChatResponse
+		stream := client.Chat.Completions.NewStreaming(ctx, param,
+			option.WithHeader(middleware.TimeoutHeader, strconv.FormatInt(budget.Remaining().Milliseconds(), 10)))
 
 		for stream.Next() {
 			chunk := stream.Current()
+			chatResponse.ID, chatResponse.Model = chunk.ID, chunk.Model
+			for _, choice := range chunk.Choices {
+				if choice.FinishReason != "" {
+					chatResponse.FinishReasons = append(chatResponse.FinishReasons, string(choice.FinishReason))
+				}
+			}
 
 			// Record first token time
 			if firstTokenTime.IsZero() && len(chunk.Choices) > 0 && chunk.Choices[0].Delta.Content != "" {
@@ -704,12 +1018,15 @@ func handleChat(client *openai.Client, model string, apiBaseURL string) http.Han
 				outputTokens++
 				_, err := fmt.Fprintf(w, "%s", chunk.Choices[0].Delta.Content)
 				if err != nil {
-					log.Printf("Error writing to stream: %v", err)
+					log.Ctx(r.Context()).Warn().Err(err).Msg("Error writing to stream")
+					tracing.EndChatSpan(chatSpan, chatResponse, err)
 					return
 				}
 				w.(http.Flusher).Flush()
 			}
 		}
+		chatResponse.InputTokens, chatResponse.OutputTokens = inputTokens, outputTokens
+		tracing.EndChatSpan(chatSpan, chatResponse, stream.Err())
 
 		// Calculate tokens per second for llama.cpp metrics
 		if strings.Contains(strings.ToLower(model), "llama") || 
@@ -723,19 +1040,49 @@ func handleChat(client *openai.Client, model string, apiBaseURL string) http.Han
 
 		// Record metrics
 		requestDuration.WithLabelValues(r.Method, r.URL.Path).Observe(time.Since(start).Seconds())
-		requestCounter.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+		if stream.Err() == nil {
+			requestCounter.WithLabelValues(r.Method, r.URL.Path, "200").Inc()
+		}
 		chatTokensCounter.WithLabelValues("output", model).Add(float64(outputTokens))
+		middleware.RecordTokens(r.Context(), inputTokens, outputTokens)
 		modelLatency.WithLabelValues(model, "inference").Observe(time.Since(modelStartTime).Seconds())
 		
 		if !firstTokenTime.IsZero() {
 			ttft := firstTokenTime.Sub(modelStartTime).Seconds()
-			log.Printf("Time to first token: %.3f seconds", ttft)
+			log.Ctx(r.Context()).Debug().Float64("ttft_seconds", ttft).Msg("Time to first token")
 			firstTokenLatency.WithLabelValues(model).Observe(ttft)
 		}
 
+		if modelDuration := time.Since(modelStartTime); slowModelCall > 0 && modelDuration > slowModelCall {
+			var ttft time.Duration
+			if !firstTokenTime.IsZero() {
+				ttft = firstTokenTime.Sub(modelStartTime)
+			}
+			recordSlowModelCall(r.Context(), slowModelCallInfo{
+				Model:        model,
+				ModelURL:     apiBaseURL,
+				TaskType:     chatTaskType(req, useMarkdown),
+				PromptTokens: inputTokens,
+				PromptChars:  promptChars,
+				OutputTokens: outputTokens,
+				Duration:     modelDuration,
+				FirstToken:   ttft,
+				Err:          stream.Err(),
+			})
+		}
+
 		if err := stream.Err(); err != nil {
-			log.Printf("Error in stream: %v", err)
-			http.Error(w, "Internal server error", http.StatusInternalServerError)
+			if errors.Is(modelCtx.Err(), context.DeadlineExceeded) {
+				deadlineExceeded.WithLabelValues(middleware.StageModel).Inc()
+				log.Ctx(r.Context()).Warn().Err(err).Dur("timeout", budget.Deadline().Sub(received)).Msg("Request deadline exceeded during the model call")
+				writeStreamError(w, r, "Request deadline exceeded", http.StatusGatewayTimeout, outputTokens > 0)
+				requestCounter.WithLabelValues(r.Method, r.URL.Path, fmt.Sprintf("%d", http.StatusGatewayTimeout)).Inc()
+				return
+			}
+			log.Ctx(r.Context()).Error().Err(err).Msg("Error in stream")
+			middleware.ReportError(r.Context(), err)
+			writeStreamError(w, r, "Internal server error", http.StatusInternalServerError, outputTokens > 0)
+			requestCounter.WithLabelValues(r.Method, r.URL.Path, fmt.Sprintf("%d", http.StatusInternalServerError)).Inc()
 			return
 		}
 	}
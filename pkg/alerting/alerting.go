@@ -0,0 +1,359 @@
+// Package alerting evaluates threshold rules in-process and sends the alerts
+// they raise to pluggable notifiers, for deployments without Alertmanager
+package alerting
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Rule comparators
+const (
+	Above = "above"
+	Below = "below"
+)
+
+// Alert statuses
+const (
+	StatusFiring   = "firing"
+	StatusResolved = "resolved"
+)
+
+// Rule states reported by Evaluator.States
+const (
+	StateInactive = "inactive"
+	StatePending  = "pending"
+	StateFiring   = "firing"
+)
+
+// Duration is a time.Duration read from and written as JSON strings like "5m"
+type Duration struct {
+	time.Duration
+}
+
+// UnmarshalJSON parses a duration string
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+// MarshalJSON formats the duration as a string
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// Rule raises an alert when a metric stays above or below a threshold for a
+// duration. Tenant and Model narrow the metric to a tenant's or model's data.
+type Rule struct {
+	Name       string   `json:"name"`
+	Metric     string   `json:"metric"`
+	Tenant     string   `json:"tenant,omitempty"`
+	Model      string   `json:"model,omitempty"`
+	Comparator string   `json:"comparator,omitempty"`
+	Threshold  float64  `json:"threshold"`
+	For        Duration `json:"for,omitempty"`
+	Severity   string   `json:"severity,omitempty"`
+}
+
+// breached reports whether value crosses the rule's threshold
+func (r Rule) breached(value float64) bool {
+	if r.Comparator == Below {
+		return value < r.Threshold
+	}
+	return value > r.Threshold
+}
+
+// Alert is a rule that started firing or resolved
+type Alert struct {
+	Rule       string     `json:"rule"`
+	Status     string     `json:"status"`
+	Metric     string     `json:"metric"`
+	Tenant     string     `json:"tenant,omitempty"`
+	Model      string     `json:"model,omitempty"`
+	Severity   string     `json:"severity"`
+	Comparator string     `json:"comparator"`
+	Threshold  float64    `json:"threshold"`
+	Value      float64    `json:"value"`
+	StartsAt   time.Time  `json:"starts_at"`
+	EndsAt     *time.Time `json:"ends_at,omitempty"`
+}
+
+// Summary describes the alert in one line for chat and paging notifiers
+func (a Alert) Summary() string {
+	subject := a.Metric
+	if a.Model != "" {
+		subject += " for model " + a.Model
+	}
+	if a.Tenant != "" {
+		subject += " in tenant " + a.Tenant
+	}
+	if a.Status == StatusResolved {
+		return fmt.Sprintf("[RESOLVED] %s: %s is %.4g", a.Rule, subject, a.Value)
+	}
+	return fmt.Sprintf("[%s] %s: %s is %.4g, %s threshold %.4g",
+		a.Severity, a.Rule, subject, a.Value, a.Comparator, a.Threshold)
+}
+
+// Config is the rules and notifiers read from an alerting config file
+type Config struct {
+	Rules     []Rule           `json:"rules"`
+	Notifiers []NotifierConfig `json:"notifiers"`
+}
+
+// LoadConfig reads and validates a JSON alerting config. Rule names must be
+// unique; comparators default to above and severities to warning.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid alerting config: %v", err)
+	}
+
+	names := make(map[string]bool)
+	for i := range config.Rules {
+		rule := &config.Rules[i]
+		if rule.Name == "" || rule.Metric == "" {
+			return nil, fmt.Errorf("rule %d requires a name and metric", i)
+		}
+		if names[rule.Name] {
+			return nil, fmt.Errorf("duplicate rule name %q", rule.Name)
+		}
+		names[rule.Name] = true
+		if rule.Comparator == "" {
+			rule.Comparator = Above
+		}
+		if rule.Comparator != Above && rule.Comparator != Below {
+			return nil, fmt.Errorf("rule %q: invalid comparator %q, expected above or below", rule.Name, rule.Comparator)
+		}
+		if rule.Severity == "" {
+			rule.Severity = "warning"
+		}
+	}
+	return &config, nil
+}
+
+// Sampler returns the current value of a rule's metric
+type Sampler func(ctx context.Context, rule Rule) (float64, error)
+
+// RuleStatus is the evaluation state of a rule
+type RuleStatus struct {
+	Rule
+	State     string    `json:"state"`
+	Value     float64   `json:"value"`
+	Since     time.Time `json:"since"`
+	Error     string    `json:"error,omitempty"`
+	Evaluated time.Time `json:"evaluated_at"`
+}
+
+// ruleState tracks a rule between evaluations
+type ruleState struct {
+	value     float64
+	err       error
+	evaluated time.Time
+	// pendingSince is when the threshold was first breached, or zero
+	pendingSince time.Time
+	// firing is the alert sent when the rule started firing, or nil
+	firing *Alert
+}
+
+// Evaluator periodically samples each rule's metric and notifies when rules
+// start firing and when they resolve
+type Evaluator struct {
+	rules     []Rule
+	notifiers []Notifier
+	sample    Sampler
+
+	mu     sync.Mutex
+	states map[string]*ruleState
+
+	firingGauge   *prometheus.GaugeVec
+	notifications *prometheus.CounterVec
+}
+
+// NewEvaluator creates an evaluator. Its metrics are registered with registerer.
+func NewEvaluator(rules []Rule, notifiers []Notifier, sample Sampler, registerer prometheus.Registerer) *Evaluator {
+	factory := promauto.With(registerer)
+	return &Evaluator{
+		rules:     rules,
+		notifiers: notifiers,
+		sample:    sample,
+		states:    make(map[string]*ruleState),
+		firingGauge: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "genai_app_alerts_firing",
+			Help: "Whether each alert rule is firing (1) or not (0)",
+		}, []string{"rule", "severity"}),
+		notifications: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "genai_app_alert_notifications_total",
+			Help: "Alert notifications by notifier and result",
+		}, []string{"notifier", "result"}),
+	}
+}
+
+// Run evaluates the rules every interval until ctx is done
+func (e *Evaluator) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			e.Evaluate(ctx, now)
+		}
+	}
+}
+
+// SetRules replaces the rules evaluated. Rules that keep their name keep
+// their state; the state of removed rules is forgotten without notifying.
+func (e *Evaluator) SetRules(rules []Rule) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	current := make(map[string]Rule, len(rules))
+	for _, rule := range rules {
+		current[rule.Name] = rule
+	}
+	for _, rule := range e.rules {
+		if kept, ok := current[rule.Name]; !ok || kept.Severity != rule.Severity {
+			e.firingGauge.DeleteLabelValues(rule.Name, rule.Severity)
+		}
+		if _, ok := current[rule.Name]; !ok {
+			delete(e.states, rule.Name)
+		}
+	}
+	e.rules = rules
+}
+
+// Evaluate samples every rule once and sends the resulting alerts
+func (e *Evaluator) Evaluate(ctx context.Context, now time.Time) {
+	e.mu.Lock()
+	rules := e.rules
+	e.mu.Unlock()
+
+	var alerts []Alert
+	for _, rule := range rules {
+		value, err := e.sample(ctx, rule)
+
+		e.mu.Lock()
+		state, ok := e.states[rule.Name]
+		if !ok {
+			state = &ruleState{}
+			e.states[rule.Name] = state
+		}
+		state.value, state.err, state.evaluated = value, err, now
+		if err != nil {
+			// Keep the current state rather than resolving on a failed sample
+			e.mu.Unlock()
+			logger.Component("alerting").Error().Err(err).Str("rule", rule.Name).Msg("Failed to evaluate alert rule")
+			continue
+		}
+
+		switch {
+		case rule.breached(value):
+			if state.pendingSince.IsZero() {
+				state.pendingSince = now
+			}
+			if state.firing == nil && now.Sub(state.pendingSince) >= rule.For.Duration {
+				state.firing = &Alert{
+					Rule:       rule.Name,
+					Status:     StatusFiring,
+					Metric:     rule.Metric,
+					Tenant:     rule.Tenant,
+					Model:      rule.Model,
+					Severity:   rule.Severity,
+					Comparator: rule.Comparator,
+					Threshold:  rule.Threshold,
+					Value:      value,
+					StartsAt:   now,
+				}
+				alerts = append(alerts, *state.firing)
+			}
+		case state.firing != nil:
+			resolved := *state.firing
+			resolved.Status = StatusResolved
+			resolved.Value = value
+			resolved.EndsAt = &now
+			alerts = append(alerts, resolved)
+			state.firing = nil
+			state.pendingSince = time.Time{}
+		default:
+			state.pendingSince = time.Time{}
+		}
+
+		firing := 0.0
+		if state.firing != nil {
+			firing = 1
+		}
+		e.mu.Unlock()
+		e.firingGauge.WithLabelValues(rule.Name, rule.Severity).Set(firing)
+	}
+
+	for _, alert := range alerts {
+		logger.Component("alerting").Warn().Str("rule", alert.Rule).Msg(alert.Summary())
+		e.notify(ctx, alert)
+	}
+}
+
+// notify sends an alert to every notifier
+func (e *Evaluator) notify(ctx context.Context, alert Alert) {
+	for _, notifier := range e.notifiers {
+		if err := notifier.Notify(ctx, alert); err != nil {
+			e.notifications.WithLabelValues(notifier.Name(), "failed").Inc()
+			logger.Component("alerting").Error().Err(err).Str("rule", alert.Rule).Str("notifier", notifier.Name()).Msg("Failed to send alert")
+			continue
+		}
+		e.notifications.WithLabelValues(notifier.Name(), "sent").Inc()
+	}
+}
+
+// States returns the current state of every rule, ordered by name
+func (e *Evaluator) States() []RuleStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	statuses := make([]RuleStatus, 0, len(e.rules))
+	for _, rule := range e.rules {
+		status := RuleStatus{Rule: rule, State: StateInactive}
+		if state, ok := e.states[rule.Name]; ok {
+			status.Value = state.value
+			status.Evaluated = state.evaluated
+			if state.err != nil {
+				status.Error = state.err.Error()
+			}
+			switch {
+			case state.firing != nil:
+				status.State = StateFiring
+				status.Since = state.firing.StartsAt
+			case !state.pendingSince.IsZero():
+				status.State = StatePending
+				status.Since = state.pendingSince
+			}
+		}
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
@@ -0,0 +1,231 @@
+package alerting
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/grafana"
+)
+
+// notifyTimeout bounds each notification request
+const notifyTimeout = 10 * time.Second
+
+// pagerDutyEventsURL is the PagerDuty Events API v2 endpoint
+const pagerDutyEventsURL = "https://events.pagerduty.com/v2/enqueue"
+
+// Notifier delivers alerts to an external system
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, alert Alert) error
+}
+
+// NotifierConfig configures a notifier in an alerting config file
+type NotifierConfig struct {
+	// Type is webhook, slack or pagerduty
+	Type string `json:"type"`
+	// URL is the webhook or Slack incoming webhook URL, or overrides the
+	// PagerDuty events endpoint
+	URL string `json:"url,omitempty"`
+	// Secret signs webhook bodies like the capture webhooks do
+	Secret string `json:"secret,omitempty"`
+	// RoutingKey is the PagerDuty integration key
+	RoutingKey string `json:"routing_key,omitempty"`
+}
+
+// NewNotifier creates the notifier described by config
+func NewNotifier(config NotifierConfig) (Notifier, error) {
+	client := &http.Client{Timeout: notifyTimeout}
+	switch config.Type {
+	case "webhook":
+		if config.URL == "" {
+			return nil, fmt.Errorf("webhook notifier requires a url")
+		}
+		return &WebhookNotifier{url: config.URL, secret: config.Secret, client: client}, nil
+	case "slack":
+		if config.URL == "" {
+			return nil, fmt.Errorf("slack notifier requires a url")
+		}
+		return &SlackNotifier{url: config.URL, client: client}, nil
+	case "pagerduty":
+		if config.RoutingKey == "" {
+			return nil, fmt.Errorf("pagerduty notifier requires a routing_key")
+		}
+		url := config.URL
+		if url == "" {
+			url = pagerDutyEventsURL
+		}
+		return &PagerDutyNotifier{url: url, routingKey: config.RoutingKey, client: client}, nil
+	default:
+		return nil, fmt.Errorf("unknown notifier type %q, expected webhook, slack or pagerduty", config.Type)
+	}
+}
+
+// WebhookNotifier posts alerts as JSON. With a secret, the body's HMAC-SHA256
+// is sent as "sha256=<digest>" in the X-Webhook-Signature header.
+type WebhookNotifier struct {
+	url    string
+	secret string
+	client *http.Client
+}
+
+// Name identifies the notifier in metrics and logs
+func (n *WebhookNotifier) Name() string { return "webhook" }
+
+// Notify posts the alert
+func (n *WebhookNotifier) Notify(ctx context.Context, alert Alert) error {
+	body, err := json.Marshal(alert)
+	if err != nil {
+		return err
+	}
+	headers := map[string]string{}
+	if n.secret != "" {
+		mac := hmac.New(sha256.New, []byte(n.secret))
+		mac.Write(body)
+		headers["X-Webhook-Signature"] = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	return post(ctx, n.client, n.url, body, headers)
+}
+
+// SlackNotifier posts alerts to a Slack incoming webhook
+type SlackNotifier struct {
+	url    string
+	client *http.Client
+}
+
+// Name identifies the notifier in metrics and logs
+func (n *SlackNotifier) Name() string { return "slack" }
+
+// Notify posts the alert's summary as a message
+func (n *SlackNotifier) Notify(ctx context.Context, alert Alert) error {
+	body, err := json.Marshal(map[string]string{"text": alert.Summary()})
+	if err != nil {
+		return err
+	}
+	return post(ctx, n.client, n.url, body, nil)
+}
+
+// PagerDutyNotifier triggers and resolves PagerDuty incidents through the
+// Events API v2, deduplicated by rule name
+type PagerDutyNotifier struct {
+	url        string
+	routingKey string
+	client     *http.Client
+}
+
+// Name identifies the notifier in metrics and logs
+func (n *PagerDutyNotifier) Name() string { return "pagerduty" }
+
+// Notify triggers an incident for a firing alert and resolves it once the
+// alert resolves
+func (n *PagerDutyNotifier) Notify(ctx context.Context, alert Alert) error {
+	action := "trigger"
+	if alert.Status == StatusResolved {
+		action = "resolve"
+	}
+
+	// PagerDuty only accepts these severities
+	severity := alert.Severity
+	switch severity {
+	case "critical", "error", "warning", "info":
+	default:
+		severity = "warning"
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"routing_key":  n.routingKey,
+		"event_action": action,
+		"dedup_key":    "aiwatch:" + alert.Rule,
+		"payload": map[string]interface{}{
+			"summary":        alert.Summary(),
+			"source":         "aiwatch",
+			"severity":       severity,
+			"timestamp":      alert.StartsAt.Format(time.RFC3339),
+			"custom_details": alert,
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return post(ctx, n.client, n.url, body, nil)
+}
+
+// GrafanaNotifier marks alerts on Grafana dashboards as annotated regions,
+// from when a rule starts firing until it resolves
+type GrafanaNotifier struct {
+	annotator *grafana.Annotator
+
+	mu sync.Mutex
+	// regions holds the annotation of each firing rule
+	regions map[string]int64
+}
+
+// NewGrafanaNotifier creates a notifier annotating through annotator
+func NewGrafanaNotifier(annotator *grafana.Annotator) *GrafanaNotifier {
+	return &GrafanaNotifier{annotator: annotator, regions: make(map[string]int64)}
+}
+
+// Name identifies the notifier in metrics and logs
+func (n *GrafanaNotifier) Name() string { return "grafana" }
+
+// Notify starts a region when an alert fires and ends it when it resolves.
+// Alerts that resolve without the notifier having seen them fire, such as
+// after a restart, are annotated as a complete region.
+func (n *GrafanaNotifier) Notify(ctx context.Context, alert Alert) error {
+	n.mu.Lock()
+	id, ok := n.regions[alert.Rule]
+	delete(n.regions, alert.Rule)
+	n.mu.Unlock()
+
+	if alert.Status == StatusResolved && ok && alert.EndsAt != nil {
+		return n.annotator.End(ctx, id, *alert.EndsAt)
+	}
+
+	annotation := grafana.Annotation{
+		Time: alert.StartsAt,
+		Tags: []string{"alert", alert.Rule, alert.Severity, alert.Status},
+		Text: alert.Summary(),
+	}
+	if alert.EndsAt != nil {
+		annotation.TimeEnd = *alert.EndsAt
+	}
+	id, err := n.annotator.Annotate(ctx, annotation)
+	if err != nil {
+		return err
+	}
+	if alert.Status == StatusFiring {
+		n.mu.Lock()
+		n.regions[alert.Rule] = id
+		n.mu.Unlock()
+	}
+	return nil
+}
+
+// post sends a JSON body, treating non-2xx responses as errors
+func post(ctx context.Context, client *http.Client, url string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,191 @@
+package capture
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/logger"
+)
+
+// Activity event types
+const (
+	ActivitySessionStarted   = "session.started"
+	ActivityModelUnavailable = "model.unavailable"
+	ActivityModelAvailable   = "model.available"
+	ActivityAlertFiring      = "alert.firing"
+	ActivityAlertResolved    = "alert.resolved"
+	ActivityBudgetExceeded   = "budget.exceeded"
+)
+
+// activityMaxLen is roughly how many events each tenant's activity stream keeps
+const activityMaxLen = 10000
+
+// maxActivityPage bounds the events returned by one ListActivity call
+const maxActivityPage = 500
+
+// ActivityEvent is a significant event shown in the dashboard's activity
+// feed. Each tenant's events are kept in a capped Redis Stream.
+type ActivityEvent struct {
+	// ID is the stream entry ID, assigned when the event is published
+	ID      string    `json:"id"`
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	Tenant  string    `json:"tenant,omitempty"`
+	Subject string    `json:"subject,omitempty"`
+	Message string    `json:"message"`
+	// Data holds details particular to the event type
+	Data map[string]string `json:"data,omitempty"`
+}
+
+// ActivityKey returns the key of a keyspace's activity stream
+func ActivityKey(ks Keyspace) string {
+	return ks.Key("events:activity")
+}
+
+// PublishActivity appends an event to its tenant's activity stream
+func PublishActivity(ctx context.Context, client redis.Cmdable, event ActivityEvent) error {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return err
+	}
+	return client.XAdd(ctx, &redis.XAddArgs{
+		Stream: ActivityKey(TenantKeyspace(event.Tenant)),
+		MaxLen: activityMaxLen,
+		Approx: true,
+		Values: map[string]interface{}{
+			"time":    event.Time.UTC().Format(time.RFC3339Nano),
+			"type":    event.Type,
+			"tenant":  event.Tenant,
+			"subject": event.Subject,
+			"message": event.Message,
+			"data":    string(data),
+		},
+	}).Err()
+}
+
+// PublishActivity appends an event to the activity stream of its tenant,
+// logging rather than returning a failure since the feed is informational
+func (tcs *TokenCaptureService) PublishActivity(ctx context.Context, event ActivityEvent) {
+	if err := PublishActivity(ctx, tcs.redis, event); err != nil {
+		logger.Component("capture").Error().Err(err).Str("type", event.Type).Msg("Failed to publish activity event")
+	}
+}
+
+// publishSessionsStarted publishes an event for each captured record that
+// was the first request of its session
+func (tcs *TokenCaptureService) publishSessionsStarted(captured []capturedRecord) {
+	for _, record := range captured {
+		if requests, _ := record.sessionRequests.Int64(); requests != 1 || record.metrics.SessionID == "" {
+			continue
+		}
+		metrics := record.metrics
+		tcs.PublishActivity(tcs.ctx, ActivityEvent{
+			Time:    metrics.Timestamp,
+			Type:    ActivitySessionStarted,
+			Tenant:  metrics.Tenant,
+			Subject: metrics.SessionID,
+			Message: "New session by " + metrics.UserID + " with " + metrics.Model,
+			Data:    map[string]string{"user_id": metrics.UserID, "model": metrics.Model},
+		})
+	}
+}
+
+// ActivityQuery selects activity events, newest first
+type ActivityQuery struct {
+	// Type, when set, selects only events of that type
+	Type string
+	// Cursor is the NextCursor of the previous page
+	Cursor string
+	Limit  int
+}
+
+// ActivityPage is a page of activity events
+type ActivityPage struct {
+	Events     []ActivityEvent `json:"events"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
+
+// ListActivity returns a page of a keyspace's activity events matching
+// query, newest first
+func ListActivity(ctx context.Context, client redis.Cmdable, ks Keyspace, query ActivityQuery) (*ActivityPage, error) {
+	limit := query.Limit
+	if limit <= 0 || limit > maxActivityPage {
+		limit = maxActivityPage
+	}
+	end := "+"
+	if query.Cursor != "" {
+		end = "(" + query.Cursor
+	}
+
+	page := &ActivityPage{Events: []ActivityEvent{}}
+	for {
+		messages, err := client.XRevRangeN(ctx, ActivityKey(ks), end, "-", int64(limit)).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, message := range messages {
+			event := activityEvent(message)
+			if query.Type == "" || event.Type == query.Type {
+				page.Events = append(page.Events, event)
+			}
+			end = "(" + message.ID
+			if len(page.Events) == limit {
+				page.NextCursor = message.ID
+				return page, nil
+			}
+		}
+		if len(messages) < limit {
+			return page, nil
+		}
+	}
+}
+
+// ActivitySince returns up to count events newer than the entry ID after,
+// oldest first
+func ActivitySince(ctx context.Context, client redis.Cmdable, ks Keyspace, after string, count int64) ([]ActivityEvent, error) {
+	messages, err := client.XRangeN(ctx, ActivityKey(ks), "("+after, "+", count).Result()
+	if err != nil {
+		return nil, err
+	}
+	events := make([]ActivityEvent, len(messages))
+	for i, message := range messages {
+		events[i] = activityEvent(message)
+	}
+	return events, nil
+}
+
+// LatestActivityID returns the ID of a keyspace's newest activity event, or
+// "0-0" when it has none
+func LatestActivityID(ctx context.Context, client redis.Cmdable, ks Keyspace) (string, error) {
+	messages, err := client.XRevRangeN(ctx, ActivityKey(ks), "+", "-", 1).Result()
+	if err != nil || len(messages) == 0 {
+		return "0-0", err
+	}
+	return messages[0].ID, nil
+}
+
+// activityEvent reads an activity event from its stream message
+func activityEvent(message redis.XMessage) ActivityEvent {
+	value := func(field string) string {
+		text, _ := message.Values[field].(string)
+		return text
+	}
+	event := ActivityEvent{
+		ID:      message.ID,
+		Type:    value("type"),
+		Tenant:  value("tenant"),
+		Subject: value("subject"),
+		Message: value("message"),
+	}
+	event.Time, _ = time.Parse(time.RFC3339Nano, value("time"))
+	if data := value("data"); data != "" && data != "null" {
+		json.Unmarshal([]byte(data), &event.Data)
+	}
+	return event
+}
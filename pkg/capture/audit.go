@@ -0,0 +1,180 @@
+package capture
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Audited actions
+const (
+	AuditBudgetPut       = "budget.put"
+	AuditBudgetDelete    = "budget.delete"
+	AuditUserDelete      = "user_data.delete"
+	AuditUserExport      = "user_data.export"
+	AuditSessionReplay   = "session.replay"
+	AuditAnalyticsExport = "analytics.export"
+)
+
+// maxAuditPage bounds the entries returned by one ListAudit call
+const maxAuditPage = 1000
+
+// AuditEntry records an administrative change or data access. The audit
+// log is a Redis Stream per tenant that entries are only ever appended to.
+type AuditEntry struct {
+	// ID is the stream entry ID, assigned when the entry is recorded
+	ID         string    `json:"id"`
+	Time       time.Time `json:"time"`
+	Actor      string    `json:"actor"`
+	Action     string    `json:"action"`
+	Resource   string    `json:"resource"`
+	Tenant     string    `json:"tenant,omitempty"`
+	RequestID  string    `json:"request_id,omitempty"`
+	RemoteAddr string    `json:"remote_addr,omitempty"`
+
+	// PayloadHash is the SHA-256 of the operation's payload, so a change
+	// can be matched to its content without the log holding the content
+	PayloadHash string `json:"payload_hash"`
+}
+
+// AuditQuery selects audit entries, newest first
+type AuditQuery struct {
+	Actor  string
+	Action string
+	From   time.Time
+	To     time.Time
+
+	// Cursor is the NextCursor of the previous page
+	Cursor string
+	Limit  int
+}
+
+// AuditPage is a page of audit entries
+type AuditPage struct {
+	Entries    []AuditEntry `json:"entries"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+}
+
+// AuditKey returns the key of a keyspace's audit stream
+func AuditKey(ks Keyspace) string {
+	return ks.Key("audit:log")
+}
+
+// HashAuditPayload returns the hex SHA-256 of an audited payload
+func HashAuditPayload(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return hex.EncodeToString(sum[:])
+}
+
+// RecordAudit appends an entry, with the hash of payload, to its tenant's
+// audit stream. The stream is never trimmed.
+func RecordAudit(ctx context.Context, client redis.Cmdable, entry AuditEntry, payload []byte) error {
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	_, err := client.XAdd(ctx, &redis.XAddArgs{
+		Stream: AuditKey(TenantKeyspace(entry.Tenant)),
+		Values: map[string]interface{}{
+			"time":         entry.Time.UTC().Format(time.RFC3339Nano),
+			"actor":        entry.Actor,
+			"action":       entry.Action,
+			"resource":     entry.Resource,
+			"tenant":       entry.Tenant,
+			"request_id":   entry.RequestID,
+			"remote_addr":  entry.RemoteAddr,
+			"payload_hash": HashAuditPayload(payload),
+		},
+	}).Result()
+	return err
+}
+
+// RecordAudit appends an entry to the audit stream of its tenant
+func (tcs *TokenCaptureService) RecordAudit(ctx context.Context, entry AuditEntry, payload []byte) error {
+	return RecordAudit(ctx, tcs.redis, entry, payload)
+}
+
+// ListAudit returns a page of a keyspace's audit entries matching query,
+// newest first
+func ListAudit(ctx context.Context, client redis.Cmdable, ks Keyspace, query AuditQuery) (*AuditPage, error) {
+	limit := query.Limit
+	if limit <= 0 || limit > maxAuditPage {
+		limit = maxAuditPage
+	}
+	start, end := "-", "+"
+	if !query.From.IsZero() {
+		start = strconv.FormatInt(query.From.UnixMilli(), 10)
+	}
+	if !query.To.IsZero() {
+		end = strconv.FormatInt(query.To.UnixMilli(), 10)
+	}
+	if query.Cursor != "" {
+		end = "(" + query.Cursor
+	}
+
+	page := &AuditPage{Entries: []AuditEntry{}}
+	for {
+		messages, err := client.XRevRangeN(ctx, AuditKey(ks), end, start, int64(limit)).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, message := range messages {
+			entry := auditEntry(message)
+			if (query.Actor == "" || entry.Actor == query.Actor) && (query.Action == "" || entry.Action == query.Action) {
+				page.Entries = append(page.Entries, entry)
+			}
+			// Only entries up to the last one returned are covered by this
+			// page, even when the rest of the batch does not match
+			end = "(" + message.ID
+			if len(page.Entries) == limit {
+				page.NextCursor = message.ID
+				return page, nil
+			}
+		}
+		if len(messages) < limit {
+			return page, nil
+		}
+	}
+}
+
+// auditEntry reads an audit entry from its stream message
+func auditEntry(message redis.XMessage) AuditEntry {
+	value := func(field string) string {
+		text, _ := message.Values[field].(string)
+		return text
+	}
+	entry := AuditEntry{
+		ID:          message.ID,
+		Actor:       value("actor"),
+		Action:      value("action"),
+		Resource:    value("resource"),
+		Tenant:      value("tenant"),
+		RequestID:   value("request_id"),
+		RemoteAddr:  value("remote_addr"),
+		PayloadHash: value("payload_hash"),
+	}
+	entry.Time, _ = time.Parse(time.RFC3339Nano, value("time"))
+	return entry
+}
+
+// ValidStreamID reports whether cursor is a stream entry ID, as the cursors
+// of audit and activity pages are
+func ValidStreamID(cursor string) error {
+	ms, seq, ok := strings.Cut(cursor, "-")
+	if ok {
+		_, err := strconv.ParseUint(ms, 10, 64)
+		if err == nil {
+			_, err = strconv.ParseUint(seq, 10, 64)
+		}
+		ok = err == nil
+	}
+	if !ok {
+		return fmt.Errorf("invalid cursor %q", cursor)
+	}
+	return nil
+}
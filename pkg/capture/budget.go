@@ -0,0 +1,141 @@
+package capture
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Budget scopes. A tenant budget caps the usage of the whole tenant, so
+// teams are budgeted by giving each team its own tenant.
+const (
+	BudgetScopeUser   = "user"
+	BudgetScopeModel  = "model"
+	BudgetScopeTenant = "tenant"
+)
+
+// Budget periods, measured in UTC
+const (
+	BudgetDaily   = "daily"
+	BudgetMonthly = "monthly"
+)
+
+// Actions taken on requests once a budget is exceeded
+const (
+	BudgetWarn  = "warn"
+	BudgetBlock = "block"
+)
+
+// Budget caps the tokens and/or dollars a user, model or tenant may use per
+// period. A zero limit is not enforced.
+type Budget struct {
+	Scope        string  `json:"scope"`
+	ID           string  `json:"id,omitempty"`
+	Period       string  `json:"period"`
+	TokenLimit   int64   `json:"token_limit,omitempty"`
+	CostLimitUSD float64 `json:"cost_limit_usd,omitempty"`
+	Action       string  `json:"action"`
+}
+
+// Validate checks the budget's scope, period, limits and action
+func (b *Budget) Validate() error {
+	switch b.Scope {
+	case BudgetScopeUser, BudgetScopeModel:
+		if b.ID == "" {
+			return fmt.Errorf("%s budgets require an id", b.Scope)
+		}
+	case BudgetScopeTenant:
+		b.ID = ""
+	default:
+		return fmt.Errorf("invalid scope %q, expected user, model or tenant", b.Scope)
+	}
+	if b.Period != BudgetDaily && b.Period != BudgetMonthly {
+		return fmt.Errorf("invalid period %q, expected daily or monthly", b.Period)
+	}
+	if b.TokenLimit < 0 || b.CostLimitUSD < 0 {
+		return fmt.Errorf("limits must not be negative")
+	}
+	if b.TokenLimit == 0 && b.CostLimitUSD == 0 {
+		return fmt.Errorf("a token_limit or cost_limit_usd is required")
+	}
+	if b.Action != BudgetWarn && b.Action != BudgetBlock {
+		return fmt.Errorf("invalid action %q, expected warn or block", b.Action)
+	}
+	return nil
+}
+
+// Field returns the field identifying the budget's subject in the budget
+// hashes: user:{id}, model:{id} or tenant
+func (b Budget) Field() string {
+	return BudgetField(b.Scope, b.ID)
+}
+
+// Name identifies the budget among a keyspace's budgets; a subject may have
+// both a daily and a monthly budget
+func (b Budget) Name() string {
+	return b.Field() + ":" + b.Period
+}
+
+// BudgetField returns the budget hash field for a scope and subject ID
+func BudgetField(scope, id string) string {
+	if scope == BudgetScopeTenant {
+		return scope
+	}
+	return scope + ":" + id
+}
+
+// BudgetsKey returns the key of the hash holding a keyspace's budgets as
+// JSON, keyed by Name
+func BudgetsKey(ks Keyspace) string {
+	return ks.Key("budgets")
+}
+
+// BudgetsExceededKey returns the key of the hash mapping the Field of each
+// subject over budget to the strictest action of its exceeded budgets. It is
+// rewritten by the analytics service's budget evaluator and read by the chat
+// backend.
+func BudgetsExceededKey(ks Keyspace) string {
+	return ks.Key("budgets:exceeded")
+}
+
+// BudgetPeriodStart returns the UTC start of the budget period containing t
+func BudgetPeriodStart(period string, t time.Time) time.Time {
+	t = t.UTC()
+	if period == BudgetMonthly {
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+}
+
+// CheckBudgets returns the action to take for a request by userID to model
+// in tenant, and the field of the budget that triggered it. Blocking budgets
+// take precedence over warnings; an empty action means no budget is exceeded.
+func (tcs *TokenCaptureService) CheckBudgets(ctx context.Context, tenant, userID, model string) (string, string, error) {
+	fields := []string{
+		BudgetField(BudgetScopeUser, userID),
+		BudgetField(BudgetScopeModel, model),
+		BudgetField(BudgetScopeTenant, ""),
+	}
+	values, err := tcs.redis.HMGet(ctx, BudgetsExceededKey(TenantKeyspace(tenant)), fields...).Result()
+	if err != nil {
+		return "", "", err
+	}
+
+	action, field := "", ""
+	for i, value := range values {
+		switch value {
+		case BudgetBlock:
+			return BudgetBlock, fields[i], nil
+		case BudgetWarn:
+			if action == "" {
+				action, field = BudgetWarn, fields[i]
+			}
+		}
+	}
+	return action, field, nil
+}
+
+// dailyCostKey returns the key of the per-user cost hash for t's UTC day
+func dailyCostKey(ks Keyspace, t time.Time) string {
+	return ks.Key("costs:daily:%s", t.UTC().Format("20060102"))
+}
@@ -0,0 +1,280 @@
+package capture
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Retry policy for batches that failed to flush
+const (
+	maxRetryAttempts = 5
+	maxRetryBackoff  = 30 * time.Second
+)
+
+// retryBatch is a failed batch waiting to be written again
+type retryBatch struct {
+	records     []*TokenMetrics
+	attempts    int
+	nextAttempt time.Time
+}
+
+// BufferedWriter queues token metrics in memory and flushes them to Redis in
+// batches, so chat requests never wait on Redis
+type BufferedWriter struct {
+	service       *TokenCaptureService
+	events        chan *TokenMetrics
+	batchSize     int
+	flushInterval time.Duration
+	done          chan struct{}
+
+	// mu guards closed, so Capture never sends on the closed events channel
+	mu     sync.RWMutex
+	closed bool
+
+	// retries is only touched by the run goroutine
+	retries        []*retryBatch
+	retryCapacity  int
+	retriedRecords int
+
+	// Prometheus metrics
+	overflowCounter     prometheus.Counter
+	flushFailureCounter prometheus.Counter
+	retryCounter        prometheus.Counter
+	droppedCounter      prometheus.Counter
+	flushedCounter      prometheus.Counter
+	flushDuration       prometheus.Histogram
+}
+
+// NewBufferedWriter creates a writer that holds up to bufferSize pending
+// records and flushes every batchSize records or flushInterval, whichever
+// comes first. Batches that fail to flush are retried with backoff, holding
+// at most bufferSize records for retry. Its metrics are registered with
+// registerer.
+func NewBufferedWriter(service *TokenCaptureService, bufferSize, batchSize int, flushInterval time.Duration, registerer prometheus.Registerer) *BufferedWriter {
+	if batchSize <= 0 {
+		batchSize = 1
+	}
+	if bufferSize < batchSize {
+		bufferSize = batchSize
+	}
+	if flushInterval <= 0 {
+		flushInterval = time.Second
+	}
+
+	factory := promauto.With(registerer)
+	bw := &BufferedWriter{
+		service:       service,
+		events:        make(chan *TokenMetrics, bufferSize),
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		done:          make(chan struct{}),
+		retryCapacity: bufferSize,
+		overflowCounter: factory.NewCounter(prometheus.CounterOpts{
+			Name: "genai_app_capture_buffer_overflow_total",
+			Help: "Token metrics records dropped because the capture buffer was full",
+		}),
+		flushFailureCounter: factory.NewCounter(prometheus.CounterOpts{
+			Name: "genai_app_capture_flush_failures_total",
+			Help: "Capture batches that failed to be written to Redis",
+		}),
+		retryCounter: factory.NewCounter(prometheus.CounterOpts{
+			Name: "genai_app_capture_retries_total",
+			Help: "Capture batches retried after a failed flush",
+		}),
+		droppedCounter: factory.NewCounter(prometheus.CounterOpts{
+			Name: "genai_app_capture_dropped_total",
+			Help: "Token metrics records dropped after exhausting their retries or the retry queue",
+		}),
+		flushedCounter: factory.NewCounter(prometheus.CounterOpts{
+			Name: "genai_app_capture_flushed_records_total",
+			Help: "Token metrics records written to Redis",
+		}),
+		flushDuration: factory.NewHistogram(prometheus.HistogramOpts{
+			Name:    "genai_app_capture_flush_duration_seconds",
+			Help:    "Time taken to write a capture batch to Redis",
+			Buckets: []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1},
+		}),
+	}
+	factory.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "genai_app_capture_buffer_depth",
+		Help: "Token metrics records waiting to be flushed",
+	}, func() float64 {
+		return float64(len(bw.events))
+	})
+
+	go bw.run()
+
+	return bw
+}
+
+// Capture queues metrics for the next flush, dropping them if the buffer is
+// full or the writer is closed
+func (bw *BufferedWriter) Capture(metrics *TokenMetrics) {
+	bw.mu.RLock()
+	defer bw.mu.RUnlock()
+	if bw.closed {
+		bw.droppedCounter.Inc()
+		logger.Component("capture").Warn().Str("request_id", metrics.RequestID).Msg("Capture writer closed, dropping token metrics")
+		return
+	}
+
+	select {
+	case bw.events <- metrics:
+	default:
+		bw.overflowCounter.Inc()
+		logger.Component("capture").Warn().Str("request_id", metrics.RequestID).Msg("Capture buffer full, dropping token metrics")
+	}
+}
+
+// Close flushes any pending records and stops the writer. Records captured
+// after Close are dropped.
+func (bw *BufferedWriter) Close() {
+	bw.mu.Lock()
+	if !bw.closed {
+		bw.closed = true
+		close(bw.events)
+	}
+	bw.mu.Unlock()
+	<-bw.done
+}
+
+// run collects records into batches until the events channel is closed
+func (bw *BufferedWriter) run() {
+	defer close(bw.done)
+
+	ticker := time.NewTicker(bw.flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*TokenMetrics, 0, bw.batchSize)
+	for {
+		select {
+		case metrics, ok := <-bw.events:
+			if !ok {
+				bw.flush(batch)
+				bw.drainRetries()
+				return
+			}
+			batch = append(batch, metrics)
+			if len(batch) >= bw.batchSize {
+				bw.flush(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				bw.flush(batch)
+				batch = batch[:0]
+			}
+			bw.processRetries()
+		}
+	}
+}
+
+// flush writes a batch to Redis, queueing it for retry on failure. While
+// Redis is unreachable the batch is queued without being attempted.
+func (bw *BufferedWriter) flush(batch []*TokenMetrics) {
+	if len(batch) == 0 {
+		return
+	}
+
+	if !bw.service.Available() {
+		records := append([]*TokenMetrics(nil), batch...)
+		bw.queueRetry(&retryBatch{records: records, nextAttempt: time.Now()})
+		return
+	}
+	if err := bw.write(batch); err != nil {
+		logger.Component("capture").Warn().Err(err).Int("records", len(batch)).Msg("Failed to flush token metrics, will retry")
+		// batch is reused by the caller, so keep a copy
+		records := append([]*TokenMetrics(nil), batch...)
+		bw.scheduleRetry(&retryBatch{records: records})
+	}
+}
+
+// write stores a batch and records the flush metrics
+func (bw *BufferedWriter) write(batch []*TokenMetrics) error {
+	start := time.Now()
+	err := bw.service.CaptureBatch(batch)
+	bw.flushDuration.Observe(time.Since(start).Seconds())
+
+	if err != nil {
+		bw.flushFailureCounter.Inc()
+		return err
+	}
+	bw.flushedCounter.Add(float64(len(batch)))
+	return nil
+}
+
+// scheduleRetry queues a failed batch with exponential backoff, dropping it
+// once it has used up its attempts and dropping the oldest batches when the
+// retry queue is full
+func (bw *BufferedWriter) scheduleRetry(rb *retryBatch) {
+	rb.attempts++
+	if rb.attempts > maxRetryAttempts {
+		bw.droppedCounter.Add(float64(len(rb.records)))
+		logger.Component("capture").Error().Int("records", len(rb.records)).Int("attempts", maxRetryAttempts).Msg("Dropping token metrics after repeated failures")
+		return
+	}
+
+	backoff := bw.flushInterval << rb.attempts
+	if backoff > maxRetryBackoff || backoff <= 0 {
+		backoff = maxRetryBackoff
+	}
+	rb.nextAttempt = time.Now().Add(backoff)
+	bw.queueRetry(rb)
+}
+
+// queueRetry adds a batch to the retry queue, dropping the oldest batches
+// when the queue is full
+func (bw *BufferedWriter) queueRetry(rb *retryBatch) {
+	bw.retries = append(bw.retries, rb)
+	bw.retriedRecords += len(rb.records)
+	for bw.retriedRecords > bw.retryCapacity && len(bw.retries) > 1 {
+		oldest := bw.retries[0]
+		bw.retries = bw.retries[1:]
+		bw.retriedRecords -= len(oldest.records)
+		bw.droppedCounter.Add(float64(len(oldest.records)))
+		logger.Component("capture").Error().Int("records", len(oldest.records)).Msg("Capture retry queue full, dropping token metrics")
+	}
+}
+
+// processRetries writes the retry batches whose backoff has elapsed. Nothing
+// is attempted while Redis is unreachable, so outages do not use up retries.
+func (bw *BufferedWriter) processRetries() {
+	if len(bw.retries) == 0 || !bw.service.Available() {
+		return
+	}
+
+	now := time.Now()
+	pending := bw.retries
+	bw.retries = nil
+	bw.retriedRecords = 0
+	for _, rb := range pending {
+		if now.Before(rb.nextAttempt) {
+			bw.retries = append(bw.retries, rb)
+			bw.retriedRecords += len(rb.records)
+			continue
+		}
+
+		bw.retryCounter.Inc()
+		if err := bw.write(rb.records); err != nil {
+			logger.Component("capture").Warn().Err(err).Int("attempt", rb.attempts).Int("records", len(rb.records)).Msg("Retrying token metrics failed")
+			bw.scheduleRetry(rb)
+		}
+	}
+}
+
+// drainRetries makes a final attempt at every queued retry on shutdown
+func (bw *BufferedWriter) drainRetries() {
+	for _, rb := range bw.retries {
+		bw.retryCounter.Inc()
+		if err := bw.write(rb.records); err != nil {
+			bw.droppedCounter.Add(float64(len(rb.records)))
+			logger.Component("capture").Error().Err(err).Int("records", len(rb.records)).Msg("Dropping token metrics on shutdown")
+		}
+	}
+	bw.retries = nil
+	bw.retriedRecords = 0
+}
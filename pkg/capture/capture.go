@@ -0,0 +1,706 @@
+package capture
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/health"
+	"github.com/ajeetraina/genai-app-demo/pkg/logger"
+	"github.com/ajeetraina/genai-app-demo/pkg/redact"
+	"github.com/ajeetraina/genai-app-demo/pkg/redisconn"
+	"github.com/google/uuid"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+// TokenMetrics represents the token usage captured for a single chat request
+type TokenMetrics struct {
+	SchemaVersion   int        `json:"schema_version"`
+	Tenant          string     `json:"tenant,omitempty"`
+	RequestID       string     `json:"request_id"`
+	SessionID       string     `json:"session_id"`
+	UserID          string     `json:"user_id"`
+	Model           string     `json:"model"`
+	InputTokens     int        `json:"input_tokens"`
+	OutputTokens    int        `json:"output_tokens"`
+	TotalTokens     int        `json:"total_tokens"`
+	ResponseTimeMs  float64    `json:"response_time_ms"`
+	FirstTokenMs    float64    `json:"time_to_first_token_ms"`
+	TokensPerSecond float64    `json:"tokens_per_second"`
+	CostUSD         float64    `json:"cost_usd"`
+	Redactions      int        `json:"redactions"`
+	Client          ClientInfo `json:"client"`
+	Status          Status     `json:"status"`
+	Timestamp       time.Time  `json:"timestamp"`
+
+	// Prompt, the conversation Messages sent before it, and Response are
+	// only stored when content capture is enabled, and then only in
+	// encrypted form
+	Prompt   string           `json:"-"`
+	Messages []ContentMessage `json:"-"`
+	Response string           `json:"-"`
+
+	// CaptureID identifies this capture of the request. Unlike RequestID,
+	// which clients may choose, it is generated by the server, so retries of
+	// a capture are skipped without also skipping requests that reuse an ID.
+	CaptureID string `json:"-"`
+
+	// prepared is set once defaults, cost and redaction have been applied,
+	// so retried captures do not apply them twice
+	prepared bool
+}
+
+// ContentMessage is a message of the conversation sent to the model with a
+// request's prompt
+type ContentMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+// captureAttempts bounds how often a batch is retried when a concurrent
+// capture of one of its requests invalidates the transaction
+const captureAttempts = 3
+
+// Retention holds how long each kind of captured data is kept in Redis
+type Retention struct {
+	Request time.Duration
+	Session time.Duration
+	Hourly  time.Duration
+}
+
+// DefaultRetention returns the retention windows used when none are configured
+func DefaultRetention() Retention {
+	return Retention{
+		Request: 7 * 24 * time.Hour,
+		Session: 30 * 24 * time.Hour,
+		Hourly:  90 * 24 * time.Hour,
+	}
+}
+
+// MarshalJSON reports the retention windows in seconds
+func (r Retention) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]int64{
+		"request_ttl_seconds": int64(r.Request.Seconds()),
+		"session_ttl_seconds": int64(r.Session.Seconds()),
+		"hourly_ttl_seconds":  int64(r.Hourly.Seconds()),
+	})
+}
+
+// activeWindows are the sliding windows tracked in the users:active:* sets
+var activeWindows = map[string]time.Duration{
+	"5m":  5 * time.Minute,
+	"15m": 15 * time.Minute,
+	"1h":  time.Hour,
+	"24h": 24 * time.Hour,
+}
+
+// TokenCaptureService stores per-request token metrics in Redis using the
+// key layout read by the analytics and timeseries services
+type TokenCaptureService struct {
+	redis      *redis.Client
+	ctx        context.Context
+	retention  Retention
+	prices     PriceTable
+	content    *ContentCipher
+	redactor   *redact.Redactor
+	webhooks   *WebhookNotifier
+	publishers []EventPublisher
+
+	// sampleRate is the fraction of requests whose per-request records are
+	// stored; aggregates always include every request
+	sampleRate float64
+
+	// monitor, when set, tracks whether Redis is reachable
+	monitor *redisconn.Monitor
+}
+
+// NewTokenCaptureService creates a new capture service. It does not contact
+// Redis; call WaitForRedis to check the connection. Retention windows left at
+// zero use the defaults.
+func NewTokenCaptureService(options redisconn.Options, retention Retention) *TokenCaptureService {
+	defaults := DefaultRetention()
+	if retention.Request <= 0 {
+		retention.Request = defaults.Request
+	}
+	if retention.Session <= 0 {
+		retention.Session = defaults.Session
+	}
+	if retention.Hourly <= 0 {
+		retention.Hourly = defaults.Hourly
+	}
+
+	rdb := options.NewClient()
+
+	return &TokenCaptureService{
+		redis:      rdb,
+		ctx:        context.Background(),
+		retention:  retention,
+		sampleRate: 1,
+	}
+}
+
+// InstrumentRedis exports the Redis client's pool stats and command
+// latencies, with metrics registered with registerer
+func (tcs *TokenCaptureService) InstrumentRedis(registerer prometheus.Registerer) {
+	redisconn.Instrument(tcs.redis, "default", registerer)
+}
+
+// WaitForRedis pings Redis with backoff until it answers or timeout elapses.
+// A timeout of zero makes a single attempt.
+func (tcs *TokenCaptureService) WaitForRedis(timeout time.Duration) error {
+	if err := redisconn.Wait(tcs.ctx, tcs.redis, timeout); err != nil {
+		return fmt.Errorf("failed to connect to Redis at %s: %v", tcs.redis.Options().Addr, err)
+	}
+	return nil
+}
+
+// MonitorRedis checks Redis every interval so writers can hold back while it
+// is unreachable. available is whether Redis answered at startup. The monitor
+// must be closed by the caller.
+func (tcs *TokenCaptureService) MonitorRedis(available bool, interval time.Duration, registerer prometheus.Registerer) *redisconn.Monitor {
+	tcs.monitor = redisconn.NewMonitor(tcs.redis, available, interval, registerer)
+	return tcs.monitor
+}
+
+// StartHeartbeat writes the service's heartbeat to Redis every interval so
+// the system status endpoint can report it. The writer must be closed by the
+// caller.
+func (tcs *TokenCaptureService) StartHeartbeat(service string, features map[string]bool, readiness *health.Readiness, interval time.Duration) *health.HeartbeatWriter {
+	return health.StartHeartbeat(tcs.redis, service, features, readiness, interval)
+}
+
+// HandleSystemStatus returns a handler reporting the status of every service
+// from the heartbeats in Redis, with the services in expected reported as
+// down while they have none
+func (tcs *TokenCaptureService) HandleSystemStatus(expected []string) http.HandlerFunc {
+	return health.HandleSystemStatus(tcs.redis, expected)
+}
+
+// Available reports whether Redis is reachable, as of the monitor's last
+// check. Without a monitor Redis is assumed to be reachable.
+func (tcs *TokenCaptureService) Available() bool {
+	return tcs.monitor.Available()
+}
+
+// Retention returns the effective retention windows
+func (tcs *TokenCaptureService) Retention() Retention {
+	return tcs.retention
+}
+
+// Close closes the underlying Redis connection
+func (tcs *TokenCaptureService) Close() error {
+	return tcs.redis.Close()
+}
+
+// SetPriceTable sets the prices used to compute the cost of captured requests
+func (tcs *TokenCaptureService) SetPriceTable(prices PriceTable) {
+	tcs.prices = prices
+}
+
+// SetContentCipher enables storing encrypted prompt and response text in
+// request:<id>:content hashes
+func (tcs *TokenCaptureService) SetContentCipher(content *ContentCipher) {
+	tcs.content = content
+}
+
+// SetRedactor scrubs PII from captured content before it is encrypted and stored
+func (tcs *TokenCaptureService) SetRedactor(redactor *redact.Redactor) {
+	tcs.redactor = redactor
+}
+
+// SetWebhooks posts capture events to webhooks once their records are stored
+func (tcs *TokenCaptureService) SetWebhooks(webhooks *WebhookNotifier) {
+	tcs.webhooks = webhooks
+}
+
+// AddEventPublisher also publishes every newly stored record to an event
+// stream or archive
+func (tcs *TokenCaptureService) AddEventPublisher(publisher EventPublisher) {
+	tcs.publishers = append(tcs.publishers, publisher)
+}
+
+// SetSampleRate sets the fraction of requests, between 0 and 1, whose
+// per-request hashes and content are stored. Session, user, model and global
+// aggregates still count every request, so high-traffic deployments can bound
+// Redis memory without skewing totals.
+func (tcs *TokenCaptureService) SetSampleRate(rate float64) {
+	if rate < 0 {
+		rate = 0
+	}
+	if rate > 1 {
+		rate = 1
+	}
+	tcs.sampleRate = rate
+}
+
+// SampleRate returns the fraction of requests whose per-request records are stored
+func (tcs *TokenCaptureService) SampleRate() float64 {
+	return tcs.sampleRate
+}
+
+// sampled reports whether a request's per-request records should be stored.
+// The decision is derived from the request ID, so retries of a batch sample
+// the same requests.
+func (tcs *TokenCaptureService) sampled(requestID string) bool {
+	if tcs.sampleRate >= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(requestID))
+	return float64(h.Sum64()%10000) < tcs.sampleRate*10000
+}
+
+// CaptureTokenMetrics stores a request's metrics and updates the session, user,
+// model and global aggregates derived from it in a single MULTI/EXEC round trip
+func (tcs *TokenCaptureService) CaptureTokenMetrics(metrics *TokenMetrics) error {
+	return tcs.CaptureBatch([]*TokenMetrics{metrics})
+}
+
+// CaptureBatch stores several requests' metrics in a single MULTI/EXEC round
+// trip. Capture is idempotent: each capture ID is marked as captured in the
+// same transaction, and captures already marked are skipped, so a batch can
+// safely be retried after an error that left its outcome unknown. Records
+// without a capture ID are given one.
+func (tcs *TokenCaptureService) CaptureBatch(batch []*TokenMetrics) error {
+	seen := make(map[string]bool, len(batch))
+	var records []*TokenMetrics
+	var dedupKeys []string
+	for _, metrics := range batch {
+		if metrics.CaptureID == "" {
+			metrics.CaptureID = uuid.New().String()
+		}
+		dedupKey := capturedKey(TenantKeyspace(metrics.Tenant), metrics.CaptureID)
+		if seen[dedupKey] {
+			continue
+		}
+		seen[dedupKey] = true
+		tcs.prepare(metrics)
+		records = append(records, metrics)
+		dedupKeys = append(dedupKeys, dedupKey)
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	var captured []capturedRecord
+	var err error
+	for attempt := 0; attempt < captureAttempts; attempt++ {
+		err = tcs.redis.Watch(tcs.ctx, func(tx *redis.Tx) error {
+			var txErr error
+			captured, txErr = tcs.captureNew(tx, records, dedupKeys)
+			return txErr
+		}, dedupKeys...)
+		if err != redis.TxFailedErr {
+			break
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to store token metrics: %v", err)
+	}
+
+	tcs.publishCaptured(captured)
+	tcs.notifyCaptured(captured)
+	tcs.publishSessionsStarted(captured)
+	return nil
+}
+
+// capturedRecord is a record written by captureNew along with the user's
+// token total for the day and its session's request count after it was
+// counted
+type capturedRecord struct {
+	metrics         *TokenMetrics
+	dailyTokens     *redis.IntCmd
+	sessionRequests *redis.Cmd
+}
+
+// captureNew writes the records whose dedup keys are not yet set, marking
+// them captured in the same transaction, and returns the records it wrote
+func (tcs *TokenCaptureService) captureNew(tx *redis.Tx, records []*TokenMetrics, dedupKeys []string) ([]capturedRecord, error) {
+	existsPipe := tx.Pipeline()
+	existsCmds := make([]*redis.IntCmd, len(dedupKeys))
+	for i, key := range dedupKeys {
+		existsCmds[i] = existsPipe.Exists(tcs.ctx, key)
+	}
+	if _, err := existsPipe.Exec(tcs.ctx); err != nil {
+		return nil, err
+	}
+
+	var captured []capturedRecord
+	_, err := tx.TxPipelined(tcs.ctx, func(pipe redis.Pipeliner) error {
+		for i, metrics := range records {
+			if existsCmds[i].Val() > 0 {
+				continue
+			}
+
+			if tcs.sampled(metrics.RequestID) {
+				tcs.queueRequestRecord(pipe, metrics)
+				tcs.queueContent(pipe, metrics)
+				tcs.queueRequestIndex(pipe, metrics)
+			}
+			sessionRequests := tcs.queueSessionMetrics(pipe, metrics)
+			tcs.queueUserMetrics(pipe, metrics)
+			tcs.queueModelUsage(pipe, metrics)
+			tcs.queueModelHourly(pipe, metrics)
+			tcs.queueLatency(pipe, metrics)
+			tcs.queueMinuteCounters(pipe, metrics)
+			tcs.queueClientUsage(pipe, metrics)
+			tcs.queueActivity(pipe, metrics)
+			tcs.queueGlobalCounters(pipe, metrics)
+			tcs.queueLeaderboards(pipe, metrics)
+			pipe.Set(tcs.ctx, dedupKeys[i], 1, tcs.retention.Request)
+			captured = append(captured, capturedRecord{
+				metrics:         metrics,
+				dailyTokens:     tcs.queueDailyUsage(pipe, metrics),
+				sessionRequests: sessionRequests,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return captured, nil
+}
+
+// publishCaptured sends newly stored records to the event publishers. Failures
+// are logged rather than returned, since the records are already stored and
+// retrying the batch would not publish them again.
+func (tcs *TokenCaptureService) publishCaptured(captured []capturedRecord) {
+	if len(tcs.publishers) == 0 || len(captured) == 0 {
+		return
+	}
+
+	records := make([]*TokenMetrics, len(captured))
+	for i, record := range captured {
+		records[i] = record.metrics
+	}
+	for _, publisher := range tcs.publishers {
+		if err := publisher.Publish(records); err != nil {
+			logger.Component("capture").Error().Err(err).Int("records", len(records)).Msg("Failed to publish token metrics")
+		}
+	}
+}
+
+// notifyCaptured posts the webhook events for newly stored records
+func (tcs *TokenCaptureService) notifyCaptured(captured []capturedRecord) {
+	if tcs.webhooks == nil {
+		return
+	}
+
+	threshold := tcs.webhooks.config.DailyTokenThreshold
+	for _, record := range captured {
+		metrics := record.metrics
+		if tcs.webhooks.config.SendRequests {
+			tcs.webhooks.Notify(EventRequestCaptured, metrics)
+		}
+
+		// Fire once, for the request that took the user's daily total past the threshold
+		total := record.dailyTokens.Val()
+		if threshold > 0 && total >= threshold && total-int64(metrics.TotalTokens) < threshold {
+			tcs.webhooks.Notify(EventUserDailyTokensExceeded, DailyTokensExceeded{
+				Tenant:      metrics.Tenant,
+				UserID:      metrics.UserID,
+				Date:        metrics.Timestamp.UTC().Format("2006-01-02"),
+				TotalTokens: total,
+				Threshold:   threshold,
+			})
+		}
+	}
+}
+
+// prepare fills in derived fields and scrubs content, once per record
+func (tcs *TokenCaptureService) prepare(metrics *TokenMetrics) {
+	if metrics.prepared {
+		return
+	}
+	metrics.prepared = true
+	metrics.SchemaVersion = SchemaVersion
+
+	if metrics.Timestamp.IsZero() {
+		metrics.Timestamp = time.Now()
+	}
+	if metrics.TotalTokens == 0 {
+		metrics.TotalTokens = metrics.InputTokens + metrics.OutputTokens
+	}
+	if metrics.CostUSD == 0 {
+		metrics.CostUSD = tcs.prices.Cost(metrics.Model, metrics.InputTokens, metrics.OutputTokens)
+	}
+
+	if tcs.content != nil && tcs.redactor != nil {
+		var promptRedactions, responseRedactions int
+		metrics.Prompt, promptRedactions = tcs.redactor.Redact(metrics.Prompt)
+		metrics.Response, responseRedactions = tcs.redactor.Redact(metrics.Response)
+		metrics.Redactions = promptRedactions + responseRedactions
+		for i := range metrics.Messages {
+			var redactions int
+			metrics.Messages[i].Content, redactions = tcs.redactor.Redact(metrics.Messages[i].Content)
+			metrics.Redactions += redactions
+		}
+	}
+}
+
+// capturedKey returns the key marking a capture as done
+func capturedKey(ks Keyspace, captureID string) string {
+	return ks.Key("capture:%s:done", captureID)
+}
+
+// queueRequestRecord queues the per-request hash
+func (tcs *TokenCaptureService) queueRequestRecord(pipe redis.Pipeliner, metrics *TokenMetrics) {
+	requestKey := TenantKeyspace(metrics.Tenant).Key("request:%s:tokens", metrics.RequestID)
+	pipe.HSet(tcs.ctx, requestKey, map[string]interface{}{
+		"request_id":             metrics.RequestID,
+		"session_id":             metrics.SessionID,
+		"user_id":                metrics.UserID,
+		"model":                  metrics.Model,
+		"input_tokens":           metrics.InputTokens,
+		"output_tokens":          metrics.OutputTokens,
+		"total_tokens":           metrics.TotalTokens,
+		"response_time_ms":       metrics.ResponseTimeMs,
+		"time_to_first_token_ms": metrics.FirstTokenMs,
+		"tokens_per_second":      metrics.TokensPerSecond,
+		"cost_usd":               metrics.CostUSD,
+		"redactions":             metrics.Redactions,
+		"client_ip":              metrics.Client.IP,
+		"client_user_agent":      metrics.Client.UserAgent,
+		"client_app":             metrics.Client.App,
+		"client_app_version":     metrics.Client.AppVersion,
+		"client_origin":          metrics.Client.Origin,
+		"client_country":         metrics.Client.Country,
+		"client_api_key":         metrics.Client.APIKey,
+		"status":                 string(metrics.Status),
+		"sample_rate":            tcs.sampleRate,
+		"schema_version":         metrics.SchemaVersion,
+		"timestamp":              metrics.Timestamp.Unix(),
+	})
+	pipe.Expire(tcs.ctx, requestKey, tcs.retention.Request)
+}
+
+// queueRequestIndex adds the request to its user's index, so its record can be
+// erased or exported, and to its session's timeline, so the session can be replayed
+func (tcs *TokenCaptureService) queueRequestIndex(pipe redis.Pipeliner, metrics *TokenMetrics) {
+	ks := TenantKeyspace(metrics.Tenant)
+	requestsKey := ks.Key("user:%s:requests", metrics.UserID)
+	pipe.SAdd(tcs.ctx, requestsKey, metrics.RequestID)
+	pipe.Expire(tcs.ctx, requestsKey, tcs.retention.Request)
+
+	timelineKey := sessionRequestsKey(ks, metrics.SessionID)
+	pipe.ZAdd(tcs.ctx, timelineKey, redis.Z{
+		Score:  float64(metrics.Timestamp.UnixMilli()),
+		Member: metrics.RequestID,
+	})
+	pipe.Expire(tcs.ctx, timelineKey, tcs.retention.Request)
+}
+
+// queueContent queues the encrypted prompt, conversation and response, if
+// content capture is enabled
+func (tcs *TokenCaptureService) queueContent(pipe redis.Pipeliner, metrics *TokenMetrics) {
+	if tcs.content == nil || (metrics.Prompt == "" && metrics.Response == "" && len(metrics.Messages) == 0) {
+		return
+	}
+
+	prompt, err := tcs.content.Encrypt(metrics.Prompt)
+	if err != nil {
+		logger.Component("capture").Warn().Err(err).Str("request_id", metrics.RequestID).Msg("Skipping content capture")
+		return
+	}
+	response, err := tcs.content.Encrypt(metrics.Response)
+	if err != nil {
+		logger.Component("capture").Warn().Err(err).Str("request_id", metrics.RequestID).Msg("Skipping content capture")
+		return
+	}
+
+	fields := map[string]interface{}{
+		"prompt":   prompt,
+		"response": response,
+	}
+	if len(metrics.Messages) > 0 {
+		conversation, _ := json.Marshal(metrics.Messages)
+		messages, err := tcs.content.Encrypt(string(conversation))
+		if err != nil {
+			logger.Component("capture").Warn().Err(err).Str("request_id", metrics.RequestID).Msg("Skipping content capture")
+			return
+		}
+		fields["messages"] = messages
+	}
+
+	contentKey := TenantKeyspace(metrics.Tenant).Key("request:%s:content", metrics.RequestID)
+	pipe.HSet(tcs.ctx, contentKey, fields)
+	pipe.Expire(tcs.ctx, contentKey, tcs.retention.Request)
+}
+
+// queueSessionMetrics queues the running totals for the request's session,
+// returning the command that yields its request count
+func (tcs *TokenCaptureService) queueSessionMetrics(pipe redis.Pipeliner, metrics *TokenMetrics) *redis.Cmd {
+	sessionKey := TenantKeyspace(metrics.Tenant).Key("session:%s:tokens", metrics.SessionID)
+	return sessionScript.Eval(tcs.ctx, pipe, []string{sessionKey},
+		metrics.InputTokens,
+		metrics.OutputTokens,
+		metrics.ResponseTimeMs,
+		metrics.UserID,
+		metrics.Model,
+		metrics.Timestamp.Unix(),
+		int64(tcs.retention.Session.Seconds()),
+		metrics.CostUSD,
+	)
+}
+
+// queueUserMetrics queues the lifetime totals for the request's user
+func (tcs *TokenCaptureService) queueUserMetrics(pipe redis.Pipeliner, metrics *TokenMetrics) {
+	ks := TenantKeyspace(metrics.Tenant)
+	userKey := ks.Key("user:%s:tokens", metrics.UserID)
+	userScript.Eval(tcs.ctx, pipe, []string{userKey},
+		metrics.InputTokens,
+		metrics.OutputTokens,
+		metrics.Timestamp.Format(time.RFC3339),
+		metrics.CostUSD,
+	)
+
+	// Rank users by each sortable total and by last activity, so user
+	// listings can be sorted and paginated without loading every user
+	pipe.ZIncrBy(tcs.ctx, ks.Key("users:rank:input_tokens"), float64(metrics.InputTokens), metrics.UserID)
+	pipe.ZIncrBy(tcs.ctx, ks.Key("users:rank:output_tokens"), float64(metrics.OutputTokens), metrics.UserID)
+	pipe.ZIncrBy(tcs.ctx, ks.Key("users:rank:cost_usd"), metrics.CostUSD, metrics.UserID)
+	pipe.ZAddGT(tcs.ctx, ks.Key("users:last_seen"), redis.Z{
+		Score:  float64(metrics.Timestamp.Unix()),
+		Member: metrics.UserID,
+	})
+
+	// Monthly and daily cost per user, so spend can be reported by billing
+	// period and checked against budgets
+	if metrics.CostUSD > 0 {
+		monthlyKey := monthlyCostKey(ks, metrics.Timestamp)
+		pipe.HIncrByFloat(tcs.ctx, monthlyKey, metrics.UserID, metrics.CostUSD)
+		pipe.Expire(tcs.ctx, monthlyKey, tcs.retention.Hourly)
+		dailyKey := dailyCostKey(ks, metrics.Timestamp)
+		pipe.HIncrByFloat(tcs.ctx, dailyKey, metrics.UserID, metrics.CostUSD)
+		pipe.Expire(tcs.ctx, dailyKey, tcs.retention.Hourly)
+	}
+
+	// Index the user's sessions so their data can be erased
+	sessionsKey := ks.Key("user:%s:sessions", metrics.UserID)
+	pipe.SAdd(tcs.ctx, sessionsKey, metrics.SessionID)
+	pipe.Expire(tcs.ctx, sessionsKey, tcs.retention.Session)
+}
+
+// queueModelUsage queues the usage statistics for the request's model
+func (tcs *TokenCaptureService) queueModelUsage(pipe redis.Pipeliner, metrics *TokenMetrics) {
+	ks := TenantKeyspace(metrics.Tenant)
+	modelKey := ks.Key("model:%s:usage", metrics.Model)
+	pipe.SAdd(tcs.ctx, ks.Key("models"), metrics.Model)
+	modelScript.Eval(tcs.ctx, pipe, []string{modelKey},
+		metrics.InputTokens,
+		metrics.OutputTokens,
+		metrics.ResponseTimeMs,
+		metrics.CostUSD,
+	)
+}
+
+// ClientDimension is a client attribute usage is grouped by. Usage of each
+// value is kept in a <Kind>:<value>:usage hash, and the values seen in the
+// Index set.
+type ClientDimension struct {
+	Name  string
+	Kind  string
+	Index string
+	// Field is the request record field holding the value
+	Field string
+}
+
+// ClientDimensions lists the client attributes usage is grouped by
+var ClientDimensions = []ClientDimension{
+	{Name: "app", Kind: "client", Index: "clients", Field: "client_app"},
+	{Name: "origin", Kind: "origin", Index: "origins", Field: "client_origin"},
+	{Name: "api_key", Kind: "apikey", Index: "api_keys", Field: "client_api_key"},
+}
+
+// Value returns the dimension's value for a client
+func (d ClientDimension) Value(client ClientInfo) string {
+	switch d.Name {
+	case "app":
+		return client.App
+	case "origin":
+		return client.Origin
+	case "api_key":
+		return client.APIKey
+	}
+	return ""
+}
+
+// queueClientUsage queues the usage statistics for the request's client
+// application, origin and API key
+func (tcs *TokenCaptureService) queueClientUsage(pipe redis.Pipeliner, metrics *TokenMetrics) {
+	ks := TenantKeyspace(metrics.Tenant)
+	for _, dimension := range ClientDimensions {
+		value := dimension.Value(metrics.Client)
+		if value == "" {
+			continue
+		}
+		pipe.SAdd(tcs.ctx, ks.Key(dimension.Index), value)
+		modelScript.Eval(tcs.ctx, pipe, []string{ks.Key("%s:%s:usage", dimension.Kind, value)},
+			metrics.InputTokens,
+			metrics.OutputTokens,
+			metrics.ResponseTimeMs,
+			metrics.CostUSD,
+		)
+	}
+}
+
+// queueDailyUsage queues the update to the user's token total for the UTC day
+func (tcs *TokenCaptureService) queueDailyUsage(pipe redis.Pipeliner, metrics *TokenMetrics) *redis.IntCmd {
+	dailyKey := dailyTokensKey(TenantKeyspace(metrics.Tenant), metrics.Timestamp)
+	total := pipe.HIncrBy(tcs.ctx, dailyKey, metrics.UserID, int64(metrics.TotalTokens))
+	pipe.Expire(tcs.ctx, dailyKey, tcs.retention.Hourly)
+	return total
+}
+
+// dailyTokensKey returns the key of the per-user token hash for t's UTC day
+func dailyTokensKey(ks Keyspace, t time.Time) string {
+	return ks.Key("tokens:daily:%s", t.UTC().Format("20060102"))
+}
+
+// monthlyCostKey returns the key of the per-user cost hash for t's month
+func monthlyCostKey(ks Keyspace, t time.Time) string {
+	return ks.Key("costs:monthly:%s", t.UTC().Format("200601"))
+}
+
+// queueActivity queues the user and session updates to the active sets
+func (tcs *TokenCaptureService) queueActivity(pipe redis.Pipeliner, metrics *TokenMetrics) {
+	ks := TenantKeyspace(metrics.Tenant)
+	for window, duration := range activeWindows {
+		key := ks.Key("users:active:%s", window)
+		pipe.SAdd(tcs.ctx, key, metrics.UserID)
+		pipe.Expire(tcs.ctx, key, duration)
+	}
+
+	pipe.SAdd(tcs.ctx, ks.Key("sessions:active"), metrics.SessionID)
+	if metrics.Tenant != "" {
+		pipe.SAdd(tcs.ctx, tenantsKey, metrics.Tenant)
+	}
+}
+
+// queueGlobalCounters queues the global token, error and hourly counters
+func (tcs *TokenCaptureService) queueGlobalCounters(pipe redis.Pipeliner, metrics *TokenMetrics) {
+	ks := TenantKeyspace(metrics.Tenant)
+	pipe.IncrBy(tcs.ctx, ks.Key("tokens:input:count"), int64(metrics.InputTokens))
+	pipe.IncrBy(tcs.ctx, ks.Key("tokens:output:count"), int64(metrics.OutputTokens))
+
+	if metrics.Status.IsError() {
+		pipe.Incr(tcs.ctx, ks.Key("errors:%s:count", metrics.Status))
+		pipe.Incr(tcs.ctx, ks.Key("errors:total:count"))
+	}
+
+	hourlyKey := ks.Key("tokens:hourly:%s", metrics.Timestamp.UTC().Format("2006010215"))
+	pipe.HIncrBy(tcs.ctx, hourlyKey, "requests", 1)
+	pipe.HIncrBy(tcs.ctx, hourlyKey, "input_tokens", int64(metrics.InputTokens))
+	pipe.HIncrBy(tcs.ctx, hourlyKey, "output_tokens", int64(metrics.OutputTokens))
+	pipe.HIncrByFloat(tcs.ctx, hourlyKey, "cost_usd", metrics.CostUSD)
+	pipe.Expire(tcs.ctx, hourlyKey, tcs.retention.Hourly)
+
+	usersKey := HourlyUsersKey(ks, metrics.Timestamp)
+	pipe.PFAdd(tcs.ctx, usersKey, metrics.UserID)
+	pipe.Expire(tcs.ctx, usersKey, tcs.retention.Hourly)
+}
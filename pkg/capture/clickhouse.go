@@ -0,0 +1,281 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/logger"
+)
+
+var clickHouseIdentifier = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// clickHouseSchema creates the table records are inserted into. Rows are
+// ordered for per-tenant, per-model scans over time and partitioned by month
+// so old months can be dropped cheaply.
+const clickHouseSchema = `CREATE TABLE IF NOT EXISTS %s (
+	tenant                 LowCardinality(String),
+	request_id             String,
+	session_id             String,
+	user_id                String,
+	model                  LowCardinality(String),
+	status                 LowCardinality(String),
+	input_tokens           UInt32,
+	output_tokens          UInt32,
+	total_tokens           UInt32,
+	response_time_ms       Float64,
+	time_to_first_token_ms Float64,
+	tokens_per_second      Float64,
+	cost_usd               Float64,
+	redactions             UInt32,
+	client_app             LowCardinality(String),
+	client_app_version     LowCardinality(String),
+	client_origin          String,
+	client_country         LowCardinality(String),
+	schema_version         UInt8,
+	timestamp              DateTime64(3, 'UTC')
+) ENGINE = MergeTree
+PARTITION BY toYYYYMM(timestamp)
+ORDER BY (tenant, model, timestamp)`
+
+// ClickHouseConfig locates the ClickHouse table and sets how records are batched
+type ClickHouseConfig struct {
+	// URL is the HTTP interface, e.g. http://clickhouse:8123
+	URL      string
+	Database string
+	Table    string
+	User     string
+	Password string
+	// BatchSize is the number of records that triggers an insert before the
+	// flush interval; ClickHouse favours few large inserts over many small ones
+	BatchSize     int
+	FlushInterval time.Duration
+	// MaxPending bounds the records held while ClickHouse is unreachable;
+	// the oldest are dropped beyond it
+	MaxPending int
+}
+
+// clickHouseRow is a record in the table's columns, encoded as JSONEachRow
+type clickHouseRow struct {
+	Tenant           string  `json:"tenant"`
+	RequestID        string  `json:"request_id"`
+	SessionID        string  `json:"session_id"`
+	UserID           string  `json:"user_id"`
+	Model            string  `json:"model"`
+	Status           string  `json:"status"`
+	InputTokens      int     `json:"input_tokens"`
+	OutputTokens     int     `json:"output_tokens"`
+	TotalTokens      int     `json:"total_tokens"`
+	ResponseTimeMs   float64 `json:"response_time_ms"`
+	FirstTokenMs     float64 `json:"time_to_first_token_ms"`
+	TokensPerSecond  float64 `json:"tokens_per_second"`
+	CostUSD          float64 `json:"cost_usd"`
+	Redactions       int     `json:"redactions"`
+	ClientApp        string  `json:"client_app"`
+	ClientAppVersion string  `json:"client_app_version"`
+	ClientOrigin     string  `json:"client_origin"`
+	ClientCountry    string  `json:"client_country"`
+	SchemaVersion    int     `json:"schema_version"`
+	Timestamp        string  `json:"timestamp"`
+}
+
+// ClickHousePublisher streams records into a ClickHouse MergeTree table over
+// the HTTP interface. Records are accumulated and inserted in large batches
+// in the background, so publishing never waits on ClickHouse.
+type ClickHousePublisher struct {
+	config   ClickHouseConfig
+	endpoint string
+	table    string
+	client   *http.Client
+
+	mu      sync.Mutex
+	pending []clickHouseRow
+	dropped int
+
+	flush     chan struct{}
+	closeOnce sync.Once
+	done      chan struct{}
+	stopped   chan struct{}
+}
+
+// NewClickHousePublisher creates the table if it does not exist and starts
+// the background inserts
+func NewClickHousePublisher(config ClickHouseConfig) (*ClickHousePublisher, error) {
+	if config.Database == "" {
+		config.Database = "default"
+	}
+	if config.Table == "" {
+		config.Table = "token_metrics"
+	}
+	if !clickHouseIdentifier.MatchString(config.Database) || !clickHouseIdentifier.MatchString(config.Table) {
+		return nil, fmt.Errorf("invalid ClickHouse database or table name")
+	}
+	if _, err := url.Parse(config.URL); err != nil || config.URL == "" {
+		return nil, fmt.Errorf("invalid ClickHouse URL %q", config.URL)
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = 10000
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = 5 * time.Second
+	}
+	if config.MaxPending < config.BatchSize {
+		config.MaxPending = 10 * config.BatchSize
+	}
+
+	cp := &ClickHousePublisher{
+		config:   config,
+		endpoint: strings.TrimRight(config.URL, "/") + "/",
+		table:    config.Database + "." + config.Table,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		flush:    make(chan struct{}, 1),
+		done:     make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+	if err := cp.exec(fmt.Sprintf(clickHouseSchema, cp.table), nil); err != nil {
+		return nil, fmt.Errorf("failed to create ClickHouse table %s: %v", cp.table, err)
+	}
+
+	go cp.run()
+	return cp, nil
+}
+
+// Publish queues the records for the next insert
+func (cp *ClickHousePublisher) Publish(records []*TokenMetrics) error {
+	cp.mu.Lock()
+	for _, m := range records {
+		cp.pending = append(cp.pending, clickHouseRow{
+			Tenant:           m.Tenant,
+			RequestID:        m.RequestID,
+			SessionID:        m.SessionID,
+			UserID:           m.UserID,
+			Model:            m.Model,
+			Status:           string(m.Status),
+			InputTokens:      m.InputTokens,
+			OutputTokens:     m.OutputTokens,
+			TotalTokens:      m.TotalTokens,
+			ResponseTimeMs:   m.ResponseTimeMs,
+			FirstTokenMs:     m.FirstTokenMs,
+			TokensPerSecond:  m.TokensPerSecond,
+			CostUSD:          m.CostUSD,
+			Redactions:       m.Redactions,
+			ClientApp:        m.Client.App,
+			ClientAppVersion: m.Client.AppVersion,
+			ClientOrigin:     m.Client.Origin,
+			ClientCountry:    m.Client.Country,
+			SchemaVersion:    m.SchemaVersion,
+			Timestamp:        m.Timestamp.UTC().Format("2006-01-02 15:04:05.000"),
+		})
+	}
+	if excess := len(cp.pending) - cp.config.MaxPending; excess > 0 {
+		cp.pending = cp.pending[excess:]
+		cp.dropped += excess
+	}
+	full := len(cp.pending) >= cp.config.BatchSize
+	cp.mu.Unlock()
+
+	if full {
+		select {
+		case cp.flush <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// Close inserts any pending records and stops the background inserts
+func (cp *ClickHousePublisher) Close() error {
+	cp.closeOnce.Do(func() {
+		close(cp.done)
+		<-cp.stopped
+	})
+	return nil
+}
+
+// run inserts pending records every flush interval, or sooner once a batch
+// is full, until closed
+func (cp *ClickHousePublisher) run() {
+	defer close(cp.stopped)
+
+	ticker := time.NewTicker(cp.config.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-cp.flush:
+		case <-cp.done:
+			cp.insertPending()
+			return
+		}
+		cp.insertPending()
+	}
+}
+
+// insertPending inserts the pending records in batches. A failed batch is
+// put back to be retried on the next flush.
+func (cp *ClickHousePublisher) insertPending() {
+	cp.mu.Lock()
+	rows := cp.pending
+	cp.pending = nil
+	if cp.dropped > 0 {
+		logger.Component("capture").Warn().Int("records", cp.dropped).Msg("ClickHouse sink dropped records while ClickHouse was unavailable")
+		cp.dropped = 0
+	}
+	cp.mu.Unlock()
+
+	for len(rows) > 0 {
+		n := min(len(rows), cp.config.BatchSize)
+		if err := cp.insert(rows[:n]); err != nil {
+			logger.Component("capture").Error().Err(err).Int("records", len(rows)).Msg("Failed to insert records into ClickHouse")
+			cp.mu.Lock()
+			cp.pending = append(rows, cp.pending...)
+			cp.mu.Unlock()
+			return
+		}
+		rows = rows[n:]
+	}
+}
+
+// insert writes rows in a single INSERT
+func (cp *ClickHousePublisher) insert(rows []clickHouseRow) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for _, row := range rows {
+		if err := encoder.Encode(row); err != nil {
+			return err
+		}
+	}
+	return cp.exec(fmt.Sprintf("INSERT INTO %s FORMAT JSONEachRow", cp.table), &body)
+}
+
+// exec runs a statement, sending body as its data
+func (cp *ClickHousePublisher) exec(query string, body io.Reader) error {
+	params := url.Values{"query": {query}, "database": {cp.config.Database}}
+	req, err := http.NewRequest(http.MethodPost, cp.endpoint+"?"+params.Encode(), body)
+	if err != nil {
+		return err
+	}
+	if cp.config.User != "" {
+		req.Header.Set("X-ClickHouse-User", cp.config.User)
+		req.Header.Set("X-ClickHouse-Key", cp.config.Password)
+	}
+
+	resp, err := cp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %d: %s", resp.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package capture
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+)
+
+// ContentCipher encrypts captured prompt and response text with AES-256-GCM
+type ContentCipher struct {
+	aead cipher.AEAD
+}
+
+// NewContentCipher creates a cipher from a base64-encoded 32-byte key
+func NewContentCipher(encodedKey string) (*ContentCipher, error) {
+	key, err := base64.StdEncoding.DecodeString(encodedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode content key: %v", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("content key must be 32 bytes, got %d", len(key))
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create content cipher: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create content cipher: %v", err)
+	}
+
+	return &ContentCipher{aead: aead}, nil
+}
+
+// Encrypt returns the base64 encoding of a random nonce followed by the
+// sealed plaintext
+func (cc *ContentCipher) Encrypt(plaintext string) (string, error) {
+	nonce := make([]byte, cc.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	sealed := cc.aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt reverses Encrypt
+func (cc *ContentCipher) Decrypt(encoded string) (string, error) {
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode content: %v", err)
+	}
+	if len(sealed) < cc.aead.NonceSize() {
+		return "", fmt.Errorf("content is too short")
+	}
+
+	nonce, ciphertext := sealed[:cc.aead.NonceSize()], sealed[cc.aead.NonceSize():]
+	plaintext, err := cc.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to decrypt content: %v", err)
+	}
+	return string(plaintext), nil
+}
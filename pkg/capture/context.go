@@ -0,0 +1,71 @@
+package capture
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// RequestInfo holds the identifiers used to attribute a request's token usage
+type RequestInfo struct {
+	Tenant    string
+	RequestID string
+	SessionID string
+	UserID    string
+	StartTime time.Time
+	Client    ClientInfo
+}
+
+// ClientInfo describes the client application that sent a request
+type ClientInfo struct {
+	IP         string
+	UserAgent  string
+	App        string
+	AppVersion string
+	Origin     string
+	Country    string
+	// APIKey identifies the API key the request was sent with. It is a
+	// fingerprint from APIKeyID, never the key itself.
+	APIKey string
+}
+
+// APIKeyID returns a stable fingerprint of an API key that usage can be
+// grouped by without storing the key
+func APIKeyID(key string) string {
+	if key == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key))
+	return "key_" + hex.EncodeToString(sum[:6])
+}
+
+type requestInfoKey struct{}
+
+// WithRequestInfo returns a copy of ctx carrying the given request info
+func WithRequestInfo(ctx context.Context, info *RequestInfo) context.Context {
+	return context.WithValue(ctx, requestInfoKey{}, info)
+}
+
+// RequestInfoFromContext returns the request info stored in ctx, if any
+func RequestInfoFromContext(ctx context.Context) (*RequestInfo, bool) {
+	info, ok := ctx.Value(requestInfoKey{}).(*RequestInfo)
+	return info, ok
+}
+
+// NewTokenMetrics builds a TokenMetrics record pre-filled from the request info
+// and a new capture ID
+func (info *RequestInfo) NewTokenMetrics(model string) *TokenMetrics {
+	return &TokenMetrics{
+		CaptureID: uuid.New().String(),
+		Tenant:    info.Tenant,
+		RequestID: info.RequestID,
+		SessionID: info.SessionID,
+		UserID:    info.UserID,
+		Model:     model,
+		Timestamp: info.StartTime,
+		Client:    info.Client,
+	}
+}
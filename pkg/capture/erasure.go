@@ -0,0 +1,196 @@
+package capture
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DeletionReport summarises the data removed for a user
+type DeletionReport struct {
+	UserID                string    `json:"user_id"`
+	RequestsDeleted       int       `json:"requests_deleted"`
+	SessionsDeleted       int       `json:"sessions_deleted"`
+	HourlyBucketsAdjusted int       `json:"hourly_buckets_adjusted"`
+	KeysDeleted           int64     `json:"keys_deleted"`
+	DeletedAt             time.Time `json:"deleted_at"`
+}
+
+// DeleteUserData removes a tenant's user: the user hash, their request and
+// session records, their active-set and ranking memberships, their entries in
+// every daily and monthly cost and token hash and user leaderboard, and their
+// contributions to the hourly, model, client and global token counters.
+// Requests whose records have already expired can no longer be subtracted
+// from those counters, so they keep counting in the aggregates without naming
+// the user. The capture:<id>:done markers, which hold no user data, are kept
+// so a retried capture cannot bring erased requests back.
+func (tcs *TokenCaptureService) DeleteUserData(tenant, userID string) (*DeletionReport, error) {
+	ks := TenantKeyspace(tenant)
+	userKey := ks.Key("user:%s:tokens", userID)
+	requestsKey := ks.Key("user:%s:requests", userID)
+	sessionsKey := ks.Key("user:%s:sessions", userID)
+
+	requestIDs, err := tcs.redis.SMembers(tcs.ctx, requestsKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list requests for user %s: %v", userID, err)
+	}
+	sessionIDs, err := tcs.redis.SMembers(tcs.ctx, sessionsKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions for user %s: %v", userID, err)
+	}
+
+	// The user has an entry in the hash or board of every period they made a
+	// request in, including those whose request records have expired
+	periodHashes, err := tcs.scanKeys(ks, userPeriodHashes)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list period hashes for user %s: %v", userID, err)
+	}
+	periodBoards, err := tcs.scanKeys(ks, userPeriodBoards)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list leaderboards for user %s: %v", userID, err)
+	}
+
+	// Read the surviving request records so their contributions can be retracted
+	readPipe := tcs.redis.Pipeline()
+	requestCmds := make([]*redis.MapStringStringCmd, len(requestIDs))
+	for i, requestID := range requestIDs {
+		requestCmds[i] = readPipe.HGetAll(tcs.ctx, ks.Key("request:%s:tokens", requestID))
+	}
+	if _, err := readPipe.Exec(tcs.ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to read requests for user %s: %v", userID, err)
+	}
+
+	report := &DeletionReport{
+		UserID:    userID,
+		DeletedAt: time.Now(),
+	}
+	buckets := make(map[string]bool)
+
+	pipe := tcs.redis.TxPipeline()
+	var delCmds []*redis.IntCmd
+	for i, requestID := range requestIDs {
+		record := requestCmds[i].Val()
+		if len(record) > 0 {
+			report.RequestsDeleted++
+			tcs.queueRetraction(pipe, ks, record, buckets)
+		}
+		delCmds = append(delCmds, pipe.Del(tcs.ctx,
+			ks.Key("request:%s:tokens", requestID),
+			ks.Key("request:%s:live", requestID),
+			ks.Key("request:%s:content", requestID),
+		))
+		pipe.ZRem(tcs.ctx, ks.Key("requests:active"), requestID)
+	}
+	for _, sessionID := range sessionIDs {
+		delCmds = append(delCmds, pipe.Del(tcs.ctx,
+			ks.Key("session:%s:tokens", sessionID),
+			ks.Key("session:%s:summary", sessionID),
+			sessionRequestsKey(ks, sessionID),
+		))
+		pipe.SRem(tcs.ctx, ks.Key("sessions:active"), sessionID)
+		pipe.ZRem(tcs.ctx, ks.Key("sessions:closed"), sessionID)
+	}
+	for window := range activeWindows {
+		pipe.SRem(tcs.ctx, ks.Key("users:active:%s", window), userID)
+	}
+	for _, key := range periodHashes {
+		pipe.HDel(tcs.ctx, key, userID)
+	}
+	for _, key := range periodBoards {
+		pipe.ZRem(tcs.ctx, key, userID)
+	}
+	allUsersKey, _ := LeaderboardKey(ks, "users", LeaderboardAll, time.Time{})
+	pipe.ZRem(tcs.ctx, allUsersKey, userID)
+	for _, key := range userRankKeys {
+		pipe.ZRem(tcs.ctx, ks.Key(key), userID)
+	}
+	delCmds = append(delCmds, pipe.Del(tcs.ctx, userKey, requestsKey, sessionsKey))
+
+	if _, err := pipe.Exec(tcs.ctx); err != nil {
+		return nil, fmt.Errorf("failed to delete data for user %s: %v", userID, err)
+	}
+
+	for _, cmd := range delCmds {
+		report.KeysDeleted += cmd.Val()
+	}
+	report.SessionsDeleted = len(sessionIDs)
+	report.HourlyBucketsAdjusted = len(buckets)
+
+	return report, nil
+}
+
+// userPeriodHashes match the daily and monthly hashes with a field per user
+var userPeriodHashes = []string{"costs:monthly:*", "costs:daily:*", "tokens:daily:*"}
+
+// userPeriodBoards match the users leaderboards of each day, week and month
+var userPeriodBoards = []string{
+	"leaderboard:users:tokens:" + LeaderboardDaily + ":*",
+	"leaderboard:users:tokens:" + LeaderboardWeekly + ":*",
+	"leaderboard:users:tokens:" + LeaderboardMonthly + ":*",
+}
+
+// scanKeys returns the keys of ks matching any of patterns
+func (tcs *TokenCaptureService) scanKeys(ks Keyspace, patterns []string) ([]string, error) {
+	var keys []string
+	for _, pattern := range patterns {
+		var cursor uint64
+		for {
+			batch, next, err := tcs.redis.Scan(tcs.ctx, cursor, ks.Key(pattern), 100).Result()
+			if err != nil {
+				return nil, err
+			}
+			keys = append(keys, batch...)
+			cursor = next
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+	return keys, nil
+}
+
+// queueRetraction queues the commands that subtract a request record from the
+// hourly, model and global aggregates
+func (tcs *TokenCaptureService) queueRetraction(pipe redis.Pipeliner, ks Keyspace, record map[string]string, buckets map[string]bool) {
+	inputTokens, _ := strconv.ParseInt(record["input_tokens"], 10, 64)
+	outputTokens, _ := strconv.ParseInt(record["output_tokens"], 10, 64)
+	responseTime, _ := strconv.ParseFloat(record["response_time_ms"], 64)
+	timestamp, _ := strconv.ParseInt(record["timestamp"], 10, 64)
+	cost, _ := strconv.ParseFloat(record["cost_usd"], 64)
+
+	pipe.DecrBy(tcs.ctx, ks.Key("tokens:input:count"), inputTokens)
+	pipe.DecrBy(tcs.ctx, ks.Key("tokens:output:count"), outputTokens)
+
+	if status := Status(record["status"]); status.IsError() {
+		pipe.Decr(tcs.ctx, ks.Key("errors:%s:count", status))
+		pipe.Decr(tcs.ctx, ks.Key("errors:total:count"))
+	}
+
+	if timestamp > 0 {
+		hourlyKey := ks.Key("tokens:hourly:%s", time.Unix(timestamp, 0).UTC().Format("2006010215"))
+		retractScript.Eval(tcs.ctx, pipe, []string{hourlyKey}, inputTokens, outputTokens, 0, cost)
+		buckets[hourlyKey] = true
+
+		if model := record["model"]; model != "" {
+			tcs.queueLeaderboardRetraction(pipe, ks, model, float64(inputTokens+outputTokens), time.Unix(timestamp, 0))
+		}
+	}
+
+	if model := record["model"]; model != "" {
+		retractScript.Eval(tcs.ctx, pipe, []string{ks.Key("model:%s:usage", model)},
+			inputTokens, outputTokens, responseTime, cost)
+		if timestamp > 0 {
+			// Latency and error counts hold no user data and are left in place
+			retractScript.Eval(tcs.ctx, pipe, []string{ModelHourlyKey(ks, model, time.Unix(timestamp, 0))},
+				inputTokens, outputTokens, 0, cost)
+		}
+	}
+	for _, dimension := range ClientDimensions {
+		if value := record[dimension.Field]; value != "" {
+			retractScript.Eval(tcs.ctx, pipe, []string{ks.Key("%s:%s:usage", dimension.Kind, value)},
+				inputTokens, outputTokens, responseTime, cost)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package capture
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Columns written to the CSV archive, in order
+var (
+	sessionColumns = []string{"session_id", "model", "status", "started_at", "last_activity", "ended_at",
+		"total_requests", "total_input_tokens", "total_output_tokens", "avg_response_time", "total_cost_usd"}
+	requestColumns = []string{"request_id", "session_id", "model", "input_tokens", "output_tokens",
+		"total_tokens", "response_time_ms", "time_to_first_token_ms", "tokens_per_second", "cost_usd", "status", "timestamp",
+		"client_ip", "client_user_agent", "client_app", "client_app_version", "client_origin", "client_country"}
+)
+
+// UserExport holds everything captured for a user
+type UserExport struct {
+	UserID     string              `json:"user_id"`
+	Stats      map[string]string   `json:"stats"`
+	Sessions   []map[string]string `json:"sessions"`
+	Requests   []map[string]string `json:"requests"`
+	ExportedAt time.Time           `json:"exported_at"`
+}
+
+// ExportUserData collects a tenant's user's aggregate stats and their session and
+// request records that are still within retention. When content capture is
+// enabled the decrypted prompt and response are included with each request.
+func (tcs *TokenCaptureService) ExportUserData(tenant, userID string) (*UserExport, error) {
+	ks := TenantKeyspace(tenant)
+	requestIDs, err := tcs.redis.SMembers(tcs.ctx, ks.Key("user:%s:requests", userID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list requests for user %s: %v", userID, err)
+	}
+	sessionIDs, err := tcs.redis.SMembers(tcs.ctx, ks.Key("user:%s:sessions", userID)).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sessions for user %s: %v", userID, err)
+	}
+	sort.Strings(requestIDs)
+	sort.Strings(sessionIDs)
+
+	pipe := tcs.redis.Pipeline()
+	statsCmd := pipe.HGetAll(tcs.ctx, ks.Key("user:%s:tokens", userID))
+	sessionCmds := make([]*redis.MapStringStringCmd, len(sessionIDs))
+	for i, sessionID := range sessionIDs {
+		sessionCmds[i] = pipe.HGetAll(tcs.ctx, ks.Key("session:%s:tokens", sessionID))
+	}
+	requestCmds := make([]*redis.MapStringStringCmd, len(requestIDs))
+	contentCmds := make([]*redis.MapStringStringCmd, len(requestIDs))
+	for i, requestID := range requestIDs {
+		requestCmds[i] = pipe.HGetAll(tcs.ctx, ks.Key("request:%s:tokens", requestID))
+		if tcs.content != nil {
+			contentCmds[i] = pipe.HGetAll(tcs.ctx, ks.Key("request:%s:content", requestID))
+		}
+	}
+	if _, err := pipe.Exec(tcs.ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to read data for user %s: %v", userID, err)
+	}
+
+	export := &UserExport{
+		UserID:     userID,
+		Stats:      statsCmd.Val(),
+		Sessions:   []map[string]string{},
+		Requests:   []map[string]string{},
+		ExportedAt: time.Now(),
+	}
+	for i, cmd := range sessionCmds {
+		if session := cmd.Val(); len(session) > 0 {
+			session["session_id"] = sessionIDs[i]
+			export.Sessions = append(export.Sessions, session)
+		}
+	}
+	for i, cmd := range requestCmds {
+		request := cmd.Val()
+		if len(request) == 0 {
+			continue
+		}
+		if contentCmds[i] != nil {
+			for field, encrypted := range contentCmds[i].Val() {
+				if plaintext, err := tcs.content.Decrypt(encrypted); err == nil {
+					request[field] = plaintext
+				}
+			}
+		}
+		export.Requests = append(export.Requests, request)
+	}
+
+	return export, nil
+}
+
+// WriteCSVArchive writes the export as a zip archive holding stats.csv,
+// sessions.csv and requests.csv
+func (e *UserExport) WriteCSVArchive(w io.Writer) error {
+	archive := zip.NewWriter(w)
+
+	stats := [][]string{{"field", "value"}}
+	fields := make([]string, 0, len(e.Stats))
+	for field := range e.Stats {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		stats = append(stats, []string{field, e.Stats[field]})
+	}
+
+	files := []struct {
+		name string
+		rows [][]string
+	}{
+		{"stats.csv", stats},
+		{"sessions.csv", tableRows(sessionColumns, e.Sessions)},
+		{"requests.csv", tableRows(requestColumns, e.Requests)},
+	}
+	for _, file := range files {
+		fw, err := archive.Create(file.name)
+		if err != nil {
+			return fmt.Errorf("failed to add %s to archive: %v", file.name, err)
+		}
+		if err := csv.NewWriter(fw).WriteAll(file.rows); err != nil {
+			return fmt.Errorf("failed to write %s: %v", file.name, err)
+		}
+	}
+
+	return archive.Close()
+}
+
+// tableRows converts records to CSV rows with a header
+func tableRows(columns []string, records []map[string]string) [][]string {
+	rows := [][]string{columns}
+	for _, record := range records {
+		row := make([]string, len(columns))
+		for i, column := range columns {
+			row[i] = record[column]
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
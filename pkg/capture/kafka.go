@@ -0,0 +1,66 @@
+package capture
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// KafkaRESTPublisher produces records to a Kafka topic through the Confluent
+// REST Proxy v2 API, keyed by request ID
+type KafkaRESTPublisher struct {
+	endpoint string
+	client   *http.Client
+}
+
+// kafkaRecord is a record in a REST Proxy produce request
+type kafkaRecord struct {
+	Key   string        `json:"key"`
+	Value *TokenMetrics `json:"value"`
+}
+
+// NewKafkaRESTPublisher creates a publisher for the REST Proxy at baseURL
+func NewKafkaRESTPublisher(baseURL, topic string) *KafkaRESTPublisher {
+	return &KafkaRESTPublisher{
+		endpoint: strings.TrimRight(baseURL, "/") + "/topics/" + topic,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// Publish produces the records in a single request
+func (kp *KafkaRESTPublisher) Publish(records []*TokenMetrics) error {
+	batch := make([]kafkaRecord, len(records))
+	for i, metrics := range records {
+		batch[i] = kafkaRecord{Key: metrics.RequestID, Value: metrics}
+	}
+	body, err := json.Marshal(map[string]interface{}{"records": batch})
+	if err != nil {
+		return fmt.Errorf("failed to encode Kafka records: %v", err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, kp.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to create Kafka produce request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+	req.Header.Set("Accept", "application/vnd.kafka.v2+json")
+
+	resp, err := kp.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to produce to %s: %v", kp.endpoint, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("failed to produce to %s: unexpected status %d", kp.endpoint, resp.StatusCode)
+	}
+	return nil
+}
+
+// Close releases idle connections to the REST Proxy
+func (kp *KafkaRESTPublisher) Close() error {
+	kp.client.CloseIdleConnections()
+	return nil
+}
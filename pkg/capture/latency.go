@@ -0,0 +1,100 @@
+package capture
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// LatencySamples is how many recent response times are kept per model and
+// per keyspace for percentile calculations
+const LatencySamples = 1000
+
+// LatencyKey returns the list of a model's most recent response times in
+// milliseconds, or the keyspace-wide list when model is empty
+func LatencyKey(ks Keyspace, model string) string {
+	if model == "" {
+		return ks.Key("latency:recent")
+	}
+	return ks.Key("model:%s:latency", model)
+}
+
+// LatencyDigestMinutes is how many complete minutes of latency digests the
+// response time percentile series are computed over
+const LatencyDigestMinutes = 5
+
+// latencyDigestTTL keeps the per-minute latency digests well past the window
+const latencyDigestTTL = time.Hour
+
+// LatencyDigestKey returns the T-Digest of the response times of successful
+// requests completed during a minute
+func LatencyDigestKey(ks Keyspace, minute time.Time) string {
+	return ks.Key("latency:digest:%s", minute.UTC().Format("200601021504"))
+}
+
+// LatencyDigestWindow returns the LatencyDigestMinutes complete minutes
+// before now, the digests response time percentiles are computed from
+func LatencyDigestWindow(now time.Time) []time.Time {
+	return CompleteMinutes(now, LatencyDigestMinutes)
+}
+
+// latencyDigestScript adds a response time to a minute's T-Digest, creating
+// the digest first since TDIGEST.ADD does not.
+// KEYS[1] digest key
+// ARGV response time ms, ttl seconds
+var latencyDigestScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	redis.call('TDIGEST.CREATE', KEYS[1])
+end
+redis.call('TDIGEST.ADD', KEYS[1], ARGV[1])
+redis.call('EXPIRE', KEYS[1], ARGV[2])
+return 1
+`)
+
+// queueLatency records the response time of a successful request in the
+// keyspace-wide and model latency samples and in the minute's digest. Failed
+// requests are left out so fast failures do not flatter the percentiles.
+func (tcs *TokenCaptureService) queueLatency(pipe redis.Pipeliner, metrics *TokenMetrics) {
+	if metrics.Status.IsError() || metrics.ResponseTimeMs <= 0 {
+		return
+	}
+
+	ks := TenantKeyspace(metrics.Tenant)
+	for _, key := range []string{LatencyKey(ks, ""), LatencyKey(ks, metrics.Model)} {
+		pipe.LPush(tcs.ctx, key, metrics.ResponseTimeMs)
+		pipe.LTrim(tcs.ctx, key, 0, LatencySamples-1)
+	}
+	latencyDigestScript.Eval(tcs.ctx, pipe, []string{LatencyDigestKey(ks, metrics.Timestamp)},
+		metrics.ResponseTimeMs, int(latencyDigestTTL.Seconds()))
+}
+
+// Percentiles returns the nearest-rank percentiles (0 < q <= 1) of latency
+// samples read from a LatencyKey list, or zeros when there are no samples
+func Percentiles(samples []string, qs ...float64) []float64 {
+	values := make([]float64, 0, len(samples))
+	for _, sample := range samples {
+		if value, err := strconv.ParseFloat(sample, 64); err == nil {
+			values = append(values, value)
+		}
+	}
+	sort.Float64s(values)
+
+	results := make([]float64, len(qs))
+	if len(values) == 0 {
+		return results
+	}
+	for i, q := range qs {
+		rank := int(math.Ceil(q*float64(len(values)))) - 1
+		if rank < 0 {
+			rank = 0
+		}
+		if rank >= len(values) {
+			rank = len(values) - 1
+		}
+		results[i] = values[rank]
+	}
+	return results
+}
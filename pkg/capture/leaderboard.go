@@ -0,0 +1,68 @@
+package capture
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Leaderboard periods. Each period other than LeaderboardAll has one board
+// per day, ISO week or month, named after the UTC time it covers.
+const (
+	LeaderboardDaily   = "daily"
+	LeaderboardWeekly  = "weekly"
+	LeaderboardMonthly = "monthly"
+	LeaderboardAll     = "all"
+)
+
+// LeaderboardPeriods lists every leaderboard period
+var LeaderboardPeriods = []string{LeaderboardDaily, LeaderboardWeekly, LeaderboardMonthly, LeaderboardAll}
+
+// LeaderboardKey returns the sorted set ranking users or models (board) by
+// tokens for the period containing t, e.g.
+// leaderboard:users:tokens:daily:20250131
+func LeaderboardKey(ks Keyspace, board, period string, t time.Time) (string, error) {
+	t = t.UTC()
+	switch period {
+	case LeaderboardDaily:
+		return ks.Key("leaderboard:%s:tokens:daily:%s", board, t.Format("20060102")), nil
+	case LeaderboardWeekly:
+		year, week := t.ISOWeek()
+		return ks.Key("leaderboard:%s:tokens:weekly:%d-W%02d", board, year, week), nil
+	case LeaderboardMonthly:
+		return ks.Key("leaderboard:%s:tokens:monthly:%s", board, t.Format("200601")), nil
+	case LeaderboardAll:
+		return ks.Key("leaderboard:%s:tokens:all", board), nil
+	default:
+		return "", fmt.Errorf("unknown leaderboard period %q", period)
+	}
+}
+
+// queueLeaderboards adds the request's tokens to its user's and model's score
+// on every period's board. Period boards expire with the hourly rollups.
+func (tcs *TokenCaptureService) queueLeaderboards(pipe redis.Pipeliner, metrics *TokenMetrics) {
+	ks := TenantKeyspace(metrics.Tenant)
+	for _, period := range LeaderboardPeriods {
+		for board, member := range map[string]string{"users": metrics.UserID, "models": metrics.Model} {
+			key, _ := LeaderboardKey(ks, board, period, metrics.Timestamp)
+			pipe.ZIncrBy(tcs.ctx, key, float64(metrics.TotalTokens), member)
+			if period != LeaderboardAll {
+				pipe.Expire(tcs.ctx, key, tcs.retention.Hourly)
+			}
+		}
+	}
+}
+
+// queueLeaderboardRetraction subtracts an erased request's tokens from its
+// model's scores on the boards covering its timestamp, without recreating
+// boards that have expired. DeleteUserData removes the user from every board.
+func (tcs *TokenCaptureService) queueLeaderboardRetraction(pipe redis.Pipeliner, ks Keyspace, model string, tokens float64, t time.Time) {
+	for _, period := range LeaderboardPeriods {
+		modelsKey, _ := LeaderboardKey(ks, "models", period, t)
+		pipe.ZAddArgsIncr(tcs.ctx, modelsKey, redis.ZAddArgs{
+			XX:      true,
+			Members: []redis.Z{{Score: -tokens, Member: model}},
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package capture
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/logger"
+	"github.com/redis/go-redis/v9"
+)
+
+// liveTTL bounds how long a live record survives if its request never finishes
+const liveTTL = 5 * time.Minute
+
+// LiveTracker publishes the progress of in-flight streamed responses to
+// request:<id>:live hashes indexed by the requests:active sorted set of the
+// request's tenant
+type LiveTracker struct {
+	redis    *redis.Client
+	ctx      context.Context
+	interval time.Duration
+}
+
+// NewLiveTracker creates a tracker that publishes progress every interval
+// using the capture service's Redis connection
+func NewLiveTracker(service *TokenCaptureService, interval time.Duration) *LiveTracker {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return &LiveTracker{
+		redis:    service.redis,
+		ctx:      service.ctx,
+		interval: interval,
+	}
+}
+
+// LiveRequest accumulates the progress of a single streamed response
+type LiveRequest struct {
+	tracker   *LiveTracker
+	key       string
+	activeKey string
+	info      *RequestInfo
+	model     string
+	startTime time.Time
+
+	mu             sync.Mutex
+	tokens         int
+	chunks         int
+	firstTokenTime time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// Start begins tracking a streamed response
+func (lt *LiveTracker) Start(info *RequestInfo, model string) *LiveRequest {
+	lr := &LiveRequest{
+		tracker:   lt,
+		key:       TenantKeyspace(info.Tenant).Key("request:%s:live", info.RequestID),
+		activeKey: TenantKeyspace(info.Tenant).Key("requests:active"),
+		info:      info,
+		model:     model,
+		startTime: time.Now(),
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	go lr.publishPeriodically()
+
+	return lr
+}
+
+// AddChunk records a streamed chunk carrying the given number of tokens
+func (lr *LiveRequest) AddChunk(tokens int) {
+	lr.mu.Lock()
+	defer lr.mu.Unlock()
+
+	if lr.firstTokenTime.IsZero() {
+		lr.firstTokenTime = time.Now()
+	}
+	lr.tokens += tokens
+	lr.chunks++
+}
+
+// Finish stops publishing and removes the live record
+func (lr *LiveRequest) Finish() {
+	close(lr.stop)
+	<-lr.done
+
+	pipe := lr.tracker.redis.Pipeline()
+	pipe.Del(lr.tracker.ctx, lr.key)
+	pipe.ZRem(lr.tracker.ctx, lr.activeKey, lr.info.RequestID)
+	if _, err := pipe.Exec(lr.tracker.ctx); err != nil {
+		logger.Component("capture").Warn().Err(err).Str("request_id", lr.info.RequestID).Msg("Failed to clear live metrics")
+	}
+}
+
+// publishPeriodically writes the current progress until Finish is called
+func (lr *LiveRequest) publishPeriodically() {
+	defer close(lr.done)
+
+	ticker := time.NewTicker(lr.tracker.interval)
+	defer ticker.Stop()
+
+	lr.publish()
+	for {
+		select {
+		case <-ticker.C:
+			lr.publish()
+		case <-lr.stop:
+			return
+		}
+	}
+}
+
+// publish writes a snapshot of the request's progress to Redis
+func (lr *LiveRequest) publish() {
+	lr.mu.Lock()
+	tokens, chunks, firstTokenTime := lr.tokens, lr.chunks, lr.firstTokenTime
+	lr.mu.Unlock()
+
+	now := time.Now()
+	fields := map[string]interface{}{
+		"request_id":    lr.info.RequestID,
+		"session_id":    lr.info.SessionID,
+		"user_id":       lr.info.UserID,
+		"model":         lr.model,
+		"started_at":    lr.startTime.Unix(),
+		"updated_at":    now.Unix(),
+		"output_tokens": tokens,
+		"chunks":        chunks,
+	}
+	if !firstTokenTime.IsZero() {
+		fields["time_to_first_token_ms"] = firstTokenTime.Sub(lr.startTime).Milliseconds()
+		if elapsed := now.Sub(firstTokenTime).Seconds(); elapsed > 0 {
+			fields["tokens_per_second"] = float64(tokens) / elapsed
+			fields["chunks_per_second"] = float64(chunks) / elapsed
+		}
+	}
+
+	pipe := lr.tracker.redis.Pipeline()
+	pipe.HSet(lr.tracker.ctx, lr.key, fields)
+	pipe.Expire(lr.tracker.ctx, lr.key, liveTTL)
+	pipe.ZAdd(lr.tracker.ctx, lr.activeKey, redis.Z{
+		Score:  float64(now.Unix()),
+		Member: lr.info.RequestID,
+	})
+	if _, err := pipe.Exec(lr.tracker.ctx); err != nil {
+		logger.Component("capture").Warn().Err(err).Str("request_id", lr.info.RequestID).Msg("Failed to publish live metrics")
+	}
+}
@@ -0,0 +1,59 @@
+package capture
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// LatencyBucketsMs are the upper bounds, in milliseconds, of the response
+// time buckets counted in each model's hourly rollup. Slower responses are
+// counted in the latency_le_inf field.
+var LatencyBucketsMs = []int64{100, 250, 500, 1000, 2500, 5000, 10000, 30000}
+
+// ModelHourlyKey returns the key of a model's rollup for t's UTC hour
+func ModelHourlyKey(ks Keyspace, model string, t time.Time) string {
+	return ks.Key("model:%s:hourly:%s", model, t.UTC().Format("2006010215"))
+}
+
+// LatencyBucketField returns the hourly rollup field counting responses no
+// slower than boundMs, or slower than every bucket when boundMs is negative
+func LatencyBucketField(boundMs int64) string {
+	if boundMs < 0 {
+		return "latency_le_inf"
+	}
+	return fmt.Sprintf("latency_le_%d", boundMs)
+}
+
+// ErrorStatusField returns the hourly rollup and minute bucket field counting
+// errors of a status
+func ErrorStatusField(status Status) string {
+	return "errors_" + string(status)
+}
+
+// queueModelHourly queues the request's contribution to its model's hourly
+// volume, token, latency and error rollup
+func (tcs *TokenCaptureService) queueModelHourly(pipe redis.Pipeliner, metrics *TokenMetrics) {
+	key := ModelHourlyKey(TenantKeyspace(metrics.Tenant), metrics.Model, metrics.Timestamp)
+	pipe.HIncrBy(tcs.ctx, key, "requests", 1)
+	pipe.HIncrBy(tcs.ctx, key, "input_tokens", int64(metrics.InputTokens))
+	pipe.HIncrBy(tcs.ctx, key, "output_tokens", int64(metrics.OutputTokens))
+	pipe.HIncrByFloat(tcs.ctx, key, "cost_usd", metrics.CostUSD)
+	pipe.HIncrByFloat(tcs.ctx, key, "response_time_ms", metrics.ResponseTimeMs)
+
+	bucket := LatencyBucketField(-1)
+	for _, bound := range LatencyBucketsMs {
+		if metrics.ResponseTimeMs <= float64(bound) {
+			bucket = LatencyBucketField(bound)
+			break
+		}
+	}
+	pipe.HIncrBy(tcs.ctx, key, bucket, 1)
+
+	if metrics.Status.IsError() {
+		pipe.HIncrBy(tcs.ctx, key, "errors", 1)
+		pipe.HIncrBy(tcs.ctx, key, ErrorStatusField(metrics.Status), 1)
+	}
+	pipe.Expire(tcs.ctx, key, tcs.retention.Hourly)
+}
@@ -0,0 +1,162 @@
+package capture
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// natsTimeout bounds connecting to NATS and each publish round trip
+const natsTimeout = 5 * time.Second
+
+// NATSPublisher publishes each record as a JSON message using the NATS client
+// protocol. Messages go to a plain subject, so they are persisted whenever a
+// JetStream stream is configured to capture it.
+type NATSPublisher struct {
+	addr    string
+	user    string
+	pass    string
+	subject string
+
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// NewNATSPublisher creates a publisher for a nats://[user:pass@]host:port URL
+// and connects to the server
+func NewNATSPublisher(rawURL, subject string) (*NATSPublisher, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid NATS URL %q", rawURL)
+	}
+	np := &NATSPublisher{addr: u.Host, subject: subject}
+	if u.User != nil {
+		np.user = u.User.Username()
+		np.pass, _ = u.User.Password()
+	}
+
+	if err := np.connect(); err != nil {
+		return nil, err
+	}
+	return np, nil
+}
+
+// Publish sends the records and waits for the server to acknowledge them
+// with a PONG, reconnecting once if the connection was lost
+func (np *NATSPublisher) Publish(records []*TokenMetrics) error {
+	np.mu.Lock()
+	defer np.mu.Unlock()
+
+	err := np.publish(records)
+	if err != nil {
+		np.disconnect()
+		if err = np.connect(); err == nil {
+			err = np.publish(records)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to publish to NATS subject %s: %v", np.subject, err)
+	}
+	return nil
+}
+
+// Close closes the connection to the server
+func (np *NATSPublisher) Close() error {
+	np.mu.Lock()
+	defer np.mu.Unlock()
+
+	np.disconnect()
+	return nil
+}
+
+// connect dials the server, reads its INFO and sends CONNECT
+func (np *NATSPublisher) connect() error {
+	conn, err := net.DialTimeout("tcp", np.addr, natsTimeout)
+	if err != nil {
+		return fmt.Errorf("failed to connect to NATS at %s: %v", np.addr, err)
+	}
+	conn.SetDeadline(time.Now().Add(natsTimeout))
+	reader := bufio.NewReader(conn)
+
+	line, err := reader.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "INFO") {
+		conn.Close()
+		return fmt.Errorf("failed to handshake with NATS at %s: %v", np.addr, err)
+	}
+
+	options := map[string]interface{}{
+		"verbose":  false,
+		"pedantic": false,
+		"name":     "genai-app-capture",
+		"lang":     "go",
+	}
+	if np.user != "" {
+		options["user"] = np.user
+		options["pass"] = np.pass
+	}
+	connect, _ := json.Marshal(options)
+	if _, err := fmt.Fprintf(conn, "CONNECT %s\r\n", connect); err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to connect to NATS at %s: %v", np.addr, err)
+	}
+
+	np.conn = conn
+	np.reader = reader
+	return nil
+}
+
+// disconnect drops the current connection, if any
+func (np *NATSPublisher) disconnect() {
+	if np.conn != nil {
+		np.conn.Close()
+		np.conn = nil
+		np.reader = nil
+	}
+}
+
+// publish writes a PUB per record followed by a PING, then reads until the
+// matching PONG, answering server PINGs and failing on -ERR
+func (np *NATSPublisher) publish(records []*TokenMetrics) error {
+	if np.conn == nil {
+		return fmt.Errorf("not connected")
+	}
+	np.conn.SetDeadline(time.Now().Add(natsTimeout))
+
+	w := bufio.NewWriter(np.conn)
+	for _, metrics := range records {
+		payload, err := json.Marshal(metrics)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "PUB %s %d\r\n", np.subject, len(payload))
+		w.Write(payload)
+		w.WriteString("\r\n")
+	}
+	w.WriteString("PING\r\n")
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	for {
+		line, err := np.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		switch {
+		case strings.HasPrefix(line, "PONG"):
+			return nil
+		case strings.HasPrefix(line, "PING"):
+			if _, err := np.conn.Write([]byte("PONG\r\n")); err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("server error: %s", strings.TrimSpace(strings.TrimPrefix(line, "-ERR")))
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package capture
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+)
+
+// What the orphan sweeper does with the orphaned request records it finds
+const (
+	OrphanReport  = "report"
+	OrphanDelete  = "delete"
+	OrphanArchive = "archive"
+)
+
+// OrphanSweeper periodically scans request:*:tokens records for ones whose
+// session:<id>:tokens hash no longer exists. Sessions outlive their requests
+// under the default retention, so such records are left behind by TTL gaps,
+// changed retention settings or crashes. Orphans are counted, deleted, or
+// published to the capture service's event publishers and then deleted.
+type OrphanSweeper struct {
+	service   *TokenCaptureService
+	mode      string
+	interval  time.Duration
+	closeOnce sync.Once
+	stop      chan struct{}
+	done      chan struct{}
+
+	foundCounter          prometheus.Counter
+	archivedCounter       prometheus.Counter
+	reclaimedKeysCounter  prometheus.Counter
+	reclaimedBytesCounter prometheus.Counter
+}
+
+// NewOrphanSweeper creates a sweeper that runs every interval in mode
+// (report, delete or archive). Archiving requires an event publisher to have
+// been added to the service. Its metrics are registered with registerer.
+func NewOrphanSweeper(service *TokenCaptureService, mode string, interval time.Duration, registerer prometheus.Registerer) (*OrphanSweeper, error) {
+	switch mode {
+	case OrphanReport, OrphanDelete:
+	case OrphanArchive:
+		if len(service.publishers) == 0 {
+			return nil, fmt.Errorf("archiving orphaned records requires an event sink, Postgres or ClickHouse")
+		}
+	default:
+		return nil, fmt.Errorf("unknown orphan sweep mode %q, expected report, delete or archive", mode)
+	}
+	if interval <= 0 {
+		interval = time.Hour
+	}
+
+	factory := promauto.With(registerer)
+	sw := &OrphanSweeper{
+		service:  service,
+		mode:     mode,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		foundCounter: factory.NewCounter(prometheus.CounterOpts{
+			Name: "genai_app_orphaned_requests_total",
+			Help: "Request records found whose session no longer exists",
+		}),
+		archivedCounter: factory.NewCounter(prometheus.CounterOpts{
+			Name: "genai_app_orphaned_requests_archived_total",
+			Help: "Orphaned request records published to the event sinks before deletion",
+		}),
+		reclaimedKeysCounter: factory.NewCounter(prometheus.CounterOpts{
+			Name: "genai_app_orphan_reclaimed_keys_total",
+			Help: "Redis keys deleted by the orphan sweeper",
+		}),
+		reclaimedBytesCounter: factory.NewCounter(prometheus.CounterOpts{
+			Name: "genai_app_orphan_reclaimed_bytes_total",
+			Help: "Redis memory reclaimed by the orphan sweeper, as reported by MEMORY USAGE",
+		}),
+	}
+
+	go sw.run()
+
+	return sw, nil
+}
+
+// Close stops the sweeper
+func (sw *OrphanSweeper) Close() {
+	sw.closeOnce.Do(func() {
+		close(sw.stop)
+		<-sw.done
+	})
+}
+
+// run sweeps every interval until Close is called
+func (sw *OrphanSweeper) run() {
+	defer close(sw.done)
+
+	ticker := time.NewTicker(sw.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !sw.service.Available() {
+				continue
+			}
+			if err := sw.Sweep(); err != nil {
+				logger.Component("capture").Error().Err(err).Msg("Orphan sweep failed")
+			}
+		case <-sw.stop:
+			return
+		}
+	}
+}
+
+// Sweep scans every tenant's request records once
+func (sw *OrphanSweeper) Sweep() error {
+	tcs := sw.service
+	tenants, err := tcs.redis.SMembers(tcs.ctx, tenantsKey).Result()
+	if err != nil {
+		return fmt.Errorf("failed to list tenants: %v", err)
+	}
+
+	for _, tenant := range append([]string{""}, tenants...) {
+		if err := sw.sweepKeyspace(tenant); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sweepKeyspace scans a single tenant's request records, a page at a time
+func (sw *OrphanSweeper) sweepKeyspace(tenant string) error {
+	tcs := sw.service
+	ks := TenantKeyspace(tenant)
+
+	var cursor uint64
+	for {
+		keys, next, err := tcs.redis.Scan(tcs.ctx, cursor, ks.Key("request:*:tokens"), 100).Result()
+		if err != nil {
+			return fmt.Errorf("failed to scan request records: %v", err)
+		}
+
+		if len(keys) > 0 {
+			orphans, err := sw.findOrphans(tcs.ctx, ks, keys)
+			if err != nil {
+				return err
+			}
+			if len(orphans) > 0 {
+				sw.foundCounter.Add(float64(len(orphans)))
+				if err := sw.reclaim(tcs.ctx, ks, tenant, orphans); err != nil {
+					return err
+				}
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// findOrphans returns the records, keyed by their Redis key, whose session is gone
+func (sw *OrphanSweeper) findOrphans(ctx context.Context, ks Keyspace, keys []string) (map[string]map[string]string, error) {
+	tcs := sw.service
+	pipe := tcs.redis.Pipeline()
+	records := make([]*redis.MapStringStringCmd, len(keys))
+	for i, key := range keys {
+		records[i] = pipe.HGetAll(ctx, key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to read request records: %v", err)
+	}
+
+	pipe = tcs.redis.Pipeline()
+	sessions := make([]*redis.IntCmd, len(keys))
+	for i := range keys {
+		sessions[i] = pipe.Exists(ctx, ks.Key("session:%s:tokens", records[i].Val()["session_id"]))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, fmt.Errorf("failed to check sessions: %v", err)
+	}
+
+	orphans := make(map[string]map[string]string)
+	for i, key := range keys {
+		if record := records[i].Val(); len(record) > 0 && sessions[i].Val() == 0 {
+			orphans[key] = record
+		}
+	}
+	return orphans, nil
+}
+
+// reclaim archives the orphans if configured and deletes them with their
+// content and index entries
+func (sw *OrphanSweeper) reclaim(ctx context.Context, ks Keyspace, tenant string, orphans map[string]map[string]string) error {
+	if sw.mode == OrphanReport {
+		return nil
+	}
+	tcs := sw.service
+
+	if sw.mode == OrphanArchive {
+		records := make([]*TokenMetrics, 0, len(orphans))
+		for _, record := range orphans {
+			records = append(records, recordMetrics(tenant, record))
+		}
+		for _, publisher := range tcs.publishers {
+			if err := publisher.Publish(records); err != nil {
+				return fmt.Errorf("failed to archive orphaned records: %v", err)
+			}
+		}
+		sw.archivedCounter.Add(float64(len(records)))
+	}
+
+	pipe := tcs.redis.Pipeline()
+	var usage []*redis.IntCmd
+	for key, record := range orphans {
+		contentKey := ks.Key("request:%s:content", record["request_id"])
+		usage = append(usage, pipe.MemoryUsage(ctx, key), pipe.MemoryUsage(ctx, contentKey))
+	}
+	pipe.Exec(ctx)
+
+	pipe = tcs.redis.Pipeline()
+	deleted := make([]*redis.IntCmd, 0, len(orphans))
+	for key, record := range orphans {
+		requestID := record["request_id"]
+		deleted = append(deleted, pipe.Del(ctx, key, ks.Key("request:%s:content", requestID)))
+		pipe.SRem(ctx, ks.Key("user:%s:requests", record["user_id"]), requestID)
+		pipe.ZRem(ctx, sessionRequestsKey(ks, record["session_id"]), requestID)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to delete orphaned records: %v", err)
+	}
+
+	for _, cmd := range deleted {
+		sw.reclaimedKeysCounter.Add(float64(cmd.Val()))
+	}
+	for _, cmd := range usage {
+		sw.reclaimedBytesCounter.Add(float64(cmd.Val()))
+	}
+	return nil
+}
+
+// recordMetrics rebuilds token metrics from a stored request record
+func recordMetrics(tenant string, record map[string]string) *TokenMetrics {
+	atoi := func(field string) int {
+		n, _ := strconv.Atoi(record[field])
+		return n
+	}
+	atof := func(field string) float64 {
+		f, _ := strconv.ParseFloat(record[field], 64)
+		return f
+	}
+
+	timestamp, _ := strconv.ParseInt(record["timestamp"], 10, 64)
+	return &TokenMetrics{
+		SchemaVersion:   recordVersion(record),
+		Tenant:          tenant,
+		RequestID:       record["request_id"],
+		SessionID:       record["session_id"],
+		UserID:          record["user_id"],
+		Model:           record["model"],
+		InputTokens:     atoi("input_tokens"),
+		OutputTokens:    atoi("output_tokens"),
+		TotalTokens:     atoi("total_tokens"),
+		ResponseTimeMs:  atof("response_time_ms"),
+		FirstTokenMs:    atof("time_to_first_token_ms"),
+		TokensPerSecond: atof("tokens_per_second"),
+		CostUSD:         atof("cost_usd"),
+		Redactions:      atoi("redactions"),
+		Client: ClientInfo{
+			IP:         record["client_ip"],
+			UserAgent:  record["client_user_agent"],
+			App:        record["client_app"],
+			AppVersion: record["client_app_version"],
+			Origin:     record["client_origin"],
+			Country:    record["client_country"],
+			APIKey:     record["client_api_key"],
+		},
+		Status:    Status(record["status"]),
+		Timestamp: time.Unix(timestamp, 0).UTC(),
+	}
+}
@@ -0,0 +1,82 @@
+package capture
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/postgres"
+)
+
+// postgresRequestColumns are the columns of the Postgres requests table
+// written for each record
+const postgresRequestColumns = "tenant, request_id, session_id, user_id, model, status, input_tokens, output_tokens, " +
+	"total_tokens, response_time_ms, time_to_first_token_ms, tokens_per_second, cost_usd, " +
+	"redactions, client_app, client_app_version, client_origin, client_country, schema_version, created_at"
+
+// PostgresPublisher archives every captured record in the requests table of a
+// Postgres database, so request history outlives its Redis retention
+type PostgresPublisher struct {
+	conn *postgres.Conn
+}
+
+// NewPostgresPublisher connects to the database at a postgres:// URL and
+// applies any pending schema migrations
+func NewPostgresPublisher(url string) (*PostgresPublisher, error) {
+	conn, err := postgres.Connect(url)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := postgres.Migrate(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to migrate Postgres schema: %v", err)
+	}
+	return &PostgresPublisher{conn: conn}, nil
+}
+
+// Publish inserts the records in a single statement. Records already archived
+// are skipped, so a batch can be safely published again.
+func (pp *PostgresPublisher) Publish(records []*TokenMetrics) error {
+	var query strings.Builder
+	query.WriteString("INSERT INTO requests (" + postgresRequestColumns + ") VALUES ")
+	for i, m := range records {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		values := []string{
+			postgres.Literal(m.Tenant),
+			postgres.Literal(m.RequestID),
+			postgres.Literal(m.SessionID),
+			postgres.Literal(m.UserID),
+			postgres.Literal(m.Model),
+			postgres.Literal(string(m.Status)),
+			strconv.Itoa(m.InputTokens),
+			strconv.Itoa(m.OutputTokens),
+			strconv.Itoa(m.TotalTokens),
+			strconv.FormatFloat(m.ResponseTimeMs, 'f', -1, 64),
+			strconv.FormatFloat(m.FirstTokenMs, 'f', -1, 64),
+			strconv.FormatFloat(m.TokensPerSecond, 'f', -1, 64),
+			strconv.FormatFloat(m.CostUSD, 'f', -1, 64),
+			strconv.Itoa(m.Redactions),
+			postgres.Literal(m.Client.App),
+			postgres.Literal(m.Client.AppVersion),
+			postgres.Literal(m.Client.Origin),
+			postgres.Literal(m.Client.Country),
+			strconv.Itoa(m.SchemaVersion),
+			postgres.Literal(m.Timestamp.UTC().Format(time.RFC3339Nano)),
+		}
+		query.WriteString("(" + strings.Join(values, ", ") + ")")
+	}
+	query.WriteString(" ON CONFLICT (tenant, request_id) DO NOTHING")
+
+	if err := pp.conn.Exec(query.String()); err != nil {
+		return fmt.Errorf("failed to archive records in Postgres: %v", err)
+	}
+	return nil
+}
+
+// Close closes the database connection
+func (pp *PostgresPublisher) Close() error {
+	return pp.conn.Close()
+}
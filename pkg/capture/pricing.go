@@ -0,0 +1,41 @@
+package capture
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// ModelPrice is the price of a model in USD per 1K tokens
+type ModelPrice struct {
+	InputPer1K  float64 `json:"input_per_1k"`
+	OutputPer1K float64 `json:"output_per_1k"`
+}
+
+// PriceTable maps model names to prices. The "*" entry, if present, prices
+// models that have no entry of their own; otherwise they cost nothing.
+type PriceTable map[string]ModelPrice
+
+// LoadPriceTable reads a price table from a JSON file such as
+// {"gpt-4o": {"input_per_1k": 0.0025, "output_per_1k": 0.01}}
+func LoadPriceTable(path string) (PriceTable, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read price table: %v", err)
+	}
+
+	var prices PriceTable
+	if err := json.Unmarshal(data, &prices); err != nil {
+		return nil, fmt.Errorf("failed to parse price table: %v", err)
+	}
+	return prices, nil
+}
+
+// Cost returns the cost in USD of a request to model
+func (pt PriceTable) Cost(model string, inputTokens, outputTokens int) float64 {
+	price, ok := pt[model]
+	if !ok {
+		price = pt["*"]
+	}
+	return float64(inputTokens)/1000*price.InputPer1K + float64(outputTokens)/1000*price.OutputPer1K
+}
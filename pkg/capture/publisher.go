@@ -0,0 +1,26 @@
+package capture
+
+import (
+	"fmt"
+)
+
+// EventPublisher publishes captured token metrics to an external event stream
+type EventPublisher interface {
+	// Publish sends the records, in order
+	Publish(records []*TokenMetrics) error
+	Close() error
+}
+
+// NewEventPublisher creates the publisher for a sink kind: "nats" publishes to
+// a NATS subject (which a JetStream stream can capture) at a nats:// URL, and
+// "kafka" produces to a Kafka topic through a Kafka REST Proxy at an http(s):// URL
+func NewEventPublisher(kind, url, topic string) (EventPublisher, error) {
+	switch kind {
+	case "nats":
+		return NewNATSPublisher(url, topic)
+	case "kafka":
+		return NewKafkaRESTPublisher(url, topic), nil
+	default:
+		return nil, fmt.Errorf("unknown event sink %q, expected nats or kafka", kind)
+	}
+}
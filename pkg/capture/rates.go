@@ -0,0 +1,147 @@
+package capture
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// TokenRateMinutes is how many complete minutes token rates are averaged over
+const TokenRateMinutes = 5
+
+// minuteTTL keeps enough per-minute buckets for the rate windows with room to spare
+const minuteTTL = 2 * time.Hour
+
+// ErrorRateWindow is a number of complete minutes an error rate is computed over
+type ErrorRateWindow struct {
+	Name    string
+	Minutes int
+}
+
+// ErrorRateWindows lists the windows error rates are computed over, shortest first
+var ErrorRateWindows = []ErrorRateWindow{{"1m", 1}, {"5m", 5}, {"1h", 60}}
+
+// ErrorRate is the share of requests within a window that failed
+type ErrorRate struct {
+	Requests int64            `json:"requests"`
+	Errors   int64            `json:"errors"`
+	Rate     float64          `json:"rate"`
+	ByStatus map[string]int64 `json:"by_status"`
+}
+
+// Per-model fields of a minute bucket are these prefixes followed by the model name
+const (
+	modelInputField  = "model_input_tokens:"
+	modelOutputField = "model_output_tokens:"
+)
+
+// TokenRate is a token throughput in tokens per minute
+type TokenRate struct {
+	InputPerMinute  float64 `json:"input_per_minute"`
+	OutputPerMinute float64 `json:"output_per_minute"`
+}
+
+// MinuteKey returns the key of the token counts for t's UTC minute
+func MinuteKey(ks Keyspace, t time.Time) string {
+	return ks.Key("tokens:minute:%s", t.UTC().Format("200601021504"))
+}
+
+// RateMinutes returns the TokenRateMinutes complete minutes before now, the
+// buckets token rates are computed from
+func RateMinutes(now time.Time) []time.Time {
+	return CompleteMinutes(now, TokenRateMinutes)
+}
+
+// CompleteMinutes returns the n complete minutes before now, most recent first
+func CompleteMinutes(now time.Time, n int) []time.Time {
+	current := now.UTC().Truncate(time.Minute)
+	minutes := make([]time.Time, n)
+	for i := range minutes {
+		minutes[i] = current.Add(-time.Duration(i+1) * time.Minute)
+	}
+	return minutes
+}
+
+// queueMinuteCounters queues the request's tokens into its minute bucket,
+// globally and for its model, and counts it and any error by status
+func (tcs *TokenCaptureService) queueMinuteCounters(pipe redis.Pipeliner, metrics *TokenMetrics) {
+	key := MinuteKey(TenantKeyspace(metrics.Tenant), metrics.Timestamp)
+	pipe.HIncrBy(tcs.ctx, key, "requests", 1)
+	if metrics.Status.IsError() {
+		pipe.HIncrBy(tcs.ctx, key, "errors", 1)
+		pipe.HIncrBy(tcs.ctx, key, ErrorStatusField(metrics.Status), 1)
+	}
+	pipe.HIncrBy(tcs.ctx, key, "input_tokens", int64(metrics.InputTokens))
+	pipe.HIncrBy(tcs.ctx, key, "output_tokens", int64(metrics.OutputTokens))
+	pipe.HIncrBy(tcs.ctx, key, modelInputField+metrics.Model, int64(metrics.InputTokens))
+	pipe.HIncrBy(tcs.ctx, key, modelOutputField+metrics.Model, int64(metrics.OutputTokens))
+	pipe.Expire(tcs.ctx, key, minuteTTL)
+}
+
+// SumTokenRates averages minute buckets read from the RateMinutes keys into
+// the overall token rate and the rate of each model
+func SumTokenRates(buckets []map[string]string) (TokenRate, map[string]TokenRate) {
+	var total TokenRate
+	models := make(map[string]TokenRate)
+	if len(buckets) == 0 {
+		return total, models
+	}
+
+	minutes := float64(len(buckets))
+	for _, bucket := range buckets {
+		for field, value := range bucket {
+			count, _ := strconv.ParseFloat(value, 64)
+			rate := count / minutes
+			switch {
+			case field == "input_tokens":
+				total.InputPerMinute += rate
+			case field == "output_tokens":
+				total.OutputPerMinute += rate
+			case strings.HasPrefix(field, modelInputField):
+				model := strings.TrimPrefix(field, modelInputField)
+				r := models[model]
+				r.InputPerMinute += rate
+				models[model] = r
+			case strings.HasPrefix(field, modelOutputField):
+				model := strings.TrimPrefix(field, modelOutputField)
+				r := models[model]
+				r.OutputPerMinute += rate
+				models[model] = r
+			}
+		}
+	}
+	return total, models
+}
+
+// SumErrorRates computes the error rate of each ErrorRateWindow, keyed by
+// window name, from minute buckets read from the CompleteMinutes keys of the
+// longest window, most recent first. Minutes before request counting began
+// have no requests field and contribute nothing.
+func SumErrorRates(buckets []map[string]string) map[string]ErrorRate {
+	rates := make(map[string]ErrorRate, len(ErrorRateWindows))
+	for _, window := range ErrorRateWindows {
+		rate := ErrorRate{ByStatus: make(map[string]int64, len(ErrorStatuses))}
+		for i := 0; i < window.Minutes && i < len(buckets); i++ {
+			requests, _ := strconv.ParseInt(buckets[i]["requests"], 10, 64)
+			errors, _ := strconv.ParseInt(buckets[i]["errors"], 10, 64)
+			rate.Requests += requests
+			rate.Errors += errors
+			for _, status := range ErrorStatuses {
+				count, _ := strconv.ParseInt(buckets[i][ErrorStatusField(status)], 10, 64)
+				rate.ByStatus[string(status)] += count
+			}
+		}
+		if rate.Requests > 0 {
+			rate.Rate = float64(rate.Errors) / float64(rate.Requests)
+		}
+		rates[window.Name] = rate
+	}
+	return rates
+}
+
+// ErrorRateMinutes returns the minutes the longest error rate window covers
+func ErrorRateMinutes(now time.Time) []time.Time {
+	return CompleteMinutes(now, ErrorRateWindows[len(ErrorRateWindows)-1].Minutes)
+}
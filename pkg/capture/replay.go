@@ -0,0 +1,93 @@
+package capture
+
+import (
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// SessionReplay holds a session's aggregates and its requests in the order
+// they were made
+type SessionReplay struct {
+	SessionID string              `json:"session_id"`
+	Session   map[string]string   `json:"session"`
+	Requests  []map[string]string `json:"requests"`
+}
+
+// sessionRequestsKey returns the sorted set of a session's request IDs scored
+// by capture time in milliseconds
+func sessionRequestsKey(ks Keyspace, sessionID string) string {
+	return ks.Key("session:%s:requests", sessionID)
+}
+
+// ReplaySession collects a tenant's session and the request records that are
+// still within retention, oldest first. Closed sessions are reported from
+// their summary. When content capture is enabled the decrypted prompt and
+// response are included with each request. Requests skipped by sampling are
+// not listed.
+func (tcs *TokenCaptureService) ReplaySession(tenant, sessionID string) (*SessionReplay, error) {
+	ks := TenantKeyspace(tenant)
+	requestIDs, err := tcs.redis.ZRange(tcs.ctx, sessionRequestsKey(ks, sessionID), 0, -1).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list requests for session %s: %v", sessionID, err)
+	}
+
+	pipe := tcs.redis.Pipeline()
+	sessionCmd := pipe.HGetAll(tcs.ctx, ks.Key("session:%s:tokens", sessionID))
+	summaryCmd := pipe.HGetAll(tcs.ctx, ks.Key("session:%s:summary", sessionID))
+	requestCmds := make([]*redis.MapStringStringCmd, len(requestIDs))
+	contentCmds := make([]*redis.MapStringStringCmd, len(requestIDs))
+	for i, requestID := range requestIDs {
+		requestCmds[i] = pipe.HGetAll(tcs.ctx, ks.Key("request:%s:tokens", requestID))
+		if tcs.content != nil {
+			contentCmds[i] = pipe.HGetAll(tcs.ctx, ks.Key("request:%s:content", requestID))
+		}
+	}
+	if _, err := pipe.Exec(tcs.ctx); err != nil && err != redis.Nil {
+		return nil, fmt.Errorf("failed to read data for session %s: %v", sessionID, err)
+	}
+
+	replay := &SessionReplay{
+		SessionID: sessionID,
+		Session:   sessionCmd.Val(),
+		Requests:  []map[string]string{},
+	}
+	if len(replay.Session) == 0 {
+		replay.Session = summaryCmd.Val()
+	}
+	for i, cmd := range requestCmds {
+		request := cmd.Val()
+		if len(request) == 0 {
+			continue
+		}
+		if contentCmds[i] != nil {
+			for field, encrypted := range contentCmds[i].Val() {
+				if plaintext, err := tcs.content.Decrypt(encrypted); err == nil {
+					request[field] = plaintext
+				}
+			}
+		}
+		replay.Requests = append(replay.Requests, request)
+	}
+
+	return replay, nil
+}
+
+// Found reports whether anything was captured for the session
+func (r *SessionReplay) Found() bool {
+	return len(r.Session) > 0 || len(r.Requests) > 0
+}
+
+// UserID returns the user the session belongs to, from its totals or
+// summary, or else from its requests
+func (r *SessionReplay) UserID() string {
+	if userID := r.Session["user_id"]; userID != "" {
+		return userID
+	}
+	for _, request := range r.Requests {
+		if userID := request["user_id"]; userID != "" {
+			return userID
+		}
+	}
+	return ""
+}
@@ -0,0 +1,20 @@
+package capture
+
+import "time"
+
+// HourlyUsersKey returns the HyperLogLog of the users active in t's UTC hour,
+// from which the rollups count unique users
+func HourlyUsersKey(ks Keyspace, t time.Time) string {
+	return ks.Key("users:hll:hourly:%s", t.UTC().Format("2006010215"))
+}
+
+// HourlyRollupKey returns the key of the compact aggregate of t's UTC hour,
+// written once the hour is complete and kept past the hourly retention
+func HourlyRollupKey(ks Keyspace, t time.Time) string {
+	return ks.Key("rollup:hourly:%s", t.UTC().Format("2006010215"))
+}
+
+// DailyRollupKey returns the key of the compact aggregate of t's UTC day
+func DailyRollupKey(ks Keyspace, t time.Time) string {
+	return ks.Key("rollup:daily:%s", t.UTC().Format("20060102"))
+}
@@ -0,0 +1,298 @@
+package capture
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// SchemaVersion is the version of the request record layout written by this
+// package. Records stored before versioning was introduced have no
+// schema_version field and are treated as version 1.
+const SchemaVersion = 4
+
+// Migration upgrades request records from Version-1 to Version
+type Migration struct {
+	Version     int
+	Description string
+	// Record optionally returns the fields to set on a request record
+	Record func(record map[string]string) map[string]interface{}
+	// Keyspace optionally migrates a tenant's aggregate keys
+	Keyspace func(tcs *TokenCaptureService, ks Keyspace) error
+}
+
+// Migrations lists every schema migration in version order
+var Migrations = []Migration{
+	{
+		Version:     2,
+		Description: "backfill fields added since version 1 and rename the generic error status to upstream_error",
+		Record: func(record map[string]string) map[string]interface{} {
+			fields := map[string]interface{}{}
+			for _, field := range []string{"time_to_first_token_ms", "tokens_per_second", "cost_usd",
+				"redactions"} {
+				if _, ok := record[field]; !ok {
+					fields[field] = 0
+				}
+			}
+			if _, ok := record["sample_rate"]; !ok {
+				fields["sample_rate"] = 1
+			}
+			switch record["status"] {
+			case "":
+				fields["status"] = string(StatusSuccess)
+			case "error":
+				fields["status"] = string(StatusUpstreamError)
+			}
+			return fields
+		},
+		Keyspace: func(tcs *TokenCaptureService, ks Keyspace) error {
+			count, err := tcs.redis.GetDel(tcs.ctx, ks.Key("errors:error:count")).Int64()
+			if err == redis.Nil {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			return tcs.redis.IncrBy(tcs.ctx, ks.Key("errors:%s:count", StatusUpstreamError), count).Err()
+		},
+	},
+	{
+		Version:     3,
+		Description: "rank users on the all-time leaderboard and list models and clients so analytics need not scan keys",
+		Keyspace:    buildUsageIndexes,
+	},
+	{
+		Version:     4,
+		Description: "rank users by input tokens, output tokens, cost and last activity for sorted user listings",
+		Keyspace:    buildUserRanks,
+	},
+}
+
+// userRankKeys are the sorted sets ranking a keyspace's users, maintained by
+// queueUserMetrics
+var userRankKeys = []string{"users:rank:input_tokens", "users:rank:output_tokens", "users:rank:cost_usd", "users:last_seen"}
+
+// buildUserRanks adds users captured before the rank sets were maintained.
+// Like buildUsageIndexes it only raises scores.
+func buildUserRanks(tcs *TokenCaptureService, ks Keyspace) error {
+	var cursor uint64
+	for {
+		keys, next, err := tcs.redis.Scan(tcs.ctx, cursor, ks.Key("user:*:tokens"), 100).Result()
+		if err != nil {
+			return err
+		}
+
+		readPipe := tcs.redis.Pipeline()
+		cmds := make([]*redis.SliceCmd, len(keys))
+		for i, key := range keys {
+			cmds[i] = readPipe.HMGet(tcs.ctx, key, "total_input_tokens", "total_output_tokens", "total_cost_usd", "last_seen")
+		}
+		if _, err := readPipe.Exec(tcs.ctx); err != nil && err != redis.Nil {
+			return err
+		}
+
+		writePipe := tcs.redis.Pipeline()
+		for i, key := range keys {
+			userID := strings.TrimSuffix(strings.TrimPrefix(key, ks.Key("user:")), ":tokens")
+			values := cmds[i].Val()
+			scores := make([]float64, len(values))
+			for j, value := range values {
+				if s, ok := value.(string); ok {
+					if j == 3 {
+						if lastSeen, err := time.Parse(time.RFC3339, s); err == nil {
+							scores[j] = float64(lastSeen.Unix())
+						}
+						continue
+					}
+					scores[j], _ = strconv.ParseFloat(s, 64)
+				}
+			}
+			for j, rankKey := range userRankKeys {
+				writePipe.ZAddGT(tcs.ctx, ks.Key(rankKey), redis.Z{Score: scores[j], Member: userID})
+			}
+		}
+		if writePipe.Len() > 0 {
+			if _, err := writePipe.Exec(tcs.ctx); err != nil {
+				return err
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
+
+// buildUsageIndexes adds the users, models and clients captured before the
+// index keys were maintained to the models and clients sets and the all-time
+// leaderboards. It only raises scores, so it is safe to run while requests
+// are being captured.
+func buildUsageIndexes(tcs *TokenCaptureService, ks Keyspace) error {
+	indexes := []struct {
+		prefix string
+		suffix string
+		set    string
+		board  string
+	}{
+		{"user:", ":tokens", "", "users"},
+		{"model:", ":usage", "models", "models"},
+		{"client:", ":usage", "clients", ""},
+	}
+	for _, idx := range indexes {
+		var cursor uint64
+		for {
+			keys, next, err := tcs.redis.Scan(tcs.ctx, cursor, ks.Key(idx.prefix+"*"+idx.suffix), 100).Result()
+			if err != nil {
+				return err
+			}
+
+			readPipe := tcs.redis.Pipeline()
+			totals := make([]*redis.SliceCmd, len(keys))
+			for i, key := range keys {
+				totals[i] = readPipe.HMGet(tcs.ctx, key, "total_input_tokens", "total_output_tokens")
+			}
+			if _, err := readPipe.Exec(tcs.ctx); err != nil && err != redis.Nil {
+				return err
+			}
+
+			writePipe := tcs.redis.Pipeline()
+			for i, key := range keys {
+				// Model names can contain colons, so trim rather than split
+				name := strings.TrimSuffix(strings.TrimPrefix(key, ks.Key(idx.prefix)), idx.suffix)
+				if idx.set != "" {
+					writePipe.SAdd(tcs.ctx, ks.Key(idx.set), name)
+				}
+				if idx.board == "" {
+					continue
+				}
+				var total float64
+				for _, value := range totals[i].Val() {
+					if s, ok := value.(string); ok {
+						n, _ := strconv.ParseFloat(s, 64)
+						total += n
+					}
+				}
+				boardKey, _ := LeaderboardKey(ks, idx.board, LeaderboardAll, time.Time{})
+				writePipe.ZAddGT(tcs.ctx, boardKey, redis.Z{Score: total, Member: name})
+			}
+			if writePipe.Len() > 0 {
+				if _, err := writePipe.Exec(tcs.ctx); err != nil {
+					return err
+				}
+			}
+
+			cursor = next
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// MigrationReport summarises a migration run
+type MigrationReport struct {
+	Scanned  int         `json:"scanned"`
+	Migrated map[int]int `json:"migrated"`
+	DryRun   bool        `json:"dry_run"`
+}
+
+// recordVersion returns the schema version of a stored request record
+func recordVersion(record map[string]string) int {
+	version, err := strconv.Atoi(record["schema_version"])
+	if err != nil || version < 1 {
+		return 1
+	}
+	return version
+}
+
+// MigrateRecords upgrades every request record, across all tenants, that is
+// older than SchemaVersion by applying the pending migrations in order. A dry
+// run only reports what would change. Records are scanned with SCAN, so the
+// migration can run against a live instance; it is safe to run again.
+func (tcs *TokenCaptureService) MigrateRecords(dryRun bool) (*MigrationReport, error) {
+	tenants, err := tcs.redis.SMembers(tcs.ctx, tenantsKey).Result()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tenants: %v", err)
+	}
+
+	report := &MigrationReport{Migrated: map[int]int{}, DryRun: dryRun}
+	for _, tenant := range append([]string{""}, tenants...) {
+		ks := TenantKeyspace(tenant)
+		if err := tcs.migrateKeyspace(ks, report); err != nil {
+			return nil, err
+		}
+		if dryRun {
+			continue
+		}
+		for _, migration := range Migrations {
+			if migration.Keyspace == nil {
+				continue
+			}
+			if err := migration.Keyspace(tcs, ks); err != nil {
+				return nil, fmt.Errorf("failed to apply migration %d to %q: %v", migration.Version, ks, err)
+			}
+		}
+	}
+	return report, nil
+}
+
+// migrateKeyspace upgrades the request records of a single tenant
+func (tcs *TokenCaptureService) migrateKeyspace(ks Keyspace, report *MigrationReport) error {
+	var cursor uint64
+	for {
+		keys, next, err := tcs.redis.Scan(tcs.ctx, cursor, ks.Key("request:*:tokens"), 100).Result()
+		if err != nil {
+			return fmt.Errorf("failed to scan request records: %v", err)
+		}
+
+		readPipe := tcs.redis.Pipeline()
+		cmds := make([]*redis.MapStringStringCmd, len(keys))
+		for i, key := range keys {
+			cmds[i] = readPipe.HGetAll(tcs.ctx, key)
+		}
+		if _, err := readPipe.Exec(tcs.ctx); err != nil && err != redis.Nil {
+			return fmt.Errorf("failed to read request records: %v", err)
+		}
+
+		writePipe := tcs.redis.Pipeline()
+		for i, key := range keys {
+			record := cmds[i].Val()
+			if len(record) == 0 {
+				continue
+			}
+			report.Scanned++
+
+			version := recordVersion(record)
+			if version >= SchemaVersion {
+				continue
+			}
+			fields := map[string]interface{}{"schema_version": SchemaVersion}
+			for _, migration := range Migrations {
+				if migration.Version <= version || migration.Record == nil {
+					continue
+				}
+				for field, value := range migration.Record(record) {
+					fields[field] = value
+					record[field] = fmt.Sprint(value)
+				}
+			}
+			report.Migrated[version]++
+			writePipe.HSet(tcs.ctx, key, fields)
+		}
+		if !report.DryRun && writePipe.Len() > 0 {
+			if _, err := writePipe.Exec(tcs.ctx); err != nil {
+				return fmt.Errorf("failed to write migrated records: %v", err)
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package capture
+
+import "github.com/redis/go-redis/v9"
+
+// The aggregate updates below increment totals and recompute the averages
+// derived from them inside Redis, so concurrent captures for the same
+// session, user or model cannot interleave between the read and the write.
+//
+// They are sent with EVAL rather than EVALSHA because they run inside the
+// capture transaction, where a NOSCRIPT error cannot be retried without
+// re-applying the other queued commands.
+
+// sessionScript updates a session hash.
+// KEYS[1] session key
+// ARGV input tokens, output tokens, response time ms, user id, model,
+// timestamp, ttl seconds, cost usd
+var sessionScript = redis.NewScript(`
+local requests = redis.call('HINCRBY', KEYS[1], 'total_requests', 1)
+redis.call('HINCRBY', KEYS[1], 'total_input_tokens', ARGV[1])
+redis.call('HINCRBY', KEYS[1], 'total_output_tokens', ARGV[2])
+local responseTime = tonumber(redis.call('HINCRBYFLOAT', KEYS[1], 'total_response_time', ARGV[3]))
+redis.call('HINCRBYFLOAT', KEYS[1], 'total_cost_usd', ARGV[8])
+redis.call('HSET', KEYS[1],
+	'avg_response_time', tostring(responseTime / requests),
+	'user_id', ARGV[4],
+	'model', ARGV[5],
+	'last_activity', ARGV[6],
+	'status', 'active')
+redis.call('HSETNX', KEYS[1], 'started_at', ARGV[6])
+redis.call('EXPIRE', KEYS[1], ARGV[7])
+return requests
+`)
+
+// userScript updates a user hash.
+// KEYS[1] user key
+// ARGV input tokens, output tokens, last seen, cost usd
+var userScript = redis.NewScript(`
+local requests = redis.call('HINCRBY', KEYS[1], 'total_requests', 1)
+local input = redis.call('HINCRBY', KEYS[1], 'total_input_tokens', ARGV[1])
+local output = redis.call('HINCRBY', KEYS[1], 'total_output_tokens', ARGV[2])
+redis.call('HINCRBYFLOAT', KEYS[1], 'total_cost_usd', ARGV[4])
+redis.call('HSET', KEYS[1],
+	'avg_tokens_per_request', string.format('%.2f', (input + output) / requests),
+	'last_seen', ARGV[3])
+return requests
+`)
+
+// modelScript updates a model or client usage hash.
+// KEYS[1] model key
+// ARGV input tokens, output tokens, response time ms, cost usd
+var modelScript = redis.NewScript(`
+local requests = redis.call('HINCRBY', KEYS[1], 'total_requests', 1)
+redis.call('HINCRBY', KEYS[1], 'total_input_tokens', ARGV[1])
+redis.call('HINCRBY', KEYS[1], 'total_output_tokens', ARGV[2])
+redis.call('HINCRBYFLOAT', KEYS[1], 'total_cost_usd', ARGV[4])
+local responseTime = tonumber(redis.call('HINCRBYFLOAT', KEYS[1], 'total_response_time', ARGV[3]))
+redis.call('HSET', KEYS[1], 'avg_response_time', tostring(responseTime / requests))
+return requests
+`)
+
+// closeSessionScript closes a session if it has been idle since the cutoff,
+// returning 1 if it was closed. Sessions whose hash has expired are simply
+// dropped from the active set.
+// KEYS[1] session key, KEYS[2] active sessions set, KEYS[3] summary key,
+// KEYS[4] closed sessions sorted set
+// ARGV session id, cutoff, now, summary ttl seconds
+var closeSessionScript = redis.NewScript(`
+local last = tonumber(redis.call('HGET', KEYS[1], 'last_activity'))
+if not last then
+	redis.call('SREM', KEYS[2], ARGV[1])
+	return 0
+end
+if last > tonumber(ARGV[2]) then
+	return 0
+end
+redis.call('SREM', KEYS[2], ARGV[1])
+redis.call('HSET', KEYS[1], 'status', 'closed', 'ended_at', last)
+local s = redis.call('HMGET', KEYS[1], 'user_id', 'model', 'started_at',
+	'total_requests', 'total_input_tokens', 'total_output_tokens', 'avg_response_time',
+	'total_cost_usd')
+local started = tonumber(s[3]) or last
+redis.call('HSET', KEYS[3],
+	'session_id', ARGV[1],
+	'user_id', s[1] or '',
+	'model', s[2] or '',
+	'started_at', started,
+	'ended_at', last,
+	'closed_at', ARGV[3],
+	'duration_seconds', last - started,
+	'total_requests', s[4] or 0,
+	'total_input_tokens', s[5] or 0,
+	'total_output_tokens', s[6] or 0,
+	'avg_response_time', s[7] or 0,
+	'total_cost_usd', s[8] or 0)
+redis.call('EXPIRE', KEYS[3], ARGV[4])
+redis.call('ZADD', KEYS[4], last, ARGV[1])
+return 1
+`)
+
+// retractScript subtracts a single request from an hourly, model or client hash,
+// recomputing the average response time if the hash tracks one. Missing
+// hashes are left alone so expired aggregates are not recreated.
+// KEYS[1] aggregate key
+// ARGV input tokens, output tokens, response time ms, cost usd
+var retractScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return 0
+end
+local requestsField = 'total_requests'
+local inputField = 'total_input_tokens'
+local outputField = 'total_output_tokens'
+local costField = 'total_cost_usd'
+if redis.call('HEXISTS', KEYS[1], 'requests') == 1 then
+	requestsField = 'requests'
+	inputField = 'input_tokens'
+	outputField = 'output_tokens'
+	costField = 'cost_usd'
+end
+local requests = redis.call('HINCRBY', KEYS[1], requestsField, -1)
+redis.call('HINCRBY', KEYS[1], inputField, -tonumber(ARGV[1]))
+redis.call('HINCRBY', KEYS[1], outputField, -tonumber(ARGV[2]))
+if redis.call('HEXISTS', KEYS[1], costField) == 1 then
+	redis.call('HINCRBYFLOAT', KEYS[1], costField, -tonumber(ARGV[4]))
+end
+if redis.call('HEXISTS', KEYS[1], 'total_response_time') == 1 then
+	local responseTime = tonumber(redis.call('HINCRBYFLOAT', KEYS[1], 'total_response_time', -tonumber(ARGV[3])))
+	local avg = 0
+	if requests > 0 then
+		avg = responseTime / requests
+	end
+	redis.call('HSET', KEYS[1], 'avg_response_time', tostring(avg))
+end
+return requests
+`)
@@ -0,0 +1,160 @@
+package capture
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+)
+
+// SessionReaper periodically closes sessions that have been idle for longer
+// than the idle timeout. Closed sessions are removed from sessions:active,
+// summarised in a session:<id>:summary hash and indexed by end time in the
+// sessions:closed sorted set.
+type SessionReaper struct {
+	redis       *redis.Client
+	ctx         context.Context
+	idleTimeout time.Duration
+	interval    time.Duration
+	summaryTTL  time.Duration
+	available   func() bool
+	closeOnce   sync.Once
+	stop        chan struct{}
+	done        chan struct{}
+
+	closedCounter prometheus.Counter
+}
+
+// NewSessionReaper creates a reaper that sweeps sessions:active every interval
+// using the capture service's Redis connection. Its metrics are registered
+// with registerer.
+func NewSessionReaper(service *TokenCaptureService, idleTimeout, interval time.Duration, registerer prometheus.Registerer) *SessionReaper {
+	if idleTimeout <= 0 {
+		idleTimeout = 30 * time.Minute
+	}
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	sr := &SessionReaper{
+		redis:       service.redis,
+		ctx:         service.ctx,
+		idleTimeout: idleTimeout,
+		interval:    interval,
+		summaryTTL:  service.retention.Session,
+		available:   service.Available,
+		stop:        make(chan struct{}),
+		done:        make(chan struct{}),
+		closedCounter: promauto.With(registerer).NewCounter(prometheus.CounterOpts{
+			Name: "genai_app_sessions_closed_total",
+			Help: "Sessions closed after exceeding the idle timeout",
+		}),
+	}
+
+	go sr.run()
+
+	return sr
+}
+
+// Close stops the reaper
+func (sr *SessionReaper) Close() {
+	sr.closeOnce.Do(func() {
+		close(sr.stop)
+		<-sr.done
+	})
+}
+
+// run sweeps the active sessions until Close is called
+func (sr *SessionReaper) run() {
+	defer close(sr.done)
+
+	ticker := time.NewTicker(sr.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !sr.available() {
+				continue
+			}
+			if err := sr.Sweep(); err != nil {
+				logger.Component("capture").Error().Err(err).Msg("Session sweep failed")
+			}
+		case <-sr.stop:
+			return
+		}
+	}
+}
+
+// Sweep closes every active session whose last activity is older than the
+// idle timeout, across all tenants. It is safe to run from several instances
+// at once.
+func (sr *SessionReaper) Sweep() error {
+	tenants, err := sr.redis.SMembers(sr.ctx, tenantsKey).Result()
+	if err != nil {
+		return fmt.Errorf("failed to list tenants: %v", err)
+	}
+
+	for _, tenant := range append([]string{""}, tenants...) {
+		if err := sr.sweepKeyspace(TenantKeyspace(tenant)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sweepKeyspace closes the idle sessions of a single tenant
+func (sr *SessionReaper) sweepKeyspace(ks Keyspace) error {
+	now := time.Now()
+	cutoff := now.Add(-sr.idleTimeout).Unix()
+	activeKey := ks.Key("sessions:active")
+	closedKey := ks.Key("sessions:closed")
+
+	var cursor uint64
+	for {
+		sessionIDs, next, err := sr.redis.SScan(sr.ctx, activeKey, cursor, "", 100).Result()
+		if err != nil {
+			return fmt.Errorf("failed to scan active sessions: %v", err)
+		}
+
+		for _, sessionID := range sessionIDs {
+			closed, err := closeSessionScript.Run(sr.ctx, sr.redis,
+				[]string{
+					ks.Key("session:%s:tokens", sessionID),
+					activeKey,
+					ks.Key("session:%s:summary", sessionID),
+					closedKey,
+				},
+				sessionID,
+				cutoff,
+				now.Unix(),
+				int64(sr.summaryTTL.Seconds()),
+			).Int()
+			if err != nil {
+				logger.Component("capture").Error().Err(err).Str("session_id", sessionID).Msg("Failed to close session")
+				continue
+			}
+			if closed == 1 {
+				sr.closedCounter.Inc()
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+
+	// Summaries expire with the session retention, so drop their index entries too
+	expired := now.Add(-sr.summaryTTL).Unix()
+	if err := sr.redis.ZRemRangeByScore(sr.ctx, closedKey, "-inf", strconv.FormatInt(expired, 10)).Err(); err != nil {
+		return fmt.Errorf("failed to trim closed sessions: %v", err)
+	}
+	return nil
+}
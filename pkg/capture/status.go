@@ -0,0 +1,30 @@
+package capture
+
+// Status classifies the outcome of a captured request
+type Status string
+
+// Request outcomes. Every status other than StatusSuccess is counted in the
+// errors:<status>:count and errors:total:count keys.
+const (
+	StatusSuccess          Status = "success"
+	StatusUpstreamTimeout  Status = "upstream_timeout"
+	StatusUpstreamError    Status = "upstream_error"
+	StatusRateLimited      Status = "rate_limited"
+	StatusCancelled        Status = "cancelled"
+	StatusGuardrailBlocked Status = "guardrail_blocked"
+)
+
+// ErrorStatuses lists the statuses that count as errors
+var ErrorStatuses = []Status{
+	StatusUpstreamTimeout,
+	StatusUpstreamError,
+	StatusRateLimited,
+	StatusCancelled,
+	StatusGuardrailBlocked,
+}
+
+// IsError reports whether the status counts as an error. An unset status is
+// treated as success.
+func (s Status) IsError() bool {
+	return s != "" && s != StatusSuccess
+}
@@ -0,0 +1,33 @@
+package capture
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// tenantsKey is the unprefixed set of tenants that have captured data
+const tenantsKey = "tenants"
+
+var tenantPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// ValidTenant reports whether tenant can be used as a tenant ID
+func ValidTenant(tenant string) bool {
+	return tenantPattern.MatchString(tenant)
+}
+
+// Keyspace is the prefix applied to a tenant's Redis keys. The default tenant
+// ("") uses unprefixed keys, so single-tenant deployments keep their layout.
+type Keyspace string
+
+// TenantKeyspace returns the keyspace holding tenant's data
+func TenantKeyspace(tenant string) Keyspace {
+	if tenant == "" {
+		return ""
+	}
+	return Keyspace("tenant:" + tenant + ":")
+}
+
+// Key formats a key within the keyspace
+func (ks Keyspace) Key(format string, args ...interface{}) string {
+	return string(ks) + fmt.Sprintf(format, args...)
+}
@@ -0,0 +1,177 @@
+package capture
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Webhook event types
+const (
+	EventRequestCaptured         = "request.captured"
+	EventUserDailyTokensExceeded = "user.daily_tokens_exceeded"
+)
+
+// Delivery policy for webhook events
+const (
+	webhookAttempts     = 3
+	webhookBackoff      = 500 * time.Millisecond
+	webhookTimeout      = 5 * time.Second
+	webhookQueueSize    = 1000
+	webhookSignatureKey = "X-Webhook-Signature"
+)
+
+// WebhookEvent is the JSON body posted to webhook URLs
+type WebhookEvent struct {
+	Type      string      `json:"type"`
+	Timestamp time.Time   `json:"timestamp"`
+	Data      interface{} `json:"data"`
+}
+
+// DailyTokensExceeded is the data of a user.daily_tokens_exceeded event
+type DailyTokensExceeded struct {
+	Tenant      string `json:"tenant,omitempty"`
+	UserID      string `json:"user_id"`
+	Date        string `json:"date"`
+	TotalTokens int64  `json:"total_tokens"`
+	Threshold   int64  `json:"threshold"`
+}
+
+// WebhookConfig configures webhook delivery
+type WebhookConfig struct {
+	URLs   []string
+	Secret string
+	// SendRequests posts a request.captured event for every captured request
+	SendRequests bool
+	// DailyTokenThreshold posts a user.daily_tokens_exceeded event the first
+	// time a user's tokens for the UTC day reach it; zero disables the event
+	DailyTokenThreshold int64
+}
+
+// WebhookNotifier posts capture events to webhook URLs in the background.
+// Each body is signed with HMAC-SHA256 using the shared secret and the hex
+// digest is sent as "sha256=<digest>" in the X-Webhook-Signature header.
+type WebhookNotifier struct {
+	config    WebhookConfig
+	client    *http.Client
+	events    chan *WebhookEvent
+	closeOnce sync.Once
+	done      chan struct{}
+
+	deliveries *prometheus.CounterVec
+}
+
+// NewWebhookNotifier creates a notifier and starts its delivery goroutine. Its
+// metrics are registered with registerer.
+func NewWebhookNotifier(config WebhookConfig, registerer prometheus.Registerer) *WebhookNotifier {
+	wn := &WebhookNotifier{
+		config: config,
+		client: &http.Client{Timeout: webhookTimeout},
+		events: make(chan *WebhookEvent, webhookQueueSize),
+		done:   make(chan struct{}),
+		deliveries: promauto.With(registerer).NewCounterVec(prometheus.CounterOpts{
+			Name: "genai_app_webhook_deliveries_total",
+			Help: "Webhook deliveries by event type and result",
+		}, []string{"type", "result"}),
+	}
+
+	go wn.run()
+
+	return wn
+}
+
+// Notify queues an event for delivery, dropping it if the queue is full
+func (wn *WebhookNotifier) Notify(eventType string, data interface{}) {
+	event := &WebhookEvent{Type: eventType, Timestamp: time.Now(), Data: data}
+	select {
+	case wn.events <- event:
+	default:
+		wn.deliveries.WithLabelValues(eventType, "dropped").Inc()
+		logger.Component("capture").Warn().Str("event", eventType).Msg("Webhook queue full, dropping event")
+	}
+}
+
+// Close delivers any queued events and stops the notifier
+func (wn *WebhookNotifier) Close() {
+	wn.closeOnce.Do(func() {
+		close(wn.events)
+		<-wn.done
+	})
+}
+
+// run delivers queued events until the events channel is closed
+func (wn *WebhookNotifier) run() {
+	defer close(wn.done)
+
+	for event := range wn.events {
+		body, err := json.Marshal(event)
+		if err != nil {
+			logger.Component("capture").Error().Err(err).Str("event", event.Type).Msg("Failed to encode webhook event")
+			continue
+		}
+		signature := wn.sign(body)
+		for _, url := range wn.config.URLs {
+			if err := wn.deliver(url, body, signature); err != nil {
+				wn.deliveries.WithLabelValues(event.Type, "failed").Inc()
+				logger.Component("capture").Warn().Err(err).Str("event", event.Type).Str("url", url).Msg("Failed to deliver webhook")
+				continue
+			}
+			wn.deliveries.WithLabelValues(event.Type, "delivered").Inc()
+		}
+	}
+}
+
+// deliver posts a body to a URL, retrying with backoff on errors and 5xx responses
+func (wn *WebhookNotifier) deliver(url string, body []byte, signature string) error {
+	var err error
+	for attempt := 0; attempt < webhookAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(webhookBackoff << (attempt - 1))
+		}
+
+		var req *http.Request
+		req, err = http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return fmt.Errorf("failed to create request: %v", err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if signature != "" {
+			req.Header.Set(webhookSignatureKey, signature)
+		}
+
+		var resp *http.Response
+		resp, err = wn.client.Do(req)
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 300 {
+			return nil
+		}
+		err = fmt.Errorf("unexpected status %d", resp.StatusCode)
+		if resp.StatusCode < 500 {
+			return err
+		}
+	}
+	return err
+}
+
+// sign returns the signature header value for a body, or "" without a secret
+func (wn *WebhookNotifier) sign(body []byte) string {
+	if wn.config.Secret == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(wn.config.Secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
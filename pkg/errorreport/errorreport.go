@@ -0,0 +1,232 @@
+// Package errorreport sends panics and server errors, with their stack traces
+// and request context, to a Sentry-compatible DSN.
+package errorreport
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/logger"
+)
+
+const (
+	// queueSize bounds the events waiting to be sent; further events are
+	// dropped rather than holding up requests
+	queueSize = 100
+
+	// sendTimeout bounds each request to the DSN
+	sendTimeout = 10 * time.Second
+
+	// clientName identifies this client in the X-Sentry-Auth header
+	clientName = "aiwatch-go/1.0"
+)
+
+// reportedHeaders are the request headers sent with an event. Credentials
+// such as Authorization, X-API-Key and cookies are never sent.
+var reportedHeaders = []string{
+	"Content-Type",
+	"User-Agent",
+	"X-Request-ID",
+	"X-Tenant-ID",
+	"X-Session-ID",
+	"X-Client-App",
+	"X-App-Version",
+}
+
+// Config selects where and how events are reported
+type Config struct {
+	// DSN is the Sentry-compatible project DSN,
+	// scheme://public_key@host[/path]/project_id
+	DSN string
+
+	// Environment and Release are attached to every event when set
+	Environment string
+	Release     string
+}
+
+// ConfigFromEnv reads SENTRY_DSN, SENTRY_ENVIRONMENT and SENTRY_RELEASE
+func ConfigFromEnv() Config {
+	return Config{
+		DSN:         os.Getenv("SENTRY_DSN"),
+		Environment: os.Getenv("SENTRY_ENVIRONMENT"),
+		Release:     os.Getenv("SENTRY_RELEASE"),
+	}
+}
+
+// Report describes a failure to report
+type Report struct {
+	// Err is what went wrong; for a panic, the recovered value as an error
+	Err   error
+	Panic bool
+
+	// Stack holds program counters from runtime.Callers, innermost first
+	Stack []uintptr
+
+	// Request is the request being served when the failure happened
+	Request *http.Request
+	UserID  string
+	Tags    map[string]string
+
+	// TraceID and SpanID link the event to the request's trace
+	TraceID string
+	SpanID  string
+}
+
+// Reporter sends events to a Sentry-compatible DSN in the background
+type Reporter struct {
+	service   string
+	config    Config
+	endpoint  string
+	auth      string
+	client    *http.Client
+	events    chan *event
+	wg        sync.WaitGroup
+	closeOnce sync.Once
+}
+
+// New creates a reporter for the service and starts sending its events
+func New(service string, config Config) (*Reporter, error) {
+	endpoint, auth, err := parseDSN(config.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SENTRY_DSN: %w", err)
+	}
+
+	r := &Reporter{
+		service:  service,
+		config:   config,
+		endpoint: endpoint,
+		auth:     auth,
+		client:   &http.Client{Timeout: sendTimeout},
+		events:   make(chan *event, queueSize),
+	}
+	r.wg.Add(1)
+	go r.run()
+	return r, nil
+}
+
+// NewFromEnv creates a reporter from ConfigFromEnv, or returns nil when
+// SENTRY_DSN is not set
+func NewFromEnv(service string) (*Reporter, error) {
+	config := ConfigFromEnv()
+	if config.DSN == "" {
+		return nil, nil
+	}
+	return New(service, config)
+}
+
+// parseDSN derives the envelope endpoint and X-Sentry-Auth header from a DSN
+func parseDSN(dsn string) (endpoint, auth string, err error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return "", "", fmt.Errorf("scheme must be http or https")
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return "", "", fmt.Errorf("missing public key")
+	}
+	prefix, project := "", strings.TrimPrefix(u.Path, "/")
+	if i := strings.LastIndex(project, "/"); i >= 0 {
+		prefix, project = "/"+project[:i], project[i+1:]
+	}
+	if project == "" {
+		return "", "", fmt.Errorf("missing project ID")
+	}
+
+	endpoint = fmt.Sprintf("%s://%s%s/api/%s/envelope/", u.Scheme, u.Host, prefix, project)
+	auth = fmt.Sprintf("Sentry sentry_version=7, sentry_client=%s, sentry_key=%s", clientName, u.User.Username())
+	if secret, ok := u.User.Password(); ok {
+		auth += ", sentry_secret=" + secret
+	}
+	return endpoint, auth, nil
+}
+
+// Capture queues a report to be sent, dropping it when the queue is full
+func (r *Reporter) Capture(report Report) {
+	e := r.newEvent(report)
+	select {
+	case r.events <- e:
+	default:
+		logger.Component("errorreport").Warn().Str("event_id", e.EventID).Msg("Error report queue full, dropping event")
+	}
+}
+
+// Close sends the queued events, waiting at most timeout
+func (r *Reporter) Close(timeout time.Duration) {
+	r.closeOnce.Do(func() { close(r.events) })
+	done := make(chan struct{})
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		logger.Component("errorreport").Warn().Msg("Timed out sending error reports")
+	}
+}
+
+func (r *Reporter) run() {
+	defer r.wg.Done()
+	for e := range r.events {
+		if err := r.send(e); err != nil {
+			logger.Component("errorreport").Warn().Err(err).Str("event_id", e.EventID).Msg("Failed to send error report")
+		}
+	}
+}
+
+// send posts an event as a Sentry envelope
+func (r *Reporter) send(e *event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	header, _ := json.Marshal(map[string]string{
+		"event_id": e.EventID,
+		"sent_at":  time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	item, _ := json.Marshal(map[string]interface{}{"type": "event", "length": len(payload)})
+
+	var body bytes.Buffer
+	for _, line := range [][]byte{header, item, payload} {
+		body.Write(line)
+		body.WriteByte('\n')
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), sendTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.endpoint, &body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", r.auth)
+
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("DSN returned %s", resp.Status)
+	}
+	return nil
+}
+
+// newEventID returns a random 32 character hex event ID
+func newEventID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
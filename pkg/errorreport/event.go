@@ -0,0 +1,197 @@
+package errorreport
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// inAppPrefix marks stack frames from this module as application code
+const inAppPrefix = "github.com/ajeetraina/genai-app-demo/"
+
+// event is the subset of the Sentry event payload this package sends
+type event struct {
+	EventID     string               `json:"event_id"`
+	Timestamp   string               `json:"timestamp"`
+	Level       string               `json:"level"`
+	Platform    string               `json:"platform"`
+	Logger      string               `json:"logger"`
+	ServerName  string               `json:"server_name,omitempty"`
+	Environment string               `json:"environment,omitempty"`
+	Release     string               `json:"release,omitempty"`
+	Transaction string               `json:"transaction,omitempty"`
+	Exception   []exception          `json:"exception"`
+	Request     *request             `json:"request,omitempty"`
+	User        *user                `json:"user,omitempty"`
+	Tags        map[string]string    `json:"tags,omitempty"`
+	Contexts    map[string]traceInfo `json:"contexts,omitempty"`
+}
+
+type exception struct {
+	Type       string      `json:"type"`
+	Value      string      `json:"value"`
+	Mechanism  *mechanism  `json:"mechanism,omitempty"`
+	Stacktrace *stacktrace `json:"stacktrace,omitempty"`
+}
+
+type mechanism struct {
+	Type    string `json:"type"`
+	Handled bool   `json:"handled"`
+}
+
+type stacktrace struct {
+	Frames []frame `json:"frames"`
+}
+
+type frame struct {
+	Function string `json:"function"`
+	Module   string `json:"module,omitempty"`
+	Filename string `json:"filename"`
+	AbsPath  string `json:"abs_path"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+type request struct {
+	Method      string            `json:"method"`
+	URL         string            `json:"url"`
+	QueryString string            `json:"query_string,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+}
+
+type user struct {
+	ID string `json:"id"`
+}
+
+type traceInfo struct {
+	TraceID string `json:"trace_id"`
+	SpanID  string `json:"span_id,omitempty"`
+	Type    string `json:"type"`
+}
+
+// newEvent builds the event for a report
+func (r *Reporter) newEvent(report Report) *event {
+	hostname, _ := os.Hostname()
+	e := &event{
+		EventID:     newEventID(),
+		Timestamp:   time.Now().UTC().Format(time.RFC3339Nano),
+		Level:       "error",
+		Platform:    "go",
+		Logger:      r.service,
+		ServerName:  hostname,
+		Environment: r.config.Environment,
+		Release:     r.config.Release,
+		Tags:        map[string]string{"service": r.service},
+	}
+	for key, value := range report.Tags {
+		if value != "" {
+			e.Tags[key] = value
+		}
+	}
+
+	exc := exception{Type: "error", Value: "unknown error"}
+	if report.Err != nil {
+		exc.Type, exc.Value = errorType(report.Err), report.Err.Error()
+	}
+	if report.Panic {
+		e.Level = "fatal"
+		exc.Mechanism = &mechanism{Type: "panic", Handled: false}
+	}
+	if frames := stackFrames(report.Stack); len(frames) > 0 {
+		exc.Stacktrace = &stacktrace{Frames: frames}
+	}
+	e.Exception = []exception{exc}
+
+	if req := report.Request; req != nil {
+		e.Transaction = req.Method + " " + req.URL.Path
+		scheme := "http"
+		if req.TLS != nil {
+			scheme = "https"
+		}
+		e.Request = &request{
+			Method:      req.Method,
+			URL:         scheme + "://" + req.Host + req.URL.Path,
+			QueryString: req.URL.RawQuery,
+			Headers:     make(map[string]string),
+		}
+		for _, name := range reportedHeaders {
+			if value := req.Header.Get(name); value != "" {
+				e.Request.Headers[name] = value
+			}
+		}
+	}
+	if report.UserID != "" {
+		e.User = &user{ID: report.UserID}
+	}
+	if report.TraceID != "" {
+		e.Contexts = map[string]traceInfo{
+			"trace": {TraceID: report.TraceID, SpanID: report.SpanID, Type: "trace"},
+		}
+	}
+	return e
+}
+
+// errorType names the innermost error's type, such as *openai.Error
+func errorType(err error) string {
+	for {
+		next := errors.Unwrap(err)
+		if next == nil {
+			return fmt.Sprintf("%T", err)
+		}
+		err = next
+	}
+}
+
+// stackFrames converts program counters to Sentry frames, which run from the
+// outermost call to the innermost. Frames of the Go runtime are left out.
+func stackFrames(pcs []uintptr) []frame {
+	if len(pcs) == 0 {
+		return nil
+	}
+	var frames []frame
+	callers := runtime.CallersFrames(pcs)
+	for {
+		caller, more := callers.Next()
+		if caller.Function != "" && !strings.HasPrefix(caller.Function, "runtime.") {
+			module, function := splitFunction(caller.Function)
+			frames = append(frames, frame{
+				Function: function,
+				Module:   module,
+				Filename: shortFilename(caller.File, module),
+				AbsPath:  caller.File,
+				Lineno:   caller.Line,
+				InApp:    strings.HasPrefix(caller.Function, inAppPrefix),
+			})
+		}
+		if !more {
+			break
+		}
+	}
+	for i, j := 0, len(frames)-1; i < j; i, j = i+1, j-1 {
+		frames[i], frames[j] = frames[j], frames[i]
+	}
+	return frames
+}
+
+// splitFunction splits a qualified function name such as
+// github.com/x/y/pkg.(*T).Method into its package and function
+func splitFunction(name string) (module, function string) {
+	slash := strings.LastIndex(name, "/")
+	dot := strings.Index(name[slash+1:], ".")
+	if dot < 0 {
+		return "", name
+	}
+	return name[:slash+1+dot], name[slash+2+dot:]
+}
+
+// shortFilename trims a source path to start at its package's last element
+func shortFilename(file, module string) string {
+	pkg := module[strings.LastIndex(module, "/")+1:]
+	if i := strings.LastIndex(file, "/"+pkg+"/"); i >= 0 {
+		return file[i+1:]
+	}
+	return file[strings.LastIndex(file, "/")+1:]
+}
@@ -0,0 +1,113 @@
+// Package grafana posts annotations to Grafana so dashboard viewers can
+// correlate metric changes with operational events
+package grafana
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// requestTimeout bounds each request to Grafana
+const requestTimeout = 10 * time.Second
+
+// Annotation is an event, or with an end time a region, shown on dashboards
+type Annotation struct {
+	Time    time.Time
+	TimeEnd time.Time
+	Tags    []string
+	Text    string
+}
+
+// Annotator creates annotations through the Grafana HTTP API. Every
+// annotation is also tagged with the annotator's tags, so dashboards can
+// show them all with one tag query.
+type Annotator struct {
+	url    string
+	token  string
+	tags   []string
+	client *http.Client
+}
+
+// NewAnnotator creates an annotator for the Grafana at url, authenticating
+// with a service account token, or returns nil when url is empty
+func NewAnnotator(url, token string, tags ...string) *Annotator {
+	if url == "" {
+		return nil
+	}
+	return &Annotator{
+		url:    strings.TrimSuffix(url, "/"),
+		token:  token,
+		tags:   tags,
+		client: &http.Client{Timeout: requestTimeout},
+	}
+}
+
+// Annotate creates an annotation and returns its ID. A nil annotator does
+// nothing.
+func (a *Annotator) Annotate(ctx context.Context, annotation Annotation) (int64, error) {
+	if a == nil {
+		return 0, nil
+	}
+	if annotation.Time.IsZero() {
+		annotation.Time = time.Now()
+	}
+	body := map[string]interface{}{
+		"time": annotation.Time.UnixMilli(),
+		"tags": append(append([]string{}, a.tags...), annotation.Tags...),
+		"text": annotation.Text,
+	}
+	if !annotation.TimeEnd.IsZero() {
+		body["timeEnd"] = annotation.TimeEnd.UnixMilli()
+	}
+
+	var response struct {
+		ID int64 `json:"id"`
+	}
+	if err := a.do(ctx, http.MethodPost, "/api/annotations", body, &response); err != nil {
+		return 0, err
+	}
+	return response.ID, nil
+}
+
+// End closes the annotation id as a region ending at end
+func (a *Annotator) End(ctx context.Context, id int64, end time.Time) error {
+	if a == nil {
+		return nil
+	}
+	return a.do(ctx, http.MethodPatch, fmt.Sprintf("/api/annotations/%d", id),
+		map[string]interface{}{"timeEnd": end.UnixMilli()}, nil)
+}
+
+// do sends a JSON request, treating non-2xx responses as errors
+func (a *Annotator) do(ctx context.Context, method, path string, body, response interface{}) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, a.url+path, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if a.token != "" {
+		req.Header.Set("Authorization", "Bearer "+a.token)
+	}
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %d from Grafana", resp.StatusCode)
+	}
+	if response != nil {
+		return json.NewDecoder(resp.Body).Decode(response)
+	}
+	return nil
+}
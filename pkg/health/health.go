@@ -2,6 +2,7 @@ package health
 
 import (
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"runtime"
 	"time"
@@ -56,18 +57,3 @@ func HandleHealth() http.HandlerFunc {
 		}
 	}
 }
-
-// HandleReadiness returns a readiness check handler
-func HandleReadiness() http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		// You can add more sophisticated checks here, such as:
-		// - Database connectivity
-		// - Model availability
-		// - External service dependencies
-
-		// For now, just return a basic OK response
-		w.Header().Set("Content-Type", "application/json")
-		w.WriteHeader(http.StatusOK)
-		json.NewEncoder(w).Encode(map[string]string{"status": "ready"})
-	}
-}
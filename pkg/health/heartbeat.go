@@ -0,0 +1,242 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/rs/zerolog/log"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/logger"
+)
+
+// HeartbeatKey is the Redis hash holding the latest heartbeat of every
+// service instance, keyed by service and instance
+const HeartbeatKey = "system:heartbeats"
+
+// heartbeatMisses is how many intervals a heartbeat stays fresh, so one
+// slow write does not mark an instance down
+const heartbeatMisses = 3
+
+// heartbeatForget is how long after going stale an instance's heartbeat is
+// dropped, so replicas that are gone for good stop being reported
+const heartbeatForget = time.Hour
+
+// Heartbeat is what a service instance last reported about itself
+type Heartbeat struct {
+	Service       string    `json:"service"`
+	Instance      string    `json:"instance"`
+	Version       string    `json:"version"`
+	StartedAt     time.Time `json:"started_at"`
+	UptimeSeconds float64   `json:"uptime_seconds"`
+	Time          time.Time `json:"time"`
+	// ExpiresAt is when the instance counts as down without a newer heartbeat
+	ExpiresAt time.Time `json:"expires_at"`
+	// Status is the readiness of the instance, or "stale" once the
+	// heartbeat has expired
+	Status       string                      `json:"status"`
+	Features     map[string]bool             `json:"features,omitempty"`
+	Dependencies map[string]DependencyStatus `json:"dependencies,omitempty"`
+}
+
+// HeartbeatWriter writes its service instance's heartbeat to Redis every
+// interval until closed
+type HeartbeatWriter struct {
+	client    redis.Cmdable
+	readiness *Readiness
+	interval  time.Duration
+	beat      Heartbeat
+	stop      chan struct{}
+	done      chan struct{}
+}
+
+// StartHeartbeat starts writing service's heartbeat, with the results of
+// readiness as its healthy dependencies and features as the optional
+// features it runs with
+func StartHeartbeat(client redis.Cmdable, service string, features map[string]bool, readiness *Readiness, interval time.Duration) *HeartbeatWriter {
+	instance, err := os.Hostname()
+	if err != nil || instance == "" {
+		instance = "unknown"
+	}
+	hw := &HeartbeatWriter{
+		client:    client,
+		readiness: readiness,
+		interval:  interval,
+		beat: Heartbeat{
+			Service:   service,
+			Instance:  instance,
+			Version:   version,
+			StartedAt: startTime,
+			Features:  features,
+		},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go hw.run()
+	return hw
+}
+
+func (hw *HeartbeatWriter) run() {
+	defer close(hw.done)
+	ticker := time.NewTicker(hw.interval)
+	defer ticker.Stop()
+	for {
+		hw.write()
+		select {
+		case <-ticker.C:
+		case <-hw.stop:
+			return
+		}
+	}
+}
+
+// write checks the instance's dependencies and stores its heartbeat
+func (hw *HeartbeatWriter) write() {
+	ctx, cancel := context.WithTimeout(context.Background(), hw.interval)
+	defer cancel()
+
+	readiness := hw.readiness.Run(ctx)
+	beat := hw.beat
+	beat.Time = time.Now()
+	beat.UptimeSeconds = beat.Time.Sub(beat.StartedAt).Seconds()
+	beat.ExpiresAt = beat.Time.Add(heartbeatMisses * hw.interval)
+	beat.Status = readiness.Status
+	beat.Dependencies = readiness.Dependencies
+
+	data, err := json.Marshal(beat)
+	if err == nil {
+		err = hw.client.HSet(ctx, HeartbeatKey, beat.Service+"/"+beat.Instance, data).Err()
+	}
+	if err != nil {
+		logger.Component("heartbeat").Warn().Err(err).Msg("Failed to write heartbeat")
+	}
+}
+
+// Close stops the heartbeats and removes the instance's, so an instance
+// shut down on purpose is not reported as down
+func (hw *HeartbeatWriter) Close() {
+	close(hw.stop)
+	<-hw.done
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	hw.client.HDel(ctx, HeartbeatKey, hw.beat.Service+"/"+hw.beat.Instance)
+}
+
+// ServiceStatus is the combined status of a service's instances: "ok" when
+// every instance is ready, "degraded" when only some are and "down" when
+// none are
+type ServiceStatus struct {
+	Service   string      `json:"service"`
+	Status    string      `json:"status"`
+	Instances []Heartbeat `json:"instances"`
+}
+
+// SystemStatus is the status of every service of the stack, "ok" only when
+// all of them are
+type SystemStatus struct {
+	Status   string          `json:"status"`
+	Time     time.Time       `json:"time"`
+	Services []ServiceStatus `json:"services"`
+}
+
+// ReadSystemStatus combines the heartbeats of every instance into the status
+// of each service. Services in expected that have no heartbeat are reported
+// as down.
+func ReadSystemStatus(ctx context.Context, client redis.Cmdable, expected []string) (*SystemStatus, error) {
+	fields, err := client.HGetAll(ctx, HeartbeatKey).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	services := make(map[string]*ServiceStatus, len(expected))
+	for _, service := range expected {
+		services[service] = &ServiceStatus{Service: service, Instances: []Heartbeat{}}
+	}
+	var forgotten []string
+	for field, data := range fields {
+		var beat Heartbeat
+		if err := json.Unmarshal([]byte(data), &beat); err != nil {
+			forgotten = append(forgotten, field)
+			continue
+		}
+		if now.After(beat.ExpiresAt) {
+			if now.Sub(beat.ExpiresAt) > heartbeatForget {
+				forgotten = append(forgotten, field)
+				continue
+			}
+			beat.Status = "stale"
+		}
+		service, ok := services[beat.Service]
+		if !ok {
+			service = &ServiceStatus{Service: beat.Service}
+			services[beat.Service] = service
+		}
+		service.Instances = append(service.Instances, beat)
+	}
+	if len(forgotten) > 0 {
+		client.HDel(ctx, HeartbeatKey, forgotten...)
+	}
+
+	status := &SystemStatus{Status: "ok", Time: now, Services: make([]ServiceStatus, 0, len(services))}
+	for _, service := range services {
+		ready := 0
+		for _, instance := range service.Instances {
+			if instance.Status == "ready" {
+				ready++
+			}
+		}
+		sort.Slice(service.Instances, func(i, j int) bool {
+			return service.Instances[i].Instance < service.Instances[j].Instance
+		})
+		switch {
+		case ready == 0:
+			service.Status = "down"
+		case ready < len(service.Instances):
+			service.Status = "degraded"
+		default:
+			service.Status = "ok"
+		}
+		if service.Status != "ok" {
+			status.Status = "degraded"
+		}
+		status.Services = append(status.Services, *service)
+	}
+	sort.Slice(status.Services, func(i, j int) bool {
+		return status.Services[i].Service < status.Services[j].Service
+	})
+	return status, nil
+}
+
+// HandleSystemStatus returns a handler reporting the status of the whole
+// stack from the services' heartbeats, answering 503 Service Unavailable
+// unless every service is ok
+func HandleSystemStatus(client redis.Cmdable, expected []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		status, err := ReadSystemStatus(r.Context(), client, expected)
+		if err != nil {
+			log.Ctx(r.Context()).Error().Err(err).Msg("Failed to read heartbeats")
+			http.Error(w, "Failed to read service heartbeats", http.StatusServiceUnavailable)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if status.Status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+		json.NewEncoder(w).Encode(status)
+	}
+}
@@ -0,0 +1,144 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ModelBackend is a model server a service sends requests to, with the
+// check that it currently serves the model
+type ModelBackend struct {
+	Model string
+	URL   string
+	Check Check
+}
+
+// ModelStatus is the outcome of a model backend's live check
+type ModelStatus struct {
+	Model     string    `json:"model"`
+	URL       string    `json:"url"`
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	LatencyMs float64   `json:"latency_ms"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// ModelProbe checks every model backend live, reusing the results for a
+// short while so frequent health polls do not load the model servers
+type ModelProbe struct {
+	timeout  time.Duration
+	cacheTTL time.Duration
+	backends []ModelBackend
+	onChange func(ModelStatus)
+
+	mu        sync.Mutex
+	statuses  []ModelStatus
+	checkedAt time.Time
+}
+
+// NewModelProbe creates a probe giving each check up to timeout, whose
+// results are reused for cacheTTL
+func NewModelProbe(timeout, cacheTTL time.Duration) *ModelProbe {
+	return &ModelProbe{timeout: timeout, cacheTTL: cacheTTL}
+}
+
+// Add registers a model backend
+func (p *ModelProbe) Add(backend ModelBackend) {
+	p.backends = append(p.backends, backend)
+}
+
+// OnChange sets a function called with a backend's status whenever a
+// check finds it changed. Backends are taken to be ok before their first
+// check, so one found unavailable at startup is reported too.
+func (p *ModelProbe) OnChange(fn func(ModelStatus)) {
+	p.onChange = fn
+}
+
+// Run returns the status of every model backend, in the order they were
+// added, checking them concurrently unless the last results are recent
+func (p *ModelProbe) Run(ctx context.Context) []ModelStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.statuses != nil && time.Since(p.checkedAt) < p.cacheTTL {
+		return p.statuses
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	statuses := make([]ModelStatus, len(p.backends))
+	var wg sync.WaitGroup
+	for i, backend := range p.backends {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			err := backend.Check(ctx)
+			statuses[i] = ModelStatus{
+				Model:     backend.Model,
+				URL:       backend.URL,
+				Status:    "ok",
+				LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+				CheckedAt: start,
+			}
+			if err != nil {
+				statuses[i].Status = "unavailable"
+				statuses[i].Error = err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if p.onChange != nil {
+		for i, status := range statuses {
+			previous := "ok"
+			if p.statuses != nil {
+				previous = p.statuses[i].Status
+			}
+			if status.Status != previous {
+				p.onChange(status)
+			}
+		}
+	}
+	p.statuses, p.checkedAt = statuses, time.Now()
+	return statuses
+}
+
+// ModelsStatus summarizes model backend statuses: "ok" when all serve,
+// "degraded" when some do and "unavailable" when none do
+func ModelsStatus(statuses []ModelStatus) string {
+	up := 0
+	for _, status := range statuses {
+		if status.Status == "ok" {
+			up++
+		}
+	}
+	switch {
+	case up == len(statuses):
+		return "ok"
+	case up > 0:
+		return "degraded"
+	}
+	return "unavailable"
+}
+
+// ParseModelBackends parses a comma-separated list of model=url pairs into
+// backends whose Check is still to be set
+func ParseModelBackends(value string) ([]ModelBackend, error) {
+	var backends []ModelBackend
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		model, url, ok := strings.Cut(pair, "=")
+		if !ok || model == "" || !strings.HasPrefix(url, "http") {
+			return nil, fmt.Errorf("%q is not model=url", pair)
+		}
+		backends = append(backends, ModelBackend{Model: model, URL: url})
+	}
+	return backends, nil
+}
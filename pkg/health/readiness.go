@@ -0,0 +1,100 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Check reports whether a dependency can be used
+type Check func(ctx context.Context) error
+
+// DependencyStatus is the outcome of one dependency's readiness check
+type DependencyStatus struct {
+	Status    string  `json:"status"`
+	Error     string  `json:"error,omitempty"`
+	LatencyMs float64 `json:"latency_ms"`
+}
+
+// ReadinessStatus is the body of a readiness response
+type ReadinessStatus struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]DependencyStatus `json:"dependencies"`
+}
+
+// Readiness holds the dependency checks that decide whether a service can
+// take traffic
+type Readiness struct {
+	timeout time.Duration
+	checks  map[string]Check
+}
+
+// NewReadiness creates a set of readiness checks, each given up to timeout
+func NewReadiness(timeout time.Duration) *Readiness {
+	return &Readiness{timeout: timeout, checks: make(map[string]Check)}
+}
+
+// Add registers the check for a dependency
+func (rd *Readiness) Add(name string, check Check) {
+	rd.checks[name] = check
+}
+
+// Run checks every dependency concurrently
+func (rd *Readiness) Run(ctx context.Context) ReadinessStatus {
+	ctx, cancel := context.WithTimeout(ctx, rd.timeout)
+	defer cancel()
+
+	status := ReadinessStatus{Status: "ready", Dependencies: make(map[string]DependencyStatus, len(rd.checks))}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for name, check := range rd.checks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			start := time.Now()
+			err := check(ctx)
+			dependency := DependencyStatus{Status: "ok", LatencyMs: float64(time.Since(start).Microseconds()) / 1000}
+			if err != nil {
+				dependency.Status = "unavailable"
+				dependency.Error = err.Error()
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			status.Dependencies[name] = dependency
+			if err != nil {
+				status.Status = "not_ready"
+			}
+		}()
+	}
+	wg.Wait()
+	return status
+}
+
+// HandleLiveness returns a liveness check handler, which only reports that
+// the process is up and serving
+func HandleLiveness() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]string{"status": "alive"})
+	}
+}
+
+// HandleReadiness returns a readiness check handler, answering 503 Service
+// Unavailable with the failed dependencies while any check fails
+func HandleReadiness(readiness *Readiness) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		status := readiness.Run(r.Context())
+
+		w.Header().Set("Content-Type", "application/json")
+		if status.Status != "ready" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+		json.NewEncoder(w).Encode(status)
+	}
+}
@@ -0,0 +1,210 @@
+package jwtauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keySetTTL is how long fetched keys are used before the key set is fetched
+// again, picking up rotated keys before tokens signed with them arrive
+const keySetTTL = time.Hour
+
+// keySetMinRefresh bounds how often a token with an unknown key ID can make
+// the key set be fetched again, so bad tokens cannot flood the issuer
+const keySetMinRefresh = 30 * time.Second
+
+// keySet caches the signing keys published at a JWKS endpoint, found
+// through the issuer's OpenID Connect discovery document when no endpoint
+// is configured
+type keySet struct {
+	url    string
+	issuer string
+	client *http.Client
+
+	mu          sync.Mutex
+	keys        map[string]crypto.PublicKey
+	fetchedAt   time.Time
+	attemptedAt time.Time
+}
+
+// jsonWebKey is a key of a JWKS document, RFC 7517
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// key returns the public key with ID kid, fetching the key set when it is
+// stale or does not have it. A token without a key ID can only be checked
+// against a key set of one key.
+func (ks *keySet) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	ks.mu.Lock()
+	defer ks.mu.Unlock()
+
+	if key, ok := ks.lookup(kid); ok && time.Since(ks.fetchedAt) < keySetTTL {
+		return key, nil
+	}
+	if time.Since(ks.attemptedAt) >= keySetMinRefresh {
+		ks.attemptedAt = time.Now()
+		// A request that gives up must not cut short the fetch every other
+		// request is waiting for
+		keys, err := ks.fetch(context.WithoutCancel(ctx))
+		if err != nil {
+			// Keep using the keys already known while the endpoint is down
+			if key, ok := ks.lookup(kid); ok {
+				return key, nil
+			}
+			return nil, err
+		}
+		ks.keys, ks.fetchedAt = keys, time.Now()
+	}
+	if key, ok := ks.lookup(kid); ok {
+		return key, nil
+	}
+	return nil, fmt.Errorf("no signing key with ID %q", kid)
+}
+
+func (ks *keySet) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(ks.keys) == 1 {
+		for _, key := range ks.keys {
+			return key, true
+		}
+	}
+	key, ok := ks.keys[kid]
+	return key, ok
+}
+
+// fetch reads the signing keys from the JWKS endpoint
+func (ks *keySet) fetch(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	if ks.url == "" {
+		url, err := ks.discover(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ks.url = url
+	}
+
+	var document struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := ks.getJSON(ctx, ks.url, &document); err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %v", err)
+	}
+	keys := make(map[string]crypto.PublicKey, len(document.Keys))
+	for _, jwk := range document.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			// Skip keys of types this package cannot verify with
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("JWKS at %s has no usable signing keys", ks.url)
+	}
+	return keys, nil
+}
+
+// discover reads the JWKS endpoint from the issuer's OpenID Connect
+// discovery document
+func (ks *keySet) discover(ctx context.Context) (string, error) {
+	var document struct {
+		JWKSURI string `json:"jwks_uri"`
+	}
+	url := strings.TrimSuffix(ks.issuer, "/") + "/.well-known/openid-configuration"
+	if err := ks.getJSON(ctx, url, &document); err != nil {
+		return "", fmt.Errorf("failed to fetch OpenID configuration: %v", err)
+	}
+	if document.JWKSURI == "" {
+		return "", fmt.Errorf("OpenID configuration at %s has no jwks_uri", url)
+	}
+	return document.JWKSURI, nil
+}
+
+func (ks *keySet) getJSON(ctx context.Context, url string, value interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := ks.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(value)
+}
+
+// publicKey decodes an RSA or elliptic curve key
+func (jwk jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := decodeBigInt(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeBigInt(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31 {
+			return nil, fmt.Errorf("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch jwk.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", jwk.Crv)
+		}
+		x, err := decodeBigInt(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeBigInt(jwk.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, fmt.Errorf("EC key is not on curve %s", jwk.Crv)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", jwk.Kty)
+}
+
+func decodeBigInt(value string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(data) == 0 {
+		return nil, fmt.Errorf("invalid key parameter")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,324 @@
+// Package jwtauth validates JWT bearer tokens issued by an OpenID Connect
+// provider such as Keycloak or Auth0, against the signing keys it publishes
+// as a JWKS
+package jwtauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config selects the tokens that are accepted and the claim naming the user
+type Config struct {
+	// JWKSURL is where the provider publishes its signing keys. When empty
+	// it is read from the issuer's OpenID Connect discovery document.
+	JWKSURL string
+
+	// Issuer, when set, must match the iss claim
+	Issuer string
+
+	// Audiences, when set, must include one of the aud claim's values
+	Audiences []string
+
+	// UserClaim names the claim holding the user ID, such as sub, email or
+	// preferred_username. Dots select nested claims.
+	UserClaim string
+
+	// TenantClaim optionally names the claim holding the tenant the user
+	// belongs to. Dots select nested claims.
+	TenantClaim string
+
+	// Leeway allows for clock skew when checking exp, nbf and iat
+	Leeway time.Duration
+}
+
+// ConfigFromEnv reads JWT_JWKS_URL, JWT_ISSUER, JWT_AUDIENCE (a
+// comma-separated list), JWT_USER_CLAIM (default sub), JWT_TENANT_CLAIM and
+// JWT_CLOCK_SKEW_SECONDS (default 60)
+func ConfigFromEnv() (Config, error) {
+	config := Config{
+		JWKSURL:     os.Getenv("JWT_JWKS_URL"),
+		Issuer:      os.Getenv("JWT_ISSUER"),
+		UserClaim:   os.Getenv("JWT_USER_CLAIM"),
+		TenantClaim: os.Getenv("JWT_TENANT_CLAIM"),
+		Leeway:      time.Minute,
+	}
+	for _, audience := range strings.Split(os.Getenv("JWT_AUDIENCE"), ",") {
+		if audience = strings.TrimSpace(audience); audience != "" {
+			config.Audiences = append(config.Audiences, audience)
+		}
+	}
+	if config.UserClaim == "" {
+		config.UserClaim = "sub"
+	}
+	if value := os.Getenv("JWT_CLOCK_SKEW_SECONDS"); value != "" {
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			return config, fmt.Errorf("invalid JWT_CLOCK_SKEW_SECONDS %q", value)
+		}
+		config.Leeway = time.Duration(seconds) * time.Second
+	}
+	return config, nil
+}
+
+// Claims are the claims of a validated token
+type Claims map[string]interface{}
+
+// Verifier validates tokens against a provider's signing keys
+type Verifier struct {
+	config Config
+	keys   *keySet
+}
+
+// NewVerifier creates a verifier for config. Keys are fetched when the
+// first token is checked.
+func NewVerifier(config Config) (*Verifier, error) {
+	if config.JWKSURL == "" && config.Issuer == "" {
+		return nil, errors.New("a JWKS URL or an issuer to discover it from is required")
+	}
+	if config.UserClaim == "" {
+		config.UserClaim = "sub"
+	}
+	return &Verifier{
+		config: config,
+		keys: &keySet{
+			url:    config.JWKSURL,
+			issuer: config.Issuer,
+			client: &http.Client{Timeout: 10 * time.Second},
+		},
+	}, nil
+}
+
+// NewFromEnv creates a verifier configured from the environment, or returns
+// nil when neither JWT_JWKS_URL nor JWT_ISSUER is set
+func NewFromEnv() (*Verifier, error) {
+	config, err := ConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if config.JWKSURL == "" && config.Issuer == "" {
+		return nil, nil
+	}
+	return NewVerifier(config)
+}
+
+// IsJWT reports whether token has the form of a signed JWT, so bearer tokens
+// such as API keys can be told apart from ones to validate
+func IsJWT(token string) bool {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	header, err := base64.RawURLEncoding.DecodeString(parts[0])
+	return err == nil && json.Valid(header)
+}
+
+// Verify checks the signature, lifetime, issuer and audience of token and
+// returns its claims
+func (v *Verifier) Verify(ctx context.Context, token string) (Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed token")
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("malformed token header: %v", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("malformed token signature")
+	}
+
+	key, err := v.keys.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	if err := verifySignature(header.Alg, key, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	var claims Claims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("malformed token claims: %v", err)
+	}
+	if err := v.checkClaims(claims, time.Now()); err != nil {
+		return nil, err
+	}
+	return claims, nil
+}
+
+// checkClaims checks the registered claims of a token with a valid signature
+func (v *Verifier) checkClaims(claims Claims, now time.Time) error {
+	exp, ok := claims.time("exp")
+	if !ok {
+		return errors.New("token has no expiry")
+	}
+	if now.After(exp.Add(v.config.Leeway)) {
+		return errors.New("token has expired")
+	}
+	if nbf, ok := claims.time("nbf"); ok && now.Add(v.config.Leeway).Before(nbf) {
+		return errors.New("token is not valid yet")
+	}
+	if iat, ok := claims.time("iat"); ok && now.Add(v.config.Leeway).Before(iat) {
+		return errors.New("token was issued in the future")
+	}
+	if v.config.Issuer != "" {
+		if iss, _ := claims["iss"].(string); iss != v.config.Issuer {
+			return fmt.Errorf("token issuer %q is not trusted", iss)
+		}
+	}
+	if len(v.config.Audiences) > 0 && !claims.hasAudience(v.config.Audiences) {
+		return errors.New("token is not for this audience")
+	}
+	return nil
+}
+
+// UserID returns the user ID named by the configured user claim, or an empty
+// string when the token does not have it
+func (v *Verifier) UserID(claims Claims) string {
+	return claims.lookup(v.config.UserClaim)
+}
+
+// Tenant returns the tenant named by the configured tenant claim, or an empty
+// string when no tenant claim is configured or the token does not have it
+func (v *Verifier) Tenant(claims Claims) string {
+	if v.config.TenantClaim == "" {
+		return ""
+	}
+	return claims.lookup(v.config.TenantClaim)
+}
+
+// lookup reads a string or numeric claim, with dots selecting nested claims
+func (c Claims) lookup(path string) string {
+	var value interface{} = map[string]interface{}(c)
+	for _, name := range strings.Split(path, ".") {
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return ""
+		}
+		value = object[name]
+	}
+	switch value := value.(type) {
+	case string:
+		return value
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	}
+	return ""
+}
+
+// time reads a NumericDate claim
+func (c Claims) time(name string) (time.Time, bool) {
+	seconds, ok := c[name].(float64)
+	if !ok {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(seconds), 0), true
+}
+
+// hasAudience reports whether the aud claim, a string or a list of them,
+// includes one of audiences
+func (c Claims) hasAudience(audiences []string) bool {
+	var values []string
+	switch aud := c["aud"].(type) {
+	case string:
+		values = []string{aud}
+	case []interface{}:
+		for _, value := range aud {
+			if text, ok := value.(string); ok {
+				values = append(values, text)
+			}
+		}
+	}
+	for _, value := range values {
+		for _, audience := range audiences {
+			if value == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// verifySignature checks signature over signed with key, using the RSA or
+// ECDSA algorithm alg. Symmetric algorithms and "none" are never accepted,
+// as the keys come from a public endpoint.
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	var hash crypto.Hash
+	switch alg[min(2, len(alg)):] {
+	case "256":
+		hash = crypto.SHA256
+	case "384":
+		hash = crypto.SHA384
+	case "512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported signing algorithm %q", alg)
+	}
+	digest := digest(hash, signed)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		switch alg[:2] {
+		case "RS":
+			if rsa.VerifyPKCS1v15(key, hash, digest, signature) == nil {
+				return nil
+			}
+		case "PS":
+			if rsa.VerifyPSS(key, hash, digest, signature, nil) == nil {
+				return nil
+			}
+		default:
+			return fmt.Errorf("signing algorithm %q does not match the RSA key", alg)
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg[:2] != "ES" || len(signature) != 2*size {
+			return fmt.Errorf("signing algorithm %q does not match the EC key", alg)
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if ecdsa.Verify(key, digest, r, s) {
+			return nil
+		}
+	}
+	return errors.New("invalid token signature")
+}
+
+func digest(hash crypto.Hash, signed string) []byte {
+	switch hash {
+	case crypto.SHA384:
+		sum := sha512.Sum384([]byte(signed))
+		return sum[:]
+	case crypto.SHA512:
+		sum := sha512.Sum512([]byte(signed))
+		return sum[:]
+	}
+	sum := sha256.Sum256([]byte(signed))
+	return sum[:]
+}
+
+func decodeSegment(segment string, value interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, value)
+}
@@ -0,0 +1,251 @@
+package jwtauth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testKeys are the signing keys published by the test JWKS server
+type testKeys struct {
+	rsa *rsa.PrivateKey
+	ec  *ecdsa.PrivateKey
+}
+
+func newTestKeys(t *testing.T) testKeys {
+	t.Helper()
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return testKeys{rsa: rsaKey, ec: ecKey}
+}
+
+// serveJWKS publishes the public halves of keys as a JWKS document
+func serveJWKS(t *testing.T, keys testKeys) *httptest.Server {
+	t.Helper()
+	encode := func(n *big.Int) string { return base64.RawURLEncoding.EncodeToString(n.Bytes()) }
+	document := map[string]interface{}{
+		"keys": []map[string]string{
+			{
+				"kty": "RSA", "kid": "rsa", "use": "sig",
+				"n": encode(keys.rsa.N), "e": encode(big.NewInt(int64(keys.rsa.E))),
+			},
+			{
+				"kty": "EC", "kid": "ec", "use": "sig", "crv": "P-256",
+				"x": encode(keys.ec.X), "y": encode(keys.ec.Y),
+			},
+		},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(document)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// sign builds a token with the given header algorithm and key ID, signed
+// with key. A nil key leaves the signature empty.
+func sign(t *testing.T, alg, kid string, claims map[string]interface{}, key interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:]); err != nil {
+			t.Fatal(err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerify(t *testing.T) {
+	keys := newTestKeys(t)
+	server := serveJWKS(t, keys)
+	verifier, err := NewVerifier(Config{
+		JWKSURL:   server.URL,
+		Issuer:    "https://issuer.example",
+		Audiences: []string{"aiwatch"},
+		Leeway:    time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		claims := map[string]interface{}{
+			"sub": "user-1",
+			"iss": "https://issuer.example",
+			"aud": "aiwatch",
+			"iat": now.Unix(),
+			"exp": now.Add(time.Hour).Unix(),
+		}
+		for name, value := range changes {
+			if value == nil {
+				delete(claims, name)
+			} else {
+				claims[name] = value
+			}
+		}
+		return claims
+	}
+	valid := sign(t, "RS256", "rsa", claims(nil), keys.rsa)
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{"RS256", valid, ""},
+		{"ES256", sign(t, "ES256", "ec", claims(nil), keys.ec), ""},
+		{"audience list", sign(t, "RS256", "rsa", claims(map[string]interface{}{"aud": []string{"other", "aiwatch"}}), keys.rsa), ""},
+		{"within leeway", sign(t, "RS256", "rsa", claims(map[string]interface{}{"exp": now.Add(-30 * time.Second).Unix()}), keys.rsa), ""},
+		{"expired", sign(t, "RS256", "rsa", claims(map[string]interface{}{"exp": now.Add(-time.Hour).Unix()}), keys.rsa), "expired"},
+		{"no expiry", sign(t, "RS256", "rsa", claims(map[string]interface{}{"exp": nil}), keys.rsa), "no expiry"},
+		{"not valid yet", sign(t, "RS256", "rsa", claims(map[string]interface{}{"nbf": now.Add(time.Hour).Unix()}), keys.rsa), "not valid yet"},
+		{"issued in the future", sign(t, "RS256", "rsa", claims(map[string]interface{}{"iat": now.Add(time.Hour).Unix()}), keys.rsa), "issued in the future"},
+		{"wrong audience", sign(t, "RS256", "rsa", claims(map[string]interface{}{"aud": "other"}), keys.rsa), "audience"},
+		{"untrusted issuer", sign(t, "RS256", "rsa", claims(map[string]interface{}{"iss": "https://evil.example"}), keys.rsa), "not trusted"},
+		{"alg none", sign(t, "none", "rsa", claims(nil), nil), "unsupported signing algorithm"},
+		{"HS256 keyed with the public key", sign(t, "HS256", "rsa", claims(nil), keys.rsa.N.Bytes()), "does not match the RSA key"},
+		{"ES256 with the RSA key", sign(t, "ES256", "rsa", claims(nil), keys.ec), "does not match the RSA key"},
+		{"RS256 with the EC key", sign(t, "RS256", "ec", claims(nil), keys.rsa), "does not match the EC key"},
+		{"signed by another key", sign(t, "RS256", "rsa", claims(nil), newTestKeys(t).rsa), "invalid token signature"},
+		{"truncated signature", valid[:len(valid)-4], "invalid token signature"},
+		{"tampered claims", tamper(t, valid, "sub", "user-2"), "invalid token signature"},
+		{"unknown key ID", sign(t, "RS256", "other", claims(nil), keys.rsa), "no signing key"},
+		{"two segments", valid[:strings.LastIndex(valid, ".")], "malformed token"},
+		{"bad signature encoding", valid + "!", "malformed token signature"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := verifier.Verify(context.Background(), tt.token)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("Verify() error = %v", err)
+				}
+				if user := verifier.UserID(got); user != "user-1" {
+					t.Errorf("UserID() = %q, want user-1", user)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("Verify() error = %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// tamper replaces a claim of token, keeping its original signature
+func tamper(t *testing.T, token, name string, value interface{}) string {
+	t.Helper()
+	parts := strings.Split(token, ".")
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		t.Fatal(err)
+	}
+	claims[name] = value
+	payload, _ := json.Marshal(claims)
+	parts[1] = base64.RawURLEncoding.EncodeToString(payload)
+	return strings.Join(parts, ".")
+}
+
+func TestUserID(t *testing.T) {
+	tests := []struct {
+		claim  string
+		claims Claims
+		want   string
+	}{
+		{"sub", Claims{"sub": "user-1"}, "user-1"},
+		{"email", Claims{"sub": "user-1", "email": "a@example.com"}, "a@example.com"},
+		{"user.id", Claims{"user": map[string]interface{}{"id": float64(42)}}, "42"},
+		{"user.id", Claims{"user": "flat"}, ""},
+		{"sub", Claims{}, ""},
+	}
+	for _, tt := range tests {
+		verifier, err := NewVerifier(Config{JWKSURL: "http://unused", UserClaim: tt.claim})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := verifier.UserID(tt.claims); got != tt.want {
+			t.Errorf("UserID(%q) = %q, want %q", tt.claim, got, tt.want)
+		}
+	}
+}
+
+func TestTenant(t *testing.T) {
+	tests := []struct {
+		claim  string
+		claims Claims
+		want   string
+	}{
+		{"", Claims{"tenant": "acme"}, ""},
+		{"tenant", Claims{"tenant": "acme"}, "acme"},
+		{"org.id", Claims{"org": map[string]interface{}{"id": "acme"}}, "acme"},
+		{"tenant", Claims{"sub": "user-1"}, ""},
+	}
+	for _, tt := range tests {
+		verifier, err := NewVerifier(Config{JWKSURL: "http://unused", TenantClaim: tt.claim})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := verifier.Tenant(tt.claims); got != tt.want {
+			t.Errorf("Tenant(%q) = %q, want %q", tt.claim, got, tt.want)
+		}
+	}
+}
+
+func TestIsJWT(t *testing.T) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"RS256"}`))
+	tests := []struct {
+		token string
+		want  bool
+	}{
+		{header + ".e30.sig", true},
+		{"sk-live-0123456789", false},
+		{"a.b.c", false},
+		{header + ".e30", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := IsJWT(tt.token); got != tt.want {
+			t.Errorf("IsJWT(%q) = %v, want %v", tt.token, got, tt.want)
+		}
+	}
+}
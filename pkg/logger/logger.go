@@ -2,28 +2,45 @@ package logger
 
 import (
 	"io"
+	stdlog "log"
 	"os"
+	"strconv"
 	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
-// Init initializes the global logger
-func Init(level string, pretty bool) {
+// Init initializes the global logger. Every entry carries the service name,
+// and output from the standard library log package goes through it as well.
+func Init(service, level string, pretty bool) {
 	// Set the global logger
-	zerolog.TimeFieldFormat = time.RFC3339
+	zerolog.TimeFieldFormat = time.RFC3339Nano
 	zerolog.SetGlobalLevel(parseLevel(level))
 
-	var output io.Writer = os.Stdout
+	var output io.Writer = os.Stderr
 	if pretty {
 		output = zerolog.ConsoleWriter{
-			Out:        os.Stdout,
+			Out:        os.Stderr,
 			TimeFormat: time.RFC3339,
 		}
 	}
 
-	log.Logger = zerolog.New(output).With().Timestamp().Caller().Logger()
+	log.Logger = zerolog.New(output).With().Timestamp().Caller().Str("service", service).Logger()
+
+	// Requests without a request-scoped logger log through the global one
+	zerolog.DefaultContextLogger = &log.Logger
+
+	// Third-party packages still using the standard logger
+	stdlog.SetFlags(0)
+	stdlog.SetOutput(log.Logger)
+}
+
+// InitFromEnv initializes the global logger from LOG_LEVEL and LOG_PRETTY.
+// Logs are JSON unless LOG_PRETTY is true.
+func InitFromEnv(service string) {
+	pretty, _ := strconv.ParseBool(os.Getenv("LOG_PRETTY"))
+	Init(service, os.Getenv("LOG_LEVEL"), pretty)
 }
 
 // parseLevel converts a string level to zerolog.Level
@@ -42,6 +59,13 @@ func parseLevel(level string) zerolog.Level {
 	}
 }
 
+// Component returns the global logger with a component field, for code that
+// runs outside of a request
+func Component(component string) *zerolog.Logger {
+	l := log.With().Str("component", component).Logger()
+	return &l
+}
+
 // Logger is a wrapper around zerolog.Logger
 type Logger struct {
 	logger zerolog.Logger
@@ -0,0 +1,26 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+// RegisterRuntimeCollectors registers Go runtime and process metrics with
+// registerer: goroutines, threads, heap and memory classes, GC pause and
+// scheduler latency histograms, GOMAXPROCS and GOMEMLIMIT, open and maximum
+// file descriptors, CPU time and resident memory, and the build info. The
+// plain Go and process collectors of the default registry are replaced.
+func RegisterRuntimeCollectors(registerer prometheus.Registerer) {
+	registerer.Unregister(collectors.NewGoCollector())
+	registerer.Unregister(collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
+	registerer.MustRegister(
+		collectors.NewGoCollector(collectors.WithGoCollectorRuntimeMetrics(
+			collectors.MetricsGC,
+			collectors.MetricsMemory,
+			collectors.MetricsScheduler,
+		)),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		collectors.NewBuildInfoCollector(),
+	)
+}
@@ -0,0 +1,249 @@
+package middleware
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+)
+
+// maxLoggedBody caps how much of a request body is kept for the access log
+const maxLoggedBody = 4096
+
+// redactedFields are the JSON fields of request bodies that carry message
+// content, whose values never reach the logs
+var redactedFields = map[string]bool{
+	"message":  true,
+	"content":  true,
+	"prompt":   true,
+	"response": true,
+	"input":    true,
+	"text":     true,
+}
+
+// AccessLogConfig controls which requests get an access log line
+type AccessLogConfig struct {
+	// SampleRates gives the fraction of requests logged per path; a path
+	// ending in * matches every path with that prefix. Other paths are
+	// always logged.
+	SampleRates map[string]float64
+
+	// LogBodies adds request bodies, with message content redacted
+	LogBodies bool
+}
+
+// AccessLogConfigFromEnv reads ACCESS_LOG_SAMPLE_RATES, falling back to
+// defaultRates, and ACCESS_LOG_BODIES
+func AccessLogConfigFromEnv(defaultRates string) (AccessLogConfig, error) {
+	var config AccessLogConfig
+	rates := os.Getenv("ACCESS_LOG_SAMPLE_RATES")
+	if rates == "" {
+		rates = defaultRates
+	}
+	var err error
+	if config.SampleRates, err = parseSampleRates(rates); err != nil {
+		return config, fmt.Errorf("invalid ACCESS_LOG_SAMPLE_RATES: %w", err)
+	}
+	if value := os.Getenv("ACCESS_LOG_BODIES"); value != "" {
+		if config.LogBodies, err = strconv.ParseBool(value); err != nil {
+			return config, fmt.Errorf("invalid ACCESS_LOG_BODIES: %w", err)
+		}
+	}
+	return config, nil
+}
+
+// parseSampleRates parses a comma-separated list of path=rate pairs
+func parseSampleRates(value string) (map[string]float64, error) {
+	rates := make(map[string]float64)
+	for _, pair := range strings.Split(value, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		path, rate, ok := strings.Cut(pair, "=")
+		if !ok || !strings.HasPrefix(path, "/") {
+			return nil, fmt.Errorf("%q is not path=rate", pair)
+		}
+		sampleRate, err := strconv.ParseFloat(rate, 64)
+		if err != nil || sampleRate < 0 || sampleRate > 1 {
+			return nil, fmt.Errorf("rate of %s must be between 0 and 1", path)
+		}
+		rates[path] = sampleRate
+	}
+	return rates, nil
+}
+
+// sampleRate returns the fraction of requests to path that are logged,
+// preferring an exact match, then the longest matching prefix
+func (c AccessLogConfig) sampleRate(path string) float64 {
+	if rate, ok := c.SampleRates[path]; ok {
+		return rate
+	}
+	rate, longest := 1.0, -1
+	for pattern, patternRate := range c.SampleRates {
+		prefix, ok := strings.CutSuffix(pattern, "*")
+		if ok && strings.HasPrefix(path, prefix) && len(prefix) > longest {
+			rate, longest = patternRate, len(prefix)
+		}
+	}
+	return rate
+}
+
+// accessRecord collects what handlers report about a request for its
+// access log line
+type accessRecord struct {
+	inputTokens  int
+	outputTokens int
+	tokens       bool
+}
+
+type accessRecordKey struct{}
+
+// RecordTokens reports the tokens a request used, for its access log line
+func RecordTokens(ctx context.Context, inputTokens, outputTokens int) {
+	if record, ok := ctx.Value(accessRecordKey{}).(*accessRecord); ok {
+		record.inputTokens, record.outputTokens, record.tokens = inputTokens, outputTokens, true
+	}
+}
+
+// AccessLog logs one line per API call with its method, path, status,
+// latency, user and token counts, through the request-scoped logger set up
+// by LoggingMiddleware. Requests to sampled paths are logged at the
+// configured rate, chosen by request ID so every service logs the same
+// requests; failed requests are always logged. Health checks and metric
+// scrapes are not logged.
+func AccessLog(config AccessLogConfig) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if strings.HasPrefix(r.URL.Path, "/health") || r.URL.Path == "/readyz" || strings.HasPrefix(r.URL.Path, "/metrics") {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			start := time.Now()
+			record := &accessRecord{}
+			var body *cappedBuffer
+			if config.LogBodies && r.Body != nil {
+				body = &cappedBuffer{limit: maxLoggedBody}
+				r.Body = teeReadCloser{Reader: io.TeeReader(r.Body, body), Closer: r.Body}
+			}
+
+			responseWriter := &responseWriterWrapper{w: w, statusCode: http.StatusOK}
+			next.ServeHTTP(responseWriter, r.WithContext(context.WithValue(r.Context(), accessRecordKey{}, record)))
+
+			status := responseWriter.statusCode
+			rate := config.sampleRate(r.URL.Path)
+			if status < http.StatusBadRequest && !sampled(RequestID(r.Context()), rate) {
+				return
+			}
+
+			logger := log.Ctx(r.Context())
+			var event *zerolog.Event
+			switch {
+			case status >= http.StatusInternalServerError:
+				event = logger.Error()
+			case status >= http.StatusBadRequest:
+				event = logger.Warn()
+			default:
+				event = logger.Info()
+			}
+			event = event.Int("status", status).
+				Dur("latency", time.Since(start)).
+				Str("user", requestUser(r))
+			if record.tokens {
+				event = event.Int("input_tokens", record.inputTokens).Int("output_tokens", record.outputTokens)
+			}
+			if rate < 1 {
+				event = event.Float64("sample_rate", rate)
+			}
+			if body != nil && body.Len() > 0 {
+				event = logBody(event, r.Header.Get("Content-Type"), body)
+			}
+			event.Msg("Request completed")
+		})
+	}
+}
+
+// sampled picks a stable fraction of request IDs
+func sampled(requestID string, rate float64) bool {
+	if rate >= 1 {
+		return true
+	}
+	h := fnv.New64a()
+	h.Write([]byte(requestID))
+	return float64(h.Sum64()%10000) < rate*10000
+}
+
+// requestUser returns the user resolved by the capture middleware, or the
+// one the caller named in X-User-ID
+func requestUser(r *http.Request) string {
+	if info, ok := capture.RequestInfoFromContext(r.Context()); ok {
+		return info.UserID
+	}
+	return r.Header.Get("X-User-ID")
+}
+
+// logBody adds a request body to an access log line. Message content in JSON
+// bodies is redacted; other bodies are only described by their size.
+func logBody(event *zerolog.Event, contentType string, body *cappedBuffer) *zerolog.Event {
+	var value interface{}
+	if !strings.HasPrefix(contentType, "application/json") || body.truncated ||
+		json.Unmarshal(body.Bytes(), &value) != nil {
+		return event.Int("body_bytes", body.Len()).Bool("body_truncated", body.truncated)
+	}
+	redacted, _ := json.Marshal(redactBody(value, false))
+	return event.RawJSON("body", redacted)
+}
+
+// redactBody replaces the string values of message fields, at any depth
+func redactBody(value interface{}, redact bool) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, field := range v {
+			v[key] = redactBody(field, redactedFields[key])
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactBody(item, redact)
+		}
+	case string:
+		if redact {
+			return fmt.Sprintf("[redacted %d chars]", len(v))
+		}
+	}
+	return value
+}
+
+// cappedBuffer keeps the first limit bytes written to it
+type cappedBuffer struct {
+	bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (cb *cappedBuffer) Write(p []byte) (int, error) {
+	if room := cb.limit - cb.Len(); room < len(p) {
+		cb.truncated = true
+		cb.Buffer.Write(p[:max(room, 0)])
+		return len(p), nil
+	}
+	return cb.Buffer.Write(p)
+}
+
+// teeReadCloser reads through a TeeReader and closes the original body
+type teeReadCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+)
+
+// AuditEntry describes an audited operation on resource made by the
+// request, naming the user resolved by the capture middleware or given in
+// X-User-ID as its actor
+func AuditEntry(r *http.Request, action, resource, tenant string) capture.AuditEntry {
+	actor := requestUser(r)
+	if actor == "" {
+		actor = "anonymous"
+	}
+	return capture.AuditEntry{
+		Actor:      actor,
+		Action:     action,
+		Resource:   resource,
+		Tenant:     tenant,
+		RequestID:  RequestID(r.Context()),
+		RemoteAddr: clientIP(r),
+	}
+}
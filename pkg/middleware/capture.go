@@ -0,0 +1,153 @@
+package middleware
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+	"github.com/ajeetraina/genai-app-demo/pkg/jwtauth"
+	"github.com/ajeetraina/genai-app-demo/pkg/tracing"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// CaptureMiddleware attaches the tenant, request, session and user identifiers
+// used for token capture to the request context. The tenant is looked up from
+// the request's API key in tenantAPIKeys, then taken from the tenant claim of
+// a token validated by JWTAuth, falling back to the X-Tenant-ID header;
+// requests with none belong to the default tenant. The request ID
+// is the one given by RequestIDMiddleware, when it runs first. The user is
+// the one named by a token validated by JWTAuth, which runs first, or else
+// comes from the X-User-ID header. The user and session, from X-Session-ID,
+// fall back to the baggage of a calling service, and are added to the
+// baggage of the request.
+func CaptureMiddleware(tenantAPIKeys map[string]string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return captureHandler(tenantAPIKeys, next)
+	}
+}
+
+type tenantAuthenticatedKey struct{}
+
+func captureHandler(tenantAPIKeys map[string]string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenant, authenticated := tenantAPIKeys[apiKey(r)]
+		if !authenticated {
+			tenant = tokenTenant(r.Context())
+			authenticated = tenant != ""
+		}
+		if !authenticated {
+			tenant = r.Header.Get("X-Tenant-ID")
+		}
+		if tenant != "" && !capture.ValidTenant(tenant) {
+			http.Error(w, "Invalid tenant ID", http.StatusBadRequest)
+			return
+		}
+
+		requestID := RequestID(r.Context())
+		if requestID == "" {
+			requestID = uuid.New().String()
+		}
+
+		// A validated token names the user, which X-User-ID cannot override.
+		// A calling service may pass the user and session on as baggage.
+		baggageUser, baggageSession := tracing.UserFromContext(r.Context())
+		userID := AuthenticatedUser(r.Context())
+		if userID == "" {
+			userID = r.Header.Get("X-User-ID")
+		}
+		if userID == "" {
+			userID = baggageUser
+		}
+		if userID == "" {
+			userID = clientIP(r)
+		}
+
+		// Requests without an explicit session are grouped per user
+		sessionID := r.Header.Get("X-Session-ID")
+		if sessionID == "" {
+			sessionID = baggageSession
+		}
+		if sessionID == "" {
+			sessionID = userID
+		}
+
+		info := &capture.RequestInfo{
+			Tenant:    tenant,
+			RequestID: requestID,
+			SessionID: sessionID,
+			UserID:    userID,
+			StartTime: time.Now(),
+			Client:    clientInfo(r),
+		}
+
+		// The user and session travel on as baggage, to the spans and logs of
+		// the request and to the services it calls
+		ctx := tracing.WithUser(r.Context(), userID, sessionID)
+		if authenticated {
+			ctx = context.WithValue(ctx, tenantAuthenticatedKey{}, true)
+		}
+		tracing.AddAttributes(ctx, attribute.String(tracing.UserIDKey, userID), attribute.String(tracing.SessionIDKey, sessionID))
+		next.ServeHTTP(w, r.WithContext(capture.WithRequestInfo(ctx, info)))
+	})
+}
+
+// TenantAuthenticated reports whether the request's tenant was bound by a
+// tenant API key or the tenant claim of a validated token, rather than named
+// in the X-Tenant-ID header, which any client may set
+func TenantAuthenticated(ctx context.Context) bool {
+	authenticated, _ := ctx.Value(tenantAuthenticatedKey{}).(bool)
+	return authenticated
+}
+
+// apiKey returns the API key sent in X-API-Key or as a bearer token. A JWT
+// bearer token is not an API key, and is neither looked up nor fingerprinted.
+func apiKey(r *http.Request) string {
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key
+	}
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && !jwtauth.IsJWT(token) {
+		return token
+	}
+	return ""
+}
+
+// countryHeaders are set by CDNs and load balancers that resolve client geo
+var countryHeaders = []string{"CF-IPCountry", "CloudFront-Viewer-Country", "X-Country-Code"}
+
+// clientInfo describes the client application from the request headers
+func clientInfo(r *http.Request) capture.ClientInfo {
+	info := capture.ClientInfo{
+		IP:         clientIP(r),
+		UserAgent:  r.UserAgent(),
+		App:        r.Header.Get("X-Client-App"),
+		AppVersion: r.Header.Get("X-App-Version"),
+		Origin:     r.Header.Get("Origin"),
+		APIKey:     capture.APIKeyID(apiKey(r)),
+	}
+	for _, header := range countryHeaders {
+		if country := r.Header.Get(header); country != "" {
+			info.Country = strings.ToUpper(country)
+			break
+		}
+	}
+	if info.App == "" {
+		info.App = "unknown"
+	}
+	return info
+}
+
+// clientIP returns the originating client address, honouring X-Forwarded-For
+func clientIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		return strings.TrimSpace(strings.Split(forwarded, ",")[0])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
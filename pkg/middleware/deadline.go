@@ -0,0 +1,103 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// TimeoutHeader carries how long a client waits for a response, in
+// milliseconds. Requests to model servers carry the time left in it too.
+const TimeoutHeader = "X-Request-Timeout-Ms"
+
+// StageModel is the model call, which gets whatever time is left
+const StageModel = "model"
+
+// DeadlineConfig bounds the time a request may take
+type DeadlineConfig struct {
+	// Default is the timeout of requests that do not state one
+	Default time.Duration
+	// Max caps the timeouts clients ask for
+	Max time.Duration
+}
+
+// DeadlineConfigFromEnv reads REQUEST_TIMEOUT_DEFAULT_MS and
+// REQUEST_TIMEOUT_MAX_MS
+func DeadlineConfigFromEnv() (DeadlineConfig, error) {
+	var config DeadlineConfig
+	settings := []struct {
+		name, fallback string
+		value          func(time.Duration)
+	}{
+		{"REQUEST_TIMEOUT_DEFAULT_MS", "60000", func(d time.Duration) { config.Default = d }},
+		{"REQUEST_TIMEOUT_MAX_MS", "85000", func(d time.Duration) { config.Max = d }},
+	}
+	for _, setting := range settings {
+		value := os.Getenv(setting.name)
+		if value == "" {
+			value = setting.fallback
+		}
+		ms, err := strconv.Atoi(value)
+		if err != nil || ms <= 0 {
+			return config, fmt.Errorf("%s must be a positive number of milliseconds", setting.name)
+		}
+		setting.value(time.Duration(ms) * time.Millisecond)
+	}
+	if config.Default > config.Max {
+		return config, fmt.Errorf("REQUEST_TIMEOUT_DEFAULT_MS must not exceed REQUEST_TIMEOUT_MAX_MS")
+	}
+	return config, nil
+}
+
+// RequestTimeout returns the timeout a request states in its
+// X-Request-Timeout-Ms header, or 0 when it states none
+func RequestTimeout(r *http.Request) (time.Duration, error) {
+	value := r.Header.Get(TimeoutHeader)
+	if value == "" {
+		return 0, nil
+	}
+	ms, err := strconv.Atoi(value)
+	if err != nil || ms <= 0 {
+		return 0, fmt.Errorf("%s must be a positive number of milliseconds", TimeoutHeader)
+	}
+	return time.Duration(ms) * time.Millisecond, nil
+}
+
+// TimeBudget is the time a request has left
+type TimeBudget struct {
+	deadline time.Time
+}
+
+// Budget starts the time budget of a request received at start. The
+// smallest positive timeout given applies, capped by the config's Max, and
+// the Default when none is given.
+func (c DeadlineConfig) Budget(start time.Time, timeouts ...time.Duration) *TimeBudget {
+	timeout := time.Duration(0)
+	for _, t := range timeouts {
+		if t > 0 && (timeout == 0 || t < timeout) {
+			timeout = t
+		}
+	}
+	if timeout == 0 {
+		timeout = c.Default
+	}
+	return &TimeBudget{deadline: start.Add(min(timeout, c.Max))}
+}
+
+// Deadline returns when the request's time runs out
+func (b *TimeBudget) Deadline() time.Time {
+	return b.deadline
+}
+
+// Remaining returns the time left before the deadline
+func (b *TimeBudget) Remaining() time.Duration {
+	return max(time.Until(b.deadline), 0)
+}
+
+// Context returns a copy of ctx that ends at the request's deadline
+func (b *TimeBudget) Context(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithDeadline(ctx, b.deadline)
+}
@@ -0,0 +1,123 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"runtime"
+
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+	"github.com/ajeetraina/genai-app-demo/pkg/errorreport"
+)
+
+// maxStackDepth bounds the stack frames kept for a report
+const maxStackDepth = 64
+
+// errorRecord holds the error a handler reported for its response
+type errorRecord struct {
+	err error
+}
+
+type errorRecordKey struct{}
+
+// ReportError attaches the error behind a 5xx response to the request, so
+// its error report carries the cause rather than just the status
+func ReportError(ctx context.Context, err error) {
+	if record, ok := ctx.Value(errorRecordKey{}).(*errorRecord); ok {
+		record.err = err
+	}
+}
+
+// ErrorReporting reports handler panics and 5xx responses to reporter, with
+// a stack trace and the request's ID, user, tenant and trace. A panic is
+// recovered and answered with a 500 when nothing was written yet. The stack
+// of a 5xx response is taken where the handler wrote its status.
+func ErrorReporting(reporter *errorreport.Reporter) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			record := &errorRecord{}
+			r = r.WithContext(context.WithValue(r.Context(), errorRecordKey{}, record))
+			writer := &stackResponseWriter{responseWriterWrapper: &responseWriterWrapper{w: w, statusCode: http.StatusOK}}
+
+			defer func() {
+				value := recover()
+				if value == nil {
+					return
+				}
+				// ErrAbortHandler is how handlers abort a response on purpose
+				if value == http.ErrAbortHandler {
+					panic(value)
+				}
+				err, ok := value.(error)
+				if !ok {
+					err = fmt.Errorf("%v", value)
+				}
+				log.Ctx(r.Context()).Error().Err(err).Msg("Handler panicked")
+				reporter.Capture(newReport(r, err, true, callers(3)))
+				if !writer.written {
+					http.Error(writer, "Internal server error", http.StatusInternalServerError)
+				}
+			}()
+
+			next.ServeHTTP(writer, r)
+
+			if writer.statusCode >= http.StatusInternalServerError {
+				err := record.err
+				if err == nil {
+					err = fmt.Errorf("%s %s responded %d %s", r.Method, r.URL.Path, writer.statusCode, http.StatusText(writer.statusCode))
+				}
+				reporter.Capture(newReport(r, err, false, writer.stack))
+			}
+		})
+	}
+}
+
+// newReport describes a failed request for the error reporter
+func newReport(r *http.Request, err error, panicked bool, stack []uintptr) errorreport.Report {
+	report := errorreport.Report{
+		Err:     err,
+		Panic:   panicked,
+		Stack:   stack,
+		Request: r,
+		UserID:  requestUser(r),
+		Tags:    map[string]string{"request_id": RequestID(r.Context())},
+	}
+	if info, ok := capture.RequestInfoFromContext(r.Context()); ok {
+		report.Tags["tenant"] = info.Tenant
+	}
+	if spanContext := trace.SpanContextFromContext(r.Context()); spanContext.IsValid() {
+		report.TraceID = spanContext.TraceID().String()
+		report.SpanID = spanContext.SpanID().String()
+	}
+	return report
+}
+
+// callers returns the calling stack, skipping skip frames
+func callers(skip int) []uintptr {
+	pcs := make([]uintptr, maxStackDepth)
+	return pcs[:runtime.Callers(skip, pcs)]
+}
+
+// stackResponseWriter records whether a response was started, and the stack
+// that wrote a 5xx status
+type stackResponseWriter struct {
+	*responseWriterWrapper
+	written bool
+	stack   []uintptr
+}
+
+func (sw *stackResponseWriter) WriteHeader(statusCode int) {
+	if !sw.written && statusCode >= http.StatusInternalServerError {
+		sw.stack = callers(3)
+	}
+	sw.written = true
+	sw.responseWriterWrapper.WriteHeader(statusCode)
+}
+
+func (sw *stackResponseWriter) Write(bytes []byte) (int, error) {
+	sw.written = true
+	return sw.responseWriterWrapper.Write(bytes)
+}
@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/jwtauth"
+)
+
+// probePaths are served without a token even when one is required, so
+// orchestrators and Prometheus keep working
+var probePaths = []string{"/health", "/healthz", "/readyz", "/metrics"}
+
+type authenticatedUserKey struct{}
+
+type tokenTenantKey struct{}
+
+// JWTAuth validates JWT bearer tokens with verifier and records the user ID
+// they name for the capture middleware, which then ignores X-User-ID, along
+// with the tenant they name when a tenant claim is configured.
+// Requests with an invalid token are rejected with 401 Unauthorized. Other
+// bearer tokens, such as tenant API keys, pass through unless required is
+// set, in which case only probe and metrics requests are served without a
+// valid token.
+func JWTAuth(verifier *jwtauth.Verifier, required bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !jwtauth.IsJWT(token) {
+				if required && r.Method != http.MethodOptions && !isProbePath(r.URL.Path) {
+					w.Header().Set("WWW-Authenticate", `Bearer`)
+					http.Error(w, "Unauthorized", http.StatusUnauthorized)
+					return
+				}
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			claims, err := verifier.Verify(r.Context(), token)
+			if err != nil {
+				log.Warn().Err(err).Str("path", r.URL.Path).Str("request_id", RequestID(r.Context())).Msg("Rejected bearer token")
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+			userID := verifier.UserID(claims)
+			if userID == "" {
+				log.Warn().Str("path", r.URL.Path).Str("request_id", RequestID(r.Context())).Msg("Bearer token has no user claim")
+				w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			ctx := context.WithValue(r.Context(), authenticatedUserKey{}, userID)
+			if tenant := verifier.Tenant(claims); tenant != "" {
+				ctx = context.WithValue(ctx, tokenTenantKey{}, tenant)
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
+
+// AuthenticatedUser returns the user ID of the request's validated token, or
+// an empty string when JWTAuth did not validate one
+func AuthenticatedUser(ctx context.Context) string {
+	userID, _ := ctx.Value(authenticatedUserKey{}).(string)
+	return userID
+}
+
+// tokenTenant returns the tenant named by the request's validated token, or
+// an empty string when it names none
+func tokenTenant(ctx context.Context) string {
+	tenant, _ := ctx.Value(tokenTenantKey{}).(string)
+	return tenant
+}
+
+func isProbePath(path string) bool {
+	for _, probe := range probePaths {
+		if path == probe || strings.HasPrefix(path, probe+"/") {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,41 @@
+package middleware
+
+import (
+	"net/http"
+
+	"github.com/rs/zerolog/log"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/capture"
+	"github.com/ajeetraina/genai-app-demo/pkg/tracing"
+)
+
+// LoggingMiddleware attaches a request-scoped logger to the request context,
+// carrying the method, path, request and trace identifiers, and the user and
+// session carried as baggage. Handlers log
+// through it with log.Ctx(r.Context()).
+func LoggingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fields := log.With().Str("method", r.Method).Str("path", r.URL.Path)
+		if requestID := RequestID(r.Context()); requestID != "" {
+			fields = fields.Str("request_id", requestID)
+		}
+		if info, ok := capture.RequestInfoFromContext(r.Context()); ok && info.Tenant != "" {
+			fields = fields.Str("tenant", info.Tenant)
+		}
+		userID, sessionID := tracing.UserFromContext(r.Context())
+		if userID != "" {
+			fields = fields.Str("user_id", userID)
+		}
+		if sessionID != "" {
+			fields = fields.Str("session_id", sessionID)
+		}
+		if spanContext := trace.SpanContextFromContext(r.Context()); spanContext.IsValid() {
+			fields = fields.Str("trace_id", spanContext.TraceID().String()).
+				Str("span_id", spanContext.SpanID().String())
+		}
+		logger := fields.Logger()
+
+		next.ServeHTTP(w, r.WithContext(logger.WithContext(r.Context())))
+	})
+}
@@ -1,6 +1,11 @@
 package middleware
 
-import "net/http"
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+)
 
 // responseWriterWrapper wraps an http.ResponseWriter to capture the status code
 type responseWriterWrapper struct {
@@ -30,3 +35,12 @@ func (rww *responseWriterWrapper) Flush() {
 		f.Flush()
 	}
 }
+
+// Hijack implements the http.Hijacker interface, for WebSocket upgrades
+func (rww *responseWriterWrapper) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rww.w.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("response writer does not support hijacking")
+	}
+	return hijacker.Hijack()
+}
@@ -0,0 +1,22 @@
+package middleware
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/slo"
+)
+
+// SLOMiddleware counts every request against the objectives of its
+// endpoint. Latency is the time to the end of the response, so it covers
+// the whole of a streamed reply.
+func SLOMiddleware(tracker *slo.Tracker) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			rww := &responseWriterWrapper{w: w, statusCode: http.StatusOK}
+			next.ServeHTTP(rww, r)
+			tracker.Observe(r.Method, r.URL.Path, rww.statusCode, time.Since(start))
+		})
+	}
+}
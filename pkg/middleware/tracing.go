@@ -17,8 +17,10 @@ func TracingMiddleware(next http.Handler) http.Handler {
 			return
 		}
 
-		// Start a new span for this request
-		ctx, span := tracing.StartSpan(r.Context(), "http_request")
+		// Start a new span for this request, continuing the caller's trace
+		// when it sent a traceparent header
+		ctx := tracing.ExtractHeaders(r.Context(), r.Header)
+		ctx, span := tracing.StartSpan(ctx, "http_request")
 		defer span.End()
 
 		// Add request attributes to the span
@@ -0,0 +1,170 @@
+package otelmetrics
+
+import (
+	"math"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/otel/attribute"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+)
+
+// convertFamilies converts gathered Prometheus metric families to OTLP
+// metrics. Counters become monotonic cumulative sums starting at start,
+// unless they record when they were created; gauges and untyped metrics
+// become gauges. Samples without a timestamp are stamped now.
+func convertFamilies(families []*dto.MetricFamily, start, now time.Time) []*metricspb.Metric {
+	metrics := make([]*metricspb.Metric, 0, len(families))
+	for _, family := range families {
+		metric := &metricspb.Metric{Name: family.GetName(), Description: family.GetHelp()}
+		switch family.GetType() {
+		case dto.MetricType_COUNTER:
+			sum := &metricspb.Sum{
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+				IsMonotonic:            true,
+			}
+			for _, m := range family.GetMetric() {
+				point := numberPoint(m, start, now, m.GetCounter().GetValue())
+				if created := m.GetCounter().GetCreatedTimestamp(); created != nil {
+					point.StartTimeUnixNano = uint64(created.AsTime().UnixNano())
+				}
+				sum.DataPoints = append(sum.DataPoints, point)
+			}
+			metric.Data = &metricspb.Metric_Sum{Sum: sum}
+
+		case dto.MetricType_GAUGE, dto.MetricType_UNTYPED:
+			gauge := &metricspb.Gauge{}
+			for _, m := range family.GetMetric() {
+				value := m.GetGauge().GetValue()
+				if family.GetType() == dto.MetricType_UNTYPED {
+					value = m.GetUntyped().GetValue()
+				}
+				gauge.DataPoints = append(gauge.DataPoints, numberPoint(m, start, now, value))
+			}
+			metric.Data = &metricspb.Metric_Gauge{Gauge: gauge}
+
+		case dto.MetricType_HISTOGRAM:
+			histogram := &metricspb.Histogram{
+				AggregationTemporality: metricspb.AggregationTemporality_AGGREGATION_TEMPORALITY_CUMULATIVE,
+			}
+			for _, m := range family.GetMetric() {
+				histogram.DataPoints = append(histogram.DataPoints, histogramPoint(m, start, now))
+			}
+			metric.Data = &metricspb.Metric_Histogram{Histogram: histogram}
+
+		case dto.MetricType_SUMMARY:
+			summary := &metricspb.Summary{}
+			for _, m := range family.GetMetric() {
+				s := m.GetSummary()
+				point := &metricspb.SummaryDataPoint{
+					Attributes:        labelAttributes(m),
+					StartTimeUnixNano: uint64(start.UnixNano()),
+					TimeUnixNano:      sampleTime(m, now),
+					Count:             s.GetSampleCount(),
+					Sum:               s.GetSampleSum(),
+				}
+				for _, q := range s.GetQuantile() {
+					point.QuantileValues = append(point.QuantileValues, &metricspb.SummaryDataPoint_ValueAtQuantile{
+						Quantile: q.GetQuantile(),
+						Value:    q.GetValue(),
+					})
+				}
+				summary.DataPoints = append(summary.DataPoints, point)
+			}
+			metric.Data = &metricspb.Metric_Summary{Summary: summary}
+
+		default:
+			// Gauge histograms are not produced by client_golang
+			continue
+		}
+		metrics = append(metrics, metric)
+	}
+	return metrics
+}
+
+// numberPoint returns a data point of value for m
+func numberPoint(m *dto.Metric, start, now time.Time, value float64) *metricspb.NumberDataPoint {
+	return &metricspb.NumberDataPoint{
+		Attributes:        labelAttributes(m),
+		StartTimeUnixNano: uint64(start.UnixNano()),
+		TimeUnixNano:      sampleTime(m, now),
+		Value:             &metricspb.NumberDataPoint_AsDouble{AsDouble: value},
+	}
+}
+
+// histogramPoint converts the cumulative buckets of a Prometheus histogram to
+// the per-bucket counts of OTLP, whose last bucket is the one above the
+// highest bound
+func histogramPoint(m *dto.Metric, start, now time.Time) *metricspb.HistogramDataPoint {
+	h := m.GetHistogram()
+	var bounds []float64
+	var counts []uint64
+	var previous uint64
+	for _, bucket := range h.GetBucket() {
+		if math.IsInf(bucket.GetUpperBound(), 1) {
+			continue
+		}
+		bounds = append(bounds, bucket.GetUpperBound())
+		counts = append(counts, bucket.GetCumulativeCount()-previous)
+		previous = bucket.GetCumulativeCount()
+	}
+	counts = append(counts, h.GetSampleCount()-previous)
+
+	sum := h.GetSampleSum()
+	startTime := start
+	if created := h.GetCreatedTimestamp(); created != nil {
+		startTime = created.AsTime()
+	}
+	return &metricspb.HistogramDataPoint{
+		Attributes:        labelAttributes(m),
+		StartTimeUnixNano: uint64(startTime.UnixNano()),
+		TimeUnixNano:      sampleTime(m, now),
+		Count:             h.GetSampleCount(),
+		Sum:               &sum,
+		BucketCounts:      counts,
+		ExplicitBounds:    bounds,
+	}
+}
+
+// sampleTime returns the time of m's sample, now if it has none
+func sampleTime(m *dto.Metric, now time.Time) uint64 {
+	if m.TimestampMs != nil {
+		return uint64(time.UnixMilli(m.GetTimestampMs()).UnixNano())
+	}
+	return uint64(now.UnixNano())
+}
+
+// labelAttributes returns m's labels as attributes
+func labelAttributes(m *dto.Metric) []*commonpb.KeyValue {
+	attributes := make([]*commonpb.KeyValue, 0, len(m.GetLabel()))
+	for _, label := range m.GetLabel() {
+		attributes = append(attributes, &commonpb.KeyValue{
+			Key:   label.GetName(),
+			Value: &commonpb.AnyValue{Value: &commonpb.AnyValue_StringValue{StringValue: label.GetValue()}},
+		})
+	}
+	return attributes
+}
+
+// resourceAttributes converts the attributes of an SDK resource
+func resourceAttributes(kvs []attribute.KeyValue) []*commonpb.KeyValue {
+	attributes := make([]*commonpb.KeyValue, 0, len(kvs))
+	for _, kv := range kvs {
+		value := &commonpb.AnyValue{}
+		switch kv.Value.Type() {
+		case attribute.BOOL:
+			value.Value = &commonpb.AnyValue_BoolValue{BoolValue: kv.Value.AsBool()}
+		case attribute.INT64:
+			value.Value = &commonpb.AnyValue_IntValue{IntValue: kv.Value.AsInt64()}
+		case attribute.FLOAT64:
+			value.Value = &commonpb.AnyValue_DoubleValue{DoubleValue: kv.Value.AsFloat64()}
+		case attribute.STRING:
+			value.Value = &commonpb.AnyValue_StringValue{StringValue: kv.Value.AsString()}
+		default:
+			value.Value = &commonpb.AnyValue_StringValue{StringValue: kv.Value.Emit()}
+		}
+		attributes = append(attributes, &commonpb.KeyValue{Key: string(kv.Key), Value: value})
+	}
+	return attributes
+}
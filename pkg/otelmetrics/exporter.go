@@ -0,0 +1,208 @@
+// Package otelmetrics pushes the metrics services register with Prometheus
+// to an OpenTelemetry Collector over OTLP, so they can be collected without
+// scraping each service's /metrics endpoint.
+package otelmetrics
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/logger"
+	"github.com/ajeetraina/genai-app-demo/pkg/tracing"
+	"github.com/prometheus/client_golang/prometheus"
+	colmetricspb "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	commonpb "go.opentelemetry.io/proto/otlp/common/v1"
+	metricspb "go.opentelemetry.io/proto/otlp/metrics/v1"
+	resourcepb "go.opentelemetry.io/proto/otlp/resource/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/protobuf/proto"
+)
+
+// scopeName identifies the exporter as the instrumentation scope of the
+// metrics it sends
+const scopeName = "github.com/ajeetraina/genai-app-demo/pkg/otelmetrics"
+
+// exporter periodically gathers metrics and sends them in one request
+type exporter struct {
+	gatherer prometheus.Gatherer
+	resource *resourcepb.Resource
+	interval time.Duration
+	timeout  time.Duration
+	send     func(ctx context.Context, request *colmetricspb.ExportMetricsServiceRequest) error
+	start    time.Time
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+// SetupFromEnv starts pushing the metrics of gatherer, as serviceName, when
+// OTEL_METRICS_EXPORTER is otlp. They are sent every
+// OTEL_METRIC_EXPORT_INTERVAL milliseconds (default 60000) to
+// OTEL_EXPORTER_OTLP_ENDPOINT (default localhost:4318), with the protocol,
+// headers and TLS settings spans use. The returned function sends the
+// metrics one last time and stops; it is nil when export is disabled.
+func SetupFromEnv(serviceName string, gatherer prometheus.Gatherer) (func(), error) {
+	switch exporterName := os.Getenv("OTEL_METRICS_EXPORTER"); exporterName {
+	case "", "none", "prometheus":
+		return nil, nil
+	case "otlp":
+	default:
+		return nil, fmt.Errorf("unsupported OTEL_METRICS_EXPORTER %q, expected otlp or none", exporterName)
+	}
+
+	interval := time.Minute
+	if text := os.Getenv("OTEL_METRIC_EXPORT_INTERVAL"); text != "" {
+		ms, err := strconv.Atoi(text)
+		if err != nil || ms <= 0 {
+			return nil, fmt.Errorf("invalid OTEL_METRIC_EXPORT_INTERVAL %q", text)
+		}
+		interval = time.Duration(ms) * time.Millisecond
+	}
+
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	if endpoint == "" {
+		endpoint = "localhost:4318"
+	}
+	config, err := tracing.ExporterConfigFromEnv(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	res, err := tracing.NewResource(serviceName)
+	if err != nil {
+		return nil, err
+	}
+
+	e := &exporter{
+		gatherer: gatherer,
+		resource: &resourcepb.Resource{Attributes: resourceAttributes(res.Attributes())},
+		interval: interval,
+		timeout:  config.Timeout,
+		start:    time.Now(),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if e.send, err = newSender(config); err != nil {
+		return nil, err
+	}
+	go e.run()
+	logger.Component("otelmetrics").Info().Dur("interval", interval).Str("protocol", config.Protocol).Str("endpoint", config.Endpoint).Msg("Exporting metrics")
+	return e.shutdown, nil
+}
+
+// newSender returns a function sending export requests with the configured
+// protocol. For http/protobuf, /v1/metrics is added to the endpoint's path.
+func newSender(config tracing.Config) (func(context.Context, *colmetricspb.ExportMetricsServiceRequest) error, error) {
+	host, path, plaintext, err := config.Target()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Protocol == "grpc" {
+		creds := credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+		if plaintext {
+			creds = insecure.NewCredentials()
+		}
+		conn, err := grpc.NewClient(host, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create OTLP gRPC connection to %s: %v", host, err)
+		}
+		client := colmetricspb.NewMetricsServiceClient(conn)
+		headers := metadata.New(config.Headers)
+		return func(ctx context.Context, request *colmetricspb.ExportMetricsServiceRequest) error {
+			_, err := client.Export(metadata.NewOutgoingContext(ctx, headers), request)
+			return err
+		}, nil
+	}
+
+	scheme := "https"
+	if plaintext {
+		scheme = "http"
+	}
+	url := scheme + "://" + host + path + "/v1/metrics"
+	client := &http.Client{}
+	return func(ctx context.Context, request *colmetricspb.ExportMetricsServiceRequest) error {
+		body, err := proto.Marshal(request)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-protobuf")
+		for name, value := range config.Headers {
+			req.Header.Set(name, value)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			message, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+			return fmt.Errorf("collector returned %s: %s", resp.Status, bytes.TrimSpace(message))
+		}
+		return nil
+	}, nil
+}
+
+// run exports every interval until stopped
+func (e *exporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := e.export(); err != nil {
+				logger.Component("otelmetrics").Error().Err(err).Msg("Failed to export metrics")
+			}
+		case <-e.stop:
+			return
+		}
+	}
+}
+
+// export gathers the metrics and sends them
+func (e *exporter) export() error {
+	families, err := e.gatherer.Gather()
+	if len(families) == 0 {
+		return err
+	}
+	if err != nil {
+		// Gathering reports some collectors' failures alongside the others'
+		// metrics, which are still worth sending
+		logger.Component("otelmetrics").Warn().Err(err).Msg("Exporting metrics despite gather errors")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
+	defer cancel()
+	return e.send(ctx, &colmetricspb.ExportMetricsServiceRequest{
+		ResourceMetrics: []*metricspb.ResourceMetrics{{
+			Resource: e.resource,
+			ScopeMetrics: []*metricspb.ScopeMetrics{{
+				Scope:   &commonpb.InstrumentationScope{Name: scopeName},
+				Metrics: convertFamilies(families, e.start, time.Now()),
+			}},
+		}},
+	})
+}
+
+// shutdown stops the periodic export and sends the metrics once more
+func (e *exporter) shutdown() {
+	close(e.stop)
+	<-e.done
+	if err := e.export(); err != nil {
+		logger.Component("otelmetrics").Error().Err(err).Msg("Failed to export metrics at shutdown")
+	}
+}
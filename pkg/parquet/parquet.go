@@ -0,0 +1,184 @@
+// Package parquet writes flat tables as Parquet files: one row group of
+// required columns, PLAIN encoded and uncompressed. It covers the simple
+// exports this project produces without pulling in a full Parquet library.
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// ColumnType is the physical type of a column
+type ColumnType int
+
+// Supported column types
+const (
+	String ColumnType = iota
+	Int64
+	Double
+)
+
+// Column describes a column of the table
+type Column struct {
+	Name string
+	Type ColumnType
+}
+
+// Parquet enum values used by the writer
+const (
+	typeInt64     = 2
+	typeDouble    = 5
+	typeByteArray = 6
+
+	repetitionRequired = 0
+	convertedUTF8      = 0
+	encodingPlain      = 0
+	encodingRLE        = 3
+	codecUncompressed  = 0
+	pageTypeData       = 0
+)
+
+var magic = []byte("PAR1")
+
+// physicalType returns the Parquet physical type of a column type
+func (t ColumnType) physicalType() int32 {
+	switch t {
+	case Int64:
+		return typeInt64
+	case Double:
+		return typeDouble
+	default:
+		return typeByteArray
+	}
+}
+
+// Write encodes rows as a Parquet file. Each row holds one value per column:
+// a string for String columns, an int64 for Int64 and a float64 for Double.
+func Write(w io.Writer, columns []Column, rows [][]interface{}) error {
+	var file bytes.Buffer
+	file.Write(magic)
+
+	type chunk struct {
+		offset int64
+		size   int64
+	}
+	chunks := make([]chunk, len(columns))
+	for c, column := range columns {
+		var values bytes.Buffer
+		for r, row := range rows {
+			if len(row) != len(columns) {
+				return fmt.Errorf("row %d has %d values, expected %d", r, len(row), len(columns))
+			}
+			if err := writePlain(&values, column.Type, row[c]); err != nil {
+				return fmt.Errorf("row %d column %s: %v", r, column.Name, err)
+			}
+		}
+
+		var header thriftWriter
+		header.i32(1, pageTypeData)
+		header.i32(2, int32(values.Len()))
+		header.i32(3, int32(values.Len()))
+		header.structBegin(5)
+		header.i32(1, int32(len(rows)))
+		header.i32(2, encodingPlain)
+		header.i32(3, encodingRLE)
+		header.i32(4, encodingRLE)
+		header.structEnd()
+		header.stop()
+
+		chunks[c].offset = int64(file.Len())
+		file.Write(header.Bytes())
+		file.Write(values.Bytes())
+		chunks[c].size = int64(file.Len()) - chunks[c].offset
+	}
+
+	var totalSize int64
+	for _, chunk := range chunks {
+		totalSize += chunk.size
+	}
+
+	var meta thriftWriter
+	meta.i32(1, 1)
+
+	meta.listBegin(2, thriftStruct, len(columns)+1)
+	meta.elemBegin()
+	meta.binary(4, "schema")
+	meta.i32(5, int32(len(columns)))
+	meta.structEnd()
+	for _, column := range columns {
+		meta.elemBegin()
+		meta.i32(1, column.Type.physicalType())
+		meta.i32(3, repetitionRequired)
+		meta.binary(4, column.Name)
+		if column.Type == String {
+			meta.i32(6, convertedUTF8)
+		}
+		meta.structEnd()
+	}
+
+	meta.i64(3, int64(len(rows)))
+
+	meta.listBegin(4, thriftStruct, 1)
+	meta.elemBegin()
+	meta.listBegin(1, thriftStruct, len(columns))
+	for c, column := range columns {
+		meta.elemBegin()
+		meta.i64(2, chunks[c].offset)
+		meta.structBegin(3)
+		meta.i32(1, column.Type.physicalType())
+		meta.listBegin(2, thriftI32, 2)
+		meta.varint(encodingPlain)
+		meta.varint(encodingRLE)
+		meta.listBegin(3, thriftBinary, 1)
+		meta.rawBinary(column.Name)
+		meta.i32(4, codecUncompressed)
+		meta.i64(5, int64(len(rows)))
+		meta.i64(6, chunks[c].size)
+		meta.i64(7, chunks[c].size)
+		meta.i64(9, chunks[c].offset)
+		meta.structEnd()
+		meta.structEnd()
+	}
+	meta.i64(2, totalSize)
+	meta.i64(3, int64(len(rows)))
+	meta.structEnd()
+
+	meta.binary(6, "aiwatch")
+	meta.stop()
+
+	file.Write(meta.Bytes())
+	binary.Write(&file, binary.LittleEndian, uint32(len(meta.Bytes())))
+	file.Write(magic)
+
+	_, err := w.Write(file.Bytes())
+	return err
+}
+
+// writePlain appends a value in PLAIN encoding
+func writePlain(buf *bytes.Buffer, t ColumnType, value interface{}) error {
+	switch t {
+	case String:
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("expected a string, got %T", value)
+		}
+		binary.Write(buf, binary.LittleEndian, uint32(len(s)))
+		buf.WriteString(s)
+	case Int64:
+		n, ok := value.(int64)
+		if !ok {
+			return fmt.Errorf("expected an int64, got %T", value)
+		}
+		binary.Write(buf, binary.LittleEndian, n)
+	case Double:
+		f, ok := value.(float64)
+		if !ok {
+			return fmt.Errorf("expected a float64, got %T", value)
+		}
+		binary.Write(buf, binary.LittleEndian, math.Float64bits(f))
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package parquet
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"reflect"
+	"testing"
+)
+
+// thriftReader decodes Thrift compact protocol structs into maps from field
+// ID to value, enough to read back what thriftWriter produces
+type thriftReader struct {
+	data []byte
+	pos  int
+}
+
+func (r *thriftReader) byte() byte {
+	if r.pos >= len(r.data) {
+		panic("thrift: unexpected end of data")
+	}
+	b := r.data[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *thriftReader) uvarint() uint64 {
+	var u uint64
+	for shift := 0; ; shift += 7 {
+		b := r.byte()
+		u |= uint64(b&0x7f) << shift
+		if b < 0x80 {
+			return u
+		}
+	}
+}
+
+func (r *thriftReader) varint() int64 {
+	u := r.uvarint()
+	return int64(u>>1) ^ -int64(u&1)
+}
+
+func (r *thriftReader) value(typ byte) interface{} {
+	switch typ {
+	case thriftI32, thriftI64:
+		return r.varint()
+	case thriftBinary:
+		n := int(r.uvarint())
+		s := string(r.data[r.pos : r.pos+n])
+		r.pos += n
+		return s
+	case thriftList:
+		header := r.byte()
+		size := int(header >> 4)
+		if size == 15 {
+			size = int(r.uvarint())
+		}
+		list := make([]interface{}, size)
+		for i := range list {
+			list[i] = r.value(header & 0x0f)
+		}
+		return list
+	case thriftStruct:
+		return r.structValue()
+	}
+	panic(fmt.Sprintf("thrift: unsupported type %d", typ))
+}
+
+func (r *thriftReader) structValue() map[int16]interface{} {
+	fields := map[int16]interface{}{}
+	var last int16
+	for {
+		header := r.byte()
+		if header == 0 {
+			return fields
+		}
+		id := last + int16(header>>4)
+		if header>>4 == 0 {
+			id = int16(r.varint())
+		}
+		fields[id] = r.value(header & 0x0f)
+		last = id
+	}
+}
+
+var testColumns = []Column{
+	{Name: "user_id", Type: String},
+	{Name: "total_tokens", Type: Int64},
+	{Name: "cost_usd", Type: Double},
+}
+
+var testRows = [][]interface{}{
+	{"alice", int64(1200), 0.0125},
+	{"", int64(0), 0.0},
+	{"bob ☃", int64(-7), math.Inf(1)},
+}
+
+func TestWriteRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, testColumns, testRows); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	file := buf.Bytes()
+	if !bytes.HasPrefix(file, magic) || !bytes.HasSuffix(file, magic) {
+		t.Fatalf("file is not framed by %q", magic)
+	}
+	footerSize := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	footerStart := len(file) - 8 - footerSize
+	footer := &thriftReader{data: file[footerStart : len(file)-8]}
+	meta := footer.structValue()
+	if footer.pos != footerSize {
+		t.Fatalf("footer has %d trailing bytes", footerSize-footer.pos)
+	}
+
+	if meta[1] != int64(1) || meta[3] != int64(len(testRows)) || meta[6] != "aiwatch" {
+		t.Errorf("file metadata version, num_rows, created_by = %v, %v, %v", meta[1], meta[3], meta[6])
+	}
+
+	schema := meta[2].([]interface{})
+	root := schema[0].(map[int16]interface{})
+	if root[4] != "schema" || root[5] != int64(len(testColumns)) {
+		t.Errorf("schema root = %v", root)
+	}
+	for c, column := range testColumns {
+		element := schema[c+1].(map[int16]interface{})
+		want := map[int16]interface{}{1: int64(column.Type.physicalType()), 3: int64(repetitionRequired), 4: column.Name}
+		if column.Type == String {
+			want[6] = int64(convertedUTF8)
+		}
+		if !reflect.DeepEqual(element, want) {
+			t.Errorf("schema element %d = %v, want %v", c, element, want)
+		}
+	}
+
+	rowGroups := meta[4].([]interface{})
+	if len(rowGroups) != 1 {
+		t.Fatalf("file has %d row groups, want 1", len(rowGroups))
+	}
+	rowGroup := rowGroups[0].(map[int16]interface{})
+	chunks := rowGroup[1].([]interface{})
+	var totalSize int64
+	for c, column := range testColumns {
+		chunk := chunks[c].(map[int16]interface{})
+		columnMeta := chunk[3].(map[int16]interface{})
+		offset := columnMeta[9].(int64)
+		size := columnMeta[7].(int64)
+		totalSize += size
+		if chunk[2] != offset || columnMeta[1] != int64(column.Type.physicalType()) ||
+			columnMeta[5] != int64(len(testRows)) || !reflect.DeepEqual(columnMeta[3], []interface{}{column.Name}) {
+			t.Errorf("column chunk %d = %v", c, chunk)
+		}
+
+		page := &thriftReader{data: file[offset : offset+size]}
+		header := page.structValue()
+		dataHeader := header[5].(map[int16]interface{})
+		if header[1] != int64(pageTypeData) || dataHeader[1] != int64(len(testRows)) || dataHeader[2] != int64(encodingPlain) {
+			t.Errorf("page header of column %s = %v", column.Name, header)
+		}
+		values := page.data[page.pos:]
+		if int64(len(values)) != header[2].(int64) {
+			t.Fatalf("page of column %s has %d value bytes, header says %v", column.Name, len(values), header[2])
+		}
+		for r, row := range testRows {
+			var got interface{}
+			switch column.Type {
+			case String:
+				n := binary.LittleEndian.Uint32(values)
+				got, values = string(values[4:4+n]), values[4+n:]
+			case Int64:
+				got, values = int64(binary.LittleEndian.Uint64(values)), values[8:]
+			case Double:
+				got, values = math.Float64frombits(binary.LittleEndian.Uint64(values)), values[8:]
+			}
+			if got != row[c] {
+				t.Errorf("row %d column %s = %v, want %v", r, column.Name, got, row[c])
+			}
+		}
+	}
+	if rowGroup[2] != totalSize || rowGroup[3] != int64(len(testRows)) {
+		t.Errorf("row group total_byte_size, num_rows = %v, %v, want %d, %d", rowGroup[2], rowGroup[3], totalSize, len(testRows))
+	}
+	if last := chunks[len(chunks)-1].(map[int16]interface{})[3].(map[int16]interface{}); last[9].(int64)+last[7].(int64) != int64(footerStart) {
+		t.Errorf("column chunks do not end at the footer")
+	}
+}
+
+func TestWriteEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Write(&buf, testColumns, nil); err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	file := buf.Bytes()
+	footerSize := int(binary.LittleEndian.Uint32(file[len(file)-8:]))
+	meta := (&thriftReader{data: file[len(file)-8-footerSize : len(file)-8]}).structValue()
+	if meta[3] != int64(0) {
+		t.Errorf("num_rows = %v, want 0", meta[3])
+	}
+}
+
+func TestWriteErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		rows [][]interface{}
+	}{
+		{"short row", [][]interface{}{{"alice", int64(1)}}},
+		{"string column", [][]interface{}{{42, int64(1), 0.5}}},
+		{"int64 column", [][]interface{}{{"alice", 1, 0.5}}},
+		{"double column", [][]interface{}{{"alice", int64(1), float32(0.5)}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := Write(&buf, testColumns, tt.rows); err == nil {
+				t.Error("Write() succeeded, want an error")
+			}
+			if buf.Len() != 0 {
+				t.Errorf("Write() wrote %d bytes of a failed file", buf.Len())
+			}
+		})
+	}
+}
+
+func TestThriftFieldDeltas(t *testing.T) {
+	var w thriftWriter
+	w.i32(1, 7)
+	w.i64(20, -3)
+	w.binary(21, "x")
+	w.stop()
+	want := []byte{0x15, 0x0e, 0x06, 0x28, 0x05, 0x18, 0x01, 'x', 0x00}
+	if !bytes.Equal(w.Bytes(), want) {
+		t.Errorf("thriftWriter wrote % x, want % x", w.Bytes(), want)
+	}
+	got := (&thriftReader{data: w.Bytes()}).structValue()
+	if !reflect.DeepEqual(got, map[int16]interface{}{1: int64(7), 20: int64(-3), 21: "x"}) {
+		t.Errorf("read back %v", got)
+	}
+}
@@ -0,0 +1,104 @@
+package parquet
+
+import "bytes"
+
+// Thrift compact protocol type codes
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftWriter encodes the Parquet metadata structs with the Thrift compact
+// protocol. Field IDs are delta-encoded against the previous field of the
+// enclosing struct, so a stack tracks the last ID of each open struct.
+type thriftWriter struct {
+	bytes.Buffer
+	last []int16
+}
+
+// field writes a field header
+func (w *thriftWriter) field(id int16, typ byte) {
+	if len(w.last) == 0 {
+		w.last = []int16{0}
+	}
+	top := len(w.last) - 1
+	if delta := id - w.last[top]; delta > 0 && delta <= 15 {
+		w.WriteByte(byte(delta)<<4 | typ)
+	} else {
+		w.WriteByte(typ)
+		w.varint(int64(id))
+	}
+	w.last[top] = id
+}
+
+// varint writes a zigzag varint, as used for i16, i32 and i64 values
+func (w *thriftWriter) varint(v int64) {
+	w.uvarint(uint64((v << 1) ^ (v >> 63)))
+}
+
+// uvarint writes an unsigned varint, as used for lengths
+func (w *thriftWriter) uvarint(u uint64) {
+	for u >= 0x80 {
+		w.WriteByte(byte(u) | 0x80)
+		u >>= 7
+	}
+	w.WriteByte(byte(u))
+}
+
+func (w *thriftWriter) i32(id int16, v int32) {
+	w.field(id, thriftI32)
+	w.varint(int64(v))
+}
+
+func (w *thriftWriter) i64(id int16, v int64) {
+	w.field(id, thriftI64)
+	w.varint(v)
+}
+
+func (w *thriftWriter) binary(id int16, s string) {
+	w.field(id, thriftBinary)
+	w.rawBinary(s)
+}
+
+// rawBinary writes a length-prefixed string without a field header, as used
+// for list elements
+func (w *thriftWriter) rawBinary(s string) {
+	w.uvarint(uint64(len(s)))
+	w.WriteString(s)
+}
+
+// listBegin writes a list field header; the caller writes size elements
+func (w *thriftWriter) listBegin(id int16, elemType byte, size int) {
+	w.field(id, thriftList)
+	if size < 15 {
+		w.WriteByte(byte(size)<<4 | elemType)
+	} else {
+		w.WriteByte(0xf0 | elemType)
+		w.uvarint(uint64(size))
+	}
+}
+
+// structBegin opens a struct field
+func (w *thriftWriter) structBegin(id int16) {
+	w.field(id, thriftStruct)
+	w.last = append(w.last, 0)
+}
+
+// elemBegin opens a struct list element
+func (w *thriftWriter) elemBegin() {
+	w.last = append(w.last, 0)
+}
+
+// structEnd closes the innermost struct
+func (w *thriftWriter) structEnd() {
+	w.WriteByte(0)
+	w.last = w.last[:len(w.last)-1]
+}
+
+// stop ends the top-level struct
+func (w *thriftWriter) stop() {
+	w.WriteByte(0)
+}
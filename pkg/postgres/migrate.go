@@ -0,0 +1,97 @@
+package postgres
+
+import (
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLock is the advisory lock key held while migrating, so services
+// starting together do not apply the same migration twice
+const migrationLock = 7268290801
+
+// Migration is a versioned schema change
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// Migrations returns the schema migrations in version order. Each file in
+// migrations/ is named NNNN_description.sql.
+func Migrations() ([]Migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]Migration, 0, len(entries))
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".sql")
+		prefix, _, _ := strings.Cut(name, "_")
+		version, err := strconv.Atoi(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("migration %s has no version prefix", entry.Name())
+		}
+		sql, err := migrationFiles.ReadFile(path.Join("migrations", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{Version: version, Name: name, SQL: string(sql)})
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// Migrate applies the migrations not yet recorded in schema_migrations, each
+// in its own transaction, and returns those applied
+func Migrate(c *Conn) ([]Migration, error) {
+	migrations, err := Migrations()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := c.Exec(fmt.Sprintf("SELECT pg_advisory_lock(%d)", migrationLock)); err != nil {
+		return nil, err
+	}
+	defer c.Exec(fmt.Sprintf("SELECT pg_advisory_unlock(%d)", migrationLock))
+
+	err = c.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (
+		version    integer     PRIMARY KEY,
+		name       text        NOT NULL,
+		applied_at timestamptz NOT NULL DEFAULT now()
+	)`)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := c.Query("SELECT version FROM schema_migrations")
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int]bool, len(rows))
+	for _, row := range rows {
+		version, _ := strconv.Atoi(row[0])
+		applied[version] = true
+	}
+
+	var ran []Migration
+	for _, migration := range migrations {
+		if applied[migration.Version] {
+			continue
+		}
+		err := c.Exec(fmt.Sprintf("BEGIN; %s; INSERT INTO schema_migrations (version, name) VALUES (%d, %s); COMMIT",
+			migration.SQL, migration.Version, Literal(migration.Name)))
+		if err != nil {
+			c.Exec("ROLLBACK")
+			return ran, fmt.Errorf("migration %s failed: %v", migration.Name, err)
+		}
+		ran = append(ran, migration)
+	}
+	return ran, nil
+}
@@ -0,0 +1,29 @@
+-- Request-level records, archived as they are captured so they outlive their
+-- Redis retention. The client IP and user agent are not archived.
+CREATE TABLE requests (
+    tenant                 text             NOT NULL DEFAULT '',
+    request_id             text             NOT NULL,
+    session_id             text             NOT NULL,
+    user_id                text             NOT NULL,
+    model                  text             NOT NULL,
+    status                 text             NOT NULL,
+    input_tokens           integer          NOT NULL,
+    output_tokens          integer          NOT NULL,
+    total_tokens           integer          NOT NULL,
+    response_time_ms       double precision NOT NULL,
+    time_to_first_token_ms double precision NOT NULL DEFAULT 0,
+    tokens_per_second      double precision NOT NULL DEFAULT 0,
+    cost_usd               numeric(18, 8)   NOT NULL DEFAULT 0,
+    redactions             integer          NOT NULL DEFAULT 0,
+    client_app             text             NOT NULL DEFAULT '',
+    client_app_version     text             NOT NULL DEFAULT '',
+    client_origin          text             NOT NULL DEFAULT '',
+    client_country         text             NOT NULL DEFAULT '',
+    schema_version         integer          NOT NULL,
+    created_at             timestamptz      NOT NULL,
+    PRIMARY KEY (tenant, request_id)
+);
+
+CREATE INDEX requests_created_at_idx ON requests (created_at);
+CREATE INDEX requests_user_created_at_idx ON requests (tenant, user_id, created_at);
+CREATE INDEX requests_model_created_at_idx ON requests (tenant, model, created_at);
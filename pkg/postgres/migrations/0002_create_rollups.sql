@@ -0,0 +1,17 @@
+-- Hourly and daily usage rollups, upserted from the analytics service's Redis
+-- rollups so year-over-year reports can be run after those expire
+CREATE TABLE rollups (
+    tenant        text           NOT NULL DEFAULT '',
+    period        text           NOT NULL CHECK (period IN ('hour', 'day')),
+    period_start  timestamptz    NOT NULL,
+    requests      bigint         NOT NULL,
+    input_tokens  bigint         NOT NULL,
+    output_tokens bigint         NOT NULL,
+    cost_usd      numeric(18, 8) NOT NULL,
+    errors        bigint         NOT NULL,
+    unique_users  bigint         NOT NULL,
+    updated_at    timestamptz    NOT NULL DEFAULT now(),
+    PRIMARY KEY (tenant, period, period_start)
+);
+
+CREATE INDEX rollups_period_start_idx ON rollups (period, period_start);
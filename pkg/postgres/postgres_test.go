@@ -0,0 +1,195 @@
+package postgres
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// exchange is a message the client is expected to send, recorded byte for
+// byte, and the server's reply to it
+type exchange struct {
+	expect string
+	reply  string
+}
+
+// fakeServer connects a Conn to a server playing back exchanges
+func fakeServer(t *testing.T, exchanges ...exchange) *Conn {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() { client.Close() })
+	go func() {
+		defer server.Close()
+		for _, e := range exchanges {
+			got := make([]byte, len(e.expect))
+			if _, err := io.ReadFull(server, got); err != nil {
+				t.Errorf("server read: %v", err)
+				return
+			}
+			if string(got) != e.expect {
+				t.Errorf("client sent %q, want %q", got, e.expect)
+				return
+			}
+			if _, err := server.Write([]byte(e.reply)); err != nil {
+				t.Errorf("server write: %v", err)
+				return
+			}
+		}
+	}()
+	return &Conn{
+		user:     "aiwatch",
+		password: "secret",
+		database: "analytics",
+		conn:     client,
+		reader:   bufio.NewReader(client),
+	}
+}
+
+const (
+	startupMessage = "\x00\x00\x00B\x00\x03\x00\x00user\x00aiwatch\x00database\x00analytics\x00application_name\x00aiwatch\x00\x00"
+	authOK         = "R\x00\x00\x00\x08\x00\x00\x00\x00"
+	parameter      = "S\x00\x00\x00\x18server_version\x0016.2\x00"
+	readyForQuery  = "Z\x00\x00\x00\x05I"
+)
+
+func TestStartup(t *testing.T) {
+	tests := []struct {
+		name      string
+		exchanges []exchange
+	}{
+		{"trust", []exchange{
+			{startupMessage, authOK + parameter + readyForQuery},
+		}},
+		{"cleartext password", []exchange{
+			{startupMessage, "R\x00\x00\x00\x08\x00\x00\x00\x03"},
+			{"p\x00\x00\x00\x0bsecret\x00", authOK + parameter + readyForQuery},
+		}},
+		{"MD5 password", []exchange{
+			{startupMessage, "R\x00\x00\x00\x0c\x00\x00\x00\x05\x01\x02\x03\x04"},
+			{"p\x00\x00\x00(md5332606e18a6211067054d64bced454d8\x00", authOK + readyForQuery},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := fakeServer(t, tt.exchanges...).startup(); err != nil {
+				t.Fatalf("startup() error = %v", err)
+			}
+		})
+	}
+}
+
+func TestStartupErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+	}{
+		{"server error", "E\x00\x00\x00\x33SFATAL\x00C28P01\x00Mpassword authentication failed\x00\x00"},
+		{"unsupported method", "R\x00\x00\x00\x08\x00\x00\x00\x07"},
+		{"no SCRAM mechanism", "R\x00\x00\x00\x15\x00\x00\x00\x0aSCRAM-SHA-1\x00\x00"},
+		{"SASL challenge without SASL", "R\x00\x00\x00\x0c\x00\x00\x00\x0br=ab"},
+		{"short authentication request", "R\x00\x00\x00\x06\x00\x00"},
+		{"invalid length", "R\x00\x00\x00\x02"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := fakeServer(t, exchange{startupMessage, tt.reply}).startup()
+			if err == nil {
+				t.Fatal("startup() succeeded, want an error")
+			}
+		})
+	}
+}
+
+func TestQuery(t *testing.T) {
+	c := fakeServer(t, exchange{
+		"Q\x00\x00\x00\x1bSELECT id, name FROM t\x00",
+		"T\x00\x00\x00\x06\x00\x00" +
+			"D\x00\x00\x00\x0f\x00\x02\x00\x00\x00\x011\xff\xff\xff\xff" +
+			"D\x00\x00\x00\x12\x00\x02\x00\x00\x00\x012\x00\x00\x00\x03two" +
+			"C\x00\x00\x00\x0dSELECT 2\x00" +
+			readyForQuery,
+	})
+	rows, err := c.query("SELECT id, name FROM t")
+	if err != nil {
+		t.Fatalf("query() error = %v", err)
+	}
+	if want := [][]string{{"1", ""}, {"2", "two"}}; !reflect.DeepEqual(rows, want) {
+		t.Errorf("query() = %q, want %q", rows, want)
+	}
+}
+
+func TestQueryError(t *testing.T) {
+	c := fakeServer(t, exchange{
+		"Q\x00\x00\x00\x1bSELECT id, name FROM t\x00",
+		"E\x00\x00\x00\x30SERROR\x00C42P01\x00Mrelation \"t\" does not exist\x00\x00" + readyForQuery,
+	})
+	_, err := c.query("SELECT id, name FROM t")
+	var serverErr *Error
+	if !errors.As(err, &serverErr) {
+		t.Fatalf("query() error = %v, want a server error", err)
+	}
+	want := Error{Severity: "ERROR", Code: "42P01", Message: `relation "t" does not exist`}
+	if *serverErr != want {
+		t.Errorf("query() error = %+v, want %+v", *serverErr, want)
+	}
+}
+
+func TestParseDataRow(t *testing.T) {
+	tests := []struct {
+		name    string
+		msg     string
+		want    []string
+		wantErr bool
+	}{
+		{"values and NULL", "\x00\x03\x00\x00\x00\x01a\xff\xff\xff\xff\x00\x00\x00\x00", []string{"a", "", ""}, false},
+		{"no columns", "\x00\x00", []string{}, false},
+		{"empty", "", nil, true},
+		{"missing column", "\x00\x02\x00\x00\x00\x01a", nil, true},
+		{"value past the end", "\x00\x01\x00\x00\x00\x05abc", nil, true},
+		{"short length", "\x00\x01\x00\x00", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseDataRow([]byte(tt.msg))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseDataRow() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseDataRow() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSend(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	c := &Conn{conn: client}
+	go c.send('X', nil)
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(server, got); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte("X\x00\x00\x00\x04"); !bytes.Equal(got, want) {
+		t.Errorf("send('X') wrote %q, want %q", got, want)
+	}
+}
+
+func TestLiteral(t *testing.T) {
+	tests := map[string]string{
+		"plain":      "'plain'",
+		"it's":       "'it''s'",
+		"a\x00b":     "'ab'",
+		`back\slash`: `'back\slash'`,
+		"'; DROP --": "'''; DROP --'",
+	}
+	for in, want := range tests {
+		if got := Literal(in); got != want {
+			t.Errorf("Literal(%q) = %s, want %s", in, got, want)
+		}
+	}
+}
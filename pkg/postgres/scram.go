@@ -0,0 +1,108 @@
+package postgres
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const scramMechanism = "SCRAM-SHA-256"
+
+// scramClient performs SCRAM-SHA-256 authentication (RFC 5802, RFC 7677)
+// without channel binding. The user name is left empty, as the server takes
+// it from the startup message.
+type scramClient struct {
+	password    string
+	nonce       string
+	clientBare  string
+	authMessage string
+	serverKey   []byte
+}
+
+func newSCRAMClient(password string) *scramClient {
+	nonce := make([]byte, 18)
+	rand.Read(nonce)
+	return &scramClient{password: password, nonce: base64.StdEncoding.EncodeToString(nonce)}
+}
+
+// clientFirst returns the client-first-message
+func (s *scramClient) clientFirst() string {
+	s.clientBare = "n=,r=" + s.nonce
+	return "n,," + s.clientBare
+}
+
+// clientFinal answers the server-first-message with the client proof
+func (s *scramClient) clientFinal(serverFirst string) (string, error) {
+	var nonce, salt string
+	var iterations int
+	for _, attr := range strings.Split(serverFirst, ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			continue
+		}
+		switch attr[0] {
+		case 'r':
+			nonce = attr[2:]
+		case 's':
+			salt = attr[2:]
+		case 'i':
+			iterations, _ = strconv.Atoi(attr[2:])
+		}
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil || !strings.HasPrefix(nonce, s.nonce) || iterations <= 0 {
+		return "", fmt.Errorf("invalid SCRAM server-first-message")
+	}
+
+	salted := pbkdf2SHA256([]byte(s.password), saltBytes, iterations)
+	clientKey := hmacSHA256(salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	s.serverKey = hmacSHA256(salted, "Server Key")
+
+	withoutProof := "c=biws,r=" + nonce
+	s.authMessage = s.clientBare + "," + serverFirst + "," + withoutProof
+	proof := hmacSHA256(storedKey[:], s.authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof), nil
+}
+
+// verifyServer checks the server signature in the server-final-message
+func (s *scramClient) verifyServer(serverFinal string) error {
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(serverFinal, "v="))
+	if err != nil || !strings.HasPrefix(serverFinal, "v=") ||
+		subtle.ConstantTimeCompare(signature, hmacSHA256(s.serverKey, s.authMessage)) != 1 {
+		return fmt.Errorf("invalid SCRAM server signature")
+	}
+	return nil
+}
+
+// pbkdf2SHA256 derives a single-block key, as SCRAM-SHA-256 needs
+func pbkdf2SHA256(password, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write(binary.BigEndian.AppendUint32(nil, 1))
+	u := mac.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,65 @@
+package postgres
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"testing"
+)
+
+// TestSCRAMVector runs the SCRAM-SHA-256 exchange of RFC 7677 section 3.
+// The client leaves the user name empty, so the RFC's client-first-message
+// bare is set directly to reproduce its proof.
+func TestSCRAMVector(t *testing.T) {
+	s := &scramClient{password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+	if got, want := s.clientFirst(), "n,,n=,r=rOprNGfwEbeRWgbNEkqO"; got != want {
+		t.Errorf("clientFirst() = %q, want %q", got, want)
+	}
+	s.clientBare = "n=user,r=rOprNGfwEbeRWgbNEkqO"
+
+	final, err := s.clientFinal("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096")
+	if err != nil {
+		t.Fatalf("clientFinal() error = %v", err)
+	}
+	if want := "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="; final != want {
+		t.Errorf("clientFinal() = %q, want %q", final, want)
+	}
+	if err := s.verifyServer("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="); err != nil {
+		t.Errorf("verifyServer() error = %v", err)
+	}
+	if err := s.verifyServer("v=" + base64.StdEncoding.EncodeToString(make([]byte, 32))); err == nil {
+		t.Error("verifyServer() accepted a wrong server signature")
+	}
+}
+
+func TestSCRAMServerFirstErrors(t *testing.T) {
+	tests := map[string]string{
+		"foreign nonce":   "r=someoneelse,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		"bad salt":        "r=rOprNGfwEbeRWgbNEkqOxyz,s=!!,i=4096",
+		"no iterations":   "r=rOprNGfwEbeRWgbNEkqOxyz,s=W22ZaJ0SNY7soEsUEjb6gQ==",
+		"zero iterations": "r=rOprNGfwEbeRWgbNEkqOxyz,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=0",
+		"empty":           "",
+	}
+	for name, serverFirst := range tests {
+		s := &scramClient{password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"}
+		s.clientFirst()
+		if _, err := s.clientFinal(serverFirst); err == nil {
+			t.Errorf("%s: clientFinal(%q) succeeded, want an error", name, serverFirst)
+		}
+	}
+
+	s := &scramClient{}
+	for _, serverFinal := range []string{"", "e=invalid-proof", "v=!!"} {
+		if err := s.verifyServer(serverFinal); err == nil {
+			t.Errorf("verifyServer(%q) succeeded, want an error", serverFinal)
+		}
+	}
+}
+
+// TestPBKDF2 checks the key derivation against the PBKDF2-HMAC-SHA256
+// vector of RFC 7914 section 11, of which a single block is derived
+func TestPBKDF2(t *testing.T) {
+	got := hex.EncodeToString(pbkdf2SHA256([]byte("passwd"), []byte("salt"), 1))
+	if want := "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"; got != want {
+		t.Errorf("pbkdf2SHA256(passwd, salt, 1) = %s, want %s", got, want)
+	}
+}
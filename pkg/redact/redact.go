@@ -0,0 +1,111 @@
+package redact
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Rule replaces matches of a pattern with a [REDACTED:<name>] marker
+type Rule struct {
+	Name    string
+	Pattern *regexp.Regexp
+	// Validate, if set, filters out matches that are not really PII
+	Validate func(match string) bool
+}
+
+// builtinRules are the rules available by name. Credit cards run before phone
+// numbers so long digit runs are not half-matched as phones.
+var builtinRules = map[string]Rule{
+	"email": {
+		Name:    "email",
+		Pattern: regexp.MustCompile(`[a-zA-Z0-9._%+\-]+@[a-zA-Z0-9.\-]+\.[a-zA-Z]{2,}`),
+	},
+	"credit_card": {
+		Name:     "credit_card",
+		Pattern:  regexp.MustCompile(`\b(?:\d[ \-]?){12,18}\d\b`),
+		Validate: luhnValid,
+	},
+	"phone": {
+		Name:    "phone",
+		Pattern: regexp.MustCompile(`(?:\+\d{1,3}[\s.\-]?)?\(?\b\d{3}\)?[\s.\-]?\d{3}[\s.\-]?\d{4}\b`),
+	},
+}
+
+// DefaultRules lists the built-in rules in the order they are applied
+var DefaultRules = []string{"email", "credit_card", "phone"}
+
+// Redactor scrubs PII from text
+type Redactor struct {
+	rules []Rule
+}
+
+// New creates a redactor applying the named built-in rules followed by the
+// custom patterns, which are keyed by the name used in their marker and
+// applied in name order
+func New(ruleNames []string, customPatterns map[string]string) (*Redactor, error) {
+	r := &Redactor{}
+	for _, name := range ruleNames {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		rule, ok := builtinRules[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown redaction rule %q", name)
+		}
+		r.rules = append(r.rules, rule)
+	}
+	names := make([]string, 0, len(customPatterns))
+	for name := range customPatterns {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		re, err := regexp.Compile(customPatterns[name])
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern for redaction rule %q: %v", name, err)
+		}
+		r.rules = append(r.rules, Rule{Name: name, Pattern: re})
+	}
+	return r, nil
+}
+
+// Redact returns text with PII replaced and the number of redactions applied
+func (r *Redactor) Redact(text string) (string, int) {
+	count := 0
+	for _, rule := range r.rules {
+		marker := fmt.Sprintf("[REDACTED:%s]", rule.Name)
+		text = rule.Pattern.ReplaceAllStringFunc(text, func(match string) string {
+			if rule.Validate != nil && !rule.Validate(match) {
+				return match
+			}
+			count++
+			return marker
+		})
+	}
+	return text, count
+}
+
+// luhnValid reports whether the digits in s pass the Luhn checksum
+func luhnValid(s string) bool {
+	sum, double, digits := 0, false, 0
+	for i := len(s) - 1; i >= 0; i-- {
+		c := s[i]
+		if c < '0' || c > '9' {
+			continue
+		}
+		d := int(c - '0')
+		if double {
+			d *= 2
+			if d > 9 {
+				d -= 9
+			}
+		}
+		sum += d
+		double = !double
+		digits++
+	}
+	return digits >= 13 && sum%10 == 0
+}
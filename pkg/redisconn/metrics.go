@@ -0,0 +1,156 @@
+package redisconn
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/redis/go-redis/v9"
+)
+
+// Instrument exports client's connection pool stats and the latency of the
+// commands it sends, labelled with name so a service's clients can be told
+// apart. Every client instrumented with the same registerer shares its
+// metrics.
+func Instrument(client redis.UniversalClient, name string, registerer prometheus.Registerer) {
+	metrics := newClientMetrics()
+	if err := registerer.Register(metrics); err != nil {
+		var registered prometheus.AlreadyRegisteredError
+		if !errors.As(err, &registered) {
+			panic(err)
+		}
+		metrics = registered.ExistingCollector.(*clientMetrics)
+	}
+	metrics.add(name, client)
+	client.AddHook(metricsHook{name: name, metrics: metrics})
+}
+
+// clientMetrics collects the pool stats of its clients when scraped, and
+// times their commands through metricsHook
+type clientMetrics struct {
+	mu      sync.Mutex
+	clients map[string]redis.UniversalClient
+
+	connections    *prometheus.Desc
+	maxConnections *prometheus.Desc
+	hits           *prometheus.Desc
+	misses         *prometheus.Desc
+	timeouts       *prometheus.Desc
+	stale          *prometheus.Desc
+
+	duration *prometheus.HistogramVec
+	errors   *prometheus.CounterVec
+}
+
+func newClientMetrics() *clientMetrics {
+	return &clientMetrics{
+		clients: make(map[string]redis.UniversalClient),
+		connections: prometheus.NewDesc("redis_pool_connections",
+			"Connections in the Redis client pool, by whether they are in use or idle",
+			[]string{"client", "state"}, nil),
+		maxConnections: prometheus.NewDesc("redis_pool_max_connections",
+			"Most connections the Redis client pool opens before commands wait for one",
+			[]string{"client"}, nil),
+		hits: prometheus.NewDesc("redis_pool_hits_total",
+			"Times a command found an idle connection in the pool",
+			[]string{"client"}, nil),
+		misses: prometheus.NewDesc("redis_pool_misses_total",
+			"Times a command found no idle connection and dialed or waited for one",
+			[]string{"client"}, nil),
+		timeouts: prometheus.NewDesc("redis_pool_timeouts_total",
+			"Times a command gave up waiting for a connection",
+			[]string{"client"}, nil),
+		stale: prometheus.NewDesc("redis_pool_stale_connections_total",
+			"Connections closed for being idle or old",
+			[]string{"client"}, nil),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "redis_command_duration_seconds",
+			Help:    "Time Redis commands took, including waiting for a connection; pipelines are timed as one",
+			Buckets: []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1},
+		}, []string{"client", "command"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "redis_command_errors_total",
+			Help: "Redis commands that failed, not counting missing keys",
+		}, []string{"client", "command"}),
+	}
+}
+
+// add includes client's pool in the collected stats
+func (m *clientMetrics) add(name string, client redis.UniversalClient) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.clients[name] = client
+}
+
+// observe records a command, or a pipeline, that started at start
+func (m *clientMetrics) observe(client, command string, start time.Time, err error) {
+	m.duration.WithLabelValues(client, command).Observe(time.Since(start).Seconds())
+	if err != nil && err != redis.Nil {
+		m.errors.WithLabelValues(client, command).Inc()
+	}
+}
+
+// Describe implements prometheus.Collector
+func (m *clientMetrics) Describe(ch chan<- *prometheus.Desc) {
+	ch <- m.connections
+	ch <- m.maxConnections
+	ch <- m.hits
+	ch <- m.misses
+	ch <- m.timeouts
+	ch <- m.stale
+	m.duration.Describe(ch)
+	m.errors.Describe(ch)
+}
+
+// Collect implements prometheus.Collector
+func (m *clientMetrics) Collect(ch chan<- prometheus.Metric) {
+	m.mu.Lock()
+	for name, client := range m.clients {
+		stats := client.PoolStats()
+		inUse := max(int64(stats.TotalConns)-int64(stats.IdleConns), 0)
+		ch <- prometheus.MustNewConstMetric(m.connections, prometheus.GaugeValue, float64(inUse), name, "in_use")
+		ch <- prometheus.MustNewConstMetric(m.connections, prometheus.GaugeValue, float64(stats.IdleConns), name, "idle")
+		ch <- prometheus.MustNewConstMetric(m.hits, prometheus.CounterValue, float64(stats.Hits), name)
+		ch <- prometheus.MustNewConstMetric(m.misses, prometheus.CounterValue, float64(stats.Misses), name)
+		ch <- prometheus.MustNewConstMetric(m.timeouts, prometheus.CounterValue, float64(stats.Timeouts), name)
+		ch <- prometheus.MustNewConstMetric(m.stale, prometheus.CounterValue, float64(stats.StaleConns), name)
+		// Cluster and ring clients have a pool per node, with no single size
+		if c, ok := client.(*redis.Client); ok {
+			ch <- prometheus.MustNewConstMetric(m.maxConnections, prometheus.GaugeValue, float64(c.Options().PoolSize), name)
+		}
+	}
+	m.mu.Unlock()
+	m.duration.Collect(ch)
+	m.errors.Collect(ch)
+}
+
+// metricsHook implements redis.Hook, timing commands for clientMetrics
+type metricsHook struct {
+	name    string
+	metrics *clientMetrics
+}
+
+func (metricsHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h metricsHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmd)
+		h.metrics.observe(h.name, strings.ToLower(cmd.Name()), start, err)
+		return err
+	}
+}
+
+func (h metricsHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		start := time.Now()
+		err := next(ctx, cmds)
+		h.metrics.observe(h.name, "pipeline", start, err)
+		return err
+	}
+}
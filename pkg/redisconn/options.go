@@ -0,0 +1,143 @@
+package redisconn
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Options selects how to reach Redis: the server at Addr, or the master
+// named MasterName through the Sentinels at SentinelAddrs, either of them
+// optionally over TLS. Redis Cluster is not an option, because capture and
+// analytics update keys in different hash slots in one transaction or Lua
+// script; only the timeseries series store can be a cluster.
+type Options struct {
+	Addr     string
+	Password string
+	DB       int
+
+	SentinelAddrs    []string
+	MasterName       string
+	SentinelPassword string
+
+	// TLS, when set, encrypts connections to Redis and the Sentinels
+	TLS *tls.Config
+
+	// Protocol is the RESP version, 3 when zero
+	Protocol int
+}
+
+// OptionsFromEnv reads the connection options shared by the services:
+//   - REDIS_ADDR (default localhost:6379), REDIS_PASSWORD and REDIS_DB
+//   - REDIS_SENTINEL_ADDRS, a comma-separated list, REDIS_SENTINEL_MASTER
+//     and REDIS_SENTINEL_PASSWORD to find the master through Sentinel
+//   - REDIS_TLS=true, with REDIS_TLS_CA_FILE, REDIS_TLS_CERT_FILE and
+//     REDIS_TLS_KEY_FILE, REDIS_TLS_SERVER_NAME and
+//     REDIS_TLS_INSECURE_SKIP_VERIFY, to connect over TLS
+func OptionsFromEnv() (Options, error) {
+	options := Options{
+		Addr:             getEnv("REDIS_ADDR", "localhost:6379"),
+		Password:         os.Getenv("REDIS_PASSWORD"),
+		MasterName:       os.Getenv("REDIS_SENTINEL_MASTER"),
+		SentinelPassword: os.Getenv("REDIS_SENTINEL_PASSWORD"),
+	}
+	if db := os.Getenv("REDIS_DB"); db != "" {
+		var err error
+		if options.DB, err = strconv.Atoi(db); err != nil {
+			return options, fmt.Errorf("invalid REDIS_DB %q", db)
+		}
+	}
+
+	for _, addr := range strings.Split(os.Getenv("REDIS_SENTINEL_ADDRS"), ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			options.SentinelAddrs = append(options.SentinelAddrs, addr)
+		}
+	}
+	if len(options.SentinelAddrs) > 0 && options.MasterName == "" {
+		return options, fmt.Errorf("REDIS_SENTINEL_MASTER is required with REDIS_SENTINEL_ADDRS")
+	}
+
+	if enabled, _ := strconv.ParseBool(os.Getenv("REDIS_TLS")); enabled {
+		config, err := tlsConfig(os.Getenv("REDIS_TLS_CA_FILE"), os.Getenv("REDIS_TLS_CERT_FILE"),
+			os.Getenv("REDIS_TLS_KEY_FILE"))
+		if err != nil {
+			return options, err
+		}
+		config.ServerName = os.Getenv("REDIS_TLS_SERVER_NAME")
+		config.InsecureSkipVerify, _ = strconv.ParseBool(os.Getenv("REDIS_TLS_INSECURE_SKIP_VERIFY"))
+		options.TLS = config
+	}
+	return options, nil
+}
+
+// tlsConfig trusts the CA certificates in caFile, or the system ones when
+// it is empty, and presents the client certificate in certFile and keyFile
+// when they are set
+func tlsConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read Redis CA file: %v", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in Redis CA file %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load Redis client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
+
+// NewClient creates a client for the configured server or Sentinel master.
+// It does not contact Redis.
+func (o Options) NewClient() *redis.Client {
+	if len(o.SentinelAddrs) > 0 {
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       o.MasterName,
+			SentinelAddrs:    o.SentinelAddrs,
+			SentinelPassword: o.SentinelPassword,
+			Password:         o.Password,
+			DB:               o.DB,
+			TLSConfig:        o.TLS,
+			Protocol:         o.Protocol,
+		})
+	}
+	return redis.NewClient(&redis.Options{
+		Addr:      o.Addr,
+		Password:  o.Password,
+		DB:        o.DB,
+		TLSConfig: o.TLS,
+		Protocol:  o.Protocol,
+	})
+}
+
+// String describes where the options connect, for logs
+func (o Options) String() string {
+	where := o.Addr
+	if len(o.SentinelAddrs) > 0 {
+		where = fmt.Sprintf("master %s via Sentinel %s", o.MasterName, strings.Join(o.SentinelAddrs, ","))
+	}
+	if o.TLS != nil {
+		where += " over TLS"
+	}
+	return where
+}
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
@@ -0,0 +1,193 @@
+// Package redisconn waits for Redis at startup and tracks whether it stays
+// reachable, so services can start before Redis and ride out restarts in a
+// degraded mode instead of exiting.
+package redisconn
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/redis/go-redis/v9"
+)
+
+// Backoff between connection attempts while waiting for Redis
+const (
+	initialBackoff = 250 * time.Millisecond
+	maxBackoff     = 5 * time.Second
+)
+
+// Wait pings Redis until it answers or timeout elapses, backing off
+// exponentially between attempts, and returns the last error if it never
+// answered. A timeout of zero makes a single attempt. The client reconnects
+// by itself once Redis is reachable, so callers may carry on degraded.
+func Wait(ctx context.Context, client *redis.Client, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	backoff := initialBackoff
+	for {
+		err := client.Ping(ctx).Err()
+		if err == nil {
+			return nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return err
+		}
+		if backoff > remaining {
+			backoff = remaining
+		}
+		logger.Component("redis").Warn().Err(err).Str("addr", client.Options().Addr).Dur("backoff", backoff).Msg("Redis unavailable, retrying")
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// Monitor pings Redis every interval and records whether it is reachable.
+// Each time Redis becomes reachable again its generation is incremented and
+// the reconnect callbacks run, so state lost in a Redis restart can be
+// rebuilt.
+type Monitor struct {
+	client     *redis.Client
+	interval   time.Duration
+	available  atomic.Bool
+	generation atomic.Uint64
+
+	mu          sync.Mutex
+	onReconnect []func()
+
+	closeOnce sync.Once
+	stop      chan struct{}
+	done      chan struct{}
+
+	upGauge          prometheus.Gauge
+	reconnectCounter prometheus.Counter
+}
+
+// NewMonitor starts monitoring client every interval. available is whether
+// Redis answered at startup. Its metrics are registered with registerer.
+func NewMonitor(client *redis.Client, available bool, interval time.Duration, registerer prometheus.Registerer) *Monitor {
+	if interval <= 0 {
+		interval = 5 * time.Second
+	}
+
+	factory := promauto.With(registerer)
+	m := &Monitor{
+		client:   client,
+		interval: interval,
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		upGauge: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "redis_connection_up",
+			Help: "Whether Redis answered the last health check",
+		}),
+		reconnectCounter: factory.NewCounter(prometheus.CounterOpts{
+			Name: "redis_reconnects_total",
+			Help: "Times Redis became reachable again after being unavailable",
+		}),
+	}
+	m.setAvailable(available)
+
+	go m.run()
+
+	return m
+}
+
+// Available reports whether Redis answered the last health check. A nil
+// monitor reports Redis as available.
+func (m *Monitor) Available() bool {
+	return m == nil || m.available.Load()
+}
+
+// Ping checks Redis now, without waiting for the next health check or
+// changing the monitor's state
+func (m *Monitor) Ping(ctx context.Context) error {
+	return m.client.Ping(ctx).Err()
+}
+
+// Generation is incremented each time Redis becomes reachable again
+func (m *Monitor) Generation() uint64 {
+	if m == nil {
+		return 0
+	}
+	return m.generation.Load()
+}
+
+// OnReconnect registers a callback run, on the monitor's goroutine, each
+// time Redis becomes reachable again
+func (m *Monitor) OnReconnect(callback func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onReconnect = append(m.onReconnect, callback)
+}
+
+// Close stops monitoring
+func (m *Monitor) Close() {
+	m.closeOnce.Do(func() {
+		close(m.stop)
+		<-m.done
+	})
+}
+
+func (m *Monitor) setAvailable(available bool) {
+	m.available.Store(available)
+	if available {
+		m.upGauge.Set(1)
+	} else {
+		m.upGauge.Set(0)
+	}
+}
+
+// run checks Redis every interval until Close is called
+func (m *Monitor) run() {
+	defer close(m.done)
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			m.check()
+		case <-m.stop:
+			return
+		}
+	}
+}
+
+// check pings Redis and handles changes in its availability
+func (m *Monitor) check() {
+	ctx, cancel := context.WithTimeout(context.Background(), m.interval)
+	err := m.client.Ping(ctx).Err()
+	cancel()
+
+	was := m.available.Load()
+	m.setAvailable(err == nil)
+	switch {
+	case err != nil && was:
+		logger.Component("redis").Error().Err(err).Str("addr", m.client.Options().Addr).Msg("Redis became unavailable, running degraded")
+	case err == nil && !was:
+		logger.Component("redis").Info().Str("addr", m.client.Options().Addr).Msg("Redis is available again")
+		m.generation.Add(1)
+		m.reconnectCounter.Inc()
+
+		m.mu.Lock()
+		callbacks := append([]func(){}, m.onReconnect...)
+		m.mu.Unlock()
+		for _, callback := range callbacks {
+			callback()
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package s3
+
+import (
+	"encoding/hex"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// Credentials used throughout the AWS Signature Version 4 examples
+const (
+	exampleAccessKey = "AKIDEXAMPLE"
+	exampleSecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+	emptyHash        = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+)
+
+func TestSigningKey(t *testing.T) {
+	// From the AWS documentation on deriving a signing key
+	got := hex.EncodeToString(signingKey(exampleSecretKey, "20120215", "us-east-1", "iam"))
+	if want := "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d"; got != want {
+		t.Errorf("signingKey() = %s, want %s", got, want)
+	}
+}
+
+func TestSignatureVectors(t *testing.T) {
+	tests := []struct {
+		name             string
+		secretKey        string
+		amzDate          string
+		region, service  string
+		canonicalRequest string
+		want             string
+	}{
+		{
+			// get-vanilla from the Signature Version 4 test suite
+			name:      "get-vanilla",
+			secretKey: exampleSecretKey,
+			amzDate:   "20150830T123600Z",
+			region:    "us-east-1",
+			service:   "service",
+			canonicalRequest: "GET\n/\n\n" +
+				"host:example.amazonaws.com\n" +
+				"x-amz-date:20150830T123600Z\n\n" +
+				"host;x-amz-date\n" +
+				emptyHash,
+			want: "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31",
+		},
+		{
+			// The GET Object example of the S3 Signature Version 4 documentation
+			name:      "s3 get object",
+			secretKey: "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY",
+			amzDate:   "20130524T000000Z",
+			region:    "us-east-1",
+			service:   "s3",
+			canonicalRequest: "GET\n/test.txt\n\n" +
+				"host:examplebucket.s3.amazonaws.com\n" +
+				"range:bytes=0-9\n" +
+				"x-amz-content-sha256:" + emptyHash + "\n" +
+				"x-amz-date:20130524T000000Z\n\n" +
+				"host;range;x-amz-content-sha256;x-amz-date\n" +
+				emptyHash,
+			want: "f0e8bdb87c964420e857bd35b5d6ed310bd44f0170aba48dd91039c6036bdb41",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			date := tt.amzDate[:8]
+			scope := date + "/" + tt.region + "/" + tt.service + "/aws4_request"
+			key := signingKey(tt.secretKey, date, tt.region, tt.service)
+			if got := signature(key, tt.amzDate, scope, tt.canonicalRequest); got != tt.want {
+				t.Errorf("signature() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSign(t *testing.T) {
+	c, err := NewClient(Config{
+		Endpoint:  "http://minio:9000",
+		Bucket:    "exports",
+		AccessKey: exampleAccessKey,
+		SecretKey: exampleSecretKey,
+		PathStyle: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest(http.MethodPut, "http://minio:9000/", nil)
+	req.Host = "minio:9000"
+	req.Header.Set("Content-Type", "application/octet-stream")
+	c.sign(req, "/exports/tenants/acme/2015-08-30 users.parquet", []byte("hello"), time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	want := map[string]string{
+		"X-Amz-Date":           "20150830T123600Z",
+		"X-Amz-Content-Sha256": "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824",
+		"Authorization": "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/s3/aws4_request, " +
+			"SignedHeaders=content-type;host;x-amz-content-sha256;x-amz-date, " +
+			"Signature=6fc4e7c32ab67ffbf843a9be38929730ac4b0c33db408434d885fa76ce349d17",
+	}
+	for header, value := range want {
+		if got := req.Header.Get(header); got != value {
+			t.Errorf("%s = %q, want %q", header, got, value)
+		}
+	}
+}
+
+func TestEscapePath(t *testing.T) {
+	tests := map[string]string{
+		"/bucket/key.parquet":    "/bucket/key.parquet",
+		"/a b/c+d":               "/a%20b/c%2Bd",
+		"/test$file.text":        "/test%24file.text",
+		"/~user/_x-y":            "/~user/_x-y",
+		"/café":                  "/caf%C3%A9",
+		"/tenant=acme/date=2024": "/tenant%3Dacme/date%3D2024",
+	}
+	for path, want := range tests {
+		if got := escapePath(path); got != want {
+			t.Errorf("escapePath(%q) = %q, want %q", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,249 @@
+// Package slo tracks per-endpoint latency and availability objectives and
+// exports how fast their error budgets burn, so multi-window burn rate
+// alerts need no recording rules
+package slo
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/alerting"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Objective types
+const (
+	// Availability counts requests answered without a 5xx status as good
+	Availability = "availability"
+	// Latency counts requests answered within the threshold as good
+	Latency = "latency"
+)
+
+// maxWindow bounds the longest window, and so the requests kept per objective
+const maxWindow = 30 * 24 * time.Hour
+
+// defaultWindows are the short and long windows of the multi-window,
+// multi-burn-rate alerts of the SRE workbook
+var defaultWindows = []time.Duration{
+	5 * time.Minute, 30 * time.Minute, time.Hour, 2 * time.Hour, 6 * time.Hour, 24 * time.Hour, 72 * time.Hour,
+}
+
+// Objective is the share of an endpoint's requests that must be good
+type Objective struct {
+	Name     string `json:"name"`
+	Endpoint string `json:"endpoint"`
+	// Method narrows the objective to one HTTP method
+	Method string  `json:"method,omitempty"`
+	Type   string  `json:"type"`
+	Target float64 `json:"target"`
+	// Threshold is the response time a latency objective allows
+	Threshold alerting.Duration `json:"threshold,omitempty"`
+}
+
+// good reports whether a request meets the objective
+func (o Objective) good(status int, duration time.Duration) bool {
+	if o.Type == Latency {
+		return duration <= o.Threshold.Duration
+	}
+	return status < 500
+}
+
+// Config is the objectives read from an SLO config file
+type Config struct {
+	Objectives []Objective `json:"objectives"`
+	// Windows are the windows burn rates are exported for. The longest is
+	// also the period of the error budget.
+	Windows []alerting.Duration `json:"windows,omitempty"`
+}
+
+// LoadConfig reads and validates a JSON SLO config. Objective names must be
+// unique; windows default to 5m, 30m, 1h, 2h, 6h, 24h and 72h.
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("invalid SLO config: %v", err)
+	}
+
+	names := make(map[string]bool)
+	for i, objective := range config.Objectives {
+		if objective.Name == "" || !strings.HasPrefix(objective.Endpoint, "/") {
+			return nil, fmt.Errorf("objective %d requires a name and an endpoint path", i)
+		}
+		if names[objective.Name] {
+			return nil, fmt.Errorf("duplicate objective name %q", objective.Name)
+		}
+		names[objective.Name] = true
+		if objective.Type != Availability && objective.Type != Latency {
+			return nil, fmt.Errorf("objective %q: invalid type %q, expected availability or latency", objective.Name, objective.Type)
+		}
+		if objective.Target <= 0 || objective.Target >= 1 {
+			return nil, fmt.Errorf("objective %q: target must be between 0 and 1", objective.Name)
+		}
+		if objective.Type == Latency && objective.Threshold.Duration <= 0 {
+			return nil, fmt.Errorf("objective %q: latency objectives require a threshold", objective.Name)
+		}
+	}
+	for _, window := range config.Windows {
+		if window.Duration < time.Minute || window.Duration > maxWindow {
+			return nil, fmt.Errorf("window %s must be between 1m and %s", window.Duration, maxWindow)
+		}
+	}
+	return &config, nil
+}
+
+// bucket counts one minute's requests
+type bucket struct {
+	minute int64
+	total  uint64
+	bad    uint64
+}
+
+// series holds an objective's per-minute counts for the longest window
+type series struct {
+	objective Objective
+	buckets   []bucket
+}
+
+// count adds the requests of the windows ending at minute now to totals
+// and bads, indexed like windows
+func (s *series) count(now int64, windows []time.Duration, totals, bads []uint64) {
+	for _, b := range s.buckets {
+		if b.total == 0 {
+			continue
+		}
+		for i, window := range windows {
+			if now-b.minute < int64(window/time.Minute) {
+				totals[i] += b.total
+				bads[i] += b.bad
+			}
+		}
+	}
+}
+
+// Tracker counts requests against the objectives of their endpoints and
+// exports burn rates when scraped. Counts are kept in memory, so each
+// replica reports on its own requests and a restart starts afresh.
+type Tracker struct {
+	windows []time.Duration
+	series  []*series
+	now     func() time.Time
+
+	mu sync.Mutex
+
+	burnRate        *prometheus.Desc
+	budgetRemaining *prometheus.Desc
+	target          *prometheus.Desc
+}
+
+// NewTracker creates a tracker for config's objectives. Its metrics are
+// registered with registerer.
+func NewTracker(config *Config, registerer prometheus.Registerer) *Tracker {
+	windows := defaultWindows
+	if len(config.Windows) > 0 {
+		windows = nil
+		for _, window := range config.Windows {
+			windows = append(windows, window.Duration.Truncate(time.Minute))
+		}
+		slices.Sort(windows)
+		windows = slices.Compact(windows)
+	}
+	period := windows[len(windows)-1]
+
+	t := &Tracker{
+		windows: windows,
+		now:     time.Now,
+		burnRate: prometheus.NewDesc("genai_app_slo_burn_rate",
+			"Rate the objective's error budget is spent over the window; 1 spends it exactly over the SLO period",
+			[]string{"slo", "window"}, nil),
+		budgetRemaining: prometheus.NewDesc("genai_app_slo_error_budget_remaining",
+			"Share of the error budget left over the longest window, negative once overspent",
+			[]string{"slo"}, nil),
+		target: prometheus.NewDesc("genai_app_slo_target",
+			"Share of requests that must be good",
+			[]string{"slo", "type", "endpoint"}, nil),
+	}
+	for _, objective := range config.Objectives {
+		t.series = append(t.series, &series{
+			objective: objective,
+			buckets:   make([]bucket, period/time.Minute),
+		})
+	}
+	registerer.MustRegister(t)
+	return t
+}
+
+// Observe counts a request against the objectives of its endpoint
+func (t *Tracker) Observe(method, path string, status int, duration time.Duration) {
+	minute := t.now().Unix() / 60
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, s := range t.series {
+		if s.objective.Endpoint != path || (s.objective.Method != "" && s.objective.Method != method) {
+			continue
+		}
+		b := &s.buckets[minute%int64(len(s.buckets))]
+		if b.minute != minute {
+			*b = bucket{minute: minute}
+		}
+		b.total++
+		if !s.objective.good(status, duration) {
+			b.bad++
+		}
+	}
+}
+
+// Describe implements prometheus.Collector
+func (t *Tracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- t.burnRate
+	ch <- t.budgetRemaining
+	ch <- t.target
+}
+
+// Collect implements prometheus.Collector
+func (t *Tracker) Collect(ch chan<- prometheus.Metric) {
+	now := t.now().Unix() / 60
+	totals := make([]uint64, len(t.windows))
+	bads := make([]uint64, len(t.windows))
+	for _, s := range t.series {
+		clear(totals)
+		clear(bads)
+		t.mu.Lock()
+		s.count(now, t.windows, totals, bads)
+		t.mu.Unlock()
+
+		objective := s.objective
+		budget := 1 - objective.Target
+		for i, window := range t.windows {
+			burn := 0.0
+			if totals[i] > 0 {
+				burn = float64(bads[i]) / float64(totals[i]) / budget
+			}
+			ch <- prometheus.MustNewConstMetric(t.burnRate, prometheus.GaugeValue, burn, objective.Name, formatWindow(window))
+			if i == len(t.windows)-1 {
+				ch <- prometheus.MustNewConstMetric(t.budgetRemaining, prometheus.GaugeValue, 1-burn, objective.Name)
+			}
+		}
+		ch <- prometheus.MustNewConstMetric(t.target, prometheus.GaugeValue, objective.Target, objective.Name, objective.Type, objective.Endpoint)
+	}
+}
+
+// formatWindow names a window as Prometheus range selectors do, such as
+// 5m, 6h or 3d
+func formatWindow(window time.Duration) string {
+	switch {
+	case window%(24*time.Hour) == 0:
+		return fmt.Sprintf("%dd", window/(24*time.Hour))
+	case window%time.Hour == 0:
+		return fmt.Sprintf("%dh", window/time.Hour)
+	}
+	return fmt.Sprintf("%dm", window/time.Minute)
+}
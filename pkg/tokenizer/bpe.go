@@ -0,0 +1,163 @@
+package tokenizer
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Pre-tokenization patterns used by the supported encodings. RE2 has no
+// lookahead, so the trailing `\s+(?!\S)` alternative of the upstream
+// patterns is emulated in splitPieces.
+var (
+	cl100kPattern = regexp.MustCompile(`^(?:(?i:'s|'t|'re|'ve|'m|'ll|'d)|[^\r\n\p{L}\p{N}]?\p{L}+|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n]*|\s*[\r\n]+|\s+)`)
+
+	o200kPattern = regexp.MustCompile(`^(?:[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]*[\p{Ll}\p{Lm}\p{Lo}\p{M}]+(?i:'s|'t|'re|'ve|'m|'ll|'d)?|[^\r\n\p{L}\p{N}]?[\p{Lu}\p{Lt}\p{Lm}\p{Lo}\p{M}]+[\p{Ll}\p{Lm}\p{Lo}\p{M}]*(?i:'s|'t|'re|'ve|'m|'ll|'d)?|\p{N}{1,3}| ?[^\s\p{L}\p{N}]+[\r\n/]*|\s*[\r\n]+|\s+)`)
+)
+
+// patternForEncoding returns the pre-tokenization pattern for an encoding
+func patternForEncoding(encoding string) *regexp.Regexp {
+	if encoding == "o200k_base" {
+		return o200kPattern
+	}
+	return cl100kPattern
+}
+
+// BPE is a byte-level byte-pair-encoding tokenizer using tiktoken rank files
+type BPE struct {
+	name    string
+	ranks   map[string]int
+	pattern *regexp.Regexp
+}
+
+// LoadBPE reads a tiktoken rank file ("<base64 token> <rank>" per line)
+func LoadBPE(name string, r io.Reader) (*BPE, error) {
+	ranks := make(map[string]int)
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid rank line %q", line)
+		}
+		token, err := base64.StdEncoding.DecodeString(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid token %q: %v", fields[0], err)
+		}
+		rank, err := strconv.Atoi(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid rank %q: %v", fields[1], err)
+		}
+		ranks[string(token)] = rank
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(ranks) == 0 {
+		return nil, fmt.Errorf("no ranks found")
+	}
+
+	return &BPE{
+		name:    name,
+		ranks:   ranks,
+		pattern: patternForEncoding(name),
+	}, nil
+}
+
+// Name returns the encoding name
+func (b *BPE) Name() string {
+	return b.name
+}
+
+// CountTokens returns the number of BPE tokens in text
+func (b *BPE) CountTokens(text string) int {
+	count := 0
+	for _, piece := range splitPieces(b.pattern, text) {
+		if _, ok := b.ranks[piece]; ok {
+			count++
+			continue
+		}
+		count += b.mergeCount(piece)
+	}
+	return count
+}
+
+// mergeCount applies byte-pair merges to a piece and returns the resulting
+// number of tokens
+func (b *BPE) mergeCount(piece string) int {
+	// parts holds the start offsets of the current tokens within piece
+	parts := make([]int, len(piece)+1)
+	for i := range parts {
+		parts[i] = i
+	}
+
+	for len(parts) > 2 {
+		best, bestRank := -1, math.MaxInt
+		for i := 0; i < len(parts)-2; i++ {
+			if rank, ok := b.ranks[piece[parts[i]:parts[i+2]]]; ok && rank < bestRank {
+				best, bestRank = i, rank
+			}
+		}
+		if best < 0 {
+			break
+		}
+		parts = append(parts[:best+1], parts[best+2:]...)
+	}
+
+	return len(parts) - 1
+}
+
+// splitPieces splits text into pre-tokenization pieces. A whitespace run
+// followed by non-whitespace gives up its last character to the next piece,
+// matching the `\s+(?!\S)` rule of the upstream patterns.
+func splitPieces(pattern *regexp.Regexp, text string) []string {
+	var pieces []string
+	for len(text) > 0 {
+		loc := pattern.FindStringIndex(text)
+		end := 0
+		if loc != nil {
+			end = loc[1]
+		}
+		if end == 0 {
+			// Should not happen with the patterns above; consume one rune
+			_, size := utf8.DecodeRuneInString(text)
+			end = size
+		}
+
+		match := text[:end]
+		if end < len(text) && isTrailingSpaceRun(match) {
+			_, size := utf8.DecodeLastRuneInString(match)
+			if size < len(match) {
+				end -= size
+				match = text[:end]
+			}
+		}
+
+		pieces = append(pieces, match)
+		text = text[end:]
+	}
+	return pieces
+}
+
+// isTrailingSpaceRun reports whether s is a whitespace run that was matched
+// by the plain `\s+` alternative rather than the newline one
+func isTrailingSpaceRun(s string) bool {
+	for _, r := range s {
+		if !unicode.IsSpace(r) {
+			return false
+		}
+	}
+	last, _ := utf8.DecodeLastRuneInString(s)
+	return last != '\n' && last != '\r'
+}
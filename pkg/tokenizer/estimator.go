@@ -0,0 +1,30 @@
+package tokenizer
+
+import "strings"
+
+// bytesPerToken approximates how many bytes of a single word or number the
+// common BPE vocabularies fold into one token
+const bytesPerToken = 6
+
+// Estimator approximates token counts when no vocabulary is available. It
+// splits text the same way the BPE tokenizers do and charges one token per
+// bytesPerToken bytes of each piece, ignoring the leading space that BPE
+// vocabularies merge into the following word.
+type Estimator struct{}
+
+// Name returns the estimator name
+func (e *Estimator) Name() string {
+	return "estimate"
+}
+
+// CountTokens returns the estimated number of tokens in text
+func (e *Estimator) CountTokens(text string) int {
+	count := 0
+	for _, piece := range splitPieces(cl100kPattern, text) {
+		if trimmed := strings.TrimPrefix(piece, " "); trimmed != "" {
+			piece = trimmed
+		}
+		count += (len(piece) + bytesPerToken - 1) / bytesPerToken
+	}
+	return count
+}
@@ -0,0 +1,102 @@
+package tokenizer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/ajeetraina/genai-app-demo/pkg/logger"
+)
+
+// Tokenizer counts the tokens a model would see for a piece of text
+type Tokenizer interface {
+	// Name identifies the encoding used to count tokens
+	Name() string
+	// CountTokens returns the number of tokens in text
+	CountTokens(text string) int
+}
+
+// family maps model name fragments to the BPE encoding they use
+type family struct {
+	patterns []string
+	encoding string
+}
+
+// families is checked in order, so more specific patterns come first
+var families = []family{
+	{patterns: []string{"gpt-4o", "gpt-4.1", "o1", "o3", "o4"}, encoding: "o200k_base"},
+	{patterns: []string{"gpt-4", "gpt-3.5", "text-embedding"}, encoding: "cl100k_base"},
+	{patterns: []string{"llama3", "llama-3"}, encoding: "llama3"},
+}
+
+// Registry selects and caches a tokenizer per model. Encodings are loaded
+// from "<encoding>.tiktoken" files in dir; models without a known family or
+// whose encoding file is missing fall back to an Estimator.
+type Registry struct {
+	dir       string
+	mu        sync.Mutex
+	encodings map[string]Tokenizer
+	fallback  Tokenizer
+}
+
+// NewRegistry creates a registry that loads encoding files from dir
+func NewRegistry(dir string) *Registry {
+	return &Registry{
+		dir:       dir,
+		encodings: make(map[string]Tokenizer),
+		fallback:  &Estimator{},
+	}
+}
+
+// ForModel returns the tokenizer to use for the given model name
+func (r *Registry) ForModel(model string) Tokenizer {
+	encoding := encodingForModel(model)
+	if encoding == "" || r.dir == "" {
+		return r.fallback
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if tok, ok := r.encodings[encoding]; ok {
+		return tok
+	}
+
+	tok := r.fallback
+	path := filepath.Join(r.dir, encoding+".tiktoken")
+	if f, err := os.Open(path); err == nil {
+		bpe, err := LoadBPE(encoding, f)
+		f.Close()
+		if err != nil {
+			logger.Component("tokenizer").Error().Err(err).Str("path", path).Msg("Failed to load tokenizer")
+		} else {
+			tok = bpe
+		}
+	} else if !os.IsNotExist(err) {
+		logger.Component("tokenizer").Error().Err(err).Str("path", path).Msg("Failed to open tokenizer")
+	}
+
+	// Cache the fallback too so a missing file is only looked up once
+	r.encodings[encoding] = tok
+	return tok
+}
+
+// encodingForModel returns the encoding name for a model, or "" if unknown
+func encodingForModel(model string) string {
+	name := strings.ToLower(model)
+	// Strip registry prefixes such as "ai/" used by Docker Model Runner
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		name = name[i+1:]
+	}
+	name = strings.ReplaceAll(name, ".", "")
+
+	for _, f := range families {
+		for _, pattern := range f.patterns {
+			if strings.HasPrefix(name, strings.ReplaceAll(pattern, ".", "")) {
+				return f.encoding
+			}
+		}
+	}
+	return ""
+}
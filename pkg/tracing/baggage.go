@@ -0,0 +1,64 @@
+package tracing
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Baggage members identifying who a request is for, named after the
+// OpenTelemetry user and session attributes
+const (
+	UserIDKey    = "user.id"
+	SessionIDKey = "session.id"
+)
+
+// userBaggageKeys are the baggage members copied onto every span
+var userBaggageKeys = []string{UserIDKey, SessionIDKey}
+
+// WithUser returns ctx carrying userID and sessionID as baggage, so they
+// reach the spans and logs of this request and, through the baggage header,
+// of the services it calls. Empty IDs leave the current value in place.
+func WithUser(ctx context.Context, userID, sessionID string) context.Context {
+	bag := baggage.FromContext(ctx)
+	for key, value := range map[string]string{UserIDKey: userID, SessionIDKey: sessionID} {
+		if value == "" {
+			continue
+		}
+		member, err := baggage.NewMemberRaw(key, value)
+		if err != nil {
+			continue
+		}
+		if updated, err := bag.SetMember(member); err == nil {
+			bag = updated
+		}
+	}
+	return baggage.ContextWithBaggage(ctx, bag)
+}
+
+// UserFromContext returns the user and session IDs carried as baggage in
+// ctx, empty when absent
+func UserFromContext(ctx context.Context) (userID, sessionID string) {
+	bag := baggage.FromContext(ctx)
+	return bag.Member(UserIDKey).Value(), bag.Member(SessionIDKey).Value()
+}
+
+// baggageSpanProcessor sets the user and session baggage of the context a
+// span starts in as attributes of the span, so traces can be searched by
+// user without each span adding them
+type baggageSpanProcessor struct{}
+
+func (baggageSpanProcessor) OnStart(ctx context.Context, span trace.ReadWriteSpan) {
+	bag := baggage.FromContext(ctx)
+	for _, key := range userBaggageKeys {
+		if value := bag.Member(key).Value(); value != "" {
+			span.SetAttributes(attribute.String(key, value))
+		}
+	}
+}
+
+func (baggageSpanProcessor) OnEnd(trace.ReadOnlySpan)         {}
+func (baggageSpanProcessor) Shutdown(context.Context) error   { return nil }
+func (baggageSpanProcessor) ForceFlush(context.Context) error { return nil }
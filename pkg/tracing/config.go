@@ -0,0 +1,154 @@
+package tracing
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Config describes where spans are exported and which are sampled
+type Config struct {
+	// Endpoint is the collector's host:port, or a URL whose scheme chooses
+	// between TLS (https) and plaintext (http). Spans are not exported when
+	// it is empty.
+	Endpoint string
+	// Protocol is grpc or http/protobuf
+	Protocol string
+	// Headers are sent with every export, such as a vendor's API key
+	Headers map[string]string
+	// Insecure sends spans in plaintext to an endpoint given without a scheme
+	Insecure bool
+	Timeout  time.Duration
+	Sampler  trace.Sampler
+}
+
+// ConfigFromEnv reads the exporter configuration from the standard
+// OpenTelemetry variables:
+//   - OTEL_EXPORTER_OTLP_ENDPOINT, or OTLP_ENDPOINT, or else defaultEndpoint
+//   - the settings ExporterConfigFromEnv reads
+//   - OTEL_TRACES_SAMPLER and OTEL_TRACES_SAMPLER_ARG
+func ConfigFromEnv(defaultEndpoint string) (Config, error) {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	if endpoint == "" {
+		endpoint = os.Getenv("OTLP_ENDPOINT")
+	}
+	if endpoint == "" {
+		endpoint = defaultEndpoint
+	}
+	config, err := ExporterConfigFromEnv(endpoint)
+	if err != nil {
+		return config, err
+	}
+	config.Sampler, err = parseSampler(os.Getenv("OTEL_TRACES_SAMPLER"), os.Getenv("OTEL_TRACES_SAMPLER_ARG"))
+	return config, err
+}
+
+// ExporterConfigFromEnv reads the OTLP settings shared by every signal, for
+// exporting to endpoint:
+//   - OTEL_EXPORTER_OTLP_PROTOCOL, grpc or http/protobuf (the default)
+//   - OTEL_EXPORTER_OTLP_HEADERS, comma-separated key=value pairs
+//   - OTEL_EXPORTER_OTLP_INSECURE, true by default for endpoints without a scheme
+//   - OTEL_EXPORTER_OTLP_TIMEOUT in milliseconds, 10000 by default
+func ExporterConfigFromEnv(endpoint string) (Config, error) {
+	config := Config{
+		Endpoint: endpoint,
+		Protocol: os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL"),
+		Insecure: true,
+		Timeout:  10 * time.Second,
+	}
+	switch config.Protocol {
+	case "":
+		config.Protocol = "http/protobuf"
+	case "grpc", "http/protobuf":
+	default:
+		return config, fmt.Errorf("unsupported OTEL_EXPORTER_OTLP_PROTOCOL %q, expected grpc or http/protobuf", config.Protocol)
+	}
+
+	headers, err := parseHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+	if err != nil {
+		return config, err
+	}
+	config.Headers = headers
+	if insecure := os.Getenv("OTEL_EXPORTER_OTLP_INSECURE"); insecure != "" {
+		if config.Insecure, err = strconv.ParseBool(insecure); err != nil {
+			return config, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_INSECURE %q", insecure)
+		}
+	}
+	if timeout := os.Getenv("OTEL_EXPORTER_OTLP_TIMEOUT"); timeout != "" {
+		ms, err := strconv.Atoi(timeout)
+		if err != nil || ms <= 0 {
+			return config, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_TIMEOUT %q", timeout)
+		}
+		config.Timeout = time.Duration(ms) * time.Millisecond
+	}
+	return config, nil
+}
+
+// Target splits the endpoint into the host:port to connect to and the base
+// path of HTTP exports, and reports whether to connect in plaintext. An
+// endpoint URL's scheme decides; a bare host:port uses plaintext when
+// Insecure is set.
+func (c Config) Target() (host, path string, plaintext bool, err error) {
+	if !strings.Contains(c.Endpoint, "://") {
+		return c.Endpoint, "", c.Insecure, nil
+	}
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return "", "", false, fmt.Errorf("invalid OTLP endpoint %q", c.Endpoint)
+	}
+	return u.Host, strings.TrimSuffix(u.Path, "/"), u.Scheme == "http", nil
+}
+
+// parseHeaders parses key=value pairs separated by commas, with values
+// URL-encoded as the OpenTelemetry specification requires
+func parseHeaders(text string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, pair := range strings.Split(text, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		key, value, found := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" {
+			return nil, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_HEADERS entry %q, expected key=value", pair)
+		}
+		decoded, err := url.QueryUnescape(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid OTEL_EXPORTER_OTLP_HEADERS value for %s: %v", key, err)
+		}
+		headers[key] = decoded
+	}
+	return headers, nil
+}
+
+// parseSampler returns the sampler named as in OTEL_TRACES_SAMPLER, which
+// samples every trace whose parent is sampled by default
+func parseSampler(name, arg string) (trace.Sampler, error) {
+	ratio := 1.0
+	if strings.HasSuffix(name, "traceidratio") && arg != "" {
+		var err error
+		if ratio, err = strconv.ParseFloat(arg, 64); err != nil || ratio < 0 || ratio > 1 {
+			return nil, fmt.Errorf("invalid OTEL_TRACES_SAMPLER_ARG %q, expected a ratio between 0 and 1", arg)
+		}
+	}
+	switch name {
+	case "", "parentbased_always_on":
+		return trace.ParentBased(trace.AlwaysSample()), nil
+	case "parentbased_always_off":
+		return trace.ParentBased(trace.NeverSample()), nil
+	case "parentbased_traceidratio":
+		return trace.ParentBased(trace.TraceIDRatioBased(ratio)), nil
+	case "always_on":
+		return trace.AlwaysSample(), nil
+	case "always_off":
+		return trace.NeverSample(), nil
+	case "traceidratio":
+		return trace.TraceIDRatioBased(ratio), nil
+	}
+	return nil, fmt.Errorf("unsupported OTEL_TRACES_SAMPLER %q", name)
+}
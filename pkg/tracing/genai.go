@@ -0,0 +1,83 @@
+package tracing
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	otelTrace "go.opentelemetry.io/otel/trace"
+)
+
+// ChatRequest describes a chat completion request for its span
+type ChatRequest struct {
+	// System is the GenAI system serving the model, such as "openai" for any
+	// OpenAI-compatible API
+	System string
+	Model  string
+
+	// BaseURL is the API's base URL, recorded as the server address and port
+	BaseURL string
+
+	// Temperature is nil when the request leaves it to the model's default
+	Temperature *float64
+}
+
+// ChatResponse describes the outcome of a chat completion request
+type ChatResponse struct {
+	ID            string
+	Model         string
+	InputTokens   int
+	OutputTokens  int
+	FinishReasons []string
+}
+
+// StartChatSpan starts a client span for a chat completion request, named
+// and annotated after the OpenTelemetry GenAI semantic conventions so
+// tracing backends with LLM views render it natively. End it with
+// EndChatSpan.
+func StartChatSpan(ctx context.Context, request ChatRequest) (context.Context, otelTrace.Span) {
+	attrs := []attribute.KeyValue{
+		attribute.String("gen_ai.operation.name", "chat"),
+		attribute.String("gen_ai.system", request.System),
+		attribute.String("gen_ai.request.model", request.Model),
+	}
+	if request.Temperature != nil {
+		attrs = append(attrs, attribute.Float64("gen_ai.request.temperature", *request.Temperature))
+	}
+	if u, err := url.Parse(request.BaseURL); err == nil && u.Hostname() != "" {
+		attrs = append(attrs, attribute.String("server.address", u.Hostname()))
+		if port, err := strconv.Atoi(u.Port()); err == nil {
+			attrs = append(attrs, attribute.Int("server.port", port))
+		}
+	}
+
+	return otel.Tracer("genai-app").Start(ctx, "chat "+request.Model,
+		otelTrace.WithSpanKind(otelTrace.SpanKindClient),
+		otelTrace.WithAttributes(attrs...))
+}
+
+// EndChatSpan records the response on a span started by StartChatSpan and
+// ends it, marking it failed when err is not nil
+func EndChatSpan(span otelTrace.Span, response ChatResponse, err error) {
+	if response.ID != "" {
+		span.SetAttributes(attribute.String("gen_ai.response.id", response.ID))
+	}
+	if response.Model != "" {
+		span.SetAttributes(attribute.String("gen_ai.response.model", response.Model))
+	}
+	if len(response.FinishReasons) > 0 {
+		span.SetAttributes(attribute.StringSlice("gen_ai.response.finish_reasons", response.FinishReasons))
+	}
+	span.SetAttributes(
+		attribute.Int("gen_ai.usage.input_tokens", response.InputTokens),
+		attribute.Int("gen_ai.usage.output_tokens", response.OutputTokens),
+	)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
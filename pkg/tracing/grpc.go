@@ -0,0 +1,78 @@
+package tracing
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	coltracepb "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	tracepb "go.opentelemetry.io/proto/otlp/trace/v1"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// grpcClient uploads spans to an OTLP collector over gRPC. Failed exports
+// are not retried; the batch span processor reports and drops them.
+type grpcClient struct {
+	target  string
+	creds   credentials.TransportCredentials
+	headers metadata.MD
+	timeout time.Duration
+
+	conn    *grpc.ClientConn
+	service coltracepb.TraceServiceClient
+}
+
+// newGRPCClient creates a client for target, host:port, in plaintext when
+// plaintext is set
+func newGRPCClient(target string, plaintext bool, headers map[string]string, timeout time.Duration) *grpcClient {
+	creds := credentials.NewTLS(&tls.Config{MinVersion: tls.VersionTLS12})
+	if plaintext {
+		creds = insecure.NewCredentials()
+	}
+	return &grpcClient{
+		target:  target,
+		creds:   creds,
+		headers: metadata.New(headers),
+		timeout: timeout,
+	}
+}
+
+// Start creates the connection, which is established lazily
+func (c *grpcClient) Start(ctx context.Context) error {
+	conn, err := grpc.NewClient(c.target, grpc.WithTransportCredentials(c.creds))
+	if err != nil {
+		return fmt.Errorf("failed to create OTLP gRPC connection to %s: %v", c.target, err)
+	}
+	c.conn = conn
+	c.service = coltracepb.NewTraceServiceClient(conn)
+	return nil
+}
+
+// Stop closes the connection
+func (c *grpcClient) Stop(ctx context.Context) error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// UploadTraces exports a batch of spans
+func (c *grpcClient) UploadTraces(ctx context.Context, spans []*tracepb.ResourceSpans) error {
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	ctx = metadata.NewOutgoingContext(ctx, c.headers)
+
+	response, err := c.service.Export(ctx, &coltracepb.ExportTraceServiceRequest{ResourceSpans: spans})
+	if err != nil {
+		return err
+	}
+	if partial := response.GetPartialSuccess(); partial.GetRejectedSpans() > 0 {
+		otel.Handle(fmt.Errorf("OTLP collector rejected %d spans: %s", partial.GetRejectedSpans(), partial.GetErrorMessage()))
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// propagator carries trace context between services in the W3C traceparent
+// and tracestate headers, and baggage in the baggage header
+var propagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// InjectHeaders adds the trace context of the span in ctx to the headers of
+// an outgoing request, so the receiving service continues the same trace
+func InjectHeaders(ctx context.Context, header http.Header) {
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(header))
+}
+
+// ExtractHeaders returns ctx carrying the trace context of an incoming
+// request's headers, if it has any, so its spans join the caller's trace
+func ExtractHeaders(ctx context.Context, header http.Header) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.HeaderCarrier(header))
+}
+
+// Transport wraps base, http.DefaultTransport when nil, to inject the trace
+// context of each request's context into its headers
+func Transport(base http.RoundTripper) http.RoundTripper {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return roundTripper{base: base}
+}
+
+type roundTripper struct {
+	base http.RoundTripper
+}
+
+func (t roundTripper) RoundTrip(r *http.Request) (*http.Response, error) {
+	// RoundTrippers must not modify the request they are given
+	r = r.Clone(r.Context())
+	InjectHeaders(r.Context(), r.Header)
+	return t.base.RoundTrip(r)
+}
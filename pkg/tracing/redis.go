@@ -0,0 +1,84 @@
+package tracing
+
+import (
+	"context"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	otelTrace "go.opentelemetry.io/otel/trace"
+)
+
+// InstrumentRedis records a span for each command and pipeline client sends
+// on behalf of a traced request. Commands whose context carries no span,
+// such as those of background collections, are not traced.
+func InstrumentRedis(client redis.UniversalClient) {
+	client.AddHook(redisHook{})
+}
+
+// redisHook implements redis.Hook
+type redisHook struct{}
+
+func (redisHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (redisHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if !otelTrace.SpanFromContext(ctx).IsRecording() {
+			return next(ctx, cmd)
+		}
+		ctx, span := startRedisSpan(ctx, "redis."+cmd.FullName(), cmd.FullName())
+		defer span.End()
+
+		err := next(ctx, cmd)
+		recordRedisError(span, err)
+		return err
+	}
+}
+
+func (redisHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if !otelTrace.SpanFromContext(ctx).IsRecording() {
+			return next(ctx, cmds)
+		}
+		// Name the pipeline by its distinct commands, in order
+		var names []string
+		seen := map[string]bool{}
+		for _, cmd := range cmds {
+			if name := cmd.FullName(); !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+		ctx, span := startRedisSpan(ctx, "redis.pipeline", strings.Join(names, " "))
+		span.SetAttributes(attribute.Int("db.redis.num_cmd", len(cmds)))
+		defer span.End()
+
+		err := next(ctx, cmds)
+		recordRedisError(span, err)
+		return err
+	}
+}
+
+// startRedisSpan starts a client span for the commands named operation
+func startRedisSpan(ctx context.Context, name, operation string) (context.Context, otelTrace.Span) {
+	ctx, span := otel.Tracer("genai-app").Start(ctx, name, otelTrace.WithSpanKind(otelTrace.SpanKindClient))
+	span.SetAttributes(
+		attribute.String("db.system", "redis"),
+		attribute.String("db.operation", operation),
+	)
+	return ctx, span
+}
+
+// recordRedisError marks the span failed unless err is nil or redis.Nil,
+// which only reports a missing key
+func recordRedisError(span otelTrace.Span, err error) {
+	if err == nil || err == redis.Nil {
+		return
+	}
+	span.RecordError(err)
+	span.SetStatus(codes.Error, err.Error())
+}
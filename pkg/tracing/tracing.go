@@ -3,9 +3,9 @@ package tracing
 import (
 	"context"
 	"fmt"
-	"log"
 	"time"
 
+	"github.com/rs/zerolog/log"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
@@ -17,60 +17,98 @@ import (
 	otelTrace "go.opentelemetry.io/otel/trace"
 )
 
-// SetupTracing initializes OpenTelemetry tracing
-func SetupTracing(serviceName string, otlpEndpoint string) (func(), error) {
-	// Create a resource with service information
-	res, err := resource.New(context.Background(),
+// NewResource describes serviceName and where it runs. The environment can
+// add to or override the attributes through OTEL_SERVICE_NAME and
+// OTEL_RESOURCE_ATTRIBUTES.
+func NewResource(serviceName string) (*resource.Resource, error) {
+	return resource.New(context.Background(),
 		resource.WithAttributes(
 			semconv.ServiceNameKey.String(serviceName),
 		),
+		resource.WithTelemetrySDK(),
+		resource.WithHost(),
+		resource.WithProcessPID(),
+		resource.WithProcessRuntimeName(),
+		resource.WithProcessRuntimeVersion(),
+		resource.WithFromEnv(),
 	)
+}
+
+// SetupTracing initializes OpenTelemetry tracing, exporting the sampled
+// spans of serviceName as config describes. The returned function flushes
+// the spans still buffered and shuts the exporter down; call it before
+// exiting.
+func SetupTracing(serviceName string, config Config) (func(), error) {
+	res, err := NewResource(serviceName)
 	if err != nil {
 		return nil, err
 	}
 
-	var traceProvider *trace.TracerProvider
-
-	// If OTLP endpoint is provided, use it
-	if otlpEndpoint != "" {
-		client := otlptracehttp.NewClient(
-			otlptracehttp.WithEndpoint(otlpEndpoint),
-			otlptracehttp.WithInsecure(),
-		)
+	sampler := config.Sampler
+	if sampler == nil {
+		sampler = trace.ParentBased(trace.AlwaysSample())
+	}
+	options := []trace.TracerProviderOption{
+		trace.WithResource(res),
+		trace.WithSampler(sampler),
+		// Spans carry the user and session of the request they are part of
+		trace.WithSpanProcessor(baggageSpanProcessor{}),
+	}
 
+	// Without an endpoint spans are sampled but go nowhere
+	if config.Endpoint != "" {
+		client, err := newExportClient(config)
+		if err != nil {
+			return nil, err
+		}
 		exporter, err := otlptrace.New(context.Background(), client)
 		if err != nil {
 			return nil, err
 		}
+		options = append(options, trace.WithBatcher(exporter,
+			trace.WithBatchTimeout(5*time.Second),
+		))
+	}
+	traceProvider := trace.NewTracerProvider(options...)
 
-		traceProvider = trace.NewTracerProvider(
-			trace.WithResource(res),
-			trace.WithBatcher(exporter,
-				trace.WithBatchTimeout(5*time.Second),
-			),
-			trace.WithSampler(trace.AlwaysSample()), // Sample all traces for development
-		)
-	} else {
-		// Use a no-op exporter if no endpoint is provided
-		traceProvider = trace.NewTracerProvider(
-			trace.WithResource(res),
-			trace.WithSampler(trace.AlwaysSample()),
-		)
-	}
-
-	// Set the global trace provider
+	// Set the global trace provider, and propagate trace context to and from
+	// other services
 	otel.SetTracerProvider(traceProvider)
+	otel.SetTextMapPropagator(propagator)
 
 	// Return a cleanup function to flush and shutdown the tracer
 	return func() {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 		if err := traceProvider.Shutdown(ctx); err != nil {
-			log.Printf("Error shutting down tracer provider: %v", err)
+			log.Error().Err(err).Msg("Error shutting down tracer provider")
 		}
 	}, nil
 }
 
+// newExportClient creates the OTLP client for the configured protocol. For
+// http/protobuf, /v1/traces is added to the endpoint's path.
+func newExportClient(config Config) (otlptrace.Client, error) {
+	host, path, plaintext, err := config.Target()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Protocol == "grpc" {
+		return newGRPCClient(host, plaintext, config.Headers, config.Timeout), nil
+	}
+	options := []otlptracehttp.Option{
+		otlptracehttp.WithEndpoint(host),
+		otlptracehttp.WithURLPath(path + "/v1/traces"),
+		otlptracehttp.WithHeaders(config.Headers),
+		otlptracehttp.WithTimeout(config.Timeout),
+	}
+	if plaintext {
+		options = append(options, otlptracehttp.WithInsecure())
+	}
+	return otlptracehttp.NewClient(options...), nil
+}
+
 // StartSpan starts a new span
 func StartSpan(ctx context.Context, spanName string) (context.Context, otelTrace.Span) {
 	tracer := otel.Tracer("genai-app")
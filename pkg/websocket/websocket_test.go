@@ -0,0 +1,265 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAcceptKey(t *testing.T) {
+	// The handshake example of RFC 6455 section 1.3
+	if got, want := acceptKey("dGhlIHNhbXBsZSBub25jZQ=="), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="; got != want {
+		t.Errorf("acceptKey() = %q, want %q", got, want)
+	}
+}
+
+func TestUpgradeRejects(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		status  int
+	}{
+		{"plain GET", http.MethodGet, nil, http.StatusBadRequest},
+		{"POST", http.MethodPost, map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "x"}, http.StatusBadRequest},
+		{"old version", http.MethodGet, map[string]string{"Connection": "keep-alive, Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "8", "Sec-WebSocket-Key": "x"}, http.StatusUpgradeRequired},
+		{"no key", http.MethodGet, map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "13"}, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "/ws", nil)
+			for name, value := range tt.headers {
+				r.Header.Set(name, value)
+			}
+			w := httptest.NewRecorder()
+			if _, err := Upgrade(w, r); err == nil {
+				t.Fatal("Upgrade() succeeded, want an error")
+			}
+			if w.Code != tt.status {
+				t.Errorf("status = %d, want %d", w.Code, tt.status)
+			}
+		})
+	}
+}
+
+// dial upgrades a connection to a test server, returning the server side
+// Conn and the client's network connection
+func dial(t *testing.T) (*Conn, net.Conn, *bufio.Reader) {
+	t.Helper()
+	conns := make(chan *Conn, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, err := Upgrade(w, r)
+		if err != nil {
+			t.Errorf("Upgrade() error = %v", err)
+			return
+		}
+		conns <- c
+	}))
+	t.Cleanup(server.Close)
+
+	client, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(client, "GET /ws HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+
+	reader := bufio.NewReader(client)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status = %d, want 101", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Sec-WebSocket-Accept = %q", got)
+	}
+	return <-conns, client, reader
+}
+
+// writeClientFrame sends a frame masked with mask, as clients must
+func writeClientFrame(t *testing.T, w io.Writer, fin bool, opcode byte, payload []byte, mask [4]byte) {
+	t.Helper()
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xffff:
+		frame = binary.BigEndian.AppendUint16(append(frame, 0x80|126), uint16(n))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, 0x80|127), uint64(n))
+	}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := w.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readServerFrame reads a frame, which servers must not mask or fragment
+func readServerFrame(t *testing.T, r io.Reader) (byte, []byte) {
+	t.Helper()
+	var header [2]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	if header[0]&0x80 == 0 || header[0]&0x70 != 0 || header[1]&0x80 != 0 {
+		t.Fatalf("server frame header % x is fragmented, masked or uses reserved bits", header)
+	}
+	size := uint64(header[1] & 0x7f)
+	switch size {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(r, ext[:])
+		size = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(r, ext[:])
+		size = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0] & 0x0f, payload
+}
+
+func TestWriteText(t *testing.T) {
+	c, _, reader := dial(t)
+	defer c.Close()
+	// One message for each of the 7 bit, 16 bit and 64 bit length encodings
+	for _, size := range []int{0, 125, 126, 0xffff, 0x10000} {
+		message := bytes.Repeat([]byte{'a' + byte(size%26)}, size)
+		if err := c.WriteText(message); err != nil {
+			t.Fatalf("WriteText(%d bytes) error = %v", size, err)
+		}
+		opcode, payload := readServerFrame(t, reader)
+		if opcode != opText || !bytes.Equal(payload, message) {
+			t.Errorf("frame of %d bytes read back as opcode %#x with %d bytes", size, opcode, len(payload))
+		}
+	}
+}
+
+func TestPing(t *testing.T) {
+	c, client, reader := dial(t)
+	defer c.Close()
+	tests := []struct {
+		name    string
+		payload []byte
+		mask    [4]byte
+	}{
+		{"empty", nil, [4]byte{1, 2, 3, 4}},
+		{"zero mask", []byte("hello"), [4]byte{}},
+		{"masked", []byte("Hello"), [4]byte{0x37, 0xfa, 0x21, 0x3d}},
+		{"16 bit length", bytes.Repeat([]byte("ping"), 100), [4]byte{0xff, 0x00, 0xaa, 0x55}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			writeClientFrame(t, client, true, opPing, tt.payload, tt.mask)
+			opcode, payload := readServerFrame(t, reader)
+			if opcode != opPong || !bytes.Equal(payload, tt.payload) {
+				t.Errorf("got opcode %#x payload %q, want a pong echoing %q", opcode, payload, tt.payload)
+			}
+		})
+	}
+}
+
+func TestMaskedFrameVector(t *testing.T) {
+	// The masked "Hello" of RFC 6455 section 5.7, read as a ping so the
+	// unmasked payload comes back in the pong
+	c, client, reader := dial(t)
+	defer c.Close()
+	client.Write([]byte{0x89, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58})
+	opcode, payload := readServerFrame(t, reader)
+	if opcode != opPong || string(payload) != "Hello" {
+		t.Errorf("got opcode %#x payload %q, want a pong with Hello", opcode, payload)
+	}
+}
+
+func TestFragmentedMessage(t *testing.T) {
+	// Control frames may be interleaved with the fragments of a message,
+	// which are discarded
+	c, client, reader := dial(t)
+	defer c.Close()
+	mask := [4]byte{9, 8, 7, 6}
+	writeClientFrame(t, client, false, opText, []byte("Hel"), mask)
+	writeClientFrame(t, client, true, opPing, []byte("between"), mask)
+	writeClientFrame(t, client, true, 0x0, []byte("lo"), mask)
+	writeClientFrame(t, client, true, opPing, []byte("after"), mask)
+	for _, want := range []string{"between", "after"} {
+		opcode, payload := readServerFrame(t, reader)
+		if opcode != opPong || string(payload) != want {
+			t.Errorf("got opcode %#x payload %q, want a pong with %q", opcode, payload, want)
+		}
+	}
+}
+
+func TestClientClose(t *testing.T) {
+	c, client, reader := dial(t)
+	writeClientFrame(t, client, true, opClose, []byte{0x03, 0xe9}, [4]byte{1, 1, 1, 1})
+	opcode, payload := readServerFrame(t, reader)
+	if opcode != opClose || len(payload) != 2 || binary.BigEndian.Uint16(payload) != 1000 {
+		t.Errorf("got opcode %#x payload % x, want a close frame with code 1000", opcode, payload)
+	}
+	select {
+	case <-c.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Done() not closed after the client closed")
+	}
+	if err := c.WriteText([]byte("late")); !errors.Is(err, ErrClosed) {
+		t.Errorf("WriteText() after close error = %v, want ErrClosed", err)
+	}
+}
+
+func TestServerClose(t *testing.T) {
+	c, _, reader := dial(t)
+	c.Close()
+	opcode, payload := readServerFrame(t, reader)
+	if opcode != opClose || binary.BigEndian.Uint16(payload) != 1000 {
+		t.Errorf("got opcode %#x payload % x, want a close frame with code 1000", opcode, payload)
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Errorf("read after close error = %v, want EOF", err)
+	}
+	c.Close()
+}
+
+func TestInvalidClientFrames(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+	}{
+		{"unmasked", []byte{0x81, 0x02, 'h', 'i'}},
+		{"too large", []byte{0x81, 0xff, 0, 0, 0, 0, 0, 0x10, 0, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, client, reader := dial(t)
+			client.Write(tt.frame)
+			select {
+			case <-c.Done():
+			case <-time.After(5 * time.Second):
+				t.Fatal("connection not closed after an invalid frame")
+			}
+			if opcode, _ := readServerFrame(t, reader); opcode != opClose {
+				t.Errorf("got opcode %#x, want a close frame", opcode)
+			}
+		})
+	}
+}